@@ -3,6 +3,8 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"os/signal"
 	"sort"
@@ -23,15 +25,63 @@ type cliArgs struct {
 	Port           uint
 	User           string
 	Password       string
+	PasswordFile   string
+	Database       string
+	DSN            string
+	TLS            bool
+	TLSCA          string
+	TLSCert        string
+	TLSKey         string
+	TLSSkipVerify  bool
 	Output         string
 	External       string
 	APIURL         string
-	Token          string
+	Token          []string
+	TokenFile      string
+	ExternalHosts  string
+	LDAPBindDN     string
+	LDAPPassFile   string
+	LDAPStartTLS   bool
 	Cache          string
+	Repos          []string
+	ExcludeRepos   []string
+	Since          string
+	Until          string
+	Refs           []string
+	QueryTimeout   time.Duration
+	Input          string
+	InputFormat    string
+	InputColumns   string
 	ExternalCache  string
+	Record         string
+	Replay         string
+	Refresh        bool
+	PositiveTTL    time.Duration
+	NegativeTTL    time.Duration
+	Workers        int
+	Batch          int
+	Rate           float64
 	MaxIdentities  int
+	LimitPolicy    string
+	TzOverlap      float64
+	RepoSim        float64
+	RepoNameSim    float64
+	RepoMaxPeople  int
 	RecentMonths   int
 	RecentMinCount int
+	Profiles       bool
+	PreferExtNames bool
+	// parsed External, APIURL, Token, TokenFile and ExternalHosts
+	providers []string
+	apiURLs   map[string]string
+	tokens    map[string][]string
+	hosts     map[string][]string
+	// parsed LDAPBindDN, LDAPPassFile and LDAPStartTLS
+	ldap external.LDAPOptions
+	// parsed InputFormat and InputColumns
+	input idmatch.InputOptions
+	// parsed Repos, ExcludeRepos, Since, Until and Refs
+	filters idmatch.SignatureFilters
 }
 
 var version string
@@ -65,30 +115,32 @@ func main() {
 	}()
 
 	var extmatcher external.Matcher
-	if args.External != "" {
-		var err error
-		extmatcher, err = external.Matchers[args.External](args.APIURL, args.Token)
-		if err != nil {
-			logrus.Fatalf("failed to initialize %s: %v", args.External, err)
-		}
-		if args.ExternalCache != "" {
-			extmatcher, err = external.NewCachedMatcher(extmatcher, args.ExternalCache)
-			if err != nil {
-				logrus.Fatalf("failed to initialize cached %s: %v", args.External, err)
-			}
-		}
+	var tokenPools map[string]*external.TokenPool
+	if len(args.providers) > 0 {
+		extmatcher, tokenPools = newExternalMatcher(args)
 	}
 
 	logrus.Info("fetching signatures from the commits")
 	start := time.Now()
-	connStr := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s",
-		args.User, args.Password, args.Host, args.Port, "gitbase")
 	blacklist, err := idmatch.NewBlacklist()
 	if err != nil {
 		logrus.Fatalf("failed to load the blacklist: %v", err)
 	}
-	people, nameFreqs, emailFreqs, err := idmatch.FindPeople(ctx, connStr, args.Cache, blacklist,
-		args.RecentMonths)
+	var people idmatch.People
+	var nameFreqs, emailFreqs map[string]*idmatch.Frequency
+	if args.Input != "" {
+		people, nameFreqs, emailFreqs, err = idmatch.ReadPeople(args.Input, args.input, blacklist,
+			args.RecentMonths)
+	} else {
+		var connStr string
+		if connStr, err = newGitbaseConnection(args).ConnString(); err != nil {
+			logrus.Fatalf("invalid gitbase connection: %v", err)
+		}
+		gitbase := idmatch.GitbaseOptions{
+			ConnString: connStr, Filters: args.filters, QueryTimeout: args.QueryTimeout}
+		people, nameFreqs, emailFreqs, err = idmatch.FindPeople(ctx, gitbase, args.Cache,
+			blacklist, args.RecentMonths)
+	}
 	if err != nil {
 		logrus.Fatalf("failed to fetch the signatures: %v", err)
 	}
@@ -99,7 +151,17 @@ func main() {
 
 	logrus.Info("reducing identities")
 	start = time.Now()
-	if err := idmatch.ReducePeople(people, extmatcher, blacklist, args.MaxIdentities); err != nil {
+	reduceOpts := idmatch.ReduceOptions{
+		MaxIdentities:         args.MaxIdentities,
+		LimitPolicy:           idmatch.IdentitiesLimitPolicy(args.LimitPolicy),
+		MinTimezoneOverlap:    args.TzOverlap,
+		MinRepoSimilarity:     args.RepoSim,
+		MinRepoNameSimilarity: args.RepoNameSim,
+		MaxRepoPeople:         args.RepoMaxPeople,
+		ExternalWorkers:       args.Workers,
+		ExternalBatchSize:     args.Batch,
+	}
+	if err := idmatch.ReducePeople(people, extmatcher, blacklist, reduceOpts); err != nil {
 		logrus.Fatalf("failed to reduce identities: %s", err)
 	}
 	logrus.WithFields(logrus.Fields{
@@ -107,15 +169,39 @@ func main() {
 		"count":   len(people),
 	}).Info("reduced identities")
 
+	profiler, isProfiler := extmatcher.(external.Profiler)
+	if isProfiler && (args.Profiles || args.PreferExtNames) {
+		logrus.Info("fetching external profiles")
+		start = time.Now()
+		if err := idmatch.FetchExternalProfiles(ctx, people, profiler); err != nil {
+			logrus.Fatalf("failed to fetch external profiles: %s", err)
+		}
+		// save the cached profiles
+		if err := extmatcher.OnIdle(); err != nil {
+			logrus.Errorf("failed to save the external cache: %s", err)
+		}
+		logrus.WithFields(logrus.Fields{
+			"elapsed": time.Since(start),
+		}).Info("fetched external profiles")
+	}
+
+	if closer, ok := extmatcher.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			logrus.Errorf("failed to close the external matchers: %s", err)
+		}
+	}
+	reportTokenUsage(tokenPools)
+
 	start = time.Now()
-	idmatch.SetPrimaryValues(people, nameFreqs, emailFreqs, args.RecentMinCount)
+	idmatch.SetPrimaryValues(
+		people, nameFreqs, emailFreqs, args.RecentMinCount, args.PreferExtNames)
 	logrus.WithFields(logrus.Fields{
 		"elapsed": time.Since(start),
 	}).Info("set primary names and emails")
 
 	logrus.Info("storing identities")
 	start = time.Now()
-	if err := people.WriteToParquet(args.Output, args.External); err != nil {
+	if err := people.WriteToParquet(args.Output); err != nil {
 		logrus.Fatalf("failed to store identities: %s", err)
 	}
 	logrus.WithFields(logrus.Fields{
@@ -138,21 +224,147 @@ func parseArgs() cliArgs {
 	flag.StringVar(&args.Host, "host", "0.0.0.0", "gitbase host")
 	flag.UintVar(&args.Port, "port", 3306, "gitbase port")
 	flag.StringVar(&args.User, "user", "root", "gitbase user, normally the default value is fine")
-	flag.StringVar(&args.Password, "password", "", "gitbase password")
+	flag.StringVar(&args.Password, "password", "",
+		"gitbase password. It is visible in the process list, prefer --password-file or "+
+			"the "+gitbasePasswordEnv+" environment variable.")
+	flag.StringVar(&args.PasswordFile, "password-file", "",
+		"Path to the file with the gitbase password.")
+	flag.StringVar(&args.Database, "database", "gitbase", "gitbase database name")
+	flag.StringVar(&args.DSN, "dsn", "",
+		"MySQL data source name of gitbase which replaces --host, --port, --user and "+
+			"--database, e.g. \"root@unix(/var/run/gitbase.sock)/gitbase\". See "+
+			"https://github.com/go-sql-driver/mysql#dsn-data-source-name")
+	flag.BoolVar(&args.TLS, "tls", false,
+		"Connect to gitbase over TLS. Implied by the other --tls-* flags.")
+	flag.StringVar(&args.TLSCA, "tls-ca", "",
+		"Path to the PEM certificates of the authorities which sign the gitbase certificate. "+
+			"The blank value means the system authorities.")
+	flag.StringVar(&args.TLSCert, "tls-cert", "",
+		"Path to the PEM client certificate for gitbase, requires --tls-key.")
+	flag.StringVar(&args.TLSKey, "tls-key", "",
+		"Path to the PEM private key of --tls-cert.")
+	flag.BoolVar(&args.TLSSkipVerify, "tls-skip-verify", false,
+		"Do not verify the gitbase certificate.")
+	flag.DurationVar(&args.QueryTimeout, "query-timeout", time.Hour,
+		"Timeout of each gitbase query. The signatures are fetched one repository at a time and "+
+			"the timed out queries are retried. 0 means unlimited.")
 	flag.StringVar(&args.External, "external", "",
-		"enable external service matching, options: "+strings.Join(matchers, ", "))
+		"enable external service matching, comma-separated list of: "+strings.Join(matchers, ", ")+
+			". The services are queried in the listed order unless the repository host defines "+
+			"which one to use.")
 	flag.StringVar(&args.APIURL, "api-url", "",
-		"API URL of the external matching service, the blank value means the public website")
-	flag.StringVar(&args.Token, "token", "", "API token for the external matching service")
-	flag.StringVar(&args.Cache, "cache", fmt.Sprintf("cache-raw-%s.csv", idmatch.HashPeopleDiscoverySQL()),
-		"Path to the cached raw signatures")
+		"API URL of the external matching service, the blank value means the public website. "+
+			"Use comma-separated \"service=URL\" pairs to set it for several services.")
+	flag.StringArrayVar(&args.Token, "token", nil, "API token for the external matching service. "+
+		"Use comma-separated \"service=token\" pairs to set it for several services. "+
+		"Repeat the flag to rotate several tokens on rate limit (GitHub, GitLab and Bitbucket).")
+	flag.StringVar(&args.TokenFile, "token-file", "",
+		"Path to the file with the API tokens to rotate, one per line. "+
+			"Use comma-separated \"service=path\" pairs to set it for several services.")
+	flag.StringVar(&args.ExternalHosts, "external-hosts", "",
+		"Comma-separated \"service=host\" pairs which route the repositories with the given host "+
+			"to the external matching service, e.g. \"gitlab=git.company.com\". The public "+
+			"websites and the --api-url hosts are routed automatically.")
+	flag.StringVar(&args.LDAPBindDN, "ldap-bind-dn", "",
+		"DN to bind to the LDAP server as, e.g. \"cn=match,dc=company,dc=com\". The blank "+
+			"value means the anonymous bind.")
+	flag.StringVar(&args.LDAPPassFile, "ldap-password-file", "",
+		"Path to the file with the password of --ldap-bind-dn. The password is read from the "+
+			ldapPasswordEnv+" environment variable otherwise.")
+	flag.BoolVar(&args.LDAPStartTLS, "ldap-starttls", false,
+		"Upgrade the ldap:// connection to TLS with StartTLS before the bind.")
+	flag.StringVar(&args.Cache, "cache", "cache-raw-{query}.csv",
+		"Path to the cached raw signatures. {query} will be replaced with the hash of the gitbase "+
+			"query, so that the differently filtered signatures are cached separately.")
+	flag.StringSliceVar(&args.Repos, "repos", nil,
+		"Comma-separated glob patterns of the repositories to fetch from gitbase, e.g. "+
+			"\"github.com/src-d/*\". \"*\" matches any characters including \"/\". "+
+			"The blank value means all the repositories.")
+	flag.StringSliceVar(&args.ExcludeRepos, "exclude-repos", nil,
+		"Comma-separated glob patterns of the repositories to skip in gitbase. "+
+			"They take precedence over --repos.")
+	flag.StringVar(&args.Since, "since", "",
+		"Fetch the commits made at or after this time from gitbase, "+
+			"e.g. \"2019-01-01\" or \"2019-01-01T12:00:00Z\".")
+	flag.StringVar(&args.Until, "until", "",
+		"Fetch the commits made before this time from gitbase, "+
+			"e.g. \"2020-01-01\" or \"2020-01-01T12:00:00Z\".")
+	flag.StringSliceVar(&args.Refs, "refs", nil,
+		"Comma-separated references whose history to fetch from gitbase, e.g. "+
+			"\"master,refs/tags/v1.0\". The short names are branches. The blank value means "+
+			"all the commits.")
+	flag.StringVar(&args.Input, "input", "",
+		"Path to the signatures to read instead of gitbase and --cache, \"-\" means stdin. "+
+			"CSV, JSONL and Parquet are supported, optionally compressed with gzip or zstd. "+
+			"The columns are repo, name, email and optionally hash, time, first_seen, commits "+
+			"and timezones.")
+	flag.StringVar(&args.InputFormat, "input-format", "",
+		"Format of --input: "+strings.Join(idmatch.InputFormats, ", ")+". The blank value "+
+			"detects it by the file extension or by the contents.")
+	flag.StringVar(&args.InputColumns, "input-columns", "",
+		"Comma-separated \"field=column\" pairs which map the signature fields to the columns "+
+			"of --input with different names, e.g. \"email=author_email,name=author_name\".")
 	flag.StringVar(&args.ExternalCache, "external-cache", "cache-external-{provider}.csv",
 		"Path to the cached matches found by using an external identity service such as GitHub API."+
-			"{provider} will be replaced with the external service name.")
+			"{provider} will be replaced with the external service name. The paths ending with "+
+			"\".db\" or \".bolt\" are BoltDB databases which import the CSV cache with the same "+
+			"name on creation.")
+	flag.StringVar(&args.Record, "external-record", "",
+		"Save the queries to the external matching service and their results to this JSON "+
+			"fixture for --external-replay. {provider} will be replaced with the external "+
+			"service name.")
+	flag.StringVar(&args.Replay, "external-replay", "",
+		"Serve the queries to the external matching service from the JSON fixture saved with "+
+			"--external-record instead of the network. {provider} will be replaced with the "+
+			"external service name. Set --external-cache to \"\" to replay every query.")
+	flag.BoolVar(&args.Refresh, "refresh-external", false,
+		"Query the external matching service again for the cached emails which have expired "+
+			"according to --external-ttl and --external-negative-ttl. The cache never expires "+
+			"otherwise.")
+	flag.DurationVar(&args.PositiveTTL, "external-ttl", 0,
+		"Time to live of the cached matches with --refresh-external, e.g. 8760h. "+
+			"0 means forever.")
+	flag.DurationVar(&args.NegativeTTL, "external-negative-ttl", 30*24*time.Hour,
+		"Time to live of the cached absent matches with --refresh-external. 0 means forever.")
+	flag.IntVar(&args.Workers, "external-workers", 1,
+		"Number of concurrent queries to the external matching service.")
+	flag.IntVar(&args.Batch, "external-batch", 1,
+		"Maximum number of commits of the same repository resolved by a single query to "+
+			"the external matching service, if it supports batching (GitHub with a token). "+
+			"1 disables batching.")
+	flag.Float64Var(&args.Rate, "external-rate", 0,
+		"Maximum number of requests per second to each external matching service shared by "+
+			"all the workers. The cached matches do not count. 0 means no limit.")
+	var policies []string
+	for _, policy := range idmatch.IdentitiesLimitPolicies {
+		policies = append(policies, string(policy))
+	}
+
 	flag.IntVar(&args.MaxIdentities, "max-identities", 20,
 		"If a person has more than this number of unique names and unique emails summed, "+
-			"no more identities will be merged. If the identities are matched by an external API "+
-			"or by email this limitation can be violated.")
+			"no more identities will be merged. See --max-identities-policy.")
+	flag.StringVar(&args.LimitPolicy, "max-identities-policy", string(idmatch.IdentitiesLimitLenient),
+		"How --max-identities is enforced: \"lenient\" - the identities matched by an external "+
+			"API or by email can violate the limit; \"strict\" - the limit applies to all matches "+
+			"and the rejected ones are reported; \"report-only\" - the same as \"lenient\" and "+
+			"the matches which violate the limit are reported. Options: "+strings.Join(policies, ", "))
+	flag.Float64Var(&args.TzOverlap, "timezone-overlap", 0,
+		"Minimum overlap (0 to 1) of the commit timezone distributions of two identities with "+
+			"the same name so that they are merged. Identities with unknown timezones are always "+
+			"merged. 0 disables the check. Requires the timezones column of --input or of "+
+			"the signatures cache and fails without it: gitbase does not expose the commit UTC "+
+			"offsets.")
+	flag.Float64Var(&args.RepoSim, "repo-similarity", 0,
+		"Minimum score (0 to 1) to merge two people who committed to the same niche "+
+			"repositories and have similar names. The score is the product of the weighted "+
+			"Jaccard similarity of the repositories and the name similarity. 0 disables "+
+			"the repository co-occurrence matching.")
+	flag.Float64Var(&args.RepoNameSim, "repo-name-similarity", 0.7,
+		"Minimum name similarity (0 to 1) of two people to merge them by the repository "+
+			"co-occurrence.")
+	flag.IntVar(&args.RepoMaxPeople, "repo-max-people", 20,
+		"Repositories with more people are not niche and ignored while looking for people to "+
+			"merge by the repository co-occurrence.")
 	flag.IntVar(&args.RecentMonths, "months", 12,
 		"Number of preceding months to consider while calculating stats for detecting "+
 			"the primary names and emails.")
@@ -160,14 +372,290 @@ func parseArgs() cliArgs {
 		"Minimum total number of commits the identity should have in the last --months so that "+
 			"the corresponding stats are used for detecting the primary names and emails. "+
 			"Otherwise, the stats collected through all the time will be used.")
+	flag.BoolVar(&args.Profiles, "external-profiles", false,
+		"Fetch the display names, avatars, profile URLs and registration dates of the matched "+
+			"people from the external matching service. It costs one query per person.")
+	flag.BoolVar(&args.PreferExtNames, "prefer-external-names", false,
+		"Use the display names from the external matching service as the primary names. "+
+			"Implies --external-profiles.")
 	flag.CommandLine.SortFlags = false
 	flag.Parse()
 
+	if args.Workers < 1 {
+		logrus.Fatalf("--external-workers must be positive: %d", args.Workers)
+	}
+	if args.Batch < 1 {
+		logrus.Fatalf("--external-batch must be positive: %d", args.Batch)
+	}
+	if !stringInSlice(policies, args.LimitPolicy) {
+		logrus.Fatalf("unsupported --max-identities-policy: %s", args.LimitPolicy)
+	}
 	if args.External != "" {
-		if _, exists := external.Matchers[args.External]; !exists {
-			logrus.Fatalf("unsupported external matching service: %s", args.External)
+		for _, provider := range strings.Split(args.External, ",") {
+			if _, exists := external.Matchers[provider]; !exists {
+				logrus.Fatalf("unsupported external matching service: %s", provider)
+			}
+			args.providers = append(args.providers, provider)
+		}
+	}
+	if args.Refresh && args.ExternalCache == "" {
+		logrus.Fatalf("--refresh-external requires --external-cache")
+	}
+	if len(args.providers) > 1 && args.ExternalCache != "" &&
+		!strings.Contains(args.ExternalCache, "{provider}") {
+		logrus.Fatalf("--external-cache must contain {provider} with several external " +
+			"matching services")
+	}
+	if args.Record != "" && args.Replay != "" {
+		logrus.Fatalf("--external-record and --external-replay are mutually exclusive")
+	}
+	for name, path := range map[string]string{
+		"--external-record": args.Record, "--external-replay": args.Replay} {
+		if len(args.providers) > 1 && path != "" && !strings.Contains(path, "{provider}") {
+			logrus.Fatalf("%s must contain {provider} with several external matching services",
+				name)
+		}
+	}
+	var err error
+	if args.InputFormat != "" && !stringInSlice(idmatch.InputFormats, args.InputFormat) {
+		logrus.Fatalf("unsupported --input-format: %s", args.InputFormat)
+	}
+	args.input.Format = args.InputFormat
+	if args.input.Columns, err = idmatch.ParseInputColumns(args.InputColumns); err != nil {
+		logrus.Fatalf("invalid --input-columns: %v", err)
+	}
+	if args.PasswordFile != "" {
+		if args.Password != "" {
+			logrus.Fatalf("--password and --password-file are mutually exclusive")
+		}
+		password, err := ioutil.ReadFile(args.PasswordFile)
+		if err != nil {
+			logrus.Fatalf("failed to read --password-file: %v", err)
+		}
+		args.Password = strings.TrimRight(string(password), "\r\n")
+	} else if args.Password == "" {
+		args.Password = os.Getenv(gitbasePasswordEnv)
+	}
+	args.ldap = external.LDAPOptions{BindDN: args.LDAPBindDN, StartTLS: args.LDAPStartTLS}
+	if args.LDAPPassFile != "" {
+		if args.LDAPBindDN == "" {
+			logrus.Fatalf("--ldap-password-file requires --ldap-bind-dn")
+		}
+		password, err := ioutil.ReadFile(args.LDAPPassFile)
+		if err != nil {
+			logrus.Fatalf("failed to read --ldap-password-file: %v", err)
+		}
+		args.ldap.Password = strings.TrimRight(string(password), "\r\n")
+	} else if args.LDAPBindDN != "" {
+		args.ldap.Password = os.Getenv(ldapPasswordEnv)
+	}
+	args.filters = idmatch.SignatureFilters{
+		Repos: args.Repos, ExcludeRepos: args.ExcludeRepos, Refs: args.Refs}
+	if args.filters.Since, err = parseFilterTime(args.Since); err != nil {
+		logrus.Fatalf("invalid --since: %v", err)
+	}
+	if args.filters.Until, err = parseFilterTime(args.Until); err != nil {
+		logrus.Fatalf("invalid --until: %v", err)
+	}
+	if err = args.filters.Validate(); err != nil {
+		logrus.Fatalf("invalid gitbase filters: %v", err)
+	}
+	if args.Input != "" && (len(args.Repos) > 0 || len(args.ExcludeRepos) > 0 ||
+		args.Since != "" || args.Until != "" || len(args.Refs) > 0) {
+		logrus.Fatalf("--repos, --exclude-repos, --since, --until and --refs do not apply " +
+			"to --input")
+	}
+	args.Cache = strings.ReplaceAll(
+		args.Cache, "{query}", idmatch.HashPeopleDiscoverySQL(args.filters))
+	if args.apiURLs, err = parseProviderValues(args.APIURL, args.providers); err != nil {
+		logrus.Fatalf("invalid --api-url: %v", err)
+	}
+	args.tokens = map[string][]string{}
+	for _, value := range args.Token {
+		tokens, err := parseProviderValues(value, args.providers)
+		if err != nil {
+			logrus.Fatalf("invalid --token: %v", err)
+		}
+		for provider, token := range tokens {
+			args.tokens[provider] = append(args.tokens[provider], token)
+		}
+	}
+	tokenFiles, err := parseProviderValues(args.TokenFile, args.providers)
+	if err != nil {
+		logrus.Fatalf("invalid --token-file: %v", err)
+	}
+	for provider, path := range tokenFiles {
+		tokens, err := external.ReadTokens(path)
+		if err != nil {
+			logrus.Fatalf("failed to read the %s tokens: %v", provider, err)
+		}
+		args.tokens[provider] = append(args.tokens[provider], tokens...)
+	}
+	if len(args.tokens["ldap"]) > 0 {
+		logrus.Fatalf("ldap does not accept --token, use --ldap-bind-dn and " +
+			"--ldap-password-file")
+	}
+	for provider, tokens := range args.tokens {
+		if _, exists := external.TokenPoolMatchers[provider]; !exists && len(tokens) > 1 {
+			logrus.Fatalf("%s does not support several tokens", provider)
+		}
+	}
+	args.hosts = map[string][]string{}
+	if args.ExternalHosts != "" {
+		for _, item := range strings.Split(args.ExternalHosts, ",") {
+			parts := strings.SplitN(item, "=", 2)
+			if len(parts) != 2 || !stringInSlice(args.providers, parts[0]) {
+				logrus.Fatalf("invalid --external-hosts item: %s", item)
+			}
+			args.hosts[parts[0]] = append(args.hosts[parts[0]], parts[1])
 		}
 	}
-	args.ExternalCache = strings.ReplaceAll(args.ExternalCache, "{provider}", args.External)
 	return args
 }
+
+// gitbasePasswordEnv is the environment variable with the gitbase password.
+const gitbasePasswordEnv = "GITBASE_PASSWORD"
+
+// ldapPasswordEnv is the environment variable with the password of --ldap-bind-dn.
+const ldapPasswordEnv = "LDAP_BIND_PASSWORD"
+
+// newGitbaseConnection collects the gitbase connection settings.
+func newGitbaseConnection(args cliArgs) idmatch.GitbaseConnection {
+	return idmatch.GitbaseConnection{
+		DSN:           args.DSN,
+		Host:          args.Host,
+		Port:          args.Port,
+		User:          args.User,
+		Password:      args.Password,
+		Database:      args.Database,
+		TLS:           args.TLS,
+		TLSCA:         args.TLSCA,
+		TLSCert:       args.TLSCert,
+		TLSKey:        args.TLSKey,
+		TLSSkipVerify: args.TLSSkipVerify,
+	}
+}
+
+// parseFilterTime parses the time of --since and --until, either RFC3339 or a date in UTC.
+// The blank value is the zero time.
+func parseFilterTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if parsed, err := time.Parse("2006-01-02", value); err == nil {
+		return parsed, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// parseProviderValues maps the external matching services to the values from a flag.
+// The value is either the same for all the services or comma-separated "service=value" pairs.
+func parseProviderValues(value string, providers []string) (map[string]string, error) {
+	result := map[string]string{}
+	if value == "" {
+		return result, nil
+	}
+	items := strings.Split(value, ",")
+	for _, item := range items {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) == 2 && stringInSlice(providers, parts[0]) {
+			result[parts[0]] = parts[1]
+			continue
+		}
+		if len(items) > 1 {
+			return nil, fmt.Errorf("not a \"service=value\" pair or unknown service: %s", item)
+		}
+		for _, provider := range providers {
+			result[provider] = value
+		}
+	}
+	return result, nil
+}
+
+// newExternalMatcher creates the matcher which routes the queries to the external matching
+// services by the repository host. It also returns the token pools of the services which
+// support several tokens.
+func newExternalMatcher(args cliArgs) (external.Matcher, map[string]*external.TokenPool) {
+	var routes []external.MatcherRoute
+	pools := map[string]*external.TokenPool{}
+	for _, provider := range args.providers {
+		apiURL := args.apiURLs[provider]
+		var matcher external.Matcher
+		var err error
+		if args.Replay != "" {
+			matcher, err = external.NewReplayMatcher(
+				strings.ReplaceAll(args.Replay, "{provider}", provider))
+		} else if provider == "ldap" {
+			matcher, err = external.NewLDAPMatcherWithOptions(apiURL, args.ldap)
+		} else if constructor, exists := external.TokenPoolMatchers[provider]; exists {
+			pools[provider] = external.NewTokenPool(args.tokens[provider]...)
+			matcher, err = constructor(apiURL, pools[provider])
+		} else {
+			token := ""
+			if tokens := args.tokens[provider]; len(tokens) > 0 {
+				token = tokens[0]
+			}
+			matcher, err = external.Matchers[provider](apiURL, token)
+		}
+		if err != nil {
+			logrus.Fatalf("failed to initialize %s: %v", provider, err)
+		}
+		if args.Record != "" {
+			matcher, err = external.NewRecordingMatcher(
+				matcher, strings.ReplaceAll(args.Record, "{provider}", provider))
+			if err != nil {
+				logrus.Fatalf("failed to initialize recorded %s: %v", provider, err)
+			}
+		}
+		if args.Rate > 0 {
+			matcher = external.NewRateLimitedMatcher(
+				matcher, external.SharedRateLimiter(provider, args.Rate))
+		}
+		if args.ExternalCache != "" {
+			cached, err := external.NewCachedMatcher(
+				matcher, strings.ReplaceAll(args.ExternalCache, "{provider}", provider))
+			if err != nil {
+				logrus.Fatalf("failed to initialize cached %s: %v", provider, err)
+			}
+			if args.Refresh {
+				cached.Refresh(args.PositiveTTL, args.NegativeTTL)
+			}
+			matcher = cached
+		}
+		var hosts []string
+		hosts = append(hosts, external.DefaultHosts[provider]...)
+		if strings.Contains(apiURL, "://") {
+			hosts = append(hosts, external.RepoHost(apiURL))
+		}
+		hosts = append(hosts, args.hosts[provider]...)
+		routes = append(routes, external.MatcherRoute{
+			Provider: provider, Hosts: hosts, Matcher: matcher})
+	}
+	return external.NewCompositeMatcher(routes...), pools
+}
+
+// reportTokenUsage commits the quota usage of each API token to the reporter.
+func reportTokenUsage(pools map[string]*external.TokenPool) {
+	for provider, pool := range pools {
+		if pool.Len() == 0 {
+			continue
+		}
+		for i, usage := range pool.Usage() {
+			prefix := fmt.Sprintf("%s token #%d", provider, i+1)
+			reporter.Commit(prefix+" requests", usage.Requests)
+			if usage.Remaining >= 0 {
+				reporter.Commit(prefix+" remaining quota", usage.Remaining)
+			}
+		}
+		reporter.Commit(provider+" token rotations", pool.Rotations())
+	}
+}
+
+func stringInSlice(slice []string, s string) bool {
+	for _, str := range slice {
+		if str == s {
+			return true
+		}
+	}
+	return false
+}
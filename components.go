@@ -0,0 +1,162 @@
+package idmatch
+
+import (
+	"fmt"
+	"sort"
+)
+
+// identityComponents is the disjoint set (union-find) of people which tracks the unique emails,
+// the unique names, the ExternalID with its provider and the commit timezones of each set
+// incrementally. The sets are the connected components of the identity graph.
+type identityComponents struct {
+	parent map[int64]int64
+	size   map[int64]int
+	// the following maps are indexed by the set roots
+	emails      map[int64]map[string]struct{}
+	names       map[int64]map[string]struct{}
+	externalIDs map[int64]externalIdentity
+	timezones   map[int64]TimezoneHistogram
+}
+
+func newIdentityComponents(people People) *identityComponents {
+	c := &identityComponents{
+		parent:      make(map[int64]int64, len(people)),
+		size:        make(map[int64]int, len(people)),
+		emails:      make(map[int64]map[string]struct{}, len(people)),
+		names:       make(map[int64]map[string]struct{}, len(people)),
+		externalIDs: map[int64]externalIdentity{},
+		timezones:   make(map[int64]TimezoneHistogram, len(people)),
+	}
+	for id, person := range people {
+		c.parent[id] = id
+		c.size[id] = 1
+		emails := make(map[string]struct{}, len(person.Emails))
+		for _, email := range person.Emails {
+			emails[email] = struct{}{}
+		}
+		c.emails[id] = emails
+		names := make(map[string]struct{}, len(person.NamesWithRepos))
+		for _, name := range person.NamesWithRepos {
+			names[name.String()] = struct{}{}
+		}
+		c.names[id] = names
+		if externalID := person.externalIdentity(); externalID != (externalIdentity{}) {
+			c.externalIDs[id] = externalID
+		}
+		c.timezones[id] = person.Timezones()
+	}
+	return c
+}
+
+// find returns the root of the set which contains the person with the given id.
+func (c *identityComponents) find(id int64) int64 {
+	root := id
+	for c.parent[root] != root {
+		root = c.parent[root]
+	}
+	// path compression
+	for id != root {
+		next := c.parent[id]
+		c.parent[id] = root
+		id = next
+	}
+	return root
+}
+
+// connected reports whether two people belong to the same set.
+func (c *identityComponents) connected(id1, id2 int64) bool {
+	return c.find(id1) == c.find(id2)
+}
+
+// uniqueEmailsAndNames returns the number of unique emails and names in the set which
+// contains the person with the given id.
+func (c *identityComponents) uniqueEmailsAndNames(id int64) (int, int) {
+	root := c.find(id)
+	return len(c.emails[root]), len(c.names[root])
+}
+
+// timezoneOverlap returns the overlap of the commit timezones of the sets which contain the two
+// people, see TimezoneHistogram.Overlap().
+func (c *identityComponents) timezoneOverlap(id1, id2 int64) (float64, bool) {
+	return c.timezones[c.find(id1)].Overlap(c.timezones[c.find(id2)])
+}
+
+// externalID returns the ExternalID of the set which contains the person with the given id.
+func (c *identityComponents) externalID(id int64) externalIdentity {
+	return c.externalIDs[c.find(id)]
+}
+
+// setExternalID assigns the ExternalID to the set which contains the person with the given id.
+func (c *identityComponents) setExternalID(id int64, externalID externalIdentity) error {
+	root := c.find(id)
+	if existing := c.externalIDs[root]; existing != (externalIdentity{}) && existing != externalID {
+		return fmt.Errorf("cannot assign ExternalID %s to the component with ExternalID %s",
+			externalID, existing)
+	}
+	c.externalIDs[root] = externalID
+	return nil
+}
+
+// union joins the sets which contain the two people. It fails if the sets have different
+// ExternalIDs, otherwise the ExternalID is propagated to the joined set.
+func (c *identityComponents) union(id1, id2 int64) error {
+	root1, root2 := c.find(id1), c.find(id2)
+	if root1 == root2 {
+		return nil
+	}
+	externalID1, externalID2 := c.externalIDs[root1], c.externalIDs[root2]
+	none := externalIdentity{}
+	if externalID1 != none && externalID2 != none && externalID1 != externalID2 {
+		return fmt.Errorf(
+			"cannot set edge between nodes with different ExternalIDs: %s %s",
+			externalID1, externalID2)
+	}
+	// union by size: the smaller set is attached to the bigger one
+	if c.size[root1] < c.size[root2] {
+		root1, root2 = root2, root1
+	}
+	c.parent[root2] = root1
+	c.size[root1] += c.size[root2]
+	delete(c.size, root2)
+	c.emails[root1] = mergeSets(c.emails[root1], c.emails[root2])
+	delete(c.emails, root2)
+	c.names[root1] = mergeSets(c.names[root1], c.names[root2])
+	delete(c.names, root2)
+	if externalID1 == none {
+		externalID1 = externalID2
+	}
+	if externalID1 != none {
+		c.externalIDs[root1] = externalID1
+	}
+	delete(c.externalIDs, root2)
+	c.timezones[root1].Add(c.timezones[root2])
+	delete(c.timezones, root2)
+	return nil
+}
+
+// mergeSets inserts the smaller set into the bigger one and returns the bigger one.
+func mergeSets(set1, set2 map[string]struct{}) map[string]struct{} {
+	if len(set1) < len(set2) {
+		set1, set2 = set2, set1
+	}
+	for key := range set2 {
+		set1[key] = struct{}{}
+	}
+	return set1
+}
+
+// groups returns the sorted IDs of each set. The sets are ordered by their smallest ID.
+func (c *identityComponents) groups() [][]int64 {
+	root2group := map[int64][]int64{}
+	for id := range c.parent {
+		root := c.find(id)
+		root2group[root] = append(root2group[root], id)
+	}
+	result := make([][]int64, 0, len(root2group))
+	for _, group := range root2group {
+		Int64Slice(group).Sort()
+		result = append(result, group)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i][0] < result[j][0] })
+	return result
+}
@@ -0,0 +1,86 @@
+package idmatch
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestComponentsPeople() People {
+	return People{
+		1: {ID: 1, NamesWithRepos: []NameWithRepo{{"bob", ""}}, Emails: []string{"bob@google.com"}},
+		2: {ID: 2, NamesWithRepos: []NameWithRepo{{"bob", ""}}, Emails: []string{"bob@gmail.com"}},
+		3: {ID: 3, NamesWithRepos: []NameWithRepo{{"alice", ""}},
+			Emails: []string{"alice@google.com"}, ExternalID: "alice"},
+		4: {ID: 4, NamesWithRepos: []NameWithRepo{{"bob", ""}},
+			Emails: []string{"bob@google.com"}, ExternalID: "bob"},
+	}
+}
+
+func TestIdentityComponentsUnion(t *testing.T) {
+	req := require.New(t)
+	c := newIdentityComponents(newTestComponentsPeople())
+	req.False(c.connected(1, 2))
+	emails, names := c.uniqueEmailsAndNames(1)
+	req.Equal(1, emails)
+	req.Equal(1, names)
+
+	req.NoError(c.union(1, 2))
+	req.True(c.connected(1, 2))
+	req.Equal(c.find(1), c.find(2))
+	emails, names = c.uniqueEmailsAndNames(2)
+	req.Equal(2, emails)
+	req.Equal(1, names)
+	req.Equal(externalIdentity{}, c.externalID(1))
+
+	req.NoError(c.union(2, 4))
+	emails, names = c.uniqueEmailsAndNames(1)
+	req.Equal(2, emails)
+	req.Equal(1, names)
+	req.Equal(externalIdentity{user: "bob"}, c.externalID(1))
+
+	// idempotent
+	req.NoError(c.union(4, 1))
+	req.Equal([][]int64{{1, 2, 4}, {3}}, c.groups())
+}
+
+func TestIdentityComponentsExternalIDs(t *testing.T) {
+	req := require.New(t)
+	c := newIdentityComponents(newTestComponentsPeople())
+	req.Error(c.union(3, 4))
+	req.False(c.connected(3, 4))
+	req.NoError(c.setExternalID(1, externalIdentity{user: "bob"}))
+	req.Error(c.setExternalID(1, externalIdentity{user: "alice"}))
+	req.Error(c.setExternalID(1, externalIdentity{provider: "gitlab", user: "bob"}))
+	req.NoError(c.union(1, 4))
+	req.Error(c.union(1, 3))
+	req.Equal(externalIdentity{user: "bob"}, c.externalID(4))
+	req.Equal(externalIdentity{user: "alice"}, c.externalID(3))
+	req.Equal([][]int64{{1, 4}, {2}, {3}}, c.groups())
+}
+
+func TestIdentityComponentsTimezones(t *testing.T) {
+	req := require.New(t)
+	people := newTestComponentsPeople()
+	people[1].EmailStats = map[string]AliasStats{
+		"bob@google.com": {Commits: 2, Timezones: TimezoneHistogram{120: 2}}}
+	people[3].EmailStats = map[string]AliasStats{
+		"alice@google.com": {Commits: 2, Timezones: TimezoneHistogram{-420: 2}}}
+	c := newIdentityComponents(people)
+	_, known := c.timezoneOverlap(1, 2)
+	req.False(known)
+	overlap, known := c.timezoneOverlap(1, 3)
+	req.True(known)
+	req.Equal(0.0, overlap)
+	// the timezones of the joined set are the sum
+	req.NoError(c.union(2, 3))
+	overlap, known = c.timezoneOverlap(1, 2)
+	req.True(known)
+	req.Equal(0.0, overlap)
+	req.Equal(TimezoneHistogram{-420: 2}, c.timezones[c.find(2)])
+	req.NoError(c.setExternalID(1, externalIdentity{user: "alice"}))
+	req.NoError(c.union(1, 3))
+	req.Equal(TimezoneHistogram{120: 2, -420: 2}, c.timezones[c.find(1)])
+	// the people's histograms are not modified
+	req.Equal(TimezoneHistogram{120: 2}, people[1].Timezones())
+}
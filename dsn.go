@@ -0,0 +1,99 @@
+package idmatch
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// gitbaseTLSConfigName is the name of the TLS configuration registered with the MySQL driver.
+const gitbaseTLSConfigName = "idmatch-gitbase"
+
+// GitbaseConnection configures the connection to gitbase.
+type GitbaseConnection struct {
+	// DSN is the complete data source name of the MySQL driver, e.g.
+	// "root@unix(/var/run/gitbase.sock)/gitbase". It replaces Host, Port, User and Database.
+	// Password and the TLS settings override it if they are set.
+	DSN      string
+	Host     string
+	Port     uint
+	User     string
+	Password string
+	Database string
+	// TLS enables TLS with the system certificate authorities. The other TLS settings imply it.
+	TLS bool
+	// TLSCA is the path to the PEM certificates of the trusted authorities.
+	TLSCA string
+	// TLSCert and TLSKey are the paths to the PEM client certificate and its private key.
+	TLSCert string
+	TLSKey  string
+	// TLSSkipVerify disables the verification of the server certificate.
+	TLSSkipVerify bool
+}
+
+// ConnString returns the DSN of the connection. It registers the TLS configuration with
+// the MySQL driver if TLS is enabled.
+func (c GitbaseConnection) ConnString() (string, error) {
+	var cfg *mysql.Config
+	if c.DSN != "" {
+		var err error
+		if cfg, err = mysql.ParseDSN(c.DSN); err != nil {
+			return "", fmt.Errorf("invalid DSN: %v", err)
+		}
+	} else {
+		cfg = mysql.NewConfig()
+		cfg.User = c.User
+		cfg.Net = "tcp"
+		cfg.Addr = net.JoinHostPort(c.Host, strconv.FormatUint(uint64(c.Port), 10))
+		cfg.DBName = c.Database
+	}
+	if c.Password != "" {
+		cfg.Passwd = c.Password
+	}
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return "", err
+	}
+	if tlsConfig != nil {
+		if err = mysql.RegisterTLSConfig(gitbaseTLSConfigName, tlsConfig); err != nil {
+			return "", err
+		}
+		cfg.TLSConfig = gitbaseTLSConfigName
+	}
+	return cfg.FormatDSN(), nil
+}
+
+// tlsConfig loads the TLS settings. It returns nil if TLS is not enabled.
+func (c GitbaseConnection) tlsConfig() (*tls.Config, error) {
+	if !c.TLS && c.TLSCA == "" && c.TLSCert == "" && c.TLSKey == "" && !c.TLSSkipVerify {
+		return nil, nil
+	}
+	config := &tls.Config{InsecureSkipVerify: c.TLSSkipVerify}
+	if c.TLSCA != "" {
+		pem, err := ioutil.ReadFile(c.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.TLSCA)
+		}
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return nil, errors.New("the TLS client certificate and key must be set together")
+	}
+	if c.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(c.TLSCert, c.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
@@ -0,0 +1,119 @@
+package idmatch
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestCertificate writes a self-signed certificate and its private key in PEM.
+func writeTestCertificate(t *testing.T) (certPath, keyPath string) {
+	req := require.New(t)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	req.NoError(err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "gitbase"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	req.NoError(err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	req.NoError(err)
+	dir := t.TempDir()
+	certPath, keyPath = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	req.NoError(ioutil.WriteFile(certPath,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0666))
+	req.NoError(ioutil.WriteFile(keyPath,
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return certPath, keyPath
+}
+
+func TestGitbaseConnectionString(t *testing.T) {
+	req := require.New(t)
+	dsn, err := GitbaseConnection{
+		Host: "0.0.0.0", Port: 3306, User: "root", Password: "p@ss:word/", Database: "gitbase",
+	}.ConnString()
+	req.NoError(err)
+	cfg, err := mysql.ParseDSN(dsn)
+	req.NoError(err)
+	req.Equal("root", cfg.User)
+	req.Equal("p@ss:word/", cfg.Passwd)
+	req.Equal("tcp", cfg.Net)
+	req.Equal("0.0.0.0:3306", cfg.Addr)
+	req.Equal("gitbase", cfg.DBName)
+	req.Empty(cfg.TLSConfig)
+
+	dsn, err = GitbaseConnection{Host: "::1", Port: 3307, Database: "other"}.ConnString()
+	req.NoError(err)
+	req.Equal("tcp([::1]:3307)/other", dsn)
+}
+
+func TestGitbaseConnectionStringDSN(t *testing.T) {
+	req := require.New(t)
+	// the DSN replaces the host, the port, the user and the database but not the password
+	conn := GitbaseConnection{DSN: "reader@unix(/var/run/gitbase.sock)/repos?timeout=5s",
+		Host: "0.0.0.0", Port: 3306, User: "root", Password: "secret", Database: "gitbase"}
+	dsn, err := conn.ConnString()
+	req.NoError(err)
+	cfg, err := mysql.ParseDSN(dsn)
+	req.NoError(err)
+	req.Equal("reader", cfg.User)
+	req.Equal("secret", cfg.Passwd)
+	req.Equal("unix", cfg.Net)
+	req.Equal("/var/run/gitbase.sock", cfg.Addr)
+	req.Equal("repos", cfg.DBName)
+	req.Equal(5*time.Second, cfg.Timeout)
+
+	_, err = GitbaseConnection{DSN: "root@tcp(0.0.0.0:3306/gitbase"}.ConnString()
+	req.Error(err)
+}
+
+func TestGitbaseConnectionTLS(t *testing.T) {
+	req := require.New(t)
+	certPath, keyPath := writeTestCertificate(t)
+	conn := GitbaseConnection{Host: "gitbase.company.com", Port: 3306, User: "root",
+		TLSCA: certPath, TLSCert: certPath, TLSKey: keyPath}
+	config, err := conn.tlsConfig()
+	req.NoError(err)
+	req.NotNil(config.RootCAs)
+	req.Len(config.Certificates, 1)
+	req.False(config.InsecureSkipVerify)
+	dsn, err := conn.ConnString()
+	req.NoError(err)
+	req.Equal("root@tcp(gitbase.company.com:3306)/?tls="+gitbaseTLSConfigName, dsn)
+	// the registered configuration is resolved by the driver
+	cfg, err := mysql.ParseDSN(dsn)
+	req.NoError(err)
+	req.Equal(gitbaseTLSConfigName, cfg.TLSConfig)
+
+	config, err = GitbaseConnection{TLSSkipVerify: true}.tlsConfig()
+	req.NoError(err)
+	req.True(config.InsecureSkipVerify)
+	config, err = GitbaseConnection{TLS: true}.tlsConfig()
+	req.NoError(err)
+	req.Nil(config.RootCAs)
+	config, err = GitbaseConnection{}.tlsConfig()
+	req.NoError(err)
+	req.Nil(config)
+
+	_, err = GitbaseConnection{TLSCert: certPath}.tlsConfig()
+	req.EqualError(err, "the TLS client certificate and key must be set together")
+	_, err = GitbaseConnection{TLSCA: keyPath}.tlsConfig()
+	req.EqualError(err, "no certificates found in "+keyPath)
+}
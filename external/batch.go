@@ -0,0 +1,55 @@
+package external
+
+import (
+	"context"
+)
+
+// CommitQuery is a single MatchByCommit() query in a batch.
+type CommitQuery struct {
+	Email  string
+	Repo   string
+	Commit string
+}
+
+// CommitMatch is the result of a CommitQuery.
+type CommitMatch struct {
+	User string
+	// Provider is the provider which found User if the matcher is a ProviderMatcher.
+	Provider string
+	// Err is ErrNoMatches if there is no match.
+	Err error
+}
+
+// BatchMatcher is implemented by the matchers which resolve many commits at once,
+// e.g. with a single GraphQL query.
+type BatchMatcher interface {
+	Matcher
+	// MatchByCommits is the batched MatchByCommit(). The matches are in the order of
+	// the queries. The error is returned if the whole batch failed, e.g. the context
+	// was canceled.
+	MatchByCommits(ctx context.Context, queries []CommitQuery) ([]CommitMatch, error)
+}
+
+// matchByCommits forwards to the matcher if it is a BatchMatcher and queries the commits
+// one by one otherwise.
+func matchByCommits(ctx context.Context, matcher Matcher, queries []CommitQuery) (
+	[]CommitMatch, error) {
+	if batcher, ok := matcher.(BatchMatcher); ok {
+		return batcher.MatchByCommits(ctx, queries)
+	}
+	return matchByCommitsOneByOne(ctx, matcher, queries)
+}
+
+// matchByCommitsOneByOne calls MatchByCommit() for each query.
+func matchByCommitsOneByOne(ctx context.Context, matcher Matcher, queries []CommitQuery) (
+	[]CommitMatch, error) {
+	matches := make([]CommitMatch, len(queries))
+	for i, query := range queries {
+		matches[i].User, matches[i].Err = matcher.MatchByCommit(
+			ctx, query.Email, query.Repo, query.Commit)
+		if ctx.Err() != nil {
+			return nil, context.Canceled
+		}
+	}
+	return matches, nil
+}
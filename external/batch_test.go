@@ -0,0 +1,238 @@
+package external
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var testGraphQLAliasRe = regexp.MustCompile(
+	`(r\d+): repository\(owner: "([^"]*)", name: "([^"]*)"\)|(c\d+): object\(oid: "([0-9a-f]+)"\)`)
+
+// testGitHubGraphQLServer resolves the commits of src-d/hercules by the fixed mapping.
+type testGitHubGraphQLServer struct {
+	*httptest.Server
+	lock    sync.Mutex
+	queries []string
+}
+
+func newTestGitHubGraphQLServer(t *testing.T) *testGitHubGraphQLServer {
+	commits := map[string]string{
+		strings.Repeat("a", 40): `{"author": {"email": "Vadim@sourced.tech", "user": {"login": "vmarkovtsev"}},
+			"committer": {"email": "noreply@github.com", "user": null}}`,
+		strings.Repeat("b", 40): `{"author": {"email": "mcuadros@gmail.com", "user": null},
+			"committer": {"email": "bot@sourced.tech", "user": {"login": "sourced-bot"}}}`,
+		strings.Repeat("c", 40): `{"author": {"email": "unknown@sourced.tech", "user": null},
+			"committer": {"email": "unknown@sourced.tech", "user": null}}`,
+	}
+	server := &testGitHubGraphQLServer{}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/graphql" || r.Method != http.MethodPost ||
+			r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var body map[string]string
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		server.lock.Lock()
+		server.queries = append(server.queries, body["query"])
+		server.lock.Unlock()
+		var repos []string
+		var repo, objects []string
+		var hercules bool
+		flush := func() {
+			if repo == nil {
+				return
+			}
+			if hercules {
+				repos = append(repos, fmt.Sprintf(`"%s": {%s}`, repo[0],
+					strings.Join(objects, ", ")))
+			} else {
+				repos = append(repos, fmt.Sprintf(`"%s": null`, repo[0]))
+			}
+			objects = objects[:0]
+		}
+		for _, match := range testGraphQLAliasRe.FindAllStringSubmatch(body["query"], -1) {
+			if match[1] != "" {
+				flush()
+				repo = []string{match[1]}
+				hercules = match[2] == "src-d" && match[3] == "hercules"
+				continue
+			}
+			commit, exists := commits[match[5]]
+			if !exists {
+				commit = "null"
+			}
+			objects = append(objects, fmt.Sprintf(`"%s": %s`, match[4], commit))
+		}
+		flush()
+		fmt.Fprintf(w, `{"data": {%s}, "errors": [{"type": "NOT_FOUND", "message": "-"}]}`,
+			strings.Join(repos, ", "))
+	}))
+	return server
+}
+
+func TestGitHubMatcherMatchByCommits(t *testing.T) {
+	req := require.New(t)
+	server := newTestGitHubGraphQLServer(t)
+	defer server.Close()
+	matcher, err := NewGitHubMatcher(server.URL+"/", "token")
+	req.NoError(err)
+	batcher := matcher.(BatchMatcher)
+	hercules := "https://github.com/src-d/hercules.git"
+	queries := []CommitQuery{
+		{Email: "vadim@sourced.tech", Repo: hercules, Commit: strings.Repeat("a", 40)},
+		{Email: "bot@sourced.tech", Repo: "git://github.com/src-d/gitbase", Commit: strings.Repeat("b", 40)},
+		{Email: "bot@sourced.tech", Repo: "github.com/src-d/hercules", Commit: strings.Repeat("B", 40)},
+		{Email: "unknown@sourced.tech", Repo: hercules, Commit: strings.Repeat("c", 40)},
+		{Email: "vadim@sourced.tech", Repo: hercules, Commit: strings.Repeat("d", 40)},
+		{Email: "vadim@sourced.tech", Repo: hercules, Commit: "abc"},
+		{Email: "vadim@sourced.tech", Repo: "gitlab.com/src-d/hercules", Commit: strings.Repeat("a", 40)},
+		{Email: "42+vmarkovtsev@users.noreply.github.com", Repo: hercules, Commit: "abc"},
+	}
+	matches, err := batcher.MatchByCommits(context.Background(), queries)
+	req.NoError(err)
+	req.Len(matches, len(queries))
+	req.Equal(CommitMatch{User: "vmarkovtsev"}, matches[0])
+	req.Equal(CommitMatch{Err: ErrNoMatches}, matches[1])
+	req.Equal(CommitMatch{User: "sourced-bot"}, matches[2])
+	req.Equal(CommitMatch{Err: ErrNoMatches}, matches[3])
+	req.Equal(CommitMatch{Err: ErrNoMatches}, matches[4])
+	req.Error(matches[5].Err)
+	req.NotEqual(ErrNoMatches, matches[5].Err)
+	req.Error(matches[6].Err)
+	req.NotEqual(ErrNoMatches, matches[6].Err)
+	req.Equal(CommitMatch{User: "vmarkovtsev"}, matches[7])
+	// both repositories fit in a single query
+	req.Len(server.queries, 1)
+	req.Contains(server.queries[0], `repository(owner: "src-d", name: "gitbase")`)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = batcher.MatchByCommits(ctx, queries[:1])
+	req.Equal(context.Canceled, err)
+}
+
+func TestGitHubMatcherMatchByCommitsChunks(t *testing.T) {
+	req := require.New(t)
+	server := newTestGitHubGraphQLServer(t)
+	defer server.Close()
+	matcher, err := NewGitHubMatcher(server.URL, "token")
+	req.NoError(err)
+	queries := make([]CommitQuery, gitHubMaxBatch*2+1)
+	for i := range queries {
+		queries[i] = CommitQuery{Email: "vadim@sourced.tech", Repo: "github.com/src-d/hercules",
+			Commit: strings.Repeat("a", 40)}
+	}
+	matches, err := matcher.(BatchMatcher).MatchByCommits(context.Background(), queries)
+	req.NoError(err)
+	for _, match := range matches {
+		req.Equal(CommitMatch{User: "vmarkovtsev"}, match)
+	}
+	req.Len(server.queries, 3)
+}
+
+func TestGitHubGraphQLURL(t *testing.T) {
+	require.Equal(t, "https://api.github.com/graphql", gitHubGraphQLURL("https://api.github.com/"))
+	require.Equal(t, "https://github.company.com/api/graphql",
+		gitHubGraphQLURL("https://github.company.com/api/v3/"))
+	matcher, err := NewGitHubMatcher("", "")
+	require.NoError(t, err)
+	require.Nil(t, matcher.(GitHubMatcher).graphql)
+}
+
+// testBatchMatcher is testMapMatcher which records the batches.
+type testBatchMatcher struct {
+	testMapMatcher
+	batches *[][]CommitQuery
+}
+
+func (m testBatchMatcher) MatchByCommits(ctx context.Context, queries []CommitQuery) (
+	[]CommitMatch, error) {
+	*m.batches = append(*m.batches, queries)
+	return matchByCommitsOneByOne(ctx, m.testMapMatcher, queries)
+}
+
+func TestCompositeMatcherMatchByCommits(t *testing.T) {
+	req := require.New(t)
+	var batches [][]CommitQuery
+	matcher := NewCompositeMatcher(
+		MatcherRoute{Provider: "github", Hosts: []string{"github.com"},
+			Matcher: testBatchMatcher{testMapMatcher{
+				users: map[string]string{"vadim@sourced.tech": "vmarkovtsev"}, commits: true},
+				&batches}},
+		MatcherRoute{Provider: "gitlab", Hosts: []string{"gitlab.com"},
+			Matcher: testMapMatcher{users: map[string]string{"vadim@sourced.tech": "vadim"}}},
+		MatcherRoute{Provider: "bitbucket", Hosts: []string{"bitbucket.org"},
+			Matcher: testMapMatcher{users: map[string]string{
+				"bob@sourced.tech": "557058:7bfc3d8e-3c4a-4b39-9f6f-0f4d9e8a1c2b"}}},
+	)
+	matches, err := matcher.MatchByCommits(context.Background(), []CommitQuery{
+		{Email: "vadim@sourced.tech", Repo: "github.com/src-d/hercules", Commit: "1"},
+		{Email: "vadim@sourced.tech", Repo: "gitlab.com/src-d/hercules", Commit: "2"},
+		{Email: "bob@sourced.tech", Repo: "github.com/src-d/gitbase", Commit: "3"},
+		{Email: "vadim@sourced.tech", Repo: "example.com/src-d/hercules", Commit: "4"},
+		{Email: "bob@sourced.tech", Repo: "bitbucket.org/src-d/hercules", Commit: "5"},
+	})
+	req.NoError(err)
+	req.Equal([]CommitMatch{
+		{User: "vmarkovtsev@1", Provider: "github"},
+		{User: "vadim", Provider: "gitlab"},
+		{Err: ErrNoMatches},
+		{User: "vmarkovtsev", Provider: "github"},
+		{User: "557058:7bfc3d8e-3c4a-4b39-9f6f-0f4d9e8a1c2b", Provider: "bitbucket"},
+	}, matches)
+	req.Len(batches, 1)
+	req.Len(batches[0], 2)
+}
+
+func TestCachedMatcherMatchByCommits(t *testing.T) {
+	req := require.New(t)
+	var batches [][]CommitQuery
+	inner := testBatchMatcher{testMapMatcher{
+		users: map[string]string{"vadim@sourced.tech": "vmarkovtsev"}, commits: true}, &batches}
+	matcher, err := NewCachedMatcher(NewRateLimitedMatcher(inner, NewRateLimiter(0)),
+		filepath.Join(t.TempDir(), "cache.csv"))
+	req.NoError(err)
+	queries := []CommitQuery{
+		{Email: "vadim@sourced.tech", Repo: "github.com/src-d/hercules", Commit: "1"},
+		{Email: "bob@sourced.tech", Repo: "github.com/src-d/hercules", Commit: "2"},
+	}
+	matches, err := matcher.MatchByCommits(context.Background(), queries)
+	req.NoError(err)
+	req.Equal([]CommitMatch{{User: "vmarkovtsev@1"}, {Err: ErrNoMatches}}, matches)
+	req.Len(batches, 1)
+	queries = append(queries, CommitQuery{
+		Email: "alice@sourced.tech", Repo: "github.com/src-d/hercules", Commit: "3"})
+	matches, err = matcher.MatchByCommits(context.Background(), queries)
+	req.NoError(err)
+	req.Equal([]CommitMatch{{User: "vmarkovtsev@1"}, {Err: ErrNoMatches}, {Err: ErrNoMatches}},
+		matches)
+	req.Len(batches, 2)
+	req.Len(batches[1], 1)
+	_, err = matcher.MatchByCommits(context.Background(), queries)
+	req.NoError(err)
+	req.Len(batches, 2)
+}
+
+func TestMatchByCommitsOneByOne(t *testing.T) {
+	req := require.New(t)
+	matcher := testMapMatcher{users: map[string]string{"vadim@sourced.tech": "vmarkovtsev"}}
+	matches, err := matchByCommits(context.Background(), matcher, []CommitQuery{
+		{Email: "vadim@sourced.tech", Commit: "1"}, {Email: "bob@sourced.tech", Commit: "2"}})
+	req.NoError(err)
+	req.Equal([]CommitMatch{{User: "vmarkovtsev@1"}, {Err: ErrNoMatches}}, matches)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = matchByCommits(ctx, matcher, []CommitQuery{{Email: "vadim@sourced.tech"}})
+	req.Equal(context.Canceled, err)
+}
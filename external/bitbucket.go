@@ -2,69 +2,165 @@ package external
 
 import (
 	"context"
-	"errors"
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
-	"github.com/wbrefvem/go-bitbucket"
+	"github.com/sirupsen/logrus"
 )
 
 // BitBucketMatcher matches emails and BitBucket users.
 type BitBucketMatcher struct {
-	authContext context.Context
-	client      *bitbucket.APIClient
+	// httpClient authorizes the requests.
+	httpClient *http.Client
+	apiURL     string
+}
+
+// bitbucketCommit is the part of the commit object which we need.
+type bitbucketCommit struct {
+	Author struct {
+		// Raw is "name <email>"
+		Raw  string `json:"raw"`
+		User *struct {
+			AccountID string `json:"account_id"`
+		} `json:"user"`
+	} `json:"author"`
 }
 
 // NewBitBucketMatcher creates a new matcher given a BitBucket personal access token.
 // https://id.atlassian.com/manage/api-tokens
 func NewBitBucketMatcher(apiURL, token string) (Matcher, error) {
+	return NewBitBucketMatcherWithTokens(apiURL, NewTokenPool(token))
+}
+
+// NewBitBucketMatcherWithTokens creates a new matcher which rotates the BitBucket tokens.
+// Each token is the value of the Authorization header, e.g. "Bearer XXX".
+// The matcher is anonymous if the pool is empty.
+func NewBitBucketMatcherWithTokens(apiURL string, tokens *TokenPool) (Matcher, error) {
 	if apiURL == "" {
 		apiURL = "https://api.bitbucket.org/2.0"
 	}
-	ctx := context.WithValue(
-		context.Background(),
-		bitbucket.ContextAPIKey,
-		bitbucket.APIKey{Key: token},
-	)
-	client := bitbucket.NewAPIClient(bitbucket.NewConfiguration())
-	return BitBucketMatcher{authContext: ctx, client: client}, nil
+	httpClient := tokens.client(func(req *http.Request, token string) {
+		req.Header.Set("Authorization", token)
+	})
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return BitBucketMatcher{httpClient: httpClient, apiURL: apiURL}, nil
 }
 
-// MatchByEmail returns the latest BitBucket user with the given email.
-func (m BitBucketMatcher) MatchByEmail(ctx context.Context, email string) (user string, err error) {
-	finished := make(chan struct{})
-	go func() {
-		defer func() { finished <- struct{}{} }()
-		var u bitbucket.User
-		var r *http.Response
-		u, r, err = m.client.UsersApi.UsersUsernameGet(m.authContext, email)
-		if err != nil {
-			// According to https://confluence.atlassian.com/bitbucket/rate-limits-668173227.html
-			// this API is not rate-limited.
-			if r.StatusCode == 404 {
-				err = ErrNoMatches
-			}
-			return
-		}
-		user = u.AccountId
-		// name = u.DisplayName
-	}()
-	select {
-	case <-finished:
-		return
-	case <-ctx.Done():
-		return "", context.Canceled
+// MatchByEmail always returns ErrNoMatches: Bitbucket does not look up the accounts by email,
+// the users API accepts only the account IDs and the UUIDs. The accounts are matched by
+// MatchByCommit instead.
+func (m BitBucketMatcher) MatchByEmail(ctx context.Context, email string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
 	}
+	return "", ErrNoMatches
 }
 
 // SupportsMatchingByCommit indicates whether this Matcher allows querying identities by commit metadata.
 func (m BitBucketMatcher) SupportsMatchingByCommit() bool {
-	return false
+	return true
 }
 
 // MatchByCommit queries the identity of a given email address in a particular commit context.
+// Bitbucket links the commit authors to the accounts, so the returned user is the account ID
+// of the commit author.
 func (m BitBucketMatcher) MatchByCommit(
 	ctx context.Context, email, repo, commit string) (user string, err error) {
-	return "", errors.New("not implemented")
+	path := strings.Split(repoPath(repo), "/")
+	if len(path) != 2 {
+		return "", fmt.Errorf("not a Bitbucket repository: %s", repo)
+	}
+	workspace, repoSlug := path[0], path[1]
+	c, err := m.getCommit(ctx, workspace, repoSlug, commit)
+	if err != nil {
+		return "", err
+	}
+	if c.Author.User == nil || c.Author.User.AccountID == "" ||
+		!strings.EqualFold(emailFromRaw(c.Author.Raw), email) {
+		logrus.Warnf("unable to find users by commit for email: %s", email)
+		return "", ErrNoMatches
+	}
+	return c.Author.User.AccountID, nil
+}
+
+func (m BitBucketMatcher) getCommit(
+	ctx context.Context, workspace, repoSlug, commit string) (bitbucketCommit, error) {
+	var c bitbucketCommit
+	err := m.get(ctx, fmt.Sprintf("repositories/%s/%s/commit/%s", workspace, repoSlug, commit), &c)
+	if err == ErrNoMatches {
+		logrus.Warnf("commit %s was not found in %s/%s", commit, workspace, repoSlug)
+	}
+	return c, err
+}
+
+// bitbucketAccount is the part of the account object which we need.
+type bitbucketAccount struct {
+	DisplayName string `json:"display_name"`
+	CreatedOn   string `json:"created_on"`
+	Links       struct {
+		Avatar struct {
+			Href string `json:"href"`
+		} `json:"avatar"`
+		HTML struct {
+			Href string `json:"href"`
+		} `json:"html"`
+	} `json:"links"`
+}
+
+// Profile returns the public profile of the account with the given ID.
+func (m BitBucketMatcher) Profile(ctx context.Context, user string) (Profile, error) {
+	var account bitbucketAccount
+	if err := m.get(ctx, "users/"+url.PathEscape(user), &account); err != nil {
+		return Profile{}, err
+	}
+	profile := Profile{
+		DisplayName: account.DisplayName,
+		AvatarURL:   account.Links.Avatar.Href,
+		ProfileURL:  account.Links.HTML.Href,
+	}
+	if account.CreatedOn != "" {
+		// the creation date is hidden for most of the accounts
+		profile.CreatedAt, _ = time.Parse(time.RFC3339Nano, account.CreatedOn)
+	}
+	return profile, nil
+}
+
+// get fetches the API object at the given path relative to the API URL. It returns
+// ErrNoMatches if the object does not exist.
+func (m BitBucketMatcher) get(ctx context.Context, path string, result interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(m.apiURL, "/")+"/"+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	response, err := doWithRetries(ctx, m.httpClient, req, isTransientCode)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotFound {
+		return ErrNoMatches
+	}
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("HTTP %d: %s", response.StatusCode, response.Status)
+	}
+	return json.NewDecoder(response.Body).Decode(result)
+}
+
+// emailFromRaw extracts the email from "name <email>".
+func emailFromRaw(raw string) string {
+	start := strings.LastIndex(raw, "<")
+	end := strings.LastIndex(raw, ">")
+	if start < 0 || end < start {
+		return ""
+	}
+	return strings.TrimSpace(raw[start+1 : end])
 }
 
 // OnIdle does nothing here.
@@ -0,0 +1,104 @@
+package external
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBitBucketMatcherMatchByCommit(t *testing.T) {
+	req := require.New(t)
+	var authorization string
+	server := newFixtureServer(t, map[string]string{
+		"/2.0/repositories/vstinner/hachoir/commit/d78a9c8b0c077b5ecdb3cf1e1efab4635c97dd7b": "bitbucket/commit.json",
+		"/2.0/repositories/vstinner/hachoir/commit/8d20cc5916edf7cfa6a9c5ed069f0640dc823c12": "bitbucket/commit_anonymous.json",
+	}, func(r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+	})
+	defer server.Close()
+	matcher, err := NewBitBucketMatcher(server.URL+"/2.0", "Bearer token")
+	req.NoError(err)
+	req.True(matcher.SupportsMatchingByCommit())
+	ctx := context.Background()
+	repo := "https://bitbucket.org/vstinner/hachoir.git"
+
+	user, err := matcher.MatchByCommit(
+		ctx, "victor.stinner@gmail.com", repo, "d78a9c8b0c077b5ecdb3cf1e1efab4635c97dd7b")
+	req.NoError(err)
+	req.Equal("557058:7bfcfebe-074d-4f48-9983-a8f959cf4a65", user)
+	req.Equal("Bearer token", authorization)
+
+	// the email does not belong to the commit
+	_, err = matcher.MatchByCommit(
+		ctx, "vadim@sourced.tech", repo, "d78a9c8b0c077b5ecdb3cf1e1efab4635c97dd7b")
+	req.Equal(ErrNoMatches, err)
+
+	// the author is not linked to an account
+	_, err = matcher.MatchByCommit(
+		ctx, "someone@example.com", repo, "8d20cc5916edf7cfa6a9c5ed069f0640dc823c12")
+	req.Equal(ErrNoMatches, err)
+
+	// the commit does not exist
+	_, err = matcher.MatchByCommit(
+		ctx, "victor.stinner@gmail.com", "git@bitbucket.org:vstinner/hachoir.git",
+		"c3b9fc1bd5b8fed1c5b0ee2fb4e7e4c0a4d1c7d9")
+	req.Equal(ErrNoMatches, err)
+
+	// not a repository URL
+	_, err = matcher.MatchByCommit(
+		ctx, "victor.stinner@gmail.com", "hachoir", "d78a9c8b0c077b5ecdb3cf1e1efab4635c97dd7b")
+	req.EqualError(err, "not a Bitbucket repository: hachoir")
+}
+
+func TestBitBucketMatcherMatchByEmail(t *testing.T) {
+	req := require.New(t)
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+	matcher, err := NewBitBucketMatcher(server.URL+"/2.0", "Bearer token")
+	req.NoError(err)
+	user, err := matcher.MatchByEmail(context.Background(), "victor.stinner@gmail.com")
+	req.Equal(ErrNoMatches, err)
+	req.Equal("", user)
+	// the users API does not accept emails, so it is not queried
+	req.Zero(requests)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = matcher.MatchByEmail(ctx, "victor.stinner@gmail.com")
+	req.Equal(context.Canceled, err)
+}
+
+func TestBitBucketMatcherProfile(t *testing.T) {
+	req := require.New(t)
+	server := newFixtureServer(t, map[string]string{
+		"/2.0/users/557058:7bfcfebe-074d-4f48-9983-a8f959cf4a65": "bitbucket/user.json",
+	}, nil)
+	defer server.Close()
+	matcher, err := NewBitBucketMatcher(server.URL+"/2.0", "")
+	req.NoError(err)
+	profile, err := matcher.(Profiler).Profile(
+		context.Background(), "557058:7bfcfebe-074d-4f48-9983-a8f959cf4a65")
+	req.NoError(err)
+	req.Equal("Victor Stinner", profile.DisplayName)
+	req.True(strings.HasPrefix(profile.AvatarURL, "https://secure.gravatar.com/avatar/"))
+	req.Equal("https://bitbucket.org/%7B6ab11d0a-4af5-4ec5-8b57-4f0b6b1ab3a2%7D/",
+		profile.ProfileURL)
+	req.True(time.Date(2010, 11, 12, 14, 5, 11, 318215000, time.UTC).Equal(profile.CreatedAt))
+	_, err = matcher.(Profiler).Profile(context.Background(), "557058:unknown")
+	req.Equal(ErrNoMatches, err)
+}
+
+func TestEmailFromRaw(t *testing.T) {
+	require.Equal(t, "victor.stinner@gmail.com",
+		emailFromRaw("Victor Stinner <victor.stinner@gmail.com>"))
+	require.Equal(t, "", emailFromRaw("Victor Stinner"))
+}
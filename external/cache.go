@@ -1,6 +1,7 @@
 package external
 
 import (
+	"bufio"
 	"context"
 	"encoding/csv"
 	"fmt"
@@ -9,6 +10,7 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
@@ -17,24 +19,70 @@ import (
 type CachedUser struct {
 	User    string
 	Matched bool // false if there is no match from the external API
+	// Time is when the external API was queried. It is zero in the caches written before
+	// the timestamps were introduced.
+	Time time.Time
+}
+
+// expired indicates whether the cached user is older than the TTL of its kind.
+// The zero TTL never expires, the unknown lookup time always expires.
+func (u CachedUser) expired(positiveTTL, negativeTTL time.Duration, now time.Time) bool {
+	ttl := negativeTTL
+	if u.Matched {
+		ttl = positiveTTL
+	}
+	return ttl > 0 && (u.Time.IsZero() || now.Sub(u.Time) > ttl)
+}
+
+// CommitKey identifies a lookup by commit. The provider is implied by the cache, which is
+// separate for each external matching service.
+type CommitKey struct {
+	Repo   string
+	Commit string
+	Email  string
 }
 
 type safeUserCache struct {
-	cache     map[string]CachedUser
+	cache map[string]CachedUser
+	// commits map the lookups by commit to their results. It is nil until the first commit
+	// is cached.
+	commits map[CommitKey]CachedUser
+	// profiles map the users to their profiles. It is nil until the first profile is cached.
+	profiles  map[string]Profile
 	lock      sync.RWMutex // mutex to make cache mapping safe for concurrent use
 	cachePath string
+	// store persists each entry as soon as it is cached. The cache is dumped to the CSV file
+	// at cachePath if it is nil.
+	store CacheStore
 }
 
 // CachedMatcher is a wrapper around Matcher with the cache for queried emails.
 type CachedMatcher struct {
 	matcher Matcher
 	cache   safeUserCache
+	// refresh enables positiveTTL and negativeTTL, the cached users never expire otherwise.
+	refresh     bool
+	positiveTTL time.Duration
+	negativeTTL time.Duration
 }
 
 const saveFreq int = 20 // Dump cache to file each saveFreq usernames fetched
 const csvTrue string = "1"
 const csvFalse string = "0"
 
+// csvCacheVersion is the current version of the CSV cache format. Version 1 has no marker
+// and no "time" column, version 2 starts with csvCacheVersionMarker.
+const csvCacheVersion = 2
+
+// csvCacheVersionMarker is the first line of the CSV caches since version 2.
+const csvCacheVersionMarker = "# external identities cache version %d"
+
+// timeNow returns the current time. It is replaced in the tests.
+var timeNow = time.Now
+
+// csvCacheColumns is the header of the current version of the CSV cache.
+var csvCacheColumns = []string{"email", "user", "match", "time"}
+
 // PathExists reports whether a file or directory exists.
 func PathExists(path string) bool {
 	if _, err := os.Stat(path); err != nil {
@@ -46,6 +94,7 @@ func PathExists(path string) bool {
 }
 
 // NewCachedMatcher creates a new matcher with a cache for a given matcher interface.
+// The cache is stored in BoltDB if IsBoltCachePath(cachePath) and in CSV otherwise.
 func NewCachedMatcher(matcher Matcher, cachePath string) (*CachedMatcher, error) {
 	if cachePath == "" {
 		panic("cachePath cannot be empty")
@@ -53,8 +102,15 @@ func NewCachedMatcher(matcher Matcher, cachePath string) (*CachedMatcher, error)
 	logrus.WithFields(logrus.Fields{
 		"cachePath": cachePath,
 	}).Info("caching the external identities")
-	cache := safeUserCache{cache: make(map[string]CachedUser), cachePath: cachePath, lock: sync.RWMutex{}}
-	cachedMatcher := &CachedMatcher{matcher: matcher, cache: cache}
+	if IsBoltCachePath(cachePath) {
+		store, err := OpenBoltCacheStore(cachePath)
+		if err != nil {
+			return nil, err
+		}
+		return NewCachedMatcherWithStore(matcher, store)
+	}
+	cachedMatcher := &CachedMatcher{matcher: matcher, cache: safeUserCache{
+		cache: make(map[string]CachedUser), cachePath: cachePath}}
 	var err error
 	if PathExists(cachePath) {
 		err = cachedMatcher.LoadCache()
@@ -65,6 +121,18 @@ func NewCachedMatcher(matcher Matcher, cachePath string) (*CachedMatcher, error)
 	return cachedMatcher, err
 }
 
+// NewCachedMatcherWithStore creates a new matcher with a cache in the given store.
+// The matcher closes the store in Close().
+func NewCachedMatcherWithStore(matcher Matcher, store CacheStore) (*CachedMatcher, error) {
+	cachedMatcher := &CachedMatcher{matcher: matcher, cache: safeUserCache{
+		cache: make(map[string]CachedUser), store: store}}
+	if err := cachedMatcher.LoadCache(); err != nil {
+		store.Close()
+		return nil, err
+	}
+	return cachedMatcher, nil
+}
+
 // LoadCache reads the CachedMatcher cache from disk.
 // It is a proxy for safeUserCache.LoadFromDisk() function.
 func (m *CachedMatcher) LoadCache() error {
@@ -73,35 +141,70 @@ func (m *CachedMatcher) LoadCache() error {
 
 // DumpCache saves the current CachedMatcher cache on disk.
 // It is a proxy for safeUserCache.DumpOnDisk() function.
-func (m CachedMatcher) DumpCache() error {
+func (m *CachedMatcher) DumpCache() error {
 	return m.cache.DumpOnDisk()
 }
 
+// Refresh makes the matcher query again the cached matches older than positiveTTL and
+// the cached absent matches older than negativeTTL. The zero TTL never expires. The entries
+// without the lookup time, which were cached by the previous versions, are always expired
+// unless the TTL is zero.
+func (m *CachedMatcher) Refresh(positiveTTL, negativeTTL time.Duration) {
+	m.refresh = true
+	m.positiveTTL = positiveTTL
+	m.negativeTTL = negativeTTL
+}
+
+// lookup returns the cached user if it exists and has not expired.
+func (m *CachedMatcher) lookup(email string) (CachedUser, bool) {
+	user, exists := m.cache.ReadUserFromCache(email)
+	if exists && m.refresh && user.expired(m.positiveTTL, m.negativeTTL, timeNow()) {
+		return CachedUser{}, false
+	}
+	return user, exists
+}
+
+// lookupCommit returns the cached user of the commit if it exists and has not expired.
+func (m *CachedMatcher) lookupCommit(key CommitKey) (CachedUser, bool) {
+	user, exists := m.cache.ReadCommitFromCache(key)
+	if exists && m.refresh && user.expired(m.positiveTTL, m.negativeTTL, timeNow()) {
+		return CachedUser{}, false
+	}
+	return user, exists
+}
+
 // OnIdle saves the current CachedMatcher cache on disk.
-func (m CachedMatcher) OnIdle() error {
+func (m *CachedMatcher) OnIdle() error {
 	return m.DumpCache()
 }
 
+// Close saves the current CachedMatcher cache on disk, closes the store and the underlying
+// Matcher if it implements io.Closer.
+func (m *CachedMatcher) Close() error {
+	var err error
+	if m.cache.store == nil {
+		err = m.DumpCache()
+	} else {
+		err = m.cache.store.Close()
+	}
+	if closeErr := closeMatcher(m.matcher); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
 // MatchByEmail looks in the cache first, and if there is a cache miss, forwards to the underlying Matcher.
 func (m *CachedMatcher) MatchByEmail(ctx context.Context, email string) (user string, err error) {
-	if username, exists := m.cache.ReadUserFromCache(email); exists {
+	if username, exists := m.lookup(email); exists {
 		if username.Matched {
 			return username.User, nil
 		}
 		return "", ErrNoMatches
 	}
 	user, err = m.matcher.MatchByEmail(ctx, email)
-	if err == nil {
-		m.cache.AddUserToCache(email, user, true)
+	if dumpErr := m.remember(email, user, err); dumpErr != nil {
+		err = dumpErr
 	}
-	if err == ErrNoMatches {
-		m.cache.AddUserToCache(email, user, false)
-	}
-	m.cache.lock.Lock()
-	if len(m.cache.cache)%saveFreq == 0 {
-		err = m.DumpCache()
-	}
-	m.cache.lock.Unlock()
 	return user, err
 }
 
@@ -110,51 +213,233 @@ func (m *CachedMatcher) SupportsMatchingByCommit() bool {
 	return m.matcher.SupportsMatchingByCommit()
 }
 
-// MatchByCommit looks in the cache first, and if there is a cache miss, forwards to the underlying Matcher.
+// MatchByCommit looks in the cache of the commits first, and if there is a cache miss, forwards
+// to the underlying Matcher. The cached matches by email are not used because the same email
+// may resolve differently in different repositories.
 func (m *CachedMatcher) MatchByCommit(
 	ctx context.Context, email, repo, commit string) (user string, err error) {
-	if username, exists := m.cache.ReadUserFromCache(email); exists {
+	key := CommitKey{Repo: repo, Commit: commit, Email: email}
+	if username, exists := m.lookupCommit(key); exists {
 		if username.Matched {
 			return username.User, nil
 		}
 		return "", ErrNoMatches
 	}
 	user, err = m.matcher.MatchByCommit(ctx, email, repo, commit)
+	if dumpErr := m.rememberCommit(key, user, err); dumpErr != nil {
+		err = dumpErr
+	}
+	return user, err
+}
+
+// MatchByCommits looks in the cache of the commits first and forwards the cache misses to the underlying
+// Matcher in a single batch.
+func (m *CachedMatcher) MatchByCommits(ctx context.Context, queries []CommitQuery) (
+	[]CommitMatch, error) {
+	matches := make([]CommitMatch, len(queries))
+	var misses []CommitQuery
+	var missIndexes []int
+	for i, query := range queries {
+		key := CommitKey{Repo: query.Repo, Commit: query.Commit, Email: query.Email}
+		if username, exists := m.lookupCommit(key); exists {
+			if username.Matched {
+				matches[i].User = username.User
+			} else {
+				matches[i].Err = ErrNoMatches
+			}
+			continue
+		}
+		misses = append(misses, query)
+		missIndexes = append(missIndexes, i)
+	}
+	if len(misses) == 0 {
+		return matches, nil
+	}
+	missMatches, err := matchByCommits(ctx, m.matcher, misses)
+	if err != nil {
+		return nil, err
+	}
+	for j, i := range missIndexes {
+		matches[i] = missMatches[j]
+		key := CommitKey{Repo: misses[j].Repo, Commit: misses[j].Commit, Email: misses[j].Email}
+		if dumpErr := m.rememberCommit(key, matches[i].User, matches[i].Err); dumpErr != nil {
+			matches[i].Err = dumpErr
+		}
+	}
+	return matches, nil
+}
+
+// remember caches the match or the absence of it and writes it to the store or periodically
+// dumps the cache on disk. It returns the error of the write, if any.
+func (m *CachedMatcher) remember(email, user string, err error) error {
+	if err == nil || err == ErrNoMatches {
+		cached := m.cache.AddUserToCache(email, user, err == nil)
+		if m.cache.store != nil {
+			return m.cache.store.PutUser(email, cached)
+		}
+	}
+	return m.dumpPeriodically(func() int { return len(m.cache.cache) })
+}
+
+// rememberCommit caches the match of the commit or the absence of it the same way as
+// remember(). The match by email is derived from the found match, but not from the absence of
+// it, because the email may match in the other repositories.
+func (m *CachedMatcher) rememberCommit(key CommitKey, user string, err error) error {
+	if err == nil || err == ErrNoMatches {
+		cached := m.cache.AddCommitToCache(key, user, err == nil)
+		if m.cache.store != nil {
+			if storeErr := m.cache.store.PutCommit(key, cached); storeErr != nil {
+				return storeErr
+			}
+		}
+	}
 	if err == nil {
-		m.cache.AddUserToCache(email, user, true)
+		return m.remember(key.Email, user, nil)
 	}
-	if err == ErrNoMatches {
-		m.cache.AddUserToCache(email, user, false)
+	return m.dumpPeriodically(func() int { return len(m.cache.commits) })
+}
+
+// dumpPeriodically dumps the cache on disk each saveFreq entries as counted by size.
+// There is nothing to do if the cache has the store.
+func (m *CachedMatcher) dumpPeriodically(size func() int) error {
+	if m.cache.store != nil {
+		return nil
 	}
 	m.cache.lock.Lock()
-	if len(m.cache.cache)%saveFreq == 0 {
-		err = m.DumpCache()
+	defer m.cache.lock.Unlock()
+	if size()%saveFreq == 0 {
+		return m.DumpCache()
 	}
-	m.cache.lock.Unlock()
-	return user, err
+	return nil
 }
 
-// Add to cache safely
-func (m *safeUserCache) AddUserToCache(email string, user string, matched bool) {
+// Profile looks in the cache first, and if there is a cache miss, forwards to the underlying
+// Matcher if it is a Profiler. Only the found profiles are cached.
+func (m *CachedMatcher) Profile(ctx context.Context, user string) (Profile, error) {
+	if p, exists := m.cache.ReadProfileFromCache(user); exists {
+		return p, nil
+	}
+	p, err := profile(ctx, m.matcher, user)
+	if err != nil {
+		return Profile{}, err
+	}
+	m.cache.AddProfileToCache(user, p)
+	if m.cache.store != nil {
+		if err = m.cache.store.PutProfile(user, p); err != nil {
+			return Profile{}, err
+		}
+	}
+	return p, nil
+}
+
+// Add to cache safely with the current time
+func (m *safeUserCache) AddUserToCache(email string, user string, matched bool) CachedUser {
+	cached := CachedUser{user, matched, timeNow().UTC().Truncate(time.Second)}
 	m.lock.Lock()
-	m.cache[email] = CachedUser{user, matched}
+	m.cache[email] = cached
 	m.lock.Unlock()
+	return cached
 }
 
 // Read from cache safely
-func (m safeUserCache) ReadUserFromCache(email string) (CachedUser, bool) {
+func (m *safeUserCache) ReadUserFromCache(email string) (CachedUser, bool) {
 	m.lock.RLock()
 	defer m.lock.RUnlock()
 	val, exists := m.cache[email]
 	return val, exists
 }
 
+// Add the match of the commit to cache safely with the current time
+func (m *safeUserCache) AddCommitToCache(key CommitKey, user string, matched bool) CachedUser {
+	cached := CachedUser{user, matched, timeNow().UTC().Truncate(time.Second)}
+	m.lock.Lock()
+	if m.commits == nil {
+		m.commits = map[CommitKey]CachedUser{}
+	}
+	m.commits[key] = cached
+	m.lock.Unlock()
+	return cached
+}
+
+// Read the match of the commit from cache safely
+func (m *safeUserCache) ReadCommitFromCache(key CommitKey) (CachedUser, bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	val, exists := m.commits[key]
+	return val, exists
+}
+
+// Add profile to cache safely
+func (m *safeUserCache) AddProfileToCache(user string, profile Profile) {
+	m.lock.Lock()
+	if m.profiles == nil {
+		m.profiles = map[string]Profile{}
+	}
+	m.profiles[user] = profile
+	m.lock.Unlock()
+}
+
+// Read profile from cache safely
+func (m *safeUserCache) ReadProfileFromCache(user string) (Profile, bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	val, exists := m.profiles[user]
+	return val, exists
+}
+
+// profilesPath returns the path to the cached profiles next to the cached users, e.g.
+// "cache-external-github-profiles.csv" for "cache-external-github.csv".
+func profilesPath(cachePath string) string {
+	return sidecarPath(cachePath, "profiles")
+}
+
+// commitsPath returns the path to the cached matches by commit next to the cached users, e.g.
+// "cache-external-github-commits.csv" for "cache-external-github.csv".
+func commitsPath(cachePath string) string {
+	return sidecarPath(cachePath, "commits")
+}
+
+func sidecarPath(cachePath, name string) string {
+	if strings.HasSuffix(cachePath, ".csv") {
+		return cachePath[:len(cachePath)-len(".csv")] + "-" + name + ".csv"
+	}
+	return cachePath + "." + name
+}
+
 // LoadFromDisk reads the cache contents from FS.
 func (m *safeUserCache) LoadFromDisk() error {
-	var file *os.File
+	if m.store != nil {
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		return m.store.Load(func(email string, user CachedUser) {
+			m.cache[email] = user
+		}, func(user string, profile Profile) {
+			if m.profiles == nil {
+				m.profiles = map[string]Profile{}
+			}
+			m.profiles[user] = profile
+		}, func(key CommitKey, user CachedUser) {
+			if m.commits == nil {
+				m.commits = map[CommitKey]CachedUser{}
+			}
+			m.commits[key] = user
+		})
+	}
+	if _, err := m.loadCSV(); err != nil {
+		return err
+	}
+	if err := m.loadProfiles(); err != nil {
+		return err
+	}
+	return m.loadCommits()
+}
+
+// loadCSV reads the cached users from the CSV file and returns the format version.
+// It is a part of LoadFromDisk().
+func (m *safeUserCache) loadCSV() (version int, err error) {
 	file, err := os.Open(m.cachePath)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	defer func() {
 		errClose := file.Close()
@@ -162,52 +447,177 @@ func (m *safeUserCache) LoadFromDisk() error {
 			err = errClose
 		}
 	}()
+	reader := bufio.NewReader(file)
+	version = 1
+	if first, err := reader.Peek(1); err == nil && first[0] == '#' {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		if _, err = fmt.Sscanf(strings.TrimSpace(line), csvCacheVersionMarker, &version); err != nil {
+			return 0, fmt.Errorf("invalid CSV cache version: %s", strings.TrimSpace(line))
+		}
+		if version > csvCacheVersion {
+			return 0, fmt.Errorf("unsupported CSV cache version %d, upgrade the program", version)
+		}
+	}
+	columns := csvCacheColumns
+	if version == 1 {
+		columns = csvCacheColumns[:3]
+	}
 
-	r := csv.NewReader(file)
+	r := csv.NewReader(reader)
 	header := make(map[string]int)
-	rowIndex := 0
 	m.lock.Lock()
 	defer m.lock.Unlock()
 	for {
 		record, err := r.Read()
-		rowIndex++
-
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return err
+			return 0, err
 		}
 		if len(header) == 0 {
-			if len(record) != 3 {
-				return fmt.Errorf("invalid CSV file: should have 3 columns")
+			if len(record) != len(columns) {
+				return 0, fmt.Errorf("invalid CSV file: should have %d columns", len(columns))
 			}
 			for index, name := range record {
 				header[name] = index
 			}
-		} else {
-			if len(record) != len(header) {
-				return fmt.Errorf("invalid CSV record: %s", strings.Join(record, ","))
+			continue
+		}
+		if len(record) != len(header) {
+			return 0, fmt.Errorf("invalid CSV record: %s", strings.Join(record, ","))
+		}
+		user := CachedUser{User: record[header["user"]], Matched: record[header["match"]] == csvTrue}
+		if version > 1 && record[header["time"]] != "" {
+			if user.Time, err = time.Parse(time.RFC3339, record[header["time"]]); err != nil {
+				return 0, fmt.Errorf("invalid CSV record: %v", err)
 			}
-			m.cache[record[header["email"]]] = CachedUser{
-				record[header["user"]], record[header["match"]] == csvTrue}
 		}
+		m.cache[record[header["email"]]] = user
 	}
-	if err == io.EOF {
-		err = nil
+	return version, nil
+}
+
+// loadProfiles reads the cached profiles from FS if they exist. It is a part of LoadFromDisk().
+func (m *safeUserCache) loadProfiles() error {
+	path := profilesPath(m.cachePath)
+	if !PathExists(path) {
+		return nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	header := map[string]int{}
+	for index, name := range records[0] {
+		header[name] = index
+	}
+	for _, name := range profileColumns {
+		if _, exists := header[name]; !exists {
+			return fmt.Errorf("invalid CSV file %s: no %s column", path, name)
+		}
+	}
+	for _, record := range records[1:] {
+		profile := Profile{
+			DisplayName: record[header["name"]],
+			AvatarURL:   record[header["avatar"]],
+			ProfileURL:  record[header["profile_url"]],
+		}
+		if created := record[header["created"]]; created != "" {
+			if profile.CreatedAt, err = time.Parse(time.RFC3339, created); err != nil {
+				return fmt.Errorf("invalid CSV record in %s: %v", path, err)
+			}
+		}
+		if m.profiles == nil {
+			m.profiles = map[string]Profile{}
+		}
+		m.profiles[record[header["user"]]] = profile
 	}
 	return nil
 }
 
-// DumpOnDisk saves cache on disk
-func (m safeUserCache) DumpOnDisk() error {
+// profileColumns is the header of the cached profiles.
+var profileColumns = []string{"user", "name", "avatar", "profile_url", "created"}
+
+// dumpProfiles overwrites the cached profiles on FS. It is a part of DumpOnDisk().
+func (m *safeUserCache) dumpProfiles() (err error) {
+	if len(m.profiles) == 0 {
+		return nil
+	}
+	file, err := os.Create(profilesPath(m.cachePath))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		errClose := file.Close()
+		if err == nil {
+			err = errClose
+		}
+	}()
+	writer := csv.NewWriter(file)
+	if err = writer.Write(profileColumns); err != nil {
+		return err
+	}
+	users := make([]string, 0, len(m.profiles))
+	for user := range m.profiles {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	for _, user := range users {
+		profile := m.profiles[user]
+		created := ""
+		if !profile.CreatedAt.IsZero() {
+			created = profile.CreatedAt.UTC().Format(time.RFC3339)
+		}
+		if err = writer.Write([]string{user, profile.DisplayName, profile.AvatarURL,
+			profile.ProfileURL, created}); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// DumpOnDisk saves cache on disk. The store already has every entry, so there is nothing to do
+// if it is set.
+func (m *safeUserCache) DumpOnDisk() error {
+	if m.store != nil {
+		return nil
+	}
 	logrus.Infof("writing the external identities cache to %s", m.cachePath)
 	var file *os.File
 	existing := safeUserCache{cache: make(map[string]CachedUser), cachePath: m.cachePath, lock: sync.RWMutex{}}
 	flag := os.O_CREATE | os.O_WRONLY
-	if existing.LoadFromDisk() == nil && len(existing.cache) > 0 {
-		flag |= os.O_APPEND
-		logrus.Infof("appending to existing %d records", len(existing.cache))
+	entries := m.cache
+	version, loadErr := existing.loadCSV()
+	if loadErr == nil && len(existing.cache) > 0 {
+		if version == csvCacheVersion {
+			flag |= os.O_APPEND
+			logrus.Infof("appending to existing %d records", len(existing.cache))
+		} else {
+			// rewrite the old format together with the existing records
+			logrus.Infof("upgrading existing %d records to version %d",
+				len(existing.cache), csvCacheVersion)
+			entries = existing.cache
+			for email, username := range m.cache {
+				entries[email] = username
+			}
+			existing.cache = map[string]CachedUser{}
+		}
+	}
+	if flag&os.O_APPEND == 0 {
+		flag |= os.O_TRUNC
 	}
 	file, err := os.OpenFile(m.cachePath, flag, 0666)
 	if err != nil {
@@ -228,19 +638,22 @@ func (m safeUserCache) DumpOnDisk() error {
 		}
 	}()
 	if len(existing.cache) == 0 {
-		err = writer.Write([]string{"email", "user", "match"})
+		if _, err = fmt.Fprintf(file, csvCacheVersionMarker+"\n", csvCacheVersion); err != nil {
+			return err
+		}
+		err = writer.Write(csvCacheColumns)
 		if err != nil {
 			return err
 		}
 	}
-	seq := make([]string, 0, len(m.cache))
-	for email := range m.cache {
+	seq := make([]string, 0, len(entries))
+	for email := range entries {
 		seq = append(seq, email)
 	}
 	sort.Strings(seq)
 	written := 0
 	for _, email := range seq {
-		username := m.cache[email]
+		username := entries[email]
 		if eusername, exists := existing.cache[email]; exists && eusername == username {
 			continue
 		}
@@ -248,12 +661,123 @@ func (m safeUserCache) DumpOnDisk() error {
 		if username.Matched {
 			match = csvTrue
 		}
-		err = writer.Write([]string{email, username.User, match})
+		lookupTime := ""
+		if !username.Time.IsZero() {
+			lookupTime = username.Time.UTC().Format(time.RFC3339)
+		}
+		err = writer.Write([]string{email, username.User, match, lookupTime})
 		if err != nil {
 			return err
 		}
 		written++
 	}
 	logrus.Infof("written %d new records", written)
+	if err = m.dumpProfiles(); err != nil {
+		return err
+	}
+	return m.dumpCommits()
+}
+
+// commitColumns is the header of the cached matches by commit.
+var commitColumns = []string{"repo", "commit", "email", "user", "match", "time"}
+
+// loadCommits reads the cached matches by commit from FS if they exist. It is a part of
+// LoadFromDisk().
+func (m *safeUserCache) loadCommits() error {
+	path := commitsPath(m.cachePath)
+	if !PathExists(path) {
+		return nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	header := map[string]int{}
+	for index, name := range records[0] {
+		header[name] = index
+	}
+	for _, name := range commitColumns {
+		if _, exists := header[name]; !exists {
+			return fmt.Errorf("invalid CSV file %s: no %s column", path, name)
+		}
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, record := range records[1:] {
+		key := CommitKey{
+			Repo:   record[header["repo"]],
+			Commit: record[header["commit"]],
+			Email:  record[header["email"]],
+		}
+		user := CachedUser{User: record[header["user"]], Matched: record[header["match"]] == csvTrue}
+		if lookupTime := record[header["time"]]; lookupTime != "" {
+			if user.Time, err = time.Parse(time.RFC3339, lookupTime); err != nil {
+				return fmt.Errorf("invalid CSV record in %s: %v", path, err)
+			}
+		}
+		if m.commits == nil {
+			m.commits = map[CommitKey]CachedUser{}
+		}
+		m.commits[key] = user
+	}
 	return nil
 }
+
+// dumpCommits overwrites the cached matches by commit on FS. It is a part of DumpOnDisk().
+func (m *safeUserCache) dumpCommits() (err error) {
+	if len(m.commits) == 0 {
+		return nil
+	}
+	file, err := os.Create(commitsPath(m.cachePath))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		errClose := file.Close()
+		if err == nil {
+			err = errClose
+		}
+	}()
+	writer := csv.NewWriter(file)
+	if err = writer.Write(commitColumns); err != nil {
+		return err
+	}
+	keys := make([]CommitKey, 0, len(m.commits))
+	for key := range m.commits {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Repo != keys[j].Repo {
+			return keys[i].Repo < keys[j].Repo
+		}
+		if keys[i].Commit != keys[j].Commit {
+			return keys[i].Commit < keys[j].Commit
+		}
+		return keys[i].Email < keys[j].Email
+	})
+	for _, key := range keys {
+		user := m.commits[key]
+		match := csvFalse
+		if user.Matched {
+			match = csvTrue
+		}
+		lookupTime := ""
+		if !user.Time.IsZero() {
+			lookupTime = user.Time.UTC().Format(time.RFC3339)
+		}
+		if err = writer.Write([]string{key.Repo, key.Commit, key.Email, user.User, match,
+			lookupTime}); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,108 @@
+package external
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testRepoMatcher matches the commits by the predefined mapping from repositories to emails
+// to users and counts the queries.
+type testRepoMatcher struct {
+	testMapMatcher
+	repos   map[string]map[string]string
+	queries *int
+}
+
+func (m testRepoMatcher) MatchByEmail(ctx context.Context, email string) (string, error) {
+	*m.queries++
+	return m.testMapMatcher.MatchByEmail(ctx, email)
+}
+
+func (m testRepoMatcher) SupportsMatchingByCommit() bool {
+	return true
+}
+
+func (m testRepoMatcher) MatchByCommit(
+	ctx context.Context, email, repo, commit string) (string, error) {
+	*m.queries++
+	if user, exists := m.repos[repo][email]; exists {
+		return user, nil
+	}
+	return "", ErrNoMatches
+}
+
+func TestCachedMatcherCommits(t *testing.T) {
+	for _, ext := range []string{".csv", ".db"} {
+		t.Run(ext, func(t *testing.T) {
+			req := require.New(t)
+			defer freezeTime(time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC))()
+			ctx := context.Background()
+			cachePath := filepath.Join(t.TempDir(), "cache"+ext)
+			queries := 0
+			inner := testRepoMatcher{
+				repos: map[string]map[string]string{
+					"org1/repo": {"vadim@sourced.tech": "vmarkovtsev", "bob@sourced.tech": "bob"},
+				},
+				queries: &queries,
+			}
+			matcher, err := NewCachedMatcher(inner, cachePath)
+			req.NoError(err)
+
+			// the absent match by email does not poison the matches by commit
+			_, err = matcher.MatchByEmail(ctx, "bob@sourced.tech")
+			req.Equal(ErrNoMatches, err)
+			user, err := matcher.MatchByCommit(ctx, "bob@sourced.tech", "org1/repo", "1")
+			req.NoError(err)
+			req.Equal("bob", user)
+			req.Equal(2, queries)
+
+			// the same email resolves differently in different repositories
+			matches, err := matcher.MatchByCommits(ctx, []CommitQuery{
+				{Email: "vadim@sourced.tech", Repo: "org1/repo", Commit: "1"},
+				{Email: "vadim@sourced.tech", Repo: "org2/repo", Commit: "2"},
+				{Email: "bob@sourced.tech", Repo: "org1/repo", Commit: "1"},
+			})
+			req.NoError(err)
+			req.Equal([]CommitMatch{{User: "vmarkovtsev"}, {Err: ErrNoMatches}, {User: "bob"}},
+				matches)
+			req.Equal(4, queries)
+
+			// the match by email is derived from the found match by commit
+			user, err = matcher.MatchByEmail(ctx, "vadim@sourced.tech")
+			req.NoError(err)
+			req.Equal("vmarkovtsev", user)
+			req.Equal(4, queries)
+			req.NoError(matcher.Close())
+
+			matcher, err = NewCachedMatcher(testRepoMatcher{queries: &queries}, cachePath)
+			req.NoError(err)
+			defer matcher.Close()
+			req.Equal(map[CommitKey]CachedUser{
+				{Repo: "org1/repo", Commit: "1", Email: "vadim@sourced.tech"}: {
+					User: "vmarkovtsev", Matched: true, Time: timeNow()},
+				{Repo: "org2/repo", Commit: "2", Email: "vadim@sourced.tech"}: {Time: timeNow()},
+				{Repo: "org1/repo", Commit: "1", Email: "bob@sourced.tech"}: {
+					User: "bob", Matched: true, Time: timeNow()},
+			}, matcher.cache.commits)
+			user, err = matcher.MatchByCommit(ctx, "vadim@sourced.tech", "org1/repo", "1")
+			req.NoError(err)
+			req.Equal("vmarkovtsev", user)
+			_, err = matcher.MatchByCommit(ctx, "vadim@sourced.tech", "org2/repo", "2")
+			req.Equal(ErrNoMatches, err)
+			user, err = matcher.MatchByEmail(ctx, "bob@sourced.tech")
+			req.NoError(err)
+			req.Equal("bob", user)
+			req.Equal(4, queries)
+		})
+	}
+}
+
+func TestCommitsPath(t *testing.T) {
+	require.Equal(t, "cache-external-github-commits.csv",
+		commitsPath("cache-external-github.csv"))
+	require.Equal(t, "cache.commits", commitsPath("cache"))
+}
@@ -0,0 +1,84 @@
+package external
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testProfileMatcher is testMapMatcher which knows the profiles and counts the queries.
+type testProfileMatcher struct {
+	testMapMatcher
+	profiles map[string]Profile
+	queries  *int
+}
+
+func (m testProfileMatcher) Profile(ctx context.Context, user string) (Profile, error) {
+	*m.queries++
+	if profile, exists := m.profiles[user]; exists {
+		return profile, nil
+	}
+	return Profile{}, ErrNoMatches
+}
+
+func TestCachedMatcherProfile(t *testing.T) {
+	req := require.New(t)
+	defer freezeTime(time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC))()
+	ctx := context.Background()
+	cachePath := filepath.Join(t.TempDir(), "cache.csv")
+	queries := 0
+	created := time.Date(2012, 11, 14, 12, 32, 56, 0, time.UTC)
+	vadim := Profile{DisplayName: "Vadim Markovtsev, Jr.", AvatarURL: "https://avatars/1",
+		ProfileURL: "https://github.com/vmarkovtsev", CreatedAt: created}
+	inner := testProfileMatcher{
+		testMapMatcher: testMapMatcher{users: map[string]string{"vadim@sourced.tech": "vmarkovtsev"}},
+		profiles:       map[string]Profile{"vmarkovtsev": vadim, "bob": {DisplayName: "Bob"}},
+		queries:        &queries,
+	}
+	matcher, err := NewCachedMatcher(inner, cachePath)
+	req.NoError(err)
+	user, err := matcher.MatchByEmail(ctx, "vadim@sourced.tech")
+	req.NoError(err)
+	profile, err := matcher.Profile(ctx, user)
+	req.NoError(err)
+	req.Equal(vadim, profile)
+	_, err = matcher.Profile(ctx, "alice")
+	req.Equal(ErrNoMatches, err)
+	profile, err = matcher.Profile(ctx, user)
+	req.NoError(err)
+	req.Equal(vadim, profile)
+	req.Equal(2, queries)
+	req.NoError(matcher.OnIdle())
+
+	data, err := ioutil.ReadFile(filepath.Join(filepath.Dir(cachePath), "cache-profiles.csv"))
+	req.NoError(err)
+	req.Equal("user,name,avatar,profile_url,created\n"+
+		"vmarkovtsev,\"Vadim Markovtsev, Jr.\",https://avatars/1,https://github.com/vmarkovtsev,"+
+		"2012-11-14T12:32:56Z\n", string(data))
+	// the profiles are not mixed with the users
+	data, err = ioutil.ReadFile(cachePath)
+	req.NoError(err)
+	req.Equal(testCacheHeader+"vadim@sourced.tech,vmarkovtsev,1,2019-10-01T12:00:00Z\n",
+		string(data))
+
+	matcher, err = NewCachedMatcher(inner, cachePath)
+	req.NoError(err)
+	profile, err = matcher.Profile(ctx, "vmarkovtsev")
+	req.NoError(err)
+	req.Equal(vadim, profile)
+	req.Equal(2, queries)
+	profile, err = matcher.Profile(ctx, "bob")
+	req.NoError(err)
+	req.Equal(Profile{DisplayName: "Bob"}, profile)
+	req.Equal(3, queries)
+}
+
+func TestProfilesPath(t *testing.T) {
+	require.Equal(t, "cache-external-github-profiles.csv",
+		profilesPath("cache-external-github.csv"))
+	require.Equal(t, "cache.profiles", profilesPath("cache"))
+}
@@ -11,6 +11,7 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -33,9 +34,8 @@ func TestNewCachedMatcher(t *testing.T) {
 	_, err := cache.Write([]byte("email,user,match"))
 	req.NoError(err)
 	cachedMatcher, err := NewCachedMatcher(matcher, cache.Name())
-	scache := safeUserCache{
-		cache: make(map[string]CachedUser), cachePath: cache.Name(), lock: sync.RWMutex{}}
-	expectedCachedMatcher := &CachedMatcher{matcher: matcher, cache: scache}
+	expectedCachedMatcher := &CachedMatcher{matcher: matcher, cache: safeUserCache{
+		cache: make(map[string]CachedUser), cachePath: cache.Name()}}
 	req.NoError(err)
 	req.Equal(expectedCachedMatcher, cachedMatcher)
 }
@@ -60,8 +60,8 @@ func TestMatchByEmailAndDump(t *testing.T) {
 	req.NoError(err)
 	cacheContent, err := ioutil.ReadFile(cache.Name())
 	req.NoError(err)
-	expectedCacheContent := "email,user,match\nmcuadros@gmail.com,mcuadros,1\n"
-	req.Equal(expectedCacheContent, string(cacheContent))
+	req.True(strings.HasPrefix(string(cacheContent),
+		testCacheHeader+"mcuadros@gmail.com,mcuadros,1,"))
 }
 
 // TestNoMatchMatcher does not match any emails.
@@ -96,6 +96,7 @@ func (m TestNoMatchMatcher) OnIdle() error {
 
 func TestMatchCacheOnly(t *testing.T) {
 	req := require.New(t)
+	defer freezeTime(time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC))()
 	matcher := TestNoMatchMatcher{}
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -129,12 +130,14 @@ func TestMatchCacheOnly(t *testing.T) {
 	req.NoError(err)
 	cacheContent, err := ioutil.ReadFile(cache.Name())
 	req.NoError(err)
+	// the old format is upgraded
 	expectedCacheContent := map[string]struct{}{
-		"email,user,match":              {},
-		"mcuadros@gmail.com,mcuadros,1": {},
-		"mcuadros-clone@gmail.com,,0":   {},
-		"new@gmail.com,new_user,1":      {},
-		"":                              {},
+		"# external identities cache version 2":         {},
+		"email,user,match,time":                         {},
+		"mcuadros@gmail.com,mcuadros,1,":                {},
+		"mcuadros-clone@gmail.com,,0,":                  {},
+		"new@gmail.com,new_user,1,2019-10-01T12:00:00Z": {},
+		"": {},
 	}
 	cacheContentMap := map[string]struct{}{}
 	for _, line := range strings.Split(string(cacheContent), "\n") {
@@ -146,14 +149,14 @@ func TestMatchCacheOnly(t *testing.T) {
 
 func TestMatchCacheAppend(t *testing.T) {
 	req := require.New(t)
+	defer freezeTime(time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC))()
 	cache, cleanup := tempFile(t, "*.csv")
 	defer cleanup()
 	matcher := safeUserCache{
 		cache: make(map[string]CachedUser), cachePath: cache.Name(), lock: sync.RWMutex{}}
-	_, err := cache.Write([]byte(
-		"email,user,match\n" +
-			"mcuadros@gmail.com,mcuadros,1\n" +
-			"mcuadros-clone@gmail.com,,0\n"))
+	_, err := cache.Write([]byte(testCacheHeader +
+		"mcuadros@gmail.com,mcuadros,1,2019-10-01T12:00:00Z\n" +
+		"mcuadros-clone@gmail.com,,0,2019-09-01T12:00:00Z\n"))
 	cache.Sync()
 	req.NoError(err)
 	matcher.AddUserToCache("mcuadros@gmail.com", "mcuadros", true)
@@ -162,11 +165,10 @@ func TestMatchCacheAppend(t *testing.T) {
 	req.NoError(matcher.DumpOnDisk())
 	cache.Seek(0, io.SeekStart)
 	txt, _ := ioutil.ReadAll(cache)
-	req.Equal(`email,user,match
-mcuadros@gmail.com,mcuadros,1
-mcuadros-clone@gmail.com,,0
-mcuadros-clone@gmail.com,mcuadros,1
-vadim@sourced.tech,vmarkovtsev,1
+	req.Equal(testCacheHeader+`mcuadros@gmail.com,mcuadros,1,2019-10-01T12:00:00Z
+mcuadros-clone@gmail.com,,0,2019-09-01T12:00:00Z
+mcuadros-clone@gmail.com,mcuadros,1,2019-10-01T12:00:00Z
+vadim@sourced.tech,vmarkovtsev,1,2019-10-01T12:00:00Z
 `, string(txt))
 }
 
@@ -182,6 +184,12 @@ func TestMatchCacheCommit(t *testing.T) {
 			"mcuadros@gmail.com,mcuadros,1\n" +
 			"mcuadros-clone@gmail.com,,0\n"))
 	req.NoError(err)
+	commits := commitsPath(cache.Name())
+	defer os.Remove(commits)
+	req.NoError(ioutil.WriteFile(commits, []byte(
+		"repo,commit,email,user,match,time\n"+
+			"repo,commit_hash,mcuadros@gmail.com,mcuadros,1,\n"+
+			"repo,commit_hash,mcuadros-clone@gmail.com,,0,\n"), 0666))
 	cachedMatcher, err := NewCachedMatcher(matcher, cache.Name())
 	req.NoError(err)
 	req.True(cachedMatcher.SupportsMatchingByCommit())
@@ -190,6 +198,11 @@ func TestMatchCacheCommit(t *testing.T) {
 	req.Equal("mcuadros", user)
 	req.NoError(err)
 
+	// the cached matches by email are not used
+	user, err = cachedMatcher.MatchByCommit(ctx, "mcuadros@gmail.com", "repo", "other_hash")
+	req.Equal("", user)
+	req.Equal(ErrTest, err)
+
 	user, err = cachedMatcher.MatchByCommit(ctx, "mcuadros-clone@gmail.com", "repo", "commit_hash")
 	req.Equal("", user)
 	req.Equal(ErrNoMatches, err)
@@ -205,53 +218,53 @@ func TestMatchCacheCommit(t *testing.T) {
 
 func TestMatchCacheScheduledDump(t *testing.T) {
 	req := require.New(t)
+	defer freezeTime(time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC))()
 	matcher := TestNoMatchMatcher{}
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	cache, cleanup := tempFile(t, "*.csv")
 	defer cleanup()
-	fixture := []byte(`email,user,match
-mcuadros-clone1@gmail.com,,0
-mcuadros-clone2@gmail.com,,0
-mcuadros-clone3@gmail.com,,0
-mcuadros-clone4@gmail.com,,0
-mcuadros-clone5@gmail.com,,0
-mcuadros-clone6@gmail.com,,0
-mcuadros-clone7@gmail.com,,0
-mcuadros-clone8@gmail.com,,0
-mcuadros-clone9@gmail.com,,0
-mcuadros-clone10@gmail.com,,0
-mcuadros-clone11@gmail.com,,0
-mcuadros-clone12@gmail.com,,0
-mcuadros-clone13@gmail.com,,0
-mcuadros-clone14@gmail.com,,0
-mcuadros-clone15@gmail.com,,0
-mcuadros-clone16@gmail.com,,0
-mcuadros-clone17@gmail.com,,0
-mcuadros-clone18@gmail.com,,0
-mcuadros-clone19@gmail.com,,0
+	defer os.Remove(commitsPath(cache.Name()))
+	fixture := []byte(testCacheHeader + `mcuadros-clone1@gmail.com,,0,2019-09-01T12:00:00Z
+mcuadros-clone2@gmail.com,,0,2019-09-01T12:00:00Z
+mcuadros-clone3@gmail.com,,0,2019-09-01T12:00:00Z
+mcuadros-clone4@gmail.com,,0,2019-09-01T12:00:00Z
+mcuadros-clone5@gmail.com,,0,2019-09-01T12:00:00Z
+mcuadros-clone6@gmail.com,,0,2019-09-01T12:00:00Z
+mcuadros-clone7@gmail.com,,0,2019-09-01T12:00:00Z
+mcuadros-clone8@gmail.com,,0,2019-09-01T12:00:00Z
+mcuadros-clone9@gmail.com,,0,2019-09-01T12:00:00Z
+mcuadros-clone10@gmail.com,,0,2019-09-01T12:00:00Z
+mcuadros-clone11@gmail.com,,0,2019-09-01T12:00:00Z
+mcuadros-clone12@gmail.com,,0,2019-09-01T12:00:00Z
+mcuadros-clone13@gmail.com,,0,2019-09-01T12:00:00Z
+mcuadros-clone14@gmail.com,,0,2019-09-01T12:00:00Z
+mcuadros-clone15@gmail.com,,0,2019-09-01T12:00:00Z
+mcuadros-clone16@gmail.com,,0,2019-09-01T12:00:00Z
+mcuadros-clone17@gmail.com,,0,2019-09-01T12:00:00Z
+mcuadros-clone18@gmail.com,,0,2019-09-01T12:00:00Z
+mcuadros-clone19@gmail.com,,0,2019-09-01T12:00:00Z
 `)
-	expected := `email,user,match
-mcuadros-clone1@gmail.com,,0
-mcuadros-clone2@gmail.com,,0
-mcuadros-clone3@gmail.com,,0
-mcuadros-clone4@gmail.com,,0
-mcuadros-clone5@gmail.com,,0
-mcuadros-clone6@gmail.com,,0
-mcuadros-clone7@gmail.com,,0
-mcuadros-clone8@gmail.com,,0
-mcuadros-clone9@gmail.com,,0
-mcuadros-clone10@gmail.com,,0
-mcuadros-clone11@gmail.com,,0
-mcuadros-clone12@gmail.com,,0
-mcuadros-clone13@gmail.com,,0
-mcuadros-clone14@gmail.com,,0
-mcuadros-clone15@gmail.com,,0
-mcuadros-clone16@gmail.com,,0
-mcuadros-clone17@gmail.com,,0
-mcuadros-clone18@gmail.com,,0
-mcuadros-clone19@gmail.com,,0
-new@gmail.com,new_user,1
+	expected := testCacheHeader + `mcuadros-clone1@gmail.com,,0,2019-09-01T12:00:00Z
+mcuadros-clone2@gmail.com,,0,2019-09-01T12:00:00Z
+mcuadros-clone3@gmail.com,,0,2019-09-01T12:00:00Z
+mcuadros-clone4@gmail.com,,0,2019-09-01T12:00:00Z
+mcuadros-clone5@gmail.com,,0,2019-09-01T12:00:00Z
+mcuadros-clone6@gmail.com,,0,2019-09-01T12:00:00Z
+mcuadros-clone7@gmail.com,,0,2019-09-01T12:00:00Z
+mcuadros-clone8@gmail.com,,0,2019-09-01T12:00:00Z
+mcuadros-clone9@gmail.com,,0,2019-09-01T12:00:00Z
+mcuadros-clone10@gmail.com,,0,2019-09-01T12:00:00Z
+mcuadros-clone11@gmail.com,,0,2019-09-01T12:00:00Z
+mcuadros-clone12@gmail.com,,0,2019-09-01T12:00:00Z
+mcuadros-clone13@gmail.com,,0,2019-09-01T12:00:00Z
+mcuadros-clone14@gmail.com,,0,2019-09-01T12:00:00Z
+mcuadros-clone15@gmail.com,,0,2019-09-01T12:00:00Z
+mcuadros-clone16@gmail.com,,0,2019-09-01T12:00:00Z
+mcuadros-clone17@gmail.com,,0,2019-09-01T12:00:00Z
+mcuadros-clone18@gmail.com,,0,2019-09-01T12:00:00Z
+mcuadros-clone19@gmail.com,,0,2019-09-01T12:00:00Z
+new@gmail.com,new_user,1,2019-10-01T12:00:00Z
 `
 	_, err := cache.Write(fixture)
 	req.NoError(err)
@@ -0,0 +1,117 @@
+package external
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// freezeTime makes the cache timestamps deterministic until the returned function is called.
+func freezeTime(now time.Time) func() {
+	timeNow = func() time.Time { return now }
+	return func() { timeNow = time.Now }
+}
+
+const testCacheHeader = "# external identities cache version 2\nemail,user,match,time\n"
+
+// testCountingMatcher is testMapMatcher which counts the queries.
+type testCountingMatcher struct {
+	testMapMatcher
+	queries *[]string
+}
+
+func (m testCountingMatcher) MatchByEmail(ctx context.Context, email string) (string, error) {
+	*m.queries = append(*m.queries, email)
+	return m.testMapMatcher.MatchByEmail(ctx, email)
+}
+
+func TestCachedUserExpired(t *testing.T) {
+	now := time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	matched := CachedUser{User: "vmarkovtsev", Matched: true, Time: now.Add(-2 * day)}
+	missing := CachedUser{Time: now.Add(-2 * day)}
+	require.False(t, matched.expired(0, day, now))
+	require.True(t, matched.expired(day, 0, now))
+	require.False(t, matched.expired(3*day, 0, now))
+	require.False(t, missing.expired(day, 0, now))
+	require.True(t, missing.expired(0, day, now))
+	// the legacy entries have unknown age
+	require.True(t, CachedUser{Matched: true}.expired(3*day, 0, now))
+	require.False(t, CachedUser{Matched: true}.expired(0, 0, now))
+}
+
+func TestCachedMatcherRefresh(t *testing.T) {
+	for _, ext := range []string{".csv", ".db"} {
+		t.Run(ext, func(t *testing.T) {
+			req := require.New(t)
+			defer freezeTime(time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC))()
+			dir := t.TempDir()
+			csvPath := filepath.Join(dir, "cache.csv")
+			// the BoltDB cache imports the CSV cache
+			req.NoError(ioutil.WriteFile(csvPath, []byte(testCacheHeader+
+				"fresh@sourced.tech,fresh,1,2019-09-30T12:00:00Z\n"+
+				"old@sourced.tech,old,1,2019-01-01T12:00:00Z\n"+
+				"fresh-missing@sourced.tech,,0,2019-09-30T23:00:00Z\n"+
+				"old-missing@sourced.tech,,0,2019-09-01T12:00:00Z\n"+
+				"legacy@sourced.tech,legacy,1,\n"), 0666))
+			var queries []string
+			inner := testCountingMatcher{testMapMatcher{users: map[string]string{
+				"old@sourced.tech": "new", "old-missing@sourced.tech": "found",
+				"legacy@sourced.tech": "legacy"}}, &queries}
+			emails := []string{"fresh@sourced.tech", "old@sourced.tech",
+				"fresh-missing@sourced.tech", "old-missing@sourced.tech", "legacy@sourced.tech"}
+			matchAll := func(matcher *CachedMatcher) []string {
+				var users []string
+				for _, email := range emails {
+					user, err := matcher.MatchByEmail(context.Background(), email)
+					if err != ErrNoMatches {
+						req.NoError(err)
+					}
+					users = append(users, user)
+				}
+				return users
+			}
+
+			matcher, err := NewCachedMatcher(inner, filepath.Join(dir, "cache"+ext))
+			req.NoError(err)
+			req.Equal([]string{"fresh", "old", "", "", "legacy"}, matchAll(matcher))
+			req.Empty(queries)
+
+			matcher.Refresh(30*24*time.Hour, 7*24*time.Hour)
+			req.Equal([]string{"fresh", "new", "", "found", "legacy"}, matchAll(matcher))
+			req.Equal([]string{"old@sourced.tech", "old-missing@sourced.tech",
+				"legacy@sourced.tech"}, queries)
+			req.NoError(matcher.Close())
+
+			// the refreshed entries are fresh
+			queries = nil
+			matcher, err = NewCachedMatcher(inner, filepath.Join(dir, "cache"+ext))
+			req.NoError(err)
+			matcher.Refresh(30*24*time.Hour, 7*24*time.Hour)
+			req.Equal([]string{"fresh", "new", "", "found", "legacy"}, matchAll(matcher))
+			req.Empty(queries)
+			req.Equal(time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC),
+				matcher.cache.cache["legacy@sourced.tech"].Time)
+			req.NoError(matcher.Close())
+		})
+	}
+}
+
+func TestCachedMatcherCSVVersion(t *testing.T) {
+	req := require.New(t)
+	path := filepath.Join(t.TempDir(), "cache.csv")
+	req.NoError(ioutil.WriteFile(path, []byte(
+		"# external identities cache version 3\nemail,user,match,time,more\n"), 0666))
+	_, err := NewCachedMatcher(testMapMatcher{}, path)
+	req.EqualError(err, "unsupported CSV cache version 3, upgrade the program")
+	req.NoError(ioutil.WriteFile(path, []byte("# hello\nemail,user,match\n"), 0666))
+	_, err = NewCachedMatcher(testMapMatcher{}, path)
+	req.EqualError(err, "invalid CSV cache version: # hello")
+	req.NoError(ioutil.WriteFile(path, []byte(testCacheHeader[:38]+"email,user,match\n"), 0666))
+	_, err = NewCachedMatcher(testMapMatcher{}, path)
+	req.EqualError(err, "invalid CSV file: should have 4 columns")
+}
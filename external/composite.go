@@ -0,0 +1,267 @@
+package external
+
+import (
+	"context"
+	"io"
+	"strings"
+)
+
+// DefaultHosts maps the registered matcher shorthands to the hosts of the public websites.
+var DefaultHosts = map[string][]string{
+	"github":    {"github.com"},
+	"gitlab":    {"gitlab.com"},
+	"bitbucket": {"bitbucket.org"},
+	"gitea":     {"gitea.com"},
+}
+
+// MatcherRoute binds a Matcher of the given provider to the repository hosts it serves.
+type MatcherRoute struct {
+	// Provider is the matcher shorthand, e.g. "github".
+	Provider string
+	// Hosts are the repository hosts, e.g. "github.com".
+	Hosts   []string
+	Matcher Matcher
+}
+
+// CompositeMatcher routes the queries to several matchers by the repository host.
+// It implements ProviderMatcher and ProviderProfiler to tell which provider found the user.
+type CompositeMatcher struct {
+	routes []MatcherRoute
+	hosts  map[string]int
+}
+
+// NewCompositeMatcher creates a new matcher which routes the queries to the given matchers.
+// The order of the routes defines the order in which the matchers are tried when
+// the repository host is unknown.
+func NewCompositeMatcher(routes ...MatcherRoute) *CompositeMatcher {
+	hosts := map[string]int{}
+	for i, route := range routes {
+		for _, host := range route.Hosts {
+			host = strings.ToLower(host)
+			if _, exists := hosts[host]; !exists {
+				hosts[host] = i
+			}
+		}
+	}
+	return &CompositeMatcher{routes: routes, hosts: hosts}
+}
+
+// RepoHost extracts the lowercase host from the repository URL, e.g. "github.com" from
+// "git://github.com/src-d/hercules.git" or "git@github.com:src-d/hercules.git".
+func RepoHost(repo string) string {
+	if pos := strings.Index(repo, "://"); pos >= 0 {
+		repo = repo[pos+3:]
+	}
+	if pos := strings.Index(repo, "/"); pos >= 0 {
+		repo = repo[:pos]
+	}
+	if pos := strings.LastIndex(repo, "@"); pos >= 0 {
+		repo = repo[pos+1:]
+	}
+	if pos := strings.Index(repo, ":"); pos >= 0 {
+		repo = repo[:pos]
+	}
+	return strings.ToLower(repo)
+}
+
+// repoPath extracts the path of the repository without the ".git" suffix from its URL,
+// e.g. "src-d/hercules" from "git://github.com/src-d/hercules.git" or
+// "git@github.com:src-d/hercules.git".
+func repoPath(repo string) string {
+	if pos := strings.Index(repo, "://"); pos >= 0 {
+		repo = repo[pos+3:]
+		if pos = strings.Index(repo, "/"); pos >= 0 {
+			repo = repo[pos+1:]
+		} else {
+			repo = ""
+		}
+	} else {
+		slash := strings.Index(repo, "/")
+		if colon := strings.Index(repo, ":"); colon >= 0 && (slash < 0 || colon < slash) {
+			repo = repo[colon+1:]
+		} else if slash >= 0 {
+			repo = repo[slash+1:]
+		} else {
+			repo = ""
+		}
+	}
+	repo = strings.Trim(repo, "/")
+	return strings.TrimSuffix(repo, ".git")
+}
+
+// MatchByEmail tries all the matchers in order and returns the first found user.
+func (m *CompositeMatcher) MatchByEmail(ctx context.Context, email string) (string, error) {
+	_, user, err := m.MatchByEmailWithProvider(ctx, email)
+	return user, err
+}
+
+// MatchByEmailWithProvider tries all the matchers in order and returns the first found user
+// together with the provider of the matcher which found it.
+func (m *CompositeMatcher) MatchByEmailWithProvider(ctx context.Context, email string) (
+	provider string, user string, err error) {
+	var lastErr error
+	for _, route := range m.routes {
+		user, err := route.Matcher.MatchByEmail(ctx, email)
+		if err == nil {
+			return route.Provider, user, nil
+		}
+		if ctx.Err() != nil {
+			return "", "", ctx.Err()
+		}
+		if err != ErrNoMatches {
+			lastErr = err
+		}
+	}
+	if lastErr != nil {
+		return "", "", lastErr
+	}
+	return "", "", ErrNoMatches
+}
+
+// SupportsMatchingByCommit is always true because the repository is required for routing.
+func (m *CompositeMatcher) SupportsMatchingByCommit() bool {
+	return true
+}
+
+// MatchByCommit queries the matcher which serves the repository host. The matcher
+// queries by commit if it supports it and by email otherwise. All the matchers are tried
+// in order if no matcher serves the host.
+func (m *CompositeMatcher) MatchByCommit(
+	ctx context.Context, email, repo, commit string) (string, error) {
+	_, user, err := m.MatchByCommitWithProvider(ctx, email, repo, commit)
+	return user, err
+}
+
+// MatchByCommitWithProvider is MatchByCommit which also returns the provider of the matcher
+// which found the user.
+func (m *CompositeMatcher) MatchByCommitWithProvider(
+	ctx context.Context, email, repo, commit string) (provider string, user string, err error) {
+	index, exists := m.hosts[RepoHost(repo)]
+	if !exists {
+		return m.MatchByEmailWithProvider(ctx, email)
+	}
+	route := m.routes[index]
+	if route.Matcher.SupportsMatchingByCommit() {
+		user, err = route.Matcher.MatchByCommit(ctx, email, repo, commit)
+	} else {
+		user, err = route.Matcher.MatchByEmail(ctx, email)
+	}
+	if err != nil {
+		return "", "", err
+	}
+	return route.Provider, user, nil
+}
+
+// MatchByCommits groups the queries by the matcher which serves the repository host and
+// forwards each group at once. The queries with unknown hosts are matched by email.
+// CommitMatch.Provider is set for each found user.
+func (m *CompositeMatcher) MatchByCommits(ctx context.Context, queries []CommitQuery) (
+	[]CommitMatch, error) {
+	matches := make([]CommitMatch, len(queries))
+	routeQueries := map[int][]int{}
+	var routes []int
+	for i, query := range queries {
+		index, exists := m.hosts[RepoHost(query.Repo)]
+		if !exists {
+			matches[i].Provider, matches[i].User, matches[i].Err = m.MatchByEmailWithProvider(
+				ctx, query.Email)
+			if ctx.Err() != nil {
+				return nil, context.Canceled
+			}
+			continue
+		}
+		if _, exists := routeQueries[index]; !exists {
+			routes = append(routes, index)
+		}
+		routeQueries[index] = append(routeQueries[index], i)
+	}
+	for _, index := range routes {
+		route := m.routes[index]
+		indexes := routeQueries[index]
+		if !route.Matcher.SupportsMatchingByCommit() {
+			for _, i := range indexes {
+				matches[i].User, matches[i].Err = route.Matcher.MatchByEmail(ctx, queries[i].Email)
+				if ctx.Err() != nil {
+					return nil, context.Canceled
+				}
+			}
+		} else {
+			batch := make([]CommitQuery, len(indexes))
+			for j, i := range indexes {
+				batch[j] = queries[i]
+			}
+			batchMatches, err := matchByCommits(ctx, route.Matcher, batch)
+			if err != nil {
+				return nil, err
+			}
+			for j, i := range indexes {
+				matches[i] = batchMatches[j]
+			}
+		}
+		for _, i := range indexes {
+			if matches[i].Err == nil {
+				matches[i].Provider = route.Provider
+			} else {
+				matches[i].Provider, matches[i].User = "", ""
+			}
+		}
+	}
+	return matches, nil
+}
+
+// Profile tries all the matchers in order and returns the first found profile. Use
+// ProfileWithProvider if the provider of the user is known.
+func (m *CompositeMatcher) Profile(ctx context.Context, user string) (Profile, error) {
+	var lastErr error
+	for _, route := range m.routes {
+		p, err := profile(ctx, route.Matcher, user)
+		if err == nil {
+			return p, nil
+		}
+		if ctx.Err() != nil {
+			return Profile{}, ctx.Err()
+		}
+		if err != ErrNoMatches {
+			lastErr = err
+		}
+	}
+	if lastErr != nil {
+		return Profile{}, lastErr
+	}
+	return Profile{}, ErrNoMatches
+}
+
+// ProfileWithProvider forwards to the matcher of the provider.
+func (m *CompositeMatcher) ProfileWithProvider(ctx context.Context, provider, user string) (
+	Profile, error) {
+	for _, route := range m.routes {
+		if route.Provider == provider {
+			return profile(ctx, route.Matcher, user)
+		}
+	}
+	return Profile{}, ErrNoMatches
+}
+
+// OnIdle forwards to all the matchers and returns the first error.
+func (m *CompositeMatcher) OnIdle() error {
+	var result error
+	for _, route := range m.routes {
+		if err := route.Matcher.OnIdle(); err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+// Close closes all the matchers which implement io.Closer and returns the first error.
+func (m *CompositeMatcher) Close() error {
+	var result error
+	for _, route := range m.routes {
+		if closer, ok := route.Matcher.(io.Closer); ok {
+			if err := closer.Close(); err != nil && result == nil {
+				result = err
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,38 @@
+package external
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newFixtureServer serves the recorded API responses from testdata. routes maps the escaped
+// request URIs to the fixture file names. The other requests fail with 404.
+// Each served request is passed to inspect if it is not nil.
+func newFixtureServer(t *testing.T, routes map[string]string,
+	inspect func(r *http.Request)) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uri := r.URL.EscapedPath()
+		if r.URL.RawQuery != "" {
+			uri += "?" + r.URL.RawQuery
+		}
+		fixture, exists := routes[uri]
+		if !exists {
+			t.Logf("no fixture for %s", uri)
+			http.Error(w, `{"message": "404 Not Found"}`, http.StatusNotFound)
+			return
+		}
+		if inspect != nil {
+			inspect(r)
+		}
+		data, err := ioutil.ReadFile(filepath.Join("testdata", fixture))
+		require.NoError(t, err)
+		w.Header().Set("Content-Type", "application/json")
+		_, err = w.Write(data)
+		require.NoError(t, err)
+	}))
+}
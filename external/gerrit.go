@@ -0,0 +1,219 @@
+package external
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// GerritMatcher matches emails and Gerrit accounts. The users are the account usernames or
+// the numeric account IDs if the usernames are not set.
+type GerritMatcher struct {
+	apiURL   string
+	user     string
+	password string
+}
+
+type gerritAccount struct {
+	ID       int64  `json:"_account_id"`
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+	Username string `json:"username"`
+}
+
+func (a gerritAccount) user() string {
+	if a.Username != "" {
+		return a.Username
+	}
+	return strconv.FormatInt(a.ID, 10)
+}
+
+type gerritRevision struct {
+	Commit struct {
+		Author struct {
+			Name  string `json:"name"`
+			Email string `json:"email"`
+		} `json:"author"`
+	} `json:"commit"`
+	Uploader *gerritAccount `json:"uploader"`
+}
+
+type gerritChange struct {
+	Project   string                    `json:"project"`
+	Owner     gerritAccount             `json:"owner"`
+	Revisions map[string]gerritRevision `json:"revisions"`
+}
+
+// gerritMagicPrefix prevents XSSI and precedes every JSON response.
+// https://gerrit-review.googlesource.com/Documentation/rest-api.html#output
+var gerritMagicPrefix = []byte(")]}'")
+
+// NewGerritMatcher creates a new matcher given the Gerrit instance URL and the HTTP credentials
+// in the "user:password" format. The credentials may be empty for anonymous access.
+// https://gerrit-review.googlesource.com/Documentation/user-upload.html#http
+func NewGerritMatcher(apiURL, token string) (Matcher, error) {
+	if apiURL == "" {
+		return GerritMatcher{}, errors.New("the Gerrit instance URL must be specified")
+	}
+	if _, err := url.Parse(apiURL); err != nil {
+		return GerritMatcher{}, err
+	}
+	m := GerritMatcher{apiURL: strings.TrimSuffix(apiURL, "/")}
+	if token != "" {
+		parts := strings.SplitN(token, ":", 2)
+		if len(parts) != 2 {
+			return GerritMatcher{}, errors.New(
+				"the Gerrit token must be the HTTP credentials in the \"user:password\" format")
+		}
+		m.user, m.password = parts[0], parts[1]
+	}
+	return m, nil
+}
+
+// get requests the API and decodes the JSON response. It returns the HTTP status code.
+func (m GerritMatcher) get(ctx context.Context, path string, query url.Values,
+	result interface{}) (int, error) {
+	u := m.apiURL
+	if m.user != "" {
+		// authenticated requests go to /a/
+		u += "/a"
+	}
+	u += path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if m.user != "" {
+		req.SetBasicAuth(m.user, m.password)
+	}
+	response, err := doWithRetries(ctx, http.DefaultClient, req, isTransientCode)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return response.StatusCode, fmt.Errorf("HTTP %d: %s", response.StatusCode, u)
+	}
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return response.StatusCode, err
+	}
+	body = bytes.TrimPrefix(body, gerritMagicPrefix)
+	return response.StatusCode, json.Unmarshal(body, result)
+}
+
+// MatchByEmail returns the Gerrit account with the given email.
+func (m GerritMatcher) MatchByEmail(ctx context.Context, email string) (string, error) {
+	var accounts []gerritAccount
+	_, err := m.get(ctx, "/accounts/", url.Values{
+		"q": {"email:" + email}, "o": {"DETAILS"}}, &accounts)
+	if err != nil {
+		return "", err
+	}
+	if len(accounts) == 0 {
+		logrus.Warnf("unable to find users for email: %s", email)
+		return "", ErrNoMatches
+	}
+	return accounts[0].user(), nil
+}
+
+// SupportsMatchingByCommit indicates whether this Matcher allows querying identities by commit metadata.
+func (m GerritMatcher) SupportsMatchingByCommit() bool {
+	return true
+}
+
+// MatchByCommit finds the change with the given commit and returns the account which uploaded
+// it if the account's email is the commit author's. Otherwise, the commit author's email is
+// looked up in the accounts.
+func (m GerritMatcher) MatchByCommit(
+	ctx context.Context, email, repo, commit string) (string, error) {
+	query := "commit:" + commit
+	if project := strings.TrimPrefix(repoPath(repo), "a/"); project != "" {
+		query += " project:" + project
+	}
+	var changes []gerritChange
+	_, err := m.get(ctx, "/changes/", url.Values{
+		"q": {query}, "o": {"ALL_REVISIONS", "ALL_COMMITS", "DETAILED_ACCOUNTS"}}, &changes)
+	if err != nil {
+		return "", err
+	}
+	for _, change := range changes {
+		revision, exists := change.Revisions[commit]
+		if !exists {
+			continue
+		}
+		if !strings.EqualFold(revision.Commit.Author.Email, email) {
+			logrus.Warnf("unable to find users by commit for email: %s", email)
+			return "", ErrNoMatches
+		}
+		for _, account := range []*gerritAccount{revision.Uploader, &change.Owner} {
+			if account != nil && strings.EqualFold(account.Email, email) {
+				return account.user(), nil
+			}
+		}
+		// somebody else uploaded the commit
+		return m.MatchByEmail(ctx, email)
+	}
+	logrus.Warnf("commit %s was not found in %s", commit, repo)
+	return "", ErrNoMatches
+}
+
+// gerritAccountDetail is the account with the profile details.
+type gerritAccountDetail struct {
+	gerritAccount
+	// RegisteredOn is "2019-09-26 09:32:17.000000000" in UTC.
+	RegisteredOn string `json:"registered_on"`
+	Avatars      []struct {
+		URL    string `json:"url"`
+		Height int    `json:"height"`
+	} `json:"avatars"`
+}
+
+// gerritTimestampLayout is the format of the timestamps in the responses.
+const gerritTimestampLayout = "2006-01-02 15:04:05.000000000"
+
+// Profile returns the details of the Gerrit account. The profile URL is the dashboard.
+func (m GerritMatcher) Profile(ctx context.Context, user string) (Profile, error) {
+	var account gerritAccountDetail
+	code, err := m.get(ctx, "/accounts/"+url.PathEscape(user)+"/detail", nil, &account)
+	if err != nil {
+		if code == http.StatusNotFound {
+			return Profile{}, ErrNoMatches
+		}
+		return Profile{}, err
+	}
+	profile := Profile{
+		DisplayName: account.Name,
+		ProfileURL:  m.apiURL + "/dashboard/" + strconv.FormatInt(account.ID, 10),
+	}
+	// the biggest avatar
+	height := 0
+	for _, avatar := range account.Avatars {
+		if avatar.Height >= height {
+			profile.AvatarURL, height = avatar.URL, avatar.Height
+		}
+	}
+	if account.RegisteredOn != "" {
+		profile.CreatedAt, _ = time.Parse(gerritTimestampLayout, account.RegisteredOn)
+	}
+	return profile, nil
+}
+
+// OnIdle does nothing here.
+func (m GerritMatcher) OnIdle() error {
+	return nil
+}
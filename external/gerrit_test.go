@@ -0,0 +1,125 @@
+package external
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newGerritFixtureServerMatcher(t *testing.T, token string) (Matcher, *http.Request, func()) {
+	prefix := ""
+	if token != "" {
+		prefix = "/a"
+	}
+	accounts := func(email string) string {
+		return prefix + "/accounts/?" + url.Values{
+			"q": {"email:" + email}, "o": {"DETAILS"}}.Encode()
+	}
+	changes := func(commit string) string {
+		return prefix + "/changes/?" + url.Values{
+			"q": {"commit:" + commit + " project:src-d/hercules"},
+			"o": {"ALL_REVISIONS", "ALL_COMMITS", "DETAILED_ACCOUNTS"}}.Encode()
+	}
+	lastRequest := &http.Request{}
+	server := newFixtureServer(t, map[string]string{
+		accounts("vadim@sourced.tech"):                      "gerrit/accounts.json",
+		accounts("mcuadros@gmail.com"):                      "gerrit/accounts_no_username.json",
+		accounts("vadim-evil-clone@sourced.tech"):           "gerrit/empty.json",
+		changes("d78a9c8b0c077b5ecdb3cf1e1efab4635c97dd7b"): "gerrit/changes.json",
+		changes("6104942438c14ec7bd21c6cd5bd995272b3faff6"): "gerrit/changes.json",
+		changes("8d20cc5916edf7cfa6a9c5ed069f0640dc823c12"): "gerrit/empty.json",
+	}, func(r *http.Request) {
+		*lastRequest = *r
+	})
+	matcher, err := NewGerritMatcher(server.URL+"/", token)
+	require.NoError(t, err)
+	return matcher, lastRequest, server.Close
+}
+
+func TestNewGerritMatcher(t *testing.T) {
+	_, err := NewGerritMatcher("", "")
+	require.Error(t, err)
+	_, err = NewGerritMatcher("https://gerrit.company.com", "password")
+	require.Error(t, err)
+	matcher, err := NewGerritMatcher("https://gerrit.company.com", "user:pass:word")
+	require.NoError(t, err)
+	require.Equal(t, GerritMatcher{
+		apiURL: "https://gerrit.company.com", user: "user", password: "pass:word"}, matcher)
+}
+
+func TestGerritMatcherMatchByEmail(t *testing.T) {
+	req := require.New(t)
+	matcher, lastRequest, cleanup := newGerritFixtureServerMatcher(t, "vadim:secret")
+	defer cleanup()
+	ctx := context.Background()
+	user, err := matcher.MatchByEmail(ctx, "vadim@sourced.tech")
+	req.NoError(err)
+	req.Equal("vmarkovtsev", user)
+	username, password, ok := lastRequest.BasicAuth()
+	req.True(ok)
+	req.Equal("vadim", username)
+	req.Equal("secret", password)
+	user, err = matcher.MatchByEmail(ctx, "mcuadros@gmail.com")
+	req.NoError(err)
+	req.Equal("1000097", user)
+	_, err = matcher.MatchByEmail(ctx, "vadim-evil-clone@sourced.tech")
+	req.Equal(ErrNoMatches, err)
+}
+
+func TestGerritMatcherMatchByCommit(t *testing.T) {
+	req := require.New(t)
+	matcher, lastRequest, cleanup := newGerritFixtureServerMatcher(t, "")
+	defer cleanup()
+	req.True(matcher.SupportsMatchingByCommit())
+	ctx := context.Background()
+	repo := "https://gerrit.company.com/a/src-d/hercules"
+
+	// the author uploaded the commit
+	user, err := matcher.MatchByCommit(
+		ctx, "mcuadros@gmail.com", repo, "d78a9c8b0c077b5ecdb3cf1e1efab4635c97dd7b")
+	req.NoError(err)
+	req.Equal("1000097", user)
+	_, _, ok := lastRequest.BasicAuth()
+	req.False(ok)
+
+	// the author owns the change
+	user, err = matcher.MatchByCommit(
+		ctx, "vadim@sourced.tech", repo, "6104942438c14ec7bd21c6cd5bd995272b3faff6")
+	req.NoError(err)
+	req.Equal("vmarkovtsev", user)
+
+	// the email does not belong to the commit
+	_, err = matcher.MatchByCommit(
+		ctx, "mcuadros@gmail.com", repo, "6104942438c14ec7bd21c6cd5bd995272b3faff6")
+	req.Equal(ErrNoMatches, err)
+
+	// the commit does not exist
+	_, err = matcher.MatchByCommit(
+		ctx, "vadim@sourced.tech", repo, "8d20cc5916edf7cfa6a9c5ed069f0640dc823c12")
+	req.Equal(ErrNoMatches, err)
+	req.NoError(matcher.OnIdle())
+}
+
+func TestGerritMatcherProfile(t *testing.T) {
+	req := require.New(t)
+	server := newFixtureServer(t, map[string]string{
+		"/accounts/vmarkovtsev/detail": "gerrit/account_detail.json",
+	}, nil)
+	defer server.Close()
+	matcher, err := NewGerritMatcher(server.URL, "")
+	req.NoError(err)
+	profile, err := matcher.(Profiler).Profile(context.Background(), "vmarkovtsev")
+	req.NoError(err)
+	req.Equal(Profile{
+		DisplayName: "Vadim Markovtsev",
+		AvatarURL:   "https://review.company.com/avatars/1000096?s=100",
+		ProfileURL:  server.URL + "/dashboard/1000096",
+		CreatedAt:   time.Date(2019, 9, 26, 9, 32, 17, 0, time.UTC),
+	}, profile)
+	_, err = matcher.(Profiler).Profile(context.Background(), "mcuadros")
+	req.Equal(ErrNoMatches, err)
+}
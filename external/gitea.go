@@ -0,0 +1,188 @@
+package external
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// GiteaMatcher matches emails and Gitea users. It works with Forgejo, too.
+type GiteaMatcher struct {
+	apiURL string
+	token  string
+}
+
+type giteaUser struct {
+	Login     string `json:"login"`
+	Email     string `json:"email"`
+	FullName  string `json:"full_name"`
+	AvatarURL string `json:"avatar_url"`
+	// HTMLURL is missing in the old Gitea versions.
+	HTMLURL string    `json:"html_url"`
+	Created time.Time `json:"created"`
+}
+
+type giteaEmail struct {
+	Email    string `json:"email"`
+	Username string `json:"username"`
+}
+
+type giteaUsers struct {
+	Data []giteaUser `json:"data"`
+	OK   bool        `json:"ok"`
+}
+
+type giteaSignature struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+type giteaCommit struct {
+	SHA    string `json:"sha"`
+	Commit struct {
+		Author    giteaSignature `json:"author"`
+		Committer giteaSignature `json:"committer"`
+	} `json:"commit"`
+	// Author and Committer are nil if the signatures are not linked to any accounts.
+	Author    *giteaUser `json:"author"`
+	Committer *giteaUser `json:"committer"`
+}
+
+// NewGiteaMatcher creates a new matcher given a Gitea access token.
+// apiURL may point either to the instance, e.g. https://git.company.com, or to its API.
+// https://docs.gitea.io/en-us/api-usage/
+func NewGiteaMatcher(apiURL, token string) (Matcher, error) {
+	if apiURL == "" {
+		apiURL = "https://gitea.com/api/v1"
+	}
+	apiURL = strings.TrimSuffix(apiURL, "/")
+	if !strings.HasSuffix(apiURL, "/api/v1") {
+		apiURL += "/api/v1"
+	}
+	if _, err := url.Parse(apiURL); err != nil {
+		return GiteaMatcher{}, err
+	}
+	return GiteaMatcher{apiURL: apiURL, token: token}, nil
+}
+
+// get requests the API and decodes the JSON response. It returns the HTTP status code.
+func (m GiteaMatcher) get(ctx context.Context, path string, query url.Values,
+	result interface{}) (int, error) {
+	u := m.apiURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if m.token != "" {
+		req.Header.Set("Authorization", "token "+m.token)
+	}
+	response, err := doWithRetries(ctx, http.DefaultClient, req, isTransientCode)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return response.StatusCode, fmt.Errorf("HTTP %d: %s", response.StatusCode, u)
+	}
+	return response.StatusCode, json.NewDecoder(response.Body).Decode(result)
+}
+
+// MatchByEmail returns the Gitea user with the given email. The search through all the emails
+// requires an admin token; otherwise, only the public emails are found.
+func (m GiteaMatcher) MatchByEmail(ctx context.Context, email string) (string, error) {
+	var emails []giteaEmail
+	code, err := m.get(ctx, "/admin/emails/search", url.Values{"q": {email}}, &emails)
+	if err == nil {
+		for _, e := range emails {
+			if strings.EqualFold(e.Email, email) {
+				return e.Username, nil
+			}
+		}
+		logrus.Warnf("unable to find users for email: %s", email)
+		return "", ErrNoMatches
+	}
+	if code != http.StatusForbidden && code != http.StatusNotFound {
+		return "", err
+	}
+	// not an admin or an old Gitea version
+	var users giteaUsers
+	if _, err = m.get(ctx, "/users/search", url.Values{"q": {email}}, &users); err != nil {
+		return "", err
+	}
+	for _, user := range users.Data {
+		if strings.EqualFold(user.Email, email) {
+			return user.Login, nil
+		}
+	}
+	logrus.Warnf("unable to find users for email: %s", email)
+	return "", ErrNoMatches
+}
+
+// SupportsMatchingByCommit indicates whether this Matcher allows querying identities by commit metadata.
+func (m GiteaMatcher) SupportsMatchingByCommit() bool {
+	return true
+}
+
+// MatchByCommit queries the identity of a given email address in a particular commit context.
+func (m GiteaMatcher) MatchByCommit(
+	ctx context.Context, email, repo, commit string) (string, error) {
+	path := strings.Split(repoPath(repo), "/")
+	if len(path) != 2 {
+		return "", fmt.Errorf("not a Gitea repository: %s", repo)
+	}
+	var c giteaCommit
+	code, err := m.get(ctx, fmt.Sprintf("/repos/%s/%s/git/commits/%s",
+		url.PathEscape(path[0]), url.PathEscape(path[1]), commit), nil, &c)
+	if err != nil {
+		if code == http.StatusNotFound {
+			logrus.Warnf("commit %s was not found in %s", commit, repo)
+			return "", ErrNoMatches
+		}
+		return "", err
+	}
+	if c.Author != nil && strings.EqualFold(c.Commit.Author.Email, email) {
+		return c.Author.Login, nil
+	}
+	if c.Committer != nil && strings.EqualFold(c.Commit.Committer.Email, email) {
+		return c.Committer.Login, nil
+	}
+	logrus.Warnf("unable to find users by commit for email: %s", email)
+	return "", ErrNoMatches
+}
+
+// Profile returns the public profile of the Gitea user.
+func (m GiteaMatcher) Profile(ctx context.Context, user string) (Profile, error) {
+	var u giteaUser
+	code, err := m.get(ctx, "/users/"+url.PathEscape(user), nil, &u)
+	if err != nil {
+		if code == http.StatusNotFound {
+			return Profile{}, ErrNoMatches
+		}
+		return Profile{}, err
+	}
+	profileURL := u.HTMLURL
+	if profileURL == "" {
+		profileURL = strings.TrimSuffix(m.apiURL, "/api/v1") + "/" + url.PathEscape(u.Login)
+	}
+	return Profile{
+		DisplayName: u.FullName,
+		AvatarURL:   u.AvatarURL,
+		ProfileURL:  profileURL,
+		CreatedAt:   u.Created,
+	}, nil
+}
+
+// OnIdle does nothing here.
+func (m GiteaMatcher) OnIdle() error {
+	return nil
+}
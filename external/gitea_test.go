@@ -0,0 +1,118 @@
+package external
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const giteaTestCommit = "d78a9c8b0c077b5ecdb3cf1e1efab4635c97dd7b"
+
+func TestNewGiteaMatcher(t *testing.T) {
+	for apiURL, expected := range map[string]string{
+		"":                                "https://gitea.com/api/v1",
+		"https://git.company.com":         "https://git.company.com/api/v1",
+		"https://git.company.com/":        "https://git.company.com/api/v1",
+		"https://git.company.com/api/v1/": "https://git.company.com/api/v1",
+	} {
+		matcher, err := NewGiteaMatcher(apiURL, "")
+		require.NoError(t, err)
+		require.Equal(t, expected, matcher.(GiteaMatcher).apiURL)
+	}
+}
+
+func TestGiteaMatcherMatchByEmailAdmin(t *testing.T) {
+	req := require.New(t)
+	var authorization string
+	server := newFixtureServer(t, map[string]string{
+		"/api/v1/admin/emails/search?q=vadim%40sourced.tech":            "gitea/emails.json",
+		"/api/v1/admin/emails/search?q=vadim-evil-clone%40sourced.tech": "gitea/emails_empty.json",
+	}, func(r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+	})
+	defer server.Close()
+	matcher, err := NewGiteaMatcher(server.URL, "secret")
+	req.NoError(err)
+	ctx := context.Background()
+	user, err := matcher.MatchByEmail(ctx, "vadim@sourced.tech")
+	req.NoError(err)
+	req.Equal("vmarkovtsev", user)
+	req.Equal("token secret", authorization)
+	_, err = matcher.MatchByEmail(ctx, "vadim-evil-clone@sourced.tech")
+	req.Equal(ErrNoMatches, err)
+}
+
+func TestGiteaMatcherMatchByEmail(t *testing.T) {
+	req := require.New(t)
+	// the admin API is not available and fails with 404
+	server := newFixtureServer(t, map[string]string{
+		"/api/v1/users/search?q=vadim%40sourced.tech":            "gitea/users.json",
+		"/api/v1/users/search?q=vadim-evil-clone%40sourced.tech": "gitea/users_empty.json",
+	}, nil)
+	defer server.Close()
+	matcher, err := NewGiteaMatcher(server.URL+"/api/v1", "")
+	req.NoError(err)
+	ctx := context.Background()
+	user, err := matcher.MatchByEmail(ctx, "vadim@sourced.tech")
+	req.NoError(err)
+	req.Equal("vmarkovtsev", user)
+	_, err = matcher.MatchByEmail(ctx, "vadim-evil-clone@sourced.tech")
+	req.Equal(ErrNoMatches, err)
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = matcher.MatchByEmail(ctx, "vadim@sourced.tech")
+	req.Equal(context.Canceled, err)
+}
+
+func TestGiteaMatcherMatchByCommit(t *testing.T) {
+	req := require.New(t)
+	server := newFixtureServer(t, map[string]string{
+		"/api/v1/repos/src-d/hercules/git/commits/" + giteaTestCommit: "gitea/commit.json",
+	}, nil)
+	defer server.Close()
+	matcher, err := NewGiteaMatcher(server.URL, "")
+	req.NoError(err)
+	req.True(matcher.SupportsMatchingByCommit())
+	ctx := context.Background()
+	repo := "https://gitea.company.com/src-d/hercules.git"
+
+	user, err := matcher.MatchByCommit(ctx, "vadim@sourced.tech", repo, giteaTestCommit)
+	req.NoError(err)
+	req.Equal("vmarkovtsev", user)
+
+	// the committer is not linked to an account
+	_, err = matcher.MatchByCommit(ctx, "mcuadros@gmail.com", repo, giteaTestCommit)
+	req.Equal(ErrNoMatches, err)
+
+	// the commit does not exist
+	_, err = matcher.MatchByCommit(ctx, "vadim@sourced.tech", repo,
+		"8d20cc5916edf7cfa6a9c5ed069f0640dc823c12")
+	req.Equal(ErrNoMatches, err)
+
+	// not a repository URL
+	_, err = matcher.MatchByCommit(ctx, "vadim@sourced.tech", "hercules", giteaTestCommit)
+	req.EqualError(err, "not a Gitea repository: hercules")
+	req.NoError(matcher.OnIdle())
+}
+
+func TestGiteaMatcherProfile(t *testing.T) {
+	req := require.New(t)
+	server := newFixtureServer(t, map[string]string{
+		"/api/v1/users/vmarkovtsev": "gitea/user.json",
+	}, nil)
+	defer server.Close()
+	matcher, err := NewGiteaMatcher(server.URL, "")
+	req.NoError(err)
+	profile, err := matcher.(Profiler).Profile(context.Background(), "vmarkovtsev")
+	req.NoError(err)
+	req.Equal("Vadim Markovtsev", profile.DisplayName)
+	req.Equal("https://gitea.company.com/avatars/c2525a7f58ae3776070e44c106c48e15",
+		profile.AvatarURL)
+	req.Equal(server.URL+"/vmarkovtsev", profile.ProfileURL)
+	req.True(time.Date(2019, 9, 26, 9, 32, 17, 0, time.UTC).Equal(profile.CreatedAt))
+	_, err = matcher.(Profiler).Profile(context.Background(), "mcuadros")
+	req.Equal(ErrNoMatches, err)
+}
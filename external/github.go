@@ -1,42 +1,66 @@
 package external
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"regexp"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/sirupsen/logrus"
-	"golang.org/x/oauth2"
 	"gopkg.in/google/go-github.v15/github"
 )
 
 // GitHubMatcher matches emails and GitHub users.
 type GitHubMatcher struct {
 	client *github.Client
+	// graphql is nil without the token because the GraphQL API requires authentication.
+	graphql *gitHubGraphQL
+}
+
+// gitHubGraphQL is the GitHub GraphQL API endpoint.
+type gitHubGraphQL struct {
+	client *http.Client
+	url    string
 }
 
 // NewGitHubMatcher creates a new matcher given a GitHub token.
 // https://github.com/settings/tokens
 func NewGitHubMatcher(apiURL, token string) (Matcher, error) {
+	return NewGitHubMatcherWithTokens(apiURL, NewTokenPool(token))
+}
+
+// NewGitHubMatcherWithTokens creates a new matcher which rotates the GitHub tokens.
+// The matcher is anonymous if the pool is empty.
+func NewGitHubMatcherWithTokens(apiURL string, tokens *TokenPool) (Matcher, error) {
 	if apiURL == "" {
 		apiURL = "https://api.github.com/"
 	}
-	var c *http.Client
-	if token != "" {
-		c = oauth2.NewClient(
-			context.Background(),
-			oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token}),
-		)
-	}
+	c := tokens.client(func(req *http.Request, token string) {
+		req.Header.Set("Authorization", "Bearer "+token)
+	})
 	// The actual upload URL does not matter - we are not going to upload anything.
 	client, err := github.NewEnterpriseClient(apiURL, apiURL, c)
 	if err != nil {
 		return GitHubMatcher{}, err
 	}
-	return GitHubMatcher{client}, nil
+	m := GitHubMatcher{client: client}
+	if c != nil {
+		m.graphql = &gitHubGraphQL{client: c, url: gitHubGraphQLURL(apiURL)}
+	}
+	return m, nil
+}
+
+// gitHubGraphQLURL converts the REST API URL to the GraphQL API URL, e.g.
+// https://api.github.com/graphql or https://github.company.com/api/graphql for
+// https://github.company.com/api/v3/
+func gitHubGraphQLURL(apiURL string) string {
+	apiURL = strings.TrimSuffix(apiURL, "/")
+	return strings.TrimSuffix(apiURL, "/v3") + "/graphql"
 }
 
 var searchOpts = &github.SearchOptions{
@@ -45,54 +69,36 @@ var searchOpts = &github.SearchOptions{
 }
 var gitHubRepoRe = regexp.MustCompile(`(.*://|^)github.com/([^/]+)/([^/]+?)(?:\.git)?$`)
 
-const (
-	responseSuccess = 0
-	responseRetry   = 1
-	responseFail    = 2
-	maxNumFailures  = 8
-)
-
 // MatchByEmail returns the latest GitHub user with the given email.
 func (m GitHubMatcher) MatchByEmail(ctx context.Context, email string) (user string, err error) {
-	finished := make(chan struct{})
-	go func() {
-		defer func() { finished <- struct{}{} }()
-
-		var numFailures uint64
-		query := email + " in:email"
-		for { // api rate limit retry loop
-			if isNoReplyEmail(email) {
-				user = userFromEmail(email)
-			} else {
-				var result *github.UsersSearchResult
-				var response *github.Response
-				result, response, err = m.client.Search.Users(ctx, query, searchOpts)
-				status := checkResponse(response, err, &numFailures)
-				if status == responseRetry {
-					continue
-				} else if status == responseFail {
-					return
-				}
-				if len(result.Users) == 0 {
-					if strings.Contains(query, "@") {
-						// Hacking time! user+domain may work instead of user@domain
-						query = strings.Replace(query, "@", " ", 1)
-						continue
-					}
-					logrus.Warnf("unable to find users for email: %s", email)
-					err = ErrNoMatches
-					return
-				}
-				user = result.Users[0].GetLogin()
-				break
-			}
+	if isNoReplyEmail(email) {
+		return userFromEmail(email), nil
+	}
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			user, err = "", context.Canceled
 		}
 	}()
-	select {
-	case <-finished:
-		return
-	case <-ctx.Done():
-		return "", context.Canceled
+	var numFailures uint64
+	query := email + " in:email"
+	for { // api rate limit retry loop
+		result, response, err := m.client.Search.Users(ctx, query, searchOpts)
+		status := checkResponse(ctx, response, err, &numFailures)
+		if status == responseRetry {
+			continue
+		} else if status == responseFail {
+			return "", err
+		}
+		if len(result.Users) == 0 {
+			if strings.Contains(query, "@") {
+				// Hacking time! user+domain may work instead of user@domain
+				query = strings.Replace(query, "@", " ", 1)
+				continue
+			}
+			logrus.Warnf("unable to find users for email: %s", email)
+			return "", ErrNoMatches
+		}
+		return result.Users[0].GetLogin(), nil
 	}
 }
 
@@ -106,95 +112,267 @@ func (m GitHubMatcher) MatchByCommit(
 	ctx context.Context, email, repo, commit string) (user string, err error) {
 	parsedRepo := gitHubRepoRe.FindStringSubmatch(repo)
 	if len(parsedRepo) < 4 {
-		logrus.Panicf("not a GitHub repository: %s", repo)
+		return "", fmt.Errorf("not a GitHub repository: %s", repo)
 	}
-	if len(commit) != 40 {
-		logrus.Panicf("not a Git hash: %s", commit)
+	if !gitHubHashRe.MatchString(commit) {
+		return "", fmt.Errorf("not a Git hash: %s", commit)
 	}
 	repoUser := parsedRepo[2]
 	repoName := parsedRepo[3]
-	finished := make(chan struct{})
-	go func() {
-		defer func() { finished <- struct{}{} }()
-
-		var numFailures uint64
-		for { // api rate limit retry loop
-			if isNoReplyEmail(email) {
-				user = userFromEmail(email)
-			} else {
-				var c *github.RepositoryCommit
-				var response *github.Response
-				c, response, err = m.client.Repositories.GetCommit(ctx, repoUser, repoName, commit)
-				status := checkResponse(response, err, &numFailures)
-				if status == responseRetry {
-					continue
-				} else if status == responseFail {
-					return
-				}
-				if c.Author != nil && c.Author.Login != nil && c.Commit.Author != nil &&
-					c.Commit.Author.Email != nil && *c.Commit.Author.Email == email {
-					user = *c.Author.Login
-				} else if c.Committer != nil && c.Committer.Login != nil && c.Commit.Committer != nil &&
-					c.Commit.Committer.Email != nil && *c.Commit.Committer.Email == email {
-					user = *c.Committer.Login
-				} else {
-					logrus.Warnf("unable to find users by commit for email: %s", email)
-					err = ErrNoMatches
-				}
-				break
-			}
+	if isNoReplyEmail(email) {
+		return userFromEmail(email), nil
+	}
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			user, err = "", context.Canceled
 		}
 	}()
-	select {
-	case <-finished:
-		return
-	case <-ctx.Done():
-		return "", context.Canceled
+	var numFailures uint64
+	for { // api rate limit retry loop
+		c, response, err := m.client.Repositories.GetCommit(ctx, repoUser, repoName, commit)
+		status := checkResponse(ctx, response, err, &numFailures)
+		if status == responseRetry {
+			continue
+		} else if status == responseFail {
+			return "", err
+		}
+		if c.Author != nil && c.Author.Login != nil && c.Commit.Author != nil &&
+			c.Commit.Author.Email != nil && *c.Commit.Author.Email == email {
+			return *c.Author.Login, nil
+		}
+		if c.Committer != nil && c.Committer.Login != nil && c.Commit.Committer != nil &&
+			c.Commit.Committer.Email != nil && *c.Commit.Committer.Email == email {
+			return *c.Committer.Login, nil
+		}
+		logrus.Warnf("unable to find users by commit for email: %s", email)
+		return "", ErrNoMatches
 	}
 }
 
-// OnIdle does nothing here.
-func (m GitHubMatcher) OnIdle() error {
-	return nil
+// Profile returns the public profile of the GitHub user.
+func (m GitHubMatcher) Profile(ctx context.Context, user string) (Profile, error) {
+	var numFailures uint64
+	for { // api rate limit retry loop
+		u, response, err := m.client.Users.Get(ctx, user)
+		if ctx.Err() != nil {
+			return Profile{}, context.Canceled
+		}
+		if response != nil && response.StatusCode == http.StatusNotFound {
+			return Profile{}, ErrNoMatches
+		}
+		status := checkResponse(ctx, response, err, &numFailures)
+		if status == responseRetry {
+			continue
+		} else if status == responseFail {
+			return Profile{}, err
+		}
+		return Profile{
+			DisplayName: u.GetName(),
+			AvatarURL:   u.GetAvatarURL(),
+			ProfileURL:  u.GetHTMLURL(),
+			CreatedAt:   u.GetCreatedAt().Time,
+		}, nil
+	}
+}
+
+// gitHubMaxBatch is the maximum number of commits resolved by a single GraphQL query.
+const gitHubMaxBatch = 100
+
+var gitHubHashRe = regexp.MustCompile(`^[0-9a-fA-F]{40}$`)
+
+type gitHubGraphQLSignature struct {
+	Email string `json:"email"`
+	User  *struct {
+		Login string `json:"login"`
+	} `json:"user"`
 }
 
-func checkResponse(response *github.Response, err error, numFailures *uint64) int {
-	code := response.Response.StatusCode
-	if err == nil && code >= 200 && code < 300 {
-		return responseSuccess
+type gitHubGraphQLCommit struct {
+	Author    *gitHubGraphQLSignature `json:"author"`
+	Committer *gitHubGraphQLSignature `json:"committer"`
+}
+
+type gitHubGraphQLResponse struct {
+	// Data maps the repository aliases to the commit aliases to the commits.
+	Data   map[string]map[string]*gitHubGraphQLCommit `json:"data"`
+	Errors []struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+// MatchByCommits resolves the commits with GraphQL queries. The commits of the same
+// repository are grouped together and each query contains up to 100 commits.
+// The commits are queried one by one with the REST API if there is no token.
+func (m GitHubMatcher) MatchByCommits(ctx context.Context, queries []CommitQuery) (
+	[]CommitMatch, error) {
+	if m.graphql == nil {
+		return matchByCommitsOneByOne(ctx, m, queries)
+	}
+	matches := make([]CommitMatch, len(queries))
+	// group the queries by repository in the order of appearance
+	var repos []string
+	repoQueries := map[string][]int{}
+	for i, query := range queries {
+		if isNoReplyEmail(query.Email) {
+			matches[i].User = userFromEmail(query.Email)
+			continue
+		}
+		parsedRepo := gitHubRepoRe.FindStringSubmatch(query.Repo)
+		if len(parsedRepo) < 4 {
+			matches[i].Err = fmt.Errorf("not a GitHub repository: %s", query.Repo)
+			continue
+		}
+		if !gitHubHashRe.MatchString(query.Commit) {
+			matches[i].Err = fmt.Errorf("not a Git hash: %s", query.Commit)
+			continue
+		}
+		repo := parsedRepo[2] + "/" + parsedRepo[3]
+		if _, exists := repoQueries[repo]; !exists {
+			repos = append(repos, repo)
+		}
+		repoQueries[repo] = append(repoQueries[repo], i)
+	}
+	var batch []int
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := m.matchBatch(ctx, queries, batch, matches)
+		batch = batch[:0]
+		return err
+	}
+	for _, repo := range repos {
+		for _, i := range repoQueries[repo] {
+			batch = append(batch, i)
+			if len(batch) == gitHubMaxBatch {
+				if err := flush(); err != nil {
+					return nil, err
+				}
+			}
+		}
 	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return matches, nil
+}
 
-	rateLimitHit := false
-	if val, exists := response.Response.Header["X-Ratelimit-Remaining"]; code == 403 &&
-		exists && len(val) == 1 && val[0] == "0" {
-		rateLimitHit = true
+// matchBatch resolves the queries with the given indexes in a single GraphQL query and
+// writes the matches.
+func (m GitHubMatcher) matchBatch(ctx context.Context, queries []CommitQuery, batch []int,
+	matches []CommitMatch) error {
+	quote := func(s string) string {
+		data, _ := json.Marshal(s)
+		return string(data)
 	}
-	if rateLimitHit {
-		t, err := strconv.ParseInt(
-			response.Response.Header["X-Ratelimit-Reset"][0], 10, 64)
-		if err != nil {
-			logrus.Errorf("Bad X-Ratelimit-Reset header: %v", err)
-			return responseFail
+	query := &strings.Builder{}
+	query.WriteString("query {")
+	repoAliases := map[string]string{}
+	commitAliases := map[int]string{}
+	var repo string
+	for _, i := range batch {
+		parsedRepo := gitHubRepoRe.FindStringSubmatch(queries[i].Repo)
+		if nextRepo := parsedRepo[2] + "/" + parsedRepo[3]; nextRepo != repo {
+			if repo != "" {
+				query.WriteString(" }")
+			}
+			repo = nextRepo
+			repoAliases[repo] = "r" + strconv.Itoa(len(repoAliases))
+			fmt.Fprintf(query, " %s: repository(owner: %s, name: %s) {", repoAliases[repo],
+				quote(parsedRepo[2]), quote(parsedRepo[3]))
 		}
-		resetTime := time.Unix(t, 0).Add(time.Second)
-		logrus.Warnf("rate limit was hit, waiting until %s", resetTime.String())
-		time.Sleep(resetTime.Sub(time.Now().UTC()))
-		return responseRetry
+		commitAliases[i] = "c" + strconv.Itoa(i)
+		fmt.Fprintf(query, " %s: object(oid: %s) { ... on Commit {"+
+			" author { email user { login } } committer { email user { login } } } }",
+			commitAliases[i], quote(strings.ToLower(queries[i].Commit)))
+	}
+	query.WriteString(" } }")
+	body, err := json.Marshal(map[string]string{"query": query.String()})
+	if err != nil {
+		return err
 	}
 
-	if err != nil || code >= 500 && code < 600 || code == 408 || code == 429 {
-		sleepTime := time.Duration((1 << *numFailures) * int64(time.Second))
-		logrus.Warnf("HTTP %d: %s, sleeping until %s", code, err,
-			time.Now().UTC().Add(sleepTime))
-		time.Sleep(sleepTime)
-		*numFailures++
-		if *numFailures > maxNumFailures {
-			return responseFail
+	var result gitHubGraphQLResponse
+	var numFailures uint64
+	for { // api rate limit retry loop
+		req, err := http.NewRequest(http.MethodPost, m.graphql.url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/json")
+		response, err := m.graphql.client.Do(req)
+		if ctx.Err() != nil {
+			if err == nil {
+				response.Body.Close()
+			}
+			return context.Canceled
+		}
+		status := checkHTTPResponse(ctx, response, err, &numFailures, isTransientCode)
+		if status != responseSuccess {
+			if err == nil {
+				response.Body.Close()
+				err = fmt.Errorf("HTTP %d: %s", response.StatusCode, m.graphql.url)
+			}
+			if status == responseRetry {
+				continue
+			}
+			for _, i := range batch {
+				matches[i].Err = err
+			}
+			return nil
+		}
+		err = json.NewDecoder(response.Body).Decode(&result)
+		response.Body.Close()
+		if err != nil {
+			return err
+		}
+		break
+	}
+	for _, e := range result.Errors {
+		// NOT_FOUND for the missing repositories and commits, the rest is unexpected
+		if e.Type != "NOT_FOUND" {
+			logrus.Errorf("GitHub GraphQL error: %s", e.Message)
+		}
+	}
+	if result.Data == nil {
+		for _, i := range batch {
+			matches[i].Err = errors.New("GitHub GraphQL query failed")
+		}
+		return nil
+	}
+	for _, i := range batch {
+		parsedRepo := gitHubRepoRe.FindStringSubmatch(queries[i].Repo)
+		c := result.Data[repoAliases[parsedRepo[2]+"/"+parsedRepo[3]]][commitAliases[i]]
+		email := queries[i].Email
+		if c != nil && c.Author != nil && c.Author.User != nil &&
+			strings.EqualFold(c.Author.Email, email) {
+			matches[i].User = c.Author.User.Login
+		} else if c != nil && c.Committer != nil && c.Committer.User != nil &&
+			strings.EqualFold(c.Committer.Email, email) {
+			matches[i].User = c.Committer.User.Login
+		} else {
+			logrus.Warnf("unable to find users by commit for email: %s", email)
+			matches[i].Err = ErrNoMatches
 		}
-		return responseRetry
 	}
-	logrus.Warnf("HTTP %d: %s", code, err)
-	return responseFail
+	return nil
+}
+
+// OnIdle does nothing here.
+func (m GitHubMatcher) OnIdle() error {
+	return nil
+}
+
+// checkResponse applies checkHTTPResponse() to the GitHub API response.
+func checkResponse(ctx context.Context, response *github.Response, err error,
+	numFailures *uint64) int {
+	var httpResponse *http.Response
+	if response != nil {
+		httpResponse = response.Response
+	}
+	return checkHTTPResponse(ctx, httpResponse, err, numFailures, isTransientCode)
 }
 
 func isNoReplyEmail(email string) bool {
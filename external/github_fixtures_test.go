@@ -0,0 +1,80 @@
+package external
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGitHubMatcherProfile(t *testing.T) {
+	req := require.New(t)
+	server := newFixtureServer(t, map[string]string{
+		"/users/vmarkovtsev": "github/user.json",
+	}, nil)
+	defer server.Close()
+	matcher, err := NewGitHubMatcher(server.URL+"/", "")
+	req.NoError(err)
+	profile, err := matcher.(Profiler).Profile(context.Background(), "vmarkovtsev")
+	req.NoError(err)
+	req.Equal("Vadim Markovtsev", profile.DisplayName)
+	req.Equal("https://avatars.githubusercontent.com/u/2793551?v=4", profile.AvatarURL)
+	req.Equal("https://github.com/vmarkovtsev", profile.ProfileURL)
+	req.True(time.Date(2012, 11, 14, 12, 32, 56, 0, time.UTC).Equal(profile.CreatedAt))
+	_, err = matcher.(Profiler).Profile(context.Background(), "mcuadros")
+	req.Equal(ErrNoMatches, err)
+}
+
+func TestGitHubMatcherCancelInFlight(t *testing.T) {
+	req := require.New(t)
+	started, aborted := make(chan struct{}, 1), make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		// hang until the client gives up
+		<-r.Context().Done()
+		aborted <- struct{}{}
+	}))
+	defer server.Close()
+	matcher, err := NewGitHubMatcher(server.URL+"/", "")
+	req.NoError(err)
+	for _, match := range []func(ctx context.Context) (string, error){
+		func(ctx context.Context) (string, error) {
+			return matcher.MatchByEmail(ctx, "vadim@sourced.tech")
+		},
+		func(ctx context.Context) (string, error) {
+			return matcher.MatchByCommit(ctx, "vadim@sourced.tech",
+				"https://github.com/src-d/hercules", "ecb4a4c2f1b5a1e8a9b8c2b9b7c4f0b1a2c3d4e5")
+		},
+	} {
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			<-started
+			cancel()
+		}()
+		user, err := match(ctx)
+		req.Equal("", user)
+		req.Equal(context.Canceled, err)
+		// the request is aborted rather than left running in the background
+		select {
+		case <-aborted:
+		case <-time.After(10 * time.Second):
+			req.FailNow("the request was not aborted")
+		}
+	}
+}
+
+func TestGitHubMatcherMatchByCommitInvalid(t *testing.T) {
+	req := require.New(t)
+	matcher, err := NewGitHubMatcher("", "")
+	req.NoError(err)
+	ctx := context.Background()
+	_, err = matcher.MatchByCommit(ctx, "vadim@sourced.tech", "https://gitlab.com/src-d/hercules",
+		"ecb4a4c2f1b5a1e8a9b8c2b9b7c4f0b1a2c3d4e5")
+	req.EqualError(err, "not a GitHub repository: https://gitlab.com/src-d/hercules")
+	_, err = matcher.MatchByCommit(ctx, "vadim@sourced.tech", "https://github.com/src-d/hercules",
+		"ecb4a4c")
+	req.EqualError(err, "not a Git hash: ecb4a4c")
+}
@@ -2,7 +2,10 @@ package external
 
 import (
 	"context"
-	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/xanzy/go-gitlab"
@@ -16,10 +19,18 @@ type GitLabMatcher struct {
 // NewGitLabMatcher creates a new matcher given a GitLab OAuth token.
 // https://gitlab.com/profile/personal_access_tokens
 func NewGitLabMatcher(apiURL, token string) (Matcher, error) {
+	return NewGitLabMatcherWithTokens(apiURL, NewTokenPool(token))
+}
+
+// NewGitLabMatcherWithTokens creates a new matcher which rotates the GitLab tokens.
+// The matcher is anonymous if the pool is empty.
+func NewGitLabMatcherWithTokens(apiURL string, tokens *TokenPool) (Matcher, error) {
 	if apiURL == "" {
 		apiURL = "https://gitlab.com/api/v4"
 	}
-	m := GitLabMatcher{gitlab.NewClient(nil, token)}
+	m := GitLabMatcher{gitlab.NewClient(tokens.client(func(req *http.Request, token string) {
+		req.Header.Set("Private-Token", token)
+	}), "")}
 	err := m.client.SetBaseURL(apiURL)
 	if err != nil {
 		return GitLabMatcher{}, err
@@ -27,47 +38,164 @@ func NewGitLabMatcher(apiURL, token string) (Matcher, error) {
 	return m, nil
 }
 
-// MatchByEmail returns the latest GitLab user with the given email.
-func (m GitLabMatcher) MatchByEmail(ctx context.Context, email string) (user string, err error) {
-	finished := make(chan struct{})
-	go func() {
-		defer func() { finished <- struct{}{} }()
-		opts := &gitlab.ListUsersOptions{Search: &email}
-		for {
-			var users []*gitlab.User
-			users, _, err = m.client.Users.ListUsers(opts)
-			if err != nil {
-				// TODO(vmarkovtsev): handle rate limit
-				// https://github.com/xanzy/go-gitlab/issues/630
-				return
-			}
-			if len(users) == 0 {
-				logrus.Warnf("unable to find users for email: %s", email)
-				err = ErrNoMatches
-				return
-			}
-			user = users[0].Username
-			// name = users[0].Name
-			return
+// retry sends the API request until it succeeds, fails permanently or ctx is canceled.
+// It follows the shared retry policy: waits for RateLimit-Reset or Retry-After on 429 and
+// backs off exponentially on 5xx. send returns the response for the status code checks.
+func (m GitLabMatcher) retry(ctx context.Context, send func() (*gitlab.Response, error)) error {
+	return retry(ctx, isTransientCode, func() (*http.Response, error) {
+		response, err := send()
+		if response == nil {
+			return nil, err
 		}
-	}()
-	select {
-	case <-finished:
+		return response.Response, err
+	})
+}
+
+// MatchByEmail returns the latest GitLab user with the given email.
+func (m GitLabMatcher) MatchByEmail(ctx context.Context, email string) (string, error) {
+	var users []*gitlab.User
+	err := m.retry(ctx, func() (response *gitlab.Response, err error) {
+		users, response, err = m.client.Users.ListUsers(
+			&gitlab.ListUsersOptions{Search: &email}, gitlab.WithContext(ctx))
 		return
-	case <-ctx.Done():
-		return "", context.Canceled
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(users) == 0 {
+		logrus.Warnf("unable to find users for email: %s", email)
+		return "", ErrNoMatches
 	}
+	// name = users[0].Name
+	return users[0].Username, nil
 }
 
 // SupportsMatchingByCommit indicates whether this Matcher allows querying identities by commit metadata.
 func (m GitLabMatcher) SupportsMatchingByCommit() bool {
-	return false
+	return true
 }
 
 // MatchByCommit queries the identity of a given email address in a particular commit context.
+// GitLab does not link the commits to the user accounts, so the commit author is looked up
+// among the project members by email and by name, and then among all the users by email.
 func (m GitLabMatcher) MatchByCommit(
 	ctx context.Context, email, repo, commit string) (user string, err error) {
-	return "", errors.New("not implemented")
+	project := repoPath(repo)
+	if strings.Count(project, "/") < 1 {
+		return "", fmt.Errorf("not a GitLab repository: %s", repo)
+	}
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			user, err = "", context.Canceled
+		}
+	}()
+	var c *gitlab.Commit
+	var response *gitlab.Response
+	err = m.retry(ctx, func() (*gitlab.Response, error) {
+		var err error
+		c, response, err = m.client.Commits.GetCommit(project, commit, gitlab.WithContext(ctx))
+		return response, err
+	})
+	if err != nil {
+		if response != nil && response.StatusCode == http.StatusNotFound {
+			logrus.Warnf("commit %s was not found in %s", commit, project)
+			err = ErrNoMatches
+		}
+		return
+	}
+	var name string
+	if strings.EqualFold(c.AuthorEmail, email) {
+		name = c.AuthorName
+	} else if strings.EqualFold(c.CommitterEmail, email) {
+		name = c.CommitterName
+	} else {
+		logrus.Warnf("unable to find users by commit for email: %s", email)
+		err = ErrNoMatches
+		return
+	}
+	var members []*gitlab.ProjectMember
+	err = m.retry(ctx, func() (response *gitlab.Response, err error) {
+		members, response, err = m.client.ProjectMembers.ListAllProjectMembers(
+			project, &gitlab.ListProjectMembersOptions{Query: &name}, gitlab.WithContext(ctx))
+		return
+	})
+	if err != nil {
+		return
+	}
+	if user = matchGitLabMember(members, email, name); user != "" {
+		return
+	}
+	var users []*gitlab.User
+	err = m.retry(ctx, func() (response *gitlab.Response, err error) {
+		users, response, err = m.client.Users.ListUsers(
+			&gitlab.ListUsersOptions{Search: &email}, gitlab.WithContext(ctx))
+		return
+	})
+	if err != nil {
+		return
+	}
+	if len(users) == 0 {
+		logrus.Warnf("unable to find users by commit for email: %s", email)
+		err = ErrNoMatches
+		return
+	}
+	user = users[0].Username
+	return
+}
+
+// matchGitLabMember returns the username of the project member with the given email or,
+// if there is no such member, of the only member with the given name.
+func matchGitLabMember(members []*gitlab.ProjectMember, email, name string) string {
+	var sameName []string
+	for _, member := range members {
+		if member.Email != "" && strings.EqualFold(member.Email, email) {
+			return member.Username
+		}
+		if strings.EqualFold(member.Name, name) {
+			sameName = append(sameName, member.Username)
+		}
+	}
+	if len(sameName) == 1 {
+		return sameName[0]
+	}
+	return ""
+}
+
+// gitLabProfile is the subset of the user fields which go-gitlab does not decode completely.
+type gitLabProfile struct {
+	Username  string     `json:"username"`
+	Name      string     `json:"name"`
+	AvatarURL string     `json:"avatar_url"`
+	WebURL    string     `json:"web_url"`
+	CreatedAt *time.Time `json:"created_at"`
+}
+
+// Profile returns the public profile of the GitLab user. The creation date is only visible
+// to the administrators.
+func (m GitLabMatcher) Profile(ctx context.Context, user string) (Profile, error) {
+	req, err := m.client.NewRequest(http.MethodGet, "users",
+		&gitlab.ListUsersOptions{Username: &user}, []gitlab.OptionFunc{gitlab.WithContext(ctx)})
+	if err != nil {
+		return Profile{}, err
+	}
+	var users []gitLabProfile
+	err = m.retry(ctx, func() (*gitlab.Response, error) {
+		return m.client.Do(req, &users)
+	})
+	if err != nil {
+		return Profile{}, err
+	}
+	for _, u := range users {
+		if !strings.EqualFold(u.Username, user) {
+			continue
+		}
+		profile := Profile{DisplayName: u.Name, AvatarURL: u.AvatarURL, ProfileURL: u.WebURL}
+		if u.CreatedAt != nil {
+			profile.CreatedAt = *u.CreatedAt
+		}
+		return profile, nil
+	}
+	return Profile{}, ErrNoMatches
 }
 
 // OnIdle does nothing here.
@@ -0,0 +1,97 @@
+package external
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const gitlabTestCommit = "6104942438c14ec7bd21c6cd5bd995272b3faff6"
+
+func newGitLabFixtureServerMatcher(t *testing.T) (Matcher, func()) {
+	projectPrefix := "/api/v4/projects/src-d%2Fhercules"
+	server := newFixtureServer(t, map[string]string{
+		projectPrefix + "/repository/commits/" + gitlabTestCommit:   "gitlab/commit.json",
+		projectPrefix + "/members/all?query=Vadim+Markovtsev":       "gitlab/members.json",
+		projectPrefix + "/members/all?query=GitLab":                 "gitlab/empty.json",
+		"/api/v4/users?search=noreply%40gitlab.com":                 "gitlab/users.json",
+		"/api/v4/users?search=vadim-evil-clone%40sourced.tech":      "gitlab/empty.json",
+		projectPrefix + "/members/all?query=Vadim+Markovtsev+Clone": "gitlab/empty.json",
+		"/api/v4/users?username=vmarkovtsev":                        "gitlab/user_profile.json",
+		"/api/v4/users?username=nobody":                             "gitlab/empty.json",
+	}, nil)
+	matcher, err := NewGitLabMatcher(server.URL, "")
+	require.NoError(t, err)
+	return matcher, server.Close
+}
+
+func TestGitLabMatcherMatchByCommit(t *testing.T) {
+	req := require.New(t)
+	matcher, cleanup := newGitLabFixtureServerMatcher(t)
+	defer cleanup()
+	req.True(matcher.SupportsMatchingByCommit())
+	ctx := context.Background()
+	repo := "https://gitlab.com/src-d/hercules.git"
+
+	// the author is a project member
+	user, err := matcher.MatchByCommit(ctx, "vadim@sourced.tech", repo, gitlabTestCommit)
+	req.NoError(err)
+	req.Equal("vmarkovtsev", user)
+
+	// the committer is not a project member
+	user, err = matcher.MatchByCommit(ctx, "noreply@gitlab.com", repo, gitlabTestCommit)
+	req.NoError(err)
+	req.Equal("gitlab-bot", user)
+
+	// the email does not belong to the commit
+	_, err = matcher.MatchByCommit(ctx, "vadim-evil-clone@sourced.tech", repo, gitlabTestCommit)
+	req.Equal(ErrNoMatches, err)
+
+	// the commit does not exist
+	_, err = matcher.MatchByCommit(ctx, "vadim@sourced.tech", repo,
+		"8d20cc5916edf7cfa6a9c5ed069f0640dc823c12")
+	req.Equal(ErrNoMatches, err)
+
+	// not a repository URL
+	_, err = matcher.MatchByCommit(ctx, "vadim@sourced.tech", "hercules", gitlabTestCommit)
+	req.EqualError(err, "not a GitLab repository: hercules")
+}
+
+func TestGitLabMatcherMatchByCommitSSH(t *testing.T) {
+	matcher, cleanup := newGitLabFixtureServerMatcher(t)
+	defer cleanup()
+	user, err := matcher.MatchByCommit(context.Background(), "vadim@sourced.tech",
+		"git@gitlab.com:src-d/hercules.git", gitlabTestCommit)
+	require.NoError(t, err)
+	require.Equal(t, "vmarkovtsev", user)
+}
+
+func TestGitLabMatcherMatchByCommitCancel(t *testing.T) {
+	matcher, cleanup := newGitLabFixtureServerMatcher(t)
+	defer cleanup()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	user, err := matcher.MatchByCommit(
+		ctx, "vadim@sourced.tech", "gitlab.com/src-d/hercules", gitlabTestCommit)
+	require.Equal(t, "", user)
+	require.Equal(t, context.Canceled, err)
+}
+
+func TestGitLabMatcherProfile(t *testing.T) {
+	req := require.New(t)
+	matcher, cleanup := newGitLabFixtureServerMatcher(t)
+	defer cleanup()
+	profile, err := matcher.(Profiler).Profile(context.Background(), "vmarkovtsev")
+	req.NoError(err)
+	req.Equal(Profile{
+		DisplayName: "Vadim Markovtsev",
+		AvatarURL: "https://secure.gravatar.com/avatar/c2525a7f58ae3776070e44c106c48e15" +
+			"?s=80&d=identicon",
+		ProfileURL: "https://gitlab.com/vmarkovtsev",
+		CreatedAt:  time.Date(2016, 5, 20, 15, 2, 11, 0, time.UTC),
+	}, profile)
+	_, err = matcher.(Profiler).Profile(context.Background(), "nobody")
+	req.Equal(ErrNoMatches, err)
+}
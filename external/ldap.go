@@ -0,0 +1,416 @@
+package external
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/sirupsen/logrus"
+)
+
+// LDAPMatcher matches emails and the uids in the corporate directory. The emails include
+// the mail, proxyAddresses and otherMailbox aliases. The entries of the former employees
+// are not filtered, so their aliases are matched to the same uids as before.
+type LDAPMatcher struct {
+	directory directory
+}
+
+// directory is the source of the directory entries: either a live LDAP server or an offline
+// export.
+type directory interface {
+	// findByEmail returns the entry with the given email or ErrNoMatches.
+	findByEmail(ctx context.Context, email string) (directoryEntry, error)
+	// findByUID returns the entry with the given uid or ErrNoMatches.
+	findByUID(ctx context.Context, uid string) (directoryEntry, error)
+	close() error
+}
+
+// directoryEntry is the person in the directory.
+type directoryEntry struct {
+	UID         string
+	DisplayName string
+	// Emails are the values of mail.
+	Emails []string
+	// Aliases are the values of proxyAddresses and otherMailbox.
+	Aliases []string
+}
+
+// ldapAttributes are the requested attributes of the directory entries.
+var ldapAttributes = []string{
+	"uid", "sAMAccountName", "displayName", "cn", "mail", "proxyAddresses", "otherMailbox"}
+
+// newDirectoryEntry extracts the entry from the attribute values mapped to lowercase names.
+// The uid falls back to sAMAccountName and the display name falls back to cn.
+func newDirectoryEntry(attrs map[string][]string) directoryEntry {
+	first := func(names ...string) string {
+		for _, name := range names {
+			if values := attrs[name]; len(values) > 0 && values[0] != "" {
+				return values[0]
+			}
+		}
+		return ""
+	}
+	entry := directoryEntry{
+		UID:         first("uid", "samaccountname"),
+		DisplayName: first("displayname", "cn"),
+	}
+	for _, email := range attrs["mail"] {
+		if email = strings.TrimSpace(email); email != "" {
+			entry.Emails = append(entry.Emails, email)
+		}
+	}
+	for _, address := range attrs["proxyaddresses"] {
+		// e.g. "SMTP:vadim@company.com" or "x500:/o=Company/ou=..."
+		parts := strings.SplitN(address, ":", 2)
+		if len(parts) == 2 && strings.EqualFold(parts[0], "smtp") {
+			entry.Aliases = append(entry.Aliases, strings.TrimSpace(parts[1]))
+		}
+	}
+	for _, email := range attrs["othermailbox"] {
+		if email = strings.TrimSpace(email); email != "" {
+			entry.Aliases = append(entry.Aliases, email)
+		}
+	}
+	return entry
+}
+
+// hasEmail checks whether the email is the entry's mail (primary) or one of the aliases.
+func (e directoryEntry) hasEmail(email string) (found bool, primary bool) {
+	for _, mail := range e.Emails {
+		if strings.EqualFold(mail, email) {
+			return true, true
+		}
+	}
+	for _, alias := range e.Aliases {
+		if strings.EqualFold(alias, email) {
+			return true, false
+		}
+	}
+	return false, false
+}
+
+// LDAPOptions are the settings of the connection to a live LDAP server.
+type LDAPOptions struct {
+	// BindDN is the DN to bind as. The bind is anonymous if it is empty.
+	BindDN string
+	// Password is the password of BindDN.
+	Password string
+	// StartTLS upgrades the ldap:// connection to TLS before the bind.
+	StartTLS bool
+	// TLSConfig configures ldaps:// and StartTLS. nil verifies the server certificate with
+	// the system authorities.
+	TLSConfig *tls.Config
+}
+
+// NewLDAPMatcher creates a new matcher given the directory location. apiURL is either an LDAP
+// URL with the optional base DN, e.g. ldaps://ldap.company.com/dc=company%2Cdc=com, or the path
+// to an offline LDIF or CSV export. The bind is anonymous: the token is not supported because
+// it would expose the password, use NewLDAPMatcherWithOptions() to bind with the credentials.
+func NewLDAPMatcher(apiURL, token string) (Matcher, error) {
+	if token != "" {
+		return LDAPMatcher{}, errors.New(
+			"the LDAP matcher does not accept a token, set the bind DN and the password in " +
+				"LDAPOptions")
+	}
+	return NewLDAPMatcherWithOptions(apiURL, LDAPOptions{})
+}
+
+// NewLDAPMatcherWithOptions creates a new matcher given the directory location, see
+// NewLDAPMatcher(), and the connection settings which apply to the live LDAP server.
+func NewLDAPMatcherWithOptions(apiURL string, options LDAPOptions) (Matcher, error) {
+	if apiURL == "" {
+		return LDAPMatcher{}, errors.New(
+			"the LDAP server URL or the path to the directory export must be specified")
+	}
+	lower := strings.ToLower(apiURL)
+	if !strings.HasPrefix(lower, "ldap://") && !strings.HasPrefix(lower, "ldaps://") {
+		dir, err := loadDirectoryExport(strings.TrimPrefix(apiURL, "file://"))
+		if err != nil {
+			return LDAPMatcher{}, err
+		}
+		return LDAPMatcher{directory: dir}, nil
+	}
+	dir, err := newLDAPDirectory(apiURL, options)
+	if err != nil {
+		return LDAPMatcher{}, err
+	}
+	return LDAPMatcher{directory: dir}, nil
+}
+
+// MatchByEmail returns the uid of the directory entry with the given email or alias.
+func (m LDAPMatcher) MatchByEmail(ctx context.Context, email string) (string, error) {
+	entry, err := m.directory.findByEmail(ctx, email)
+	if err != nil {
+		if err == ErrNoMatches {
+			logrus.Warnf("unable to find users for email: %s", email)
+		}
+		return "", err
+	}
+	return entry.UID, nil
+}
+
+// SupportsMatchingByCommit indicates whether this Matcher allows querying identities by commit metadata.
+func (m LDAPMatcher) SupportsMatchingByCommit() bool {
+	return false
+}
+
+// MatchByCommit queries the identity of a given email address in a particular commit context.
+func (m LDAPMatcher) MatchByCommit(
+	ctx context.Context, email, repo, commit string) (user string, err error) {
+	return "", errors.New("not implemented")
+}
+
+// Profile returns the display name of the directory entry with the given uid.
+// The directory does not store the rest of the profile.
+func (m LDAPMatcher) Profile(ctx context.Context, user string) (Profile, error) {
+	entry, err := m.directory.findByUID(ctx, user)
+	if err != nil {
+		return Profile{}, err
+	}
+	if entry.DisplayName == "" {
+		return Profile{}, ErrNoMatches
+	}
+	return Profile{DisplayName: entry.DisplayName}, nil
+}
+
+// OnIdle closes the connection to the LDAP server. The next query reconnects.
+func (m LDAPMatcher) OnIdle() error {
+	return m.directory.close()
+}
+
+// ldapTimeout limits dialing and each request to the LDAP server.
+const ldapTimeout = 30 * time.Second
+
+// ldapPageSize is the number of entries in each page of the search results.
+const ldapPageSize = 500
+
+// ldapDirectory queries a live LDAP server through a single connection which is established
+// lazily and shared by the concurrent queries.
+type ldapDirectory struct {
+	url     string
+	options LDAPOptions
+
+	lock   sync.Mutex
+	baseDN string
+	conn   *ldap.Conn
+}
+
+func newLDAPDirectory(apiURL string, options LDAPOptions) (*ldapDirectory, error) {
+	u, err := url.Parse(apiURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("the LDAP server host is empty: %s", apiURL)
+	}
+	if options.StartTLS && strings.EqualFold(u.Scheme, "ldaps") {
+		return nil, errors.New("StartTLS does not apply to ldaps://")
+	}
+	if options.BindDN == "" && options.Password != "" {
+		return nil, errors.New("the LDAP bind password requires the bind DN")
+	}
+	if options.TLSConfig == nil {
+		options.TLSConfig = &tls.Config{ServerName: u.Hostname()}
+	}
+	return &ldapDirectory{
+		url:     strings.ToLower(u.Scheme) + "://" + u.Host,
+		options: options,
+		baseDN:  strings.TrimPrefix(u.Path, "/"),
+	}, nil
+}
+
+func (d *ldapDirectory) findByEmail(ctx context.Context, email string) (directoryEntry, error) {
+	escaped := ldap.EscapeFilter(email)
+	entries, err := d.search(ctx, fmt.Sprintf(
+		"(|(mail=%s)(proxyAddresses=smtp:%s)(otherMailbox=%s))", escaped, escaped, escaped))
+	if err != nil {
+		return directoryEntry{}, err
+	}
+	// the mail takes precedence over the aliases, and the smallest uid wins the ties
+	var result *directoryEntry
+	resultIsPrimary := false
+	for i, entry := range entries {
+		found, primary := entry.hasEmail(email)
+		if !found || entry.UID == "" {
+			continue
+		}
+		if result == nil || primary && !resultIsPrimary ||
+			primary == resultIsPrimary && entry.UID < result.UID {
+			result = &entries[i]
+			resultIsPrimary = primary
+		}
+	}
+	if result == nil {
+		return directoryEntry{}, ErrNoMatches
+	}
+	return *result, nil
+}
+
+func (d *ldapDirectory) findByUID(ctx context.Context, uid string) (directoryEntry, error) {
+	escaped := ldap.EscapeFilter(uid)
+	entries, err := d.search(ctx, fmt.Sprintf("(|(uid=%s)(sAMAccountName=%s))", escaped, escaped))
+	if err != nil {
+		return directoryEntry{}, err
+	}
+	for _, entry := range entries {
+		if strings.EqualFold(entry.UID, uid) {
+			return entry, nil
+		}
+	}
+	return directoryEntry{}, ErrNoMatches
+}
+
+func (d *ldapDirectory) close() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.disconnect()
+}
+
+// disconnect unbinds and closes the connection. The lock must be held.
+func (d *ldapDirectory) disconnect() error {
+	if d.conn == nil {
+		return nil
+	}
+	err := d.conn.Unbind()
+	if err == ldap.ErrConnUnbound {
+		// already closed by the canceled context
+		err = nil
+	}
+	d.conn = nil
+	return err
+}
+
+// search finds the entries which satisfy the filter in the whole subtree of the base DN.
+// The results are requested in pages so that the server's size limit does not apply.
+func (d *ldapDirectory) search(ctx context.Context, filter string) ([]directoryEntry, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if ctx.Err() != nil {
+		return nil, context.Canceled
+	}
+	var entries []directoryEntry
+	err := func() error {
+		if err := d.connect(); err != nil {
+			return err
+		}
+		stop := interruptOnCancel(ctx, d.conn)
+		defer func() {
+			if stop() {
+				// the connection is closed and cannot be reused
+				d.disconnect()
+			}
+		}()
+		if d.baseDN == "" {
+			baseDN, err := d.discoverBaseDN()
+			if err != nil {
+				return err
+			}
+			d.baseDN = baseDN
+		}
+		result, err := d.conn.SearchWithPaging(ldap.NewSearchRequest(
+			d.baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+			filter, ldapAttributes, nil), ldapPageSize)
+		if err != nil {
+			return err
+		}
+		for _, entry := range result.Entries {
+			entries = append(entries, newDirectoryEntry(ldapEntryAttributes(entry)))
+		}
+		return nil
+	}()
+	if err != nil {
+		// the connection state is unknown
+		d.disconnect()
+		if ctx.Err() != nil {
+			return nil, context.Canceled
+		}
+		return nil, err
+	}
+	return entries, nil
+}
+
+// interruptOnCancel closes the connection when the context is canceled, which aborts
+// the pending requests, until the returned function is called. The function reports whether
+// the connection was closed.
+func interruptOnCancel(ctx context.Context, conn *ldap.Conn) func() bool {
+	stop := make(chan struct{})
+	closed := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+			closed <- true
+		case <-stop:
+			closed <- false
+		}
+	}()
+	return func() bool {
+		close(stop)
+		return <-closed
+	}
+}
+
+// connect dials, upgrades the connection to TLS with StartTLS if needed and binds if there is
+// no connection yet. The lock must be held.
+func (d *ldapDirectory) connect() error {
+	if d.conn != nil {
+		return nil
+	}
+	conn, err := ldap.DialURL(d.url, ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}),
+		ldap.DialWithTLSConfig(d.options.TLSConfig))
+	if err != nil {
+		return err
+	}
+	conn.SetTimeout(ldapTimeout)
+	if d.options.StartTLS {
+		if err = conn.StartTLS(d.options.TLSConfig); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	if d.options.BindDN != "" {
+		if err = conn.Bind(d.options.BindDN, d.options.Password); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	d.conn = conn
+	return nil
+}
+
+// discoverBaseDN reads the default naming context from the root DSE. The lock must be held.
+func (d *ldapDirectory) discoverBaseDN() (string, error) {
+	result, err := d.conn.Search(ldap.NewSearchRequest(
+		"", ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false, "(objectClass=*)",
+		[]string{"defaultNamingContext", "namingContexts"}, nil))
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range result.Entries {
+		attrs := ldapEntryAttributes(entry)
+		for _, name := range []string{"defaultnamingcontext", "namingcontexts"} {
+			if values := attrs[name]; len(values) > 0 {
+				logrus.Infof("LDAP base DN: %s", values[0])
+				return values[0], nil
+			}
+		}
+	}
+	return "", errors.New("failed to discover the LDAP base DN, please specify it in the URL")
+}
+
+// ldapEntryAttributes maps the lowercase attribute names to the values.
+func ldapEntryAttributes(entry *ldap.Entry) map[string][]string {
+	attrs := map[string][]string{}
+	for _, attr := range entry.Attributes {
+		name := strings.ToLower(attr.Name)
+		attrs[name] = append(attrs[name], attr.Values...)
+	}
+	return attrs
+}
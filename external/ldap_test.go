@@ -0,0 +1,403 @@
+package external
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func testLDAPMatcher(t *testing.T, matcher Matcher) {
+	req := require.New(t)
+	ctx := context.Background()
+	req.False(matcher.SupportsMatchingByCommit())
+	for email, uid := range map[string]string{
+		"vadim@company.com":       "vadim",
+		"VMarkovtsev@company.com": "vadim",
+		"vadim@sourced.tech":      "vadim",
+		"vadim@old-company.com":   "vadim",
+		"bob@company.com":         "bsmith",
+	} {
+		user, err := matcher.MatchByEmail(ctx, email)
+		req.NoError(err, email)
+		req.Equal(uid, user, email)
+	}
+	for _, email := range []string{"vadim@gmail.com", "/o=Company/ou=Exchange/cn=vadim"} {
+		_, err := matcher.MatchByEmail(ctx, email)
+		req.Equal(ErrNoMatches, err, email)
+	}
+	profile, err := matcher.(Profiler).Profile(ctx, "vadim")
+	req.NoError(err)
+	req.Equal(Profile{DisplayName: "Vadim Markovtsev"}, profile)
+	profile, err = matcher.(Profiler).Profile(ctx, "bsmith")
+	req.NoError(err)
+	req.Equal(Profile{DisplayName: "Bob Smith"}, profile)
+	_, err = matcher.(Profiler).Profile(ctx, "alice")
+	req.Equal(ErrNoMatches, err)
+	req.NoError(matcher.OnIdle())
+}
+
+func TestLDAPMatcherLDIF(t *testing.T) {
+	matcher, err := NewLDAPMatcher("testdata/ldap/directory.ldif", "")
+	require.NoError(t, err)
+	testLDAPMatcher(t, matcher)
+	user, err := matcher.MatchByEmail(context.Background(), "mcuadros@gmail.com")
+	require.NoError(t, err)
+	require.Equal(t, "maximo", user)
+	profile, err := matcher.(Profiler).Profile(context.Background(), "maximo")
+	require.NoError(t, err)
+	require.Equal(t, "Máximo Cuadros", profile.DisplayName)
+	_, err = matcher.MatchByEmail(context.Background(), "printer@company.com")
+	require.Equal(t, ErrNoMatches, err)
+}
+
+func TestLDAPMatcherCSV(t *testing.T) {
+	matcher, err := NewLDAPMatcher("file://testdata/ldap/directory.csv", "")
+	require.NoError(t, err)
+	testLDAPMatcher(t, matcher)
+}
+
+func TestNewLDAPMatcherErrors(t *testing.T) {
+	_, err := NewLDAPMatcher("", "")
+	require.Error(t, err)
+	_, err = NewLDAPMatcher("testdata/ldap/missing.ldif", "")
+	require.Error(t, err)
+	_, err = NewLDAPMatcher("testdata/gitea/users.json", "")
+	require.Error(t, err)
+	_, err = NewLDAPMatcher("ldap://ldap.company.com", "cn=admin,dc=company,dc=com:secret")
+	require.Error(t, err)
+	_, err = NewLDAPMatcher("ldaps:///dc=company%2Cdc=com", "")
+	require.Error(t, err)
+	_, err = NewLDAPMatcherWithOptions("ldaps://ldap.company.com", LDAPOptions{StartTLS: true})
+	require.Error(t, err)
+	_, err = NewLDAPMatcherWithOptions("ldap://ldap.company.com", LDAPOptions{Password: "secret"})
+	require.Error(t, err)
+}
+
+func TestReadLDIF(t *testing.T) {
+	entries, err := readLDIF(strings.NewReader("dn: uid=a,dc=com\nmail;lang-en: a@company.com\n" +
+		"jpegPhoto:< file:///tmp/a.jpg\n\n\n# comment\ndn: uid=b,dc=com\r\nuid: b\r\n"))
+	require.NoError(t, err)
+	require.Equal(t, []map[string][]string{
+		{"dn": {"uid=a,dc=com"}, "mail": {"a@company.com"}},
+		{"dn": {"uid=b,dc=com"}, "uid": {"b"}},
+	}, entries)
+	_, err = readLDIF(strings.NewReader("dn: uid=a,dc=com\nmail\n"))
+	require.Error(t, err)
+	_, err = readLDIF(strings.NewReader("dn: uid=a,dc=com\nmail:: !!!\n"))
+	require.Error(t, err)
+}
+
+// testLDAPServer serves the search requests from the offline directory index. The results are
+// paged by one entry.
+type testLDAPServer struct {
+	listener  net.Listener
+	entries   []map[string][]string
+	password  string
+	tlsConfig *tls.Config
+	binds     int
+	pages     int
+	lock      sync.Mutex
+}
+
+func newTestLDAPServer(t *testing.T, password string) *testLDAPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	entries, err := readLDIF(strings.NewReader(ldifFixture(t)))
+	require.NoError(t, err)
+	for _, attrs := range entries {
+		for name, values := range attrs {
+			if name == "displayname" {
+				// the live server returns the original attribute names
+				delete(attrs, name)
+				attrs["displayName"] = values
+			}
+		}
+	}
+	// borrow the self-signed certificate of httptest for StartTLS
+	tlsServer := httptest.NewTLSServer(nil)
+	tlsServer.Close()
+	server := &testLDAPServer{listener: listener, entries: entries, password: password,
+		tlsConfig: tlsServer.TLS}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+// clientTLSConfig trusts the certificate of the server.
+func (s *testLDAPServer) clientTLSConfig() *tls.Config {
+	cert, err := x509.ParseCertificate(s.tlsConfig.Certificates[0].Certificate[0])
+	if err != nil {
+		panic(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &tls.Config{RootCAs: pool, ServerName: "example.com"}
+}
+
+// ldifFixture converts the offline directory to the LDIF without the clashing aliases.
+func ldifFixture(t *testing.T) string {
+	matcher, err := NewLDAPMatcher("testdata/ldap/directory.ldif", "")
+	require.NoError(t, err)
+	index := matcher.(LDAPMatcher).directory.(*directoryIndex)
+	emails := map[string][]string{}
+	for email, entry := range index.byEmail {
+		if index.primary[email] {
+			emails[entry.UID] = append(emails[entry.UID], "mail: "+email)
+		} else {
+			emails[entry.UID] = append(emails[entry.UID], "proxyAddresses: smtp:"+email)
+		}
+	}
+	var lines []string
+	for _, entry := range index.byUID {
+		lines = append(lines, "dn: uid="+entry.UID+",dc=company,dc=com", "uid: "+entry.UID,
+			"displayName: "+entry.DisplayName)
+		lines = append(lines, emails[entry.UID]...)
+		lines = append(lines, "")
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (s *testLDAPServer) serve(conn net.Conn) {
+	defer func() { conn.Close() }()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		id := packet.Children[0].Value.(int64)
+		request := packet.Children[1]
+		switch request.Tag {
+		case ldap.ApplicationExtendedRequest:
+			// StartTLS
+			s.respond(conn, id, ldap.ApplicationExtendedResponse, 0, nil)
+			conn = tls.Server(conn, s.tlsConfig)
+		case ldap.ApplicationBindRequest:
+			s.lock.Lock()
+			s.binds++
+			s.lock.Unlock()
+			code := int64(0)
+			if ber.DecodeString(request.Children[2].Data.Bytes()) != s.password {
+				code = ldap.LDAPResultInvalidCredentials
+			}
+			s.respond(conn, id, ldap.ApplicationBindResponse, code, nil)
+		case ldap.ApplicationSearchRequest:
+			base := ber.DecodeString(request.Children[0].Data.Bytes())
+			if base == "" {
+				s.respondEntry(conn, id, map[string][]string{
+					"defaultNamingContext": {"dc=company,dc=com"}})
+				s.respond(conn, id, ldap.ApplicationSearchResultDone, 0, nil)
+				continue
+			}
+			var found []map[string][]string
+			for _, attrs := range s.entries {
+				if testLDAPFilterMatches(request.Children[6], attrs) {
+					found = append(found, attrs)
+				}
+			}
+			offset := 0
+			var paging *ldap.ControlPaging
+			if len(packet.Children) > 2 {
+				control, err := ldap.DecodeControl(packet.Children[2].Children[0])
+				if err != nil {
+					return
+				}
+				paging = control.(*ldap.ControlPaging)
+				offset, _ = strconv.Atoi(string(paging.Cookie))
+			}
+			if paging != nil && offset < len(found) {
+				s.lock.Lock()
+				s.pages++
+				s.lock.Unlock()
+				s.respondEntry(conn, id, found[offset])
+				paging.SetCookie(nil)
+				if offset+1 < len(found) {
+					paging.SetCookie([]byte(strconv.Itoa(offset + 1)))
+				}
+			} else {
+				for _, attrs := range found {
+					s.respondEntry(conn, id, attrs)
+				}
+			}
+			var controls []ldap.Control
+			if paging != nil {
+				controls = append(controls, paging)
+			}
+			s.respond(conn, id, ldap.ApplicationSearchResultDone, 0, controls)
+		case ldap.ApplicationUnbindRequest:
+			return
+		}
+	}
+}
+
+func testLDAPFilterMatches(filter *ber.Packet, attrs map[string][]string) bool {
+	for _, equality := range filter.Children {
+		name := strings.ToLower(ber.DecodeString(equality.Children[0].Data.Bytes()))
+		value := ber.DecodeString(equality.Children[1].Data.Bytes())
+		for attr, values := range attrs {
+			if strings.ToLower(attr) != name {
+				continue
+			}
+			for _, v := range values {
+				if strings.EqualFold(v, value) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func (s *testLDAPServer) respond(conn net.Conn, id int64, tag ber.Tag, code int64,
+	controls []ldap.Control) {
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive,
+		ber.TagEnumerated, code, "Code"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive,
+		ber.TagOctetString, "", "Matched DN"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive,
+		ber.TagOctetString, "test", "Message"))
+	message := testLDAPEnvelope(id, result)
+	if len(controls) > 0 {
+		encoded := ber.Encode(ber.ClassContext, ber.TypeConstructed, 0, nil, "Controls")
+		for _, control := range controls {
+			encoded.AppendChild(control.Encode())
+		}
+		message.AppendChild(encoded)
+	}
+	conn.Write(message.Bytes())
+}
+
+func (s *testLDAPServer) respondEntry(conn net.Conn, id int64, attrs map[string][]string) {
+	entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed,
+		ldap.ApplicationSearchResultEntry, nil, "Entry")
+	entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive,
+		ber.TagOctetString, "", "DN"))
+	list := ber.NewSequence("Attributes")
+	for name, values := range attrs {
+		attr := ber.NewSequence("Attribute")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive,
+			ber.TagOctetString, name, "Name"))
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+		for _, value := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive,
+				ber.TagOctetString, value, "Value"))
+		}
+		attr.AppendChild(set)
+		list.AppendChild(attr)
+	}
+	entry.AppendChild(list)
+	conn.Write(testLDAPEnvelope(id, entry).Bytes())
+}
+
+// testLDAPEnvelope wraps the protocol operation in an LDAPMessage.
+func testLDAPEnvelope(messageID int64, operation *ber.Packet) *ber.Packet {
+	message := ber.NewSequence("LDAP Message")
+	message.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger,
+		messageID, "Message ID"))
+	message.AppendChild(operation)
+	return message
+}
+
+func TestLDAPMatcherLive(t *testing.T) {
+	server := newTestLDAPServer(t, "secret")
+	defer server.listener.Close()
+	address := "ldap://" + server.listener.Addr().String()
+	matcher, err := NewLDAPMatcherWithOptions(address, LDAPOptions{
+		BindDN: "cn=admin,dc=company,dc=com", Password: "secret"})
+	require.NoError(t, err)
+	testLDAPMatcher(t, matcher)
+	require.Equal(t, "dc=company,dc=com",
+		matcher.(LDAPMatcher).directory.(*ldapDirectory).baseDN)
+	// OnIdle() disconnected, so the next query binds again
+	_, err = matcher.MatchByEmail(context.Background(), "vadim@company.com")
+	require.NoError(t, err)
+	server.lock.Lock()
+	require.Equal(t, 2, server.binds)
+	require.NotZero(t, server.pages)
+	server.lock.Unlock()
+
+	matcher, err = NewLDAPMatcherWithOptions(address+"/dc=company%2Cdc=com", LDAPOptions{
+		BindDN: "cn=admin,dc=company,dc=com", Password: "wrong"})
+	require.NoError(t, err)
+	require.Equal(t, "dc=company,dc=com",
+		matcher.(LDAPMatcher).directory.(*ldapDirectory).baseDN)
+	_, err = matcher.MatchByEmail(context.Background(), "vadim@company.com")
+	require.Error(t, err)
+	require.NotEqual(t, ErrNoMatches, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = matcher.MatchByEmail(ctx, "vadim@company.com")
+	require.Equal(t, context.Canceled, err)
+}
+
+func TestLDAPMatcherStartTLS(t *testing.T) {
+	server := newTestLDAPServer(t, "")
+	defer server.listener.Close()
+	matcher, err := NewLDAPMatcherWithOptions("ldap://"+server.listener.Addr().String(),
+		LDAPOptions{StartTLS: true, TLSConfig: server.clientTLSConfig()})
+	require.NoError(t, err)
+	user, err := matcher.MatchByEmail(context.Background(), "bob@company.com")
+	require.NoError(t, err)
+	require.Equal(t, "bsmith", user)
+	require.NoError(t, matcher.OnIdle())
+	// anonymous
+	server.lock.Lock()
+	require.Equal(t, 0, server.binds)
+	server.lock.Unlock()
+
+	// the certificate is not trusted
+	matcher, err = NewLDAPMatcherWithOptions("ldap://"+server.listener.Addr().String(),
+		LDAPOptions{StartTLS: true})
+	require.NoError(t, err)
+	_, err = matcher.MatchByEmail(context.Background(), "bob@company.com")
+	require.Error(t, err)
+}
+
+func TestLDAPMatcherCancelInFlight(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	received := make(chan struct{}, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// never respond
+		for {
+			if _, err := ber.ReadPacket(conn); err != nil {
+				return
+			}
+			received <- struct{}{}
+		}
+	}()
+	matcher, err := NewLDAPMatcher("ldap://"+listener.Addr().String()+"/dc=company%2Cdc=com", "")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-received
+		cancel()
+	}()
+	_, err = matcher.MatchByEmail(ctx, "vadim@company.com")
+	require.Equal(t, context.Canceled, err)
+	require.NoError(t, matcher.OnIdle())
+}
@@ -0,0 +1,219 @@
+package external
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// directoryIndex is the offline directory loaded from an export.
+type directoryIndex struct {
+	byEmail map[string]*directoryEntry
+	byUID   map[string]*directoryEntry
+	// primary marks the emails which are the mail of the entry and not the aliases.
+	primary map[string]bool
+}
+
+func newDirectoryIndex() *directoryIndex {
+	return &directoryIndex{
+		byEmail: map[string]*directoryEntry{},
+		byUID:   map[string]*directoryEntry{},
+		primary: map[string]bool{},
+	}
+}
+
+// add indexes the entry. The entries with the same uid, e.g. the archived accounts of
+// the former employees, are merged. The mail takes precedence over the aliases when
+// the entries clash.
+func (d *directoryIndex) add(entry directoryEntry) {
+	if entry.UID == "" {
+		logrus.Warnf("skipped a directory entry without uid: %v", entry.Emails)
+		return
+	}
+	uid := strings.ToLower(entry.UID)
+	existing := d.byUID[uid]
+	if existing == nil {
+		existing = &directoryEntry{UID: entry.UID}
+		d.byUID[uid] = existing
+	}
+	if existing.DisplayName == "" {
+		existing.DisplayName = entry.DisplayName
+	}
+	existing.Emails = append(existing.Emails, entry.Emails...)
+	existing.Aliases = append(existing.Aliases, entry.Aliases...)
+	for _, email := range entry.Emails {
+		email = strings.ToLower(email)
+		if other := d.byEmail[email]; other != nil && other != existing && d.primary[email] {
+			logrus.Warnf("%s belongs to both %s and %s", email, other.UID, existing.UID)
+			continue
+		}
+		d.byEmail[email] = existing
+		d.primary[email] = true
+	}
+	for _, email := range entry.Aliases {
+		email = strings.ToLower(email)
+		if other := d.byEmail[email]; other != nil && other != existing {
+			logrus.Warnf("%s belongs to both %s and %s", email, other.UID, existing.UID)
+			continue
+		}
+		d.byEmail[email] = existing
+	}
+}
+
+func (d *directoryIndex) findByEmail(ctx context.Context, email string) (directoryEntry, error) {
+	if entry := d.byEmail[strings.ToLower(email)]; entry != nil {
+		return *entry, nil
+	}
+	return directoryEntry{}, ErrNoMatches
+}
+
+func (d *directoryIndex) findByUID(ctx context.Context, uid string) (directoryEntry, error) {
+	if entry := d.byUID[strings.ToLower(uid)]; entry != nil {
+		return *entry, nil
+	}
+	return directoryEntry{}, ErrNoMatches
+}
+
+func (d *directoryIndex) close() error {
+	return nil
+}
+
+// loadDirectoryExport reads the directory from an LDIF or CSV file depending on
+// the extension.
+func loadDirectoryExport(path string) (*directoryIndex, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var entries []map[string][]string
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".ldif":
+		entries, err = readLDIF(file)
+	case ".csv":
+		entries, err = readDirectoryCSV(file)
+	default:
+		return nil, fmt.Errorf("unsupported directory export format %s, must be .ldif or .csv", ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	index := newDirectoryIndex()
+	for _, attrs := range entries {
+		index.add(newDirectoryEntry(attrs))
+	}
+	logrus.Infof("loaded %d directory users from %s", len(index.byUID), path)
+	return index, nil
+}
+
+// readLDIF parses the LDIF content records and maps the lowercase attribute names to the values.
+// https://tools.ietf.org/html/rfc2849
+func readLDIF(input io.Reader) ([]map[string][]string, error) {
+	var entries []map[string][]string
+	var lines []string
+	flush := func() error {
+		if len(lines) == 0 {
+			return nil
+		}
+		attrs := map[string][]string{}
+		for _, line := range lines {
+			pos := strings.Index(line, ":")
+			if pos <= 0 {
+				return fmt.Errorf("invalid LDIF line: %s", line)
+			}
+			// strip the options such as ";lang-en" or ";binary"
+			name := strings.ToLower(strings.SplitN(line[:pos], ";", 2)[0])
+			value := line[pos+1:]
+			switch {
+			case strings.HasPrefix(value, ":"):
+				decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value[1:]))
+				if err != nil {
+					return fmt.Errorf("invalid base64 value of %s: %v", name, err)
+				}
+				value = string(decoded)
+			case strings.HasPrefix(value, "<"):
+				// URL references are not supported
+				continue
+			default:
+				value = strings.TrimLeft(value, " ")
+			}
+			attrs[name] = append(attrs[name], value)
+		}
+		lines = lines[:0]
+		if _, isEntry := attrs["dn"]; isEntry {
+			entries = append(entries, attrs)
+		}
+		return nil
+	}
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		switch {
+		case line == "":
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		case strings.HasPrefix(line, "#"):
+		case strings.HasPrefix(line, " "):
+			// continuation of the previous line
+			if len(lines) > 0 {
+				lines[len(lines)-1] += line[1:]
+			}
+		default:
+			lines = append(lines, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// readDirectoryCSV parses the CSV export with the header, e.g. produced by csvde.
+// The column names are the attribute names and the multiple values are separated by ";".
+func readDirectoryCSV(input io.Reader) ([]map[string][]string, error) {
+	reader := csv.NewReader(input)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	for i, name := range header {
+		header[i] = strings.ToLower(strings.TrimSpace(name))
+	}
+	var entries []map[string][]string
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		attrs := map[string][]string{}
+		for i, field := range record {
+			if i >= len(header) || field == "" {
+				continue
+			}
+			for _, value := range strings.Split(field, ";") {
+				if value = strings.TrimSpace(value); value != "" {
+					attrs[header[i]] = append(attrs[header[i]], value)
+				}
+			}
+		}
+		entries = append(entries, attrs)
+	}
+	return entries, nil
+}
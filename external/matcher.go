@@ -3,6 +3,8 @@ package external
 import (
 	"context"
 	"errors"
+	"io"
+	"time"
 )
 
 // Matcher defines the external matching service API, either by email or by commit.
@@ -17,6 +19,56 @@ type Matcher interface {
 	OnIdle() error
 }
 
+// Profile is the public information about a user of the external service.
+// Any field may be empty.
+type Profile struct {
+	DisplayName string
+	AvatarURL   string
+	ProfileURL  string
+	CreatedAt   time.Time
+}
+
+// Profiler is implemented by the matchers which know the profiles of their users, e.g.
+// the full names in the corporate directory.
+type Profiler interface {
+	// Profile returns the profile of the user returned by the Matcher.
+	Profile(ctx context.Context, user string) (Profile, error)
+}
+
+// ProviderMatcher is implemented by the matchers which query several providers, e.g.
+// CompositeMatcher. The users of different providers may clash, so the provider which found
+// the user is returned separately.
+type ProviderMatcher interface {
+	// MatchByEmailWithProvider is Matcher.MatchByEmail which also returns the provider.
+	MatchByEmailWithProvider(ctx context.Context, email string) (provider string, user string,
+		err error)
+	// MatchByCommitWithProvider is Matcher.MatchByCommit which also returns the provider.
+	MatchByCommitWithProvider(ctx context.Context, email, repo, commit string) (provider string,
+		user string, err error)
+}
+
+// ProviderProfiler is implemented by the Profiler-s which query several providers.
+type ProviderProfiler interface {
+	// ProfileWithProvider returns the profile of the user returned by the given provider.
+	ProfileWithProvider(ctx context.Context, provider, user string) (Profile, error)
+}
+
+// profile forwards to the matcher if it is a Profiler and returns ErrNoMatches otherwise.
+func profile(ctx context.Context, matcher Matcher, user string) (Profile, error) {
+	if profiler, ok := matcher.(Profiler); ok {
+		return profiler.Profile(ctx, user)
+	}
+	return Profile{}, ErrNoMatches
+}
+
+// closeMatcher closes the matcher if it implements io.Closer.
+func closeMatcher(matcher Matcher) error {
+	if closer, ok := matcher.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
 // MatcherConstructor is the Matcher constructor function type.
 type MatcherConstructor func(apiURL, token string) (Matcher, error)
 
@@ -28,4 +80,20 @@ var Matchers = map[string]MatcherConstructor{
 	"github":    NewGitHubMatcher,
 	"gitlab":    NewGitLabMatcher,
 	"bitbucket": NewBitBucketMatcher,
+	"gitea":     NewGiteaMatcher,
+	"gerrit":    NewGerritMatcher,
+	"ldap":      NewLDAPMatcher,
+	"webhook":   NewWebhookMatcher,
+}
+
+// TokenPoolMatcherConstructor is the constructor function type of the matchers which rotate
+// several API tokens.
+type TokenPoolMatcherConstructor func(apiURL string, tokens *TokenPool) (Matcher, error)
+
+// TokenPoolMatchers is the registered constructors of the matchers which support TokenPool
+// mapped to shorthands.
+var TokenPoolMatchers = map[string]TokenPoolMatcherConstructor{
+	"github":    NewGitHubMatcherWithTokens,
+	"gitlab":    NewGitLabMatcherWithTokens,
+	"bitbucket": NewBitBucketMatcherWithTokens,
 }
@@ -0,0 +1,139 @@
+package external
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RateLimiter spaces the requests to an external API evenly in time.
+// It is safe for concurrent use.
+type RateLimiter struct {
+	interval time.Duration
+	lock     sync.Mutex
+	next     time.Time
+}
+
+// NewRateLimiter creates a new RateLimiter which allows the given number of requests per second.
+// A non-positive rate means no limit.
+func NewRateLimiter(requestsPerSecond float64) *RateLimiter {
+	limiter := &RateLimiter{}
+	if requestsPerSecond > 0 {
+		limiter.interval = time.Duration(float64(time.Second) / requestsPerSecond)
+	}
+	return limiter
+}
+
+// Wait blocks until the next request is allowed or the context is canceled.
+func (l *RateLimiter) Wait(ctx context.Context) error {
+	if l.interval == 0 {
+		return ctx.Err()
+	}
+	l.lock.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.lock.Unlock()
+	if delay == 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+var sharedRateLimiters = struct {
+	sync.Mutex
+	limiters map[string]*RateLimiter
+}{limiters: map[string]*RateLimiter{}}
+
+// SharedRateLimiter returns the RateLimiter of the given provider, e.g. "github".
+// The limiter is created with the given rate on the first call; the subsequent calls
+// return the same instance so that all the matchers of one provider share the quota.
+func SharedRateLimiter(provider string, requestsPerSecond float64) *RateLimiter {
+	sharedRateLimiters.Lock()
+	defer sharedRateLimiters.Unlock()
+	limiter, exists := sharedRateLimiters.limiters[provider]
+	if !exists {
+		limiter = NewRateLimiter(requestsPerSecond)
+		sharedRateLimiters.limiters[provider] = limiter
+	}
+	return limiter
+}
+
+// RateLimitedMatcher is a wrapper around Matcher which waits for the RateLimiter before
+// each query.
+type RateLimitedMatcher struct {
+	matcher Matcher
+	limiter *RateLimiter
+}
+
+// NewRateLimitedMatcher creates a new matcher which limits the query rate of the given one.
+func NewRateLimitedMatcher(matcher Matcher, limiter *RateLimiter) *RateLimitedMatcher {
+	return &RateLimitedMatcher{matcher: matcher, limiter: limiter}
+}
+
+// MatchByEmail waits for the rate limiter and forwards to the underlying Matcher.
+func (m *RateLimitedMatcher) MatchByEmail(ctx context.Context, email string) (string, error) {
+	if err := m.limiter.Wait(ctx); err != nil {
+		return "", err
+	}
+	return m.matcher.MatchByEmail(ctx, email)
+}
+
+// SupportsMatchingByCommit acts the same as the underlying Matcher.
+func (m *RateLimitedMatcher) SupportsMatchingByCommit() bool {
+	return m.matcher.SupportsMatchingByCommit()
+}
+
+// MatchByCommit waits for the rate limiter and forwards to the underlying Matcher.
+func (m *RateLimitedMatcher) MatchByCommit(
+	ctx context.Context, email, repo, commit string) (string, error) {
+	if err := m.limiter.Wait(ctx); err != nil {
+		return "", err
+	}
+	return m.matcher.MatchByCommit(ctx, email, repo, commit)
+}
+
+// MatchByCommits waits for the rate limiter once and forwards the whole batch to
+// the underlying Matcher if it is a BatchMatcher. Otherwise, it waits before each query.
+func (m *RateLimitedMatcher) MatchByCommits(ctx context.Context, queries []CommitQuery) (
+	[]CommitMatch, error) {
+	if batcher, ok := m.matcher.(BatchMatcher); ok {
+		if err := m.limiter.Wait(ctx); err != nil {
+			return nil, err
+		}
+		return batcher.MatchByCommits(ctx, queries)
+	}
+	return matchByCommitsOneByOne(ctx, m, queries)
+}
+
+// Profile waits for the rate limiter and forwards to the underlying Matcher if it is
+// a Profiler.
+func (m *RateLimitedMatcher) Profile(ctx context.Context, user string) (Profile, error) {
+	if _, ok := m.matcher.(Profiler); !ok {
+		return Profile{}, ErrNoMatches
+	}
+	if err := m.limiter.Wait(ctx); err != nil {
+		return Profile{}, err
+	}
+	return profile(ctx, m.matcher, user)
+}
+
+// OnIdle forwards to the underlying Matcher.
+func (m *RateLimitedMatcher) OnIdle() error {
+	return m.matcher.OnIdle()
+}
+
+// Close closes the underlying Matcher if it implements io.Closer.
+func (m *RateLimitedMatcher) Close() error {
+	return closeMatcher(m.matcher)
+}
@@ -0,0 +1,91 @@
+package external
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiterWait(t *testing.T) {
+	req := require.New(t)
+	limiter := NewRateLimiter(100)
+	ctx := context.Background()
+	start := time.Now()
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req.NoError(limiter.Wait(ctx))
+			req.NoError(limiter.Wait(ctx))
+		}()
+	}
+	wg.Wait()
+	// the first request is immediate, the other 7 are spaced by 10ms
+	req.True(time.Since(start) >= 70*time.Millisecond)
+}
+
+func TestRateLimiterUnlimited(t *testing.T) {
+	limiter := NewRateLimiter(0)
+	for i := 0; i < 1000; i++ {
+		require.NoError(t, limiter.Wait(context.Background()))
+	}
+}
+
+func TestRateLimiterCanceled(t *testing.T) {
+	req := require.New(t)
+	limiter := NewRateLimiter(0.001)
+	ctx, cancel := context.WithCancel(context.Background())
+	req.NoError(limiter.Wait(ctx))
+	cancel()
+	req.Equal(context.Canceled, limiter.Wait(ctx))
+}
+
+func TestSharedRateLimiter(t *testing.T) {
+	limiter := SharedRateLimiter("test", 10)
+	require.True(t, limiter == SharedRateLimiter("test", 20))
+	require.False(t, limiter == SharedRateLimiter("test2", 10))
+	require.Equal(t, 100*time.Millisecond, limiter.interval)
+}
+
+// testStaticMatcher matches every email with the same user.
+type testStaticMatcher struct {
+	user string
+}
+
+func (m testStaticMatcher) MatchByEmail(ctx context.Context, email string) (string, error) {
+	return m.user, nil
+}
+
+func (m testStaticMatcher) SupportsMatchingByCommit() bool {
+	return true
+}
+
+func (m testStaticMatcher) MatchByCommit(
+	ctx context.Context, email, repo, commit string) (string, error) {
+	return m.user, nil
+}
+
+func (m testStaticMatcher) OnIdle() error {
+	return nil
+}
+
+func TestRateLimitedMatcher(t *testing.T) {
+	req := require.New(t)
+	matcher := NewRateLimitedMatcher(testStaticMatcher{"new_user"}, NewRateLimiter(0))
+	req.True(matcher.SupportsMatchingByCommit())
+	user, err := matcher.MatchByEmail(context.Background(), "new@gmail.com")
+	req.NoError(err)
+	req.Equal("new_user", user)
+	user, err = matcher.MatchByCommit(context.Background(), "new@gmail.com", "repo", "commit")
+	req.NoError(err)
+	req.Equal("new_user", user)
+	req.NoError(matcher.OnIdle())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = matcher.MatchByEmail(ctx, "new@gmail.com")
+	req.Equal(context.Canceled, err)
+}
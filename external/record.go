@@ -0,0 +1,261 @@
+package external
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ErrNotRecorded is returned by ReplayMatcher for the queries which are absent in the fixture.
+var ErrNotRecorded = errors.New("the query was not recorded")
+
+const (
+	recordedEmail   = "email"
+	recordedCommit  = "commit"
+	recordedProfile = "profile"
+)
+
+// recordedCall is a query to the Matcher and its result in the fixture file. User is
+// the result of the matches and the argument of the profiles.
+type recordedCall struct {
+	Method  string   `json:"method"`
+	Email   string   `json:"email,omitempty"`
+	Repo    string   `json:"repo,omitempty"`
+	Commit  string   `json:"commit,omitempty"`
+	User    string   `json:"user,omitempty"`
+	Profile *Profile `json:"profile,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// key identifies the query regardless of its result.
+func (c recordedCall) key() string {
+	if c.Method == recordedProfile {
+		return c.Method + "\x00" + c.User
+	}
+	return c.Method + "\x00" + c.Email + "\x00" + c.Repo + "\x00" + c.Commit
+}
+
+// err returns the recorded error. ErrNoMatches is restored as is, the rest are only
+// the messages.
+func (c recordedCall) err() error {
+	switch c.Error {
+	case "":
+		return nil
+	case ErrNoMatches.Error():
+		return ErrNoMatches
+	default:
+		return errors.New(c.Error)
+	}
+}
+
+// recordedFixture is the contents of the fixture file.
+type recordedFixture struct {
+	// Commits is the result of SupportsMatchingByCommit().
+	Commits bool           `json:"commits"`
+	Calls   []recordedCall `json:"calls"`
+}
+
+// readFixture reads the recorded calls mapped by their keys.
+func readFixture(path string) (bool, map[string]recordedCall, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false, nil, err
+	}
+	var fixture recordedFixture
+	if err = json.Unmarshal(data, &fixture); err != nil {
+		return false, nil, fmt.Errorf("invalid fixture %s: %v", path, err)
+	}
+	calls := make(map[string]recordedCall, len(fixture.Calls))
+	for _, call := range fixture.Calls {
+		calls[call.key()] = call
+	}
+	return fixture.Commits, calls, nil
+}
+
+// RecordingMatcher is a wrapper around Matcher which saves the queries and their results to
+// a fixture file for ReplayMatcher. The file is written in OnIdle() and Close().
+type RecordingMatcher struct {
+	matcher Matcher
+	path    string
+	calls   map[string]recordedCall
+	lock    sync.Mutex
+}
+
+// NewRecordingMatcher creates a new RecordingMatcher which writes to the given path. The calls
+// which are already recorded in the file are kept.
+func NewRecordingMatcher(matcher Matcher, path string) (*RecordingMatcher, error) {
+	recorder := &RecordingMatcher{matcher: matcher, path: path, calls: map[string]recordedCall{}}
+	if PathExists(path) {
+		var err error
+		if _, recorder.calls, err = readFixture(path); err != nil {
+			return nil, err
+		}
+	}
+	return recorder, nil
+}
+
+// record remembers the result of the call. The canceled queries are not recorded.
+func (m *RecordingMatcher) record(call recordedCall, err error) {
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return
+	}
+	if err != nil {
+		call.Error = err.Error()
+	}
+	m.lock.Lock()
+	m.calls[call.key()] = call
+	m.lock.Unlock()
+}
+
+// MatchByEmail forwards to the underlying Matcher and records the result.
+func (m *RecordingMatcher) MatchByEmail(ctx context.Context, email string) (string, error) {
+	user, err := m.matcher.MatchByEmail(ctx, email)
+	m.record(recordedCall{Method: recordedEmail, Email: email, User: user}, err)
+	return user, err
+}
+
+// SupportsMatchingByCommit acts the same as the underlying Matcher.
+func (m *RecordingMatcher) SupportsMatchingByCommit() bool {
+	return m.matcher.SupportsMatchingByCommit()
+}
+
+// MatchByCommit forwards to the underlying Matcher and records the result.
+func (m *RecordingMatcher) MatchByCommit(
+	ctx context.Context, email, repo, commit string) (string, error) {
+	user, err := m.matcher.MatchByCommit(ctx, email, repo, commit)
+	m.record(recordedCall{
+		Method: recordedCommit, Email: email, Repo: repo, Commit: commit, User: user}, err)
+	return user, err
+}
+
+// MatchByCommits forwards to the underlying Matcher in a single batch if it is a BatchMatcher
+// and records the results one by one.
+func (m *RecordingMatcher) MatchByCommits(ctx context.Context, queries []CommitQuery) (
+	[]CommitMatch, error) {
+	matches, err := matchByCommits(ctx, m.matcher, queries)
+	if err != nil {
+		return nil, err
+	}
+	for i, query := range queries {
+		m.record(recordedCall{Method: recordedCommit, Email: query.Email, Repo: query.Repo,
+			Commit: query.Commit, User: matches[i].User}, matches[i].Err)
+	}
+	return matches, nil
+}
+
+// Profile forwards to the underlying Matcher if it is a Profiler and records the result.
+func (m *RecordingMatcher) Profile(ctx context.Context, user string) (Profile, error) {
+	p, err := profile(ctx, m.matcher, user)
+	call := recordedCall{Method: recordedProfile, User: user}
+	if err == nil {
+		call.Profile = &p
+	}
+	m.record(call, err)
+	return p, err
+}
+
+// OnIdle forwards to the underlying Matcher and writes the fixture file.
+func (m *RecordingMatcher) OnIdle() error {
+	err := m.matcher.OnIdle()
+	if saveErr := m.save(); err == nil {
+		err = saveErr
+	}
+	return err
+}
+
+// Close writes the fixture file and closes the underlying Matcher if it is io.Closer.
+func (m *RecordingMatcher) Close() error {
+	err := m.save()
+	if closeErr := closeMatcher(m.matcher); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// save writes all the recorded calls sorted by their keys, so that the fixture diffs well.
+func (m *RecordingMatcher) save() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	fixture := recordedFixture{
+		Commits: m.matcher.SupportsMatchingByCommit(),
+		Calls:   make([]recordedCall, 0, len(m.calls)),
+	}
+	for _, call := range m.calls {
+		fixture.Calls = append(fixture.Calls, call)
+	}
+	sort.Slice(fixture.Calls, func(i, j int) bool {
+		return fixture.Calls[i].key() < fixture.Calls[j].key()
+	})
+	data, err := json.MarshalIndent(fixture, "", "  ")
+	if err != nil {
+		return err
+	}
+	logrus.Infof("writing %d recorded external queries to %s", len(fixture.Calls), m.path)
+	return ioutil.WriteFile(m.path, append(data, '\n'), 0666)
+}
+
+// ReplayMatcher serves the queries recorded by RecordingMatcher without the network.
+// The queries which were not recorded fail with ErrNotRecorded.
+type ReplayMatcher struct {
+	commits bool
+	calls   map[string]recordedCall
+}
+
+// NewReplayMatcher creates a new ReplayMatcher from the fixture file.
+func NewReplayMatcher(path string) (*ReplayMatcher, error) {
+	commits, calls, err := readFixture(path)
+	if err != nil {
+		return nil, err
+	}
+	return &ReplayMatcher{commits: commits, calls: calls}, nil
+}
+
+// replay returns the recorded result of the call.
+func (m *ReplayMatcher) replay(call recordedCall) (recordedCall, error) {
+	recorded, exists := m.calls[call.key()]
+	if !exists {
+		logrus.Warnf("external %s query was not recorded: %s %s %s %s",
+			call.Method, call.Email, call.Repo, call.Commit, call.User)
+		return recordedCall{}, ErrNotRecorded
+	}
+	return recorded, recorded.err()
+}
+
+// MatchByEmail returns the recorded match of the email.
+func (m *ReplayMatcher) MatchByEmail(ctx context.Context, email string) (string, error) {
+	call, err := m.replay(recordedCall{Method: recordedEmail, Email: email})
+	return call.User, err
+}
+
+// SupportsMatchingByCommit acts the same as the recorded Matcher.
+func (m *ReplayMatcher) SupportsMatchingByCommit() bool {
+	return m.commits
+}
+
+// MatchByCommit returns the recorded match of the commit.
+func (m *ReplayMatcher) MatchByCommit(
+	ctx context.Context, email, repo, commit string) (string, error) {
+	call, err := m.replay(recordedCall{
+		Method: recordedCommit, Email: email, Repo: repo, Commit: commit})
+	return call.User, err
+}
+
+// Profile returns the recorded profile of the user.
+func (m *ReplayMatcher) Profile(ctx context.Context, user string) (Profile, error) {
+	call, err := m.replay(recordedCall{Method: recordedProfile, User: user})
+	if err != nil || call.Profile == nil {
+		return Profile{}, err
+	}
+	return *call.Profile, nil
+}
+
+// OnIdle does nothing.
+func (m *ReplayMatcher) OnIdle() error {
+	return nil
+}
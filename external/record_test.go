@@ -0,0 +1,152 @@
+package external
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testFailingMatcher fails the queries to the emails which are not matched.
+type testFailingMatcher struct {
+	testProfileMatcher
+}
+
+func (m testFailingMatcher) MatchByEmail(ctx context.Context, email string) (string, error) {
+	*m.queries++
+	if email == "canceled@sourced.tech" {
+		return "", context.Canceled
+	}
+	if user, exists := m.users[email]; exists {
+		return user, nil
+	}
+	return "", errors.New("HTTP 500")
+}
+
+func TestRecordingMatcher(t *testing.T) {
+	req := require.New(t)
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "fixture.json")
+	queries := 0
+	created := time.Date(2012, 11, 14, 12, 32, 56, 0, time.UTC)
+	inner := testFailingMatcher{testProfileMatcher{
+		testMapMatcher: testMapMatcher{
+			users: map[string]string{"vadim@sourced.tech": "vmarkovtsev"}, commits: true},
+		profiles: map[string]Profile{"vmarkovtsev": {DisplayName: "Vadim", CreatedAt: created}},
+		queries:  &queries,
+	}}
+	recorder, err := NewRecordingMatcher(inner, path)
+	req.NoError(err)
+	user, err := recorder.MatchByEmail(ctx, "vadim@sourced.tech")
+	req.NoError(err)
+	req.Equal("vmarkovtsev", user)
+	_, err = recorder.MatchByEmail(ctx, "bob@sourced.tech")
+	req.EqualError(err, "HTTP 500")
+	_, err = recorder.MatchByEmail(ctx, "canceled@sourced.tech")
+	req.Equal(context.Canceled, err)
+	matches, err := recorder.MatchByCommits(ctx, []CommitQuery{
+		{Email: "vadim@sourced.tech", Repo: "org/repo", Commit: "1"},
+		{Email: "bob@sourced.tech", Repo: "org/repo", Commit: "2"},
+	})
+	req.NoError(err)
+	req.Equal([]CommitMatch{{User: "vmarkovtsev@1"}, {Err: ErrNoMatches}}, matches)
+	_, err = recorder.Profile(ctx, "vmarkovtsev")
+	req.NoError(err)
+	req.NoError(recorder.Close())
+
+	data, err := ioutil.ReadFile(path)
+	req.NoError(err)
+	req.Equal(`{
+  "commits": true,
+  "calls": [
+    {
+      "method": "commit",
+      "email": "bob@sourced.tech",
+      "repo": "org/repo",
+      "commit": "2",
+      "error": "no matches found"
+    },
+    {
+      "method": "commit",
+      "email": "vadim@sourced.tech",
+      "repo": "org/repo",
+      "commit": "1",
+      "user": "vmarkovtsev@1"
+    },
+    {
+      "method": "email",
+      "email": "bob@sourced.tech",
+      "error": "HTTP 500"
+    },
+    {
+      "method": "email",
+      "email": "vadim@sourced.tech",
+      "user": "vmarkovtsev"
+    },
+    {
+      "method": "profile",
+      "user": "vmarkovtsev",
+      "profile": {
+        "DisplayName": "Vadim",
+        "AvatarURL": "",
+        "ProfileURL": "",
+        "CreatedAt": "2012-11-14T12:32:56Z"
+      }
+    }
+  ]
+}
+`, string(data))
+
+	// recording again keeps the existing calls
+	recorder, err = NewRecordingMatcher(inner, path)
+	req.NoError(err)
+	req.Len(recorder.calls, 5)
+}
+
+func TestReplayMatcher(t *testing.T) {
+	req := require.New(t)
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "fixture.json")
+	queries := 0
+	inner := testProfileMatcher{
+		testMapMatcher: testMapMatcher{users: map[string]string{"vadim@sourced.tech": "vmarkovtsev"}},
+		profiles:       map[string]Profile{"vmarkovtsev": {DisplayName: "Vadim"}},
+		queries:        &queries,
+	}
+	recorder, err := NewRecordingMatcher(NewRateLimitedMatcher(inner, NewRateLimiter(0)), path)
+	req.NoError(err)
+	cached, err := NewCachedMatcher(recorder, filepath.Join(t.TempDir(), "cache.db"))
+	req.NoError(err)
+	_, err = cached.MatchByEmail(ctx, "vadim@sourced.tech")
+	req.NoError(err)
+	_, err = cached.MatchByEmail(ctx, "bob@sourced.tech")
+	req.Equal(ErrNoMatches, err)
+	_, err = cached.Profile(ctx, "vmarkovtsev")
+	req.NoError(err)
+	// the cache closes the recorder which writes the fixture
+	req.NoError(cached.Close())
+
+	replay, err := NewReplayMatcher(path)
+	req.NoError(err)
+	req.False(replay.SupportsMatchingByCommit())
+	user, err := replay.MatchByEmail(ctx, "vadim@sourced.tech")
+	req.NoError(err)
+	req.Equal("vmarkovtsev", user)
+	_, err = replay.MatchByEmail(ctx, "bob@sourced.tech")
+	req.Equal(ErrNoMatches, err)
+	_, err = replay.MatchByEmail(ctx, "alice@sourced.tech")
+	req.Equal(ErrNotRecorded, err)
+	_, err = replay.MatchByCommit(ctx, "vadim@sourced.tech", "org/repo", "1")
+	req.Equal(ErrNotRecorded, err)
+	profile, err := replay.Profile(ctx, "vmarkovtsev")
+	req.NoError(err)
+	req.Equal(Profile{DisplayName: "Vadim"}, profile)
+	req.Equal(1, queries)
+
+	_, err = NewReplayMatcher(filepath.Join(t.TempDir(), "missing.json"))
+	req.Error(err)
+}
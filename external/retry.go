@@ -0,0 +1,185 @@
+package external
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	responseSuccess = 0
+	responseRetry   = 1
+	responseFail    = 2
+	maxNumFailures  = 8
+)
+
+// retryBaseDelay is the first sleep interval of the exponential backoff.
+var retryBaseDelay = time.Second
+
+// isTransientCode returns true for the HTTP status codes which are worth retrying.
+func isTransientCode(code int) bool {
+	return code >= 500 && code < 600 || code == http.StatusRequestTimeout ||
+		code == http.StatusTooManyRequests
+}
+
+// isRateLimitHit returns true if the response reports the exhausted rate limit: 429 or
+// GitHub's 403 with zero remaining requests.
+func isRateLimitHit(response *http.Response) bool {
+	if response.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+	if response.StatusCode != http.StatusForbidden {
+		return false
+	}
+	remaining, exists := rateLimitHeader(response.Header, "Remaining")
+	return exists && remaining == 0
+}
+
+// retryAfter parses the Retry-After header which is either the number of seconds or
+// the HTTP date. https://tools.ietf.org/html/rfc7231#section-7.1.3
+func retryAfter(header http.Header) (time.Duration, bool) {
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date), true
+	}
+	return 0, false
+}
+
+// sleepContext sleeps for the given duration and returns false if the context is canceled
+// earlier.
+func sleepContext(ctx context.Context, duration time.Duration) bool {
+	if duration <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// checkHTTPResponse decides whether the request succeeded, should be retried or failed.
+// This is the retry policy shared by all the HTTP matchers. It sleeps until the rate limit
+// resets (X-RateLimit-Reset on GitHub, RateLimit-Reset on GitLab, Retry-After otherwise) or
+// backs off exponentially before retrying the network errors and the status codes selected by
+// isRetryCode. The sleep is interrupted and the request fails if ctx is canceled.
+// response may be nil if err is not nil.
+func checkHTTPResponse(ctx context.Context, response *http.Response, err error,
+	numFailures *uint64, isRetryCode func(int) bool) int {
+	code := 0
+	if response != nil {
+		code = response.StatusCode
+	}
+	if err == nil && code >= 200 && code < 300 {
+		return responseSuccess
+	}
+
+	if response != nil && isRateLimitHit(response) {
+		if reset, exists := rateLimitHeader(response.Header, "Reset"); exists {
+			resetTime := time.Unix(reset, 0).Add(time.Second)
+			logrus.Warnf("rate limit was hit, waiting until %s", resetTime.String())
+			if !sleepContext(ctx, time.Until(resetTime)) {
+				return responseFail
+			}
+			return responseRetry
+		}
+		if code == http.StatusForbidden {
+			logrus.Errorf("Bad X-Ratelimit-Reset header: %q",
+				response.Header.Get("X-Ratelimit-Reset"))
+			return responseFail
+		}
+	}
+
+	// the API clients report the unsuccessful status codes as errors, too
+	if (response == nil && err != nil) || isRetryCode(code) {
+		sleepTime := time.Duration(1<<*numFailures) * retryBaseDelay
+		if response != nil {
+			if delay, exists := retryAfter(response.Header); exists {
+				sleepTime = delay
+			}
+		}
+		logrus.Warnf("HTTP %d: %v, sleeping until %s", code, err,
+			time.Now().UTC().Add(sleepTime))
+		if !sleepContext(ctx, sleepTime) {
+			return responseFail
+		}
+		*numFailures++
+		if *numFailures > maxNumFailures {
+			return responseFail
+		}
+		return responseRetry
+	}
+	logrus.Warnf("HTTP %d: %v", code, err)
+	return responseFail
+}
+
+// retry calls send until checkHTTPResponse() decides that the request succeeded or failed.
+// send must consume and close the response body itself, as the API client libraries do.
+// retry returns context.Canceled if ctx is canceled while sending or waiting.
+func retry(ctx context.Context, isRetryCode func(int) bool,
+	send func() (*http.Response, error)) error {
+	var numFailures uint64
+	for {
+		response, err := send()
+		if ctx.Err() != nil {
+			return context.Canceled
+		}
+		switch checkHTTPResponse(ctx, response, err, &numFailures, isRetryCode) {
+		case responseSuccess:
+			return nil
+		case responseFail:
+			if ctx.Err() != nil {
+				return context.Canceled
+			}
+			if err == nil {
+				err = fmt.Errorf("HTTP %s", response.Status)
+			}
+			return err
+		}
+	}
+}
+
+// doWithRetries sends the request without body until checkHTTPResponse() decides that it
+// succeeded or failed. It returns the last response, which may be unsuccessful, and the caller
+// must close its body. It returns context.Canceled if ctx is canceled while sending or waiting.
+func doWithRetries(ctx context.Context, client *http.Client, req *http.Request,
+	isRetryCode func(int) bool) (*http.Response, error) {
+	req = req.WithContext(ctx)
+	var numFailures uint64
+	for {
+		response, err := client.Do(req)
+		if ctx.Err() != nil {
+			if err == nil {
+				response.Body.Close()
+			}
+			return nil, context.Canceled
+		}
+		status := checkHTTPResponse(ctx, response, err, &numFailures, isRetryCode)
+		if status == responseRetry {
+			if err == nil {
+				response.Body.Close()
+			}
+			continue
+		}
+		if ctx.Err() != nil {
+			if err == nil {
+				response.Body.Close()
+			}
+			return nil, context.Canceled
+		}
+		return response, err
+	}
+}
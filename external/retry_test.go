@@ -0,0 +1,140 @@
+package external
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestResponse(code int, headers ...string) *http.Response {
+	response := &http.Response{StatusCode: code, Status: http.StatusText(code), Header: http.Header{}}
+	for i := 0; i < len(headers); i += 2 {
+		response.Header.Set(headers[i], headers[i+1])
+	}
+	return response
+}
+
+func TestCheckHTTPResponse(t *testing.T) {
+	req := require.New(t)
+	defer func(delay time.Duration) { retryBaseDelay = delay }(retryBaseDelay)
+	retryBaseDelay = time.Millisecond
+	ctx := context.Background()
+	past := strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)
+	var numFailures uint64
+
+	req.Equal(responseSuccess, checkHTTPResponse(
+		ctx, newTestResponse(http.StatusOK), nil, &numFailures, isTransientCode))
+	// GitLab
+	req.Equal(responseRetry, checkHTTPResponse(ctx, newTestResponse(
+		http.StatusTooManyRequests, "RateLimit-Remaining", "0", "RateLimit-Reset", past),
+		errors.New("429"), &numFailures, isTransientCode))
+	// GitHub
+	req.Equal(responseRetry, checkHTTPResponse(ctx, newTestResponse(
+		http.StatusForbidden, "X-RateLimit-Remaining", "0", "X-RateLimit-Reset", past),
+		errors.New("403"), &numFailures, isTransientCode))
+	req.Equal(uint64(0), numFailures)
+	req.Equal(responseFail, checkHTTPResponse(ctx, newTestResponse(
+		http.StatusForbidden, "X-RateLimit-Remaining", "0"),
+		errors.New("403"), &numFailures, isTransientCode))
+	req.Equal(responseFail, checkHTTPResponse(ctx, newTestResponse(http.StatusForbidden),
+		errors.New("403"), &numFailures, isTransientCode))
+	req.Equal(responseFail, checkHTTPResponse(ctx, newTestResponse(http.StatusNotFound),
+		errors.New("404"), &numFailures, isTransientCode))
+	req.Equal(uint64(0), numFailures)
+
+	req.Equal(responseRetry, checkHTTPResponse(ctx, newTestResponse(
+		http.StatusTooManyRequests, "Retry-After", "0"), nil, &numFailures, isTransientCode))
+	req.Equal(responseRetry, checkHTTPResponse(ctx, newTestResponse(http.StatusBadGateway),
+		nil, &numFailures, isTransientCode))
+	req.Equal(responseRetry, checkHTTPResponse(
+		ctx, nil, errors.New("connection reset"), &numFailures, isTransientCode))
+	req.Equal(uint64(3), numFailures)
+	numFailures = maxNumFailures
+	req.Equal(responseFail, checkHTTPResponse(ctx, newTestResponse(http.StatusBadGateway),
+		nil, &numFailures, isTransientCode))
+}
+
+func TestCheckHTTPResponseCancel(t *testing.T) {
+	req := require.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	future := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	start := time.Now()
+	var numFailures uint64
+	req.Equal(responseFail, checkHTTPResponse(ctx, newTestResponse(
+		http.StatusTooManyRequests, "RateLimit-Reset", future), nil, &numFailures, isTransientCode))
+	req.Equal(responseFail, checkHTTPResponse(ctx, newTestResponse(
+		http.StatusServiceUnavailable, "Retry-After", "3600"), nil, &numFailures, isTransientCode))
+	req.True(time.Since(start) < time.Minute)
+}
+
+func TestRetryAfter(t *testing.T) {
+	req := require.New(t)
+	delay, exists := retryAfter(http.Header{"Retry-After": {"120"}})
+	req.True(exists)
+	req.Equal(2*time.Minute, delay)
+	delay, exists = retryAfter(http.Header{
+		"Retry-After": {time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)}})
+	req.True(exists)
+	req.InDelta(time.Hour.Seconds(), delay.Seconds(), 5)
+	_, exists = retryAfter(http.Header{"Retry-After": {"soon"}})
+	req.False(exists)
+	_, exists = retryAfter(http.Header{})
+	req.False(exists)
+}
+
+// newFlakyGitLabServer replies with the rate limit error, then with the server error and
+// then serves the users.
+func newFlakyGitLabServer(t *testing.T, reset time.Time) (*httptest.Server, *int32) {
+	var requests int32
+	fixtures := newFixtureServer(t, map[string]string{
+		"/api/v4/users?search=noreply%40gitlab.com": "gitlab/users.json",
+	}, nil)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt32(&requests, 1) {
+		case 1:
+			w.Header().Set("RateLimit-Remaining", "0")
+			w.Header().Set("RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+			w.WriteHeader(http.StatusTooManyRequests)
+		case 2:
+			w.WriteHeader(http.StatusBadGateway)
+		default:
+			fixtures.Config.Handler.ServeHTTP(w, r)
+		}
+	}))
+	t.Cleanup(fixtures.Close)
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func TestGitLabMatcherRetry(t *testing.T) {
+	req := require.New(t)
+	defer func(delay time.Duration) { retryBaseDelay = delay }(retryBaseDelay)
+	retryBaseDelay = time.Millisecond
+	server, requests := newFlakyGitLabServer(t, time.Now().Add(-time.Minute))
+	matcher, err := NewGitLabMatcher(server.URL, "")
+	req.NoError(err)
+	user, err := matcher.MatchByEmail(context.Background(), "noreply@gitlab.com")
+	req.NoError(err)
+	req.Equal("gitlab-bot", user)
+	req.Equal(int32(3), atomic.LoadInt32(requests))
+}
+
+func TestGitLabMatcherRetryCancel(t *testing.T) {
+	req := require.New(t)
+	server, requests := newFlakyGitLabServer(t, time.Now().Add(time.Hour))
+	matcher, err := NewGitLabMatcher(server.URL, "")
+	req.NoError(err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = matcher.MatchByEmail(ctx, "noreply@gitlab.com")
+	req.Equal(context.Canceled, err)
+	req.Equal(int32(1), atomic.LoadInt32(requests))
+}
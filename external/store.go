@@ -0,0 +1,212 @@
+package external
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// CacheStore persists the entries of CachedMatcher. The implementations must be safe for
+// concurrent use and store each entry durably before returning, so that an interrupted run
+// loses nothing.
+type CacheStore interface {
+	// Load passes all the stored users, profiles and matches by commit to the callbacks.
+	Load(users func(email string, user CachedUser), profiles func(user string, profile Profile),
+		commits func(key CommitKey, user CachedUser)) error
+	// PutUser stores the match of the email.
+	PutUser(email string, user CachedUser) error
+	// PutCommit stores the match of the commit.
+	PutCommit(key CommitKey, user CachedUser) error
+	// PutProfile stores the profile of the user.
+	PutProfile(user string, profile Profile) error
+	// Close releases the store.
+	Close() error
+}
+
+// boltCacheVersion is the format version of the BoltDB cache.
+const boltCacheVersion = "1"
+
+var (
+	boltUsersBucket    = []byte("users")
+	boltProfilesBucket = []byte("profiles")
+	boltCommitsBucket  = []byte("commits")
+	boltMetaBucket     = []byte("meta")
+	boltVersionKey     = []byte("version")
+)
+
+// boltCacheStore keeps the cache in a BoltDB file: the users, the profiles and the matches by
+// commit are JSON values in separate buckets.
+type boltCacheStore struct {
+	db *bolt.DB
+}
+
+// IsBoltCachePath returns true if the cache at the given path should be stored in BoltDB,
+// that is, the file extension is ".db" or ".bolt". The other paths are CSV.
+func IsBoltCachePath(path string) bool {
+	ext := filepath.Ext(path)
+	return ext == ".db" || ext == ".bolt"
+}
+
+// OpenBoltCacheStore opens or creates the BoltDB cache. A new cache imports the CSV cache with
+// the same name, e.g. "cache-external-github.csv" for "cache-external-github.db", if it exists.
+func OpenBoltCacheStore(path string) (CacheStore, error) {
+	created := !PathExists(path)
+	// BoltDB locks the file, fail instead of waiting for the other process forever
+	db, err := bolt.Open(path, 0666, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	store := &boltCacheStore{db: db}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltUsersBucket, boltProfilesBucket, boltCommitsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		meta, err := tx.CreateBucketIfNotExists(boltMetaBucket)
+		if err != nil {
+			return err
+		}
+		version := meta.Get(boltVersionKey)
+		if version == nil {
+			return meta.Put(boltVersionKey, []byte(boltCacheVersion))
+		}
+		if string(version) != boltCacheVersion {
+			return fmt.Errorf("unsupported cache version %s in %s", version, path)
+		}
+		return nil
+	})
+	if err == nil && created {
+		csvPath := strings.TrimSuffix(path, filepath.Ext(path)) + ".csv"
+		if PathExists(csvPath) {
+			err = store.importCSV(csvPath)
+		}
+	}
+	if err != nil {
+		db.Close()
+		if created {
+			// migrate again the next time
+			os.Remove(path)
+		}
+		return nil, err
+	}
+	return store, nil
+}
+
+// importCSV copies the CSV cache, its profiles and matches by commit to the store in a single transaction.
+func (s *boltCacheStore) importCSV(csvPath string) error {
+	legacy := safeUserCache{cache: map[string]CachedUser{}, cachePath: csvPath}
+	if err := legacy.LoadFromDisk(); err != nil {
+		return fmt.Errorf("failed to migrate %s: %v", csvPath, err)
+	}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for email, user := range legacy.cache {
+			if err := putJSON(tx.Bucket(boltUsersBucket), email, user); err != nil {
+				return err
+			}
+		}
+		for user, profile := range legacy.profiles {
+			if err := putJSON(tx.Bucket(boltProfilesBucket), user, profile); err != nil {
+				return err
+			}
+		}
+		for key, user := range legacy.commits {
+			if err := putJSON(tx.Bucket(boltCommitsBucket), commitBoltKey(key), user); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	logrus.Infof("migrated %d users, %d profiles and %d commits from %s",
+		len(legacy.cache), len(legacy.profiles), len(legacy.commits), csvPath)
+	return nil
+}
+
+// commitBoltKey joins the parts of the key with zero bytes, which never appear in them.
+func commitBoltKey(key CommitKey) string {
+	return key.Repo + "\x00" + key.Commit + "\x00" + key.Email
+}
+
+func putJSON(bucket *bolt.Bucket, key string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(key), data)
+}
+
+// Load passes all the stored users, profiles and matches by commit to the callbacks.
+func (s *boltCacheStore) Load(users func(email string, user CachedUser),
+	profiles func(user string, profile Profile), commits func(key CommitKey, user CachedUser)) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		err := tx.Bucket(boltUsersBucket).ForEach(func(key, value []byte) error {
+			var user CachedUser
+			if err := json.Unmarshal(value, &user); err != nil {
+				return fmt.Errorf("invalid cached user %s: %v", key, err)
+			}
+			users(string(key), user)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		err = tx.Bucket(boltProfilesBucket).ForEach(func(key, value []byte) error {
+			var profile Profile
+			if err := json.Unmarshal(value, &profile); err != nil {
+				return fmt.Errorf("invalid cached profile %s: %v", key, err)
+			}
+			profiles(string(key), profile)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(boltCommitsBucket).ForEach(func(key, value []byte) error {
+			parts := strings.SplitN(string(key), "\x00", 3)
+			if len(parts) != 3 {
+				return fmt.Errorf("invalid cached commit key %q", key)
+			}
+			var user CachedUser
+			if err := json.Unmarshal(value, &user); err != nil {
+				return fmt.Errorf("invalid cached commit %q: %v", key, err)
+			}
+			commits(CommitKey{Repo: parts[0], Commit: parts[1], Email: parts[2]}, user)
+			return nil
+		})
+	})
+}
+
+// PutUser stores the match of the email. The concurrent calls are committed together.
+func (s *boltCacheStore) PutUser(email string, user CachedUser) error {
+	return s.db.Batch(func(tx *bolt.Tx) error {
+		return putJSON(tx.Bucket(boltUsersBucket), email, user)
+	})
+}
+
+// PutCommit stores the match of the commit. The concurrent calls are committed together.
+func (s *boltCacheStore) PutCommit(key CommitKey, user CachedUser) error {
+	return s.db.Batch(func(tx *bolt.Tx) error {
+		return putJSON(tx.Bucket(boltCommitsBucket), commitBoltKey(key), user)
+	})
+}
+
+// PutProfile stores the profile of the user. The concurrent calls are committed together.
+func (s *boltCacheStore) PutProfile(user string, profile Profile) error {
+	return s.db.Batch(func(tx *bolt.Tx) error {
+		return putJSON(tx.Bucket(boltProfilesBucket), user, profile)
+	})
+}
+
+// Close closes the BoltDB file.
+func (s *boltCacheStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,144 @@
+package external
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestIsBoltCachePath(t *testing.T) {
+	require.True(t, IsBoltCachePath("cache-external-github.db"))
+	require.True(t, IsBoltCachePath("/tmp/cache.bolt"))
+	require.False(t, IsBoltCachePath("cache-external-github.csv"))
+	require.False(t, IsBoltCachePath("cache"))
+}
+
+func TestCachedMatcherBolt(t *testing.T) {
+	req := require.New(t)
+	ctx := context.Background()
+	cachePath := filepath.Join(t.TempDir(), "cache.db")
+	queries := 0
+	inner := testProfileMatcher{
+		testMapMatcher: testMapMatcher{users: map[string]string{"vadim@sourced.tech": "vmarkovtsev"}},
+		profiles:       map[string]Profile{"vmarkovtsev": {DisplayName: "Vadim"}},
+		queries:        &queries,
+	}
+	matcher, err := NewCachedMatcher(inner, cachePath)
+	req.NoError(err)
+	user, err := matcher.MatchByEmail(ctx, "vadim@sourced.tech")
+	req.NoError(err)
+	req.Equal("vmarkovtsev", user)
+	_, err = matcher.MatchByEmail(ctx, "bob@sourced.tech")
+	req.Equal(ErrNoMatches, err)
+	_, err = matcher.Profile(ctx, user)
+	req.NoError(err)
+	req.Equal(1, queries)
+	// no dump
+	req.NoError(matcher.Close())
+
+	matcher, err = NewCachedMatcher(testMapMatcher{}, cachePath)
+	req.NoError(err)
+	defer matcher.Close()
+	user, err = matcher.MatchByEmail(ctx, "vadim@sourced.tech")
+	req.NoError(err)
+	req.Equal("vmarkovtsev", user)
+	_, err = matcher.MatchByEmail(ctx, "bob@sourced.tech")
+	req.Equal(ErrNoMatches, err)
+	profile, err := matcher.Profile(ctx, user)
+	req.NoError(err)
+	req.Equal(Profile{DisplayName: "Vadim"}, profile)
+	req.False(PathExists(filepath.Join(filepath.Dir(cachePath), "cache-profiles.csv")))
+}
+
+func TestCachedMatcherBoltConcurrent(t *testing.T) {
+	req := require.New(t)
+	users := map[string]string{}
+	for i := 0; i < 100; i++ {
+		users[fmt.Sprintf("%d@sourced.tech", i)] = fmt.Sprintf("user%d", i)
+	}
+	cachePath := filepath.Join(t.TempDir(), "cache.db")
+	matcher, err := NewCachedMatcher(testMapMatcher{users: users}, cachePath)
+	req.NoError(err)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for email := range users {
+				_, err := matcher.MatchByEmail(context.Background(), email)
+				require.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+	req.NoError(matcher.Close())
+
+	store, err := OpenBoltCacheStore(cachePath)
+	req.NoError(err)
+	defer store.Close()
+	loaded := map[string]string{}
+	req.NoError(store.Load(func(email string, user CachedUser) {
+		req.True(user.Matched)
+		loaded[email] = user.User
+	}, func(string, Profile) {}, func(CommitKey, CachedUser) {}))
+	req.Equal(users, loaded)
+}
+
+func TestOpenBoltCacheStoreMigration(t *testing.T) {
+	req := require.New(t)
+	dir := t.TempDir()
+	req.NoError(ioutil.WriteFile(filepath.Join(dir, "cache-external-github.csv"), []byte(
+		"email,user,match\nvadim@sourced.tech,vmarkovtsev,1\nbob@sourced.tech,,0\n"), 0666))
+	req.NoError(ioutil.WriteFile(filepath.Join(dir, "cache-external-github-profiles.csv"), []byte(
+		"user,name,avatar,profile_url,created\nvmarkovtsev,Vadim,,,2012-11-14T12:32:56Z\n"), 0666))
+	matcher, err := NewCachedMatcher(testMapMatcher{},
+		filepath.Join(dir, "cache-external-github.db"))
+	req.NoError(err)
+	req.Equal(map[string]CachedUser{
+		"vadim@sourced.tech": {User: "vmarkovtsev", Matched: true},
+		"bob@sourced.tech":   {},
+	}, matcher.cache.cache)
+	req.Equal(map[string]Profile{"vmarkovtsev": {
+		DisplayName: "Vadim", CreatedAt: time.Date(2012, 11, 14, 12, 32, 56, 0, time.UTC)}},
+		matcher.cache.profiles)
+	req.NoError(matcher.Close())
+
+	// the existing database does not import the CSV again
+	req.NoError(ioutil.WriteFile(filepath.Join(dir, "cache-external-github.csv"), []byte(
+		"email,user,match\nalice@sourced.tech,alice,1\n"), 0666))
+	matcher, err = NewCachedMatcher(testMapMatcher{},
+		filepath.Join(dir, "cache-external-github.db"))
+	req.NoError(err)
+	req.Len(matcher.cache.cache, 2)
+	req.NoError(matcher.Close())
+
+	// the broken CSV is not half-imported
+	req.NoError(ioutil.WriteFile(filepath.Join(dir, "broken.csv"), []byte("email,user\n"), 0666))
+	_, err = OpenBoltCacheStore(filepath.Join(dir, "broken.db"))
+	req.Error(err)
+	req.False(PathExists(filepath.Join(dir, "broken.db")))
+}
+
+func TestOpenBoltCacheStoreVersion(t *testing.T) {
+	req := require.New(t)
+	path := filepath.Join(t.TempDir(), "cache.db")
+	db, err := bolt.Open(path, 0666, nil)
+	req.NoError(err)
+	req.NoError(db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucket(boltMetaBucket)
+		if err != nil {
+			return err
+		}
+		return meta.Put(boltVersionKey, []byte("100"))
+	}))
+	req.NoError(db.Close())
+	_, err = OpenBoltCacheStore(path)
+	req.EqualError(err, "unsupported cache version 100 in "+path)
+}
@@ -0,0 +1,222 @@
+package external
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// defaultTokenCooldown is how long an exhausted token rests if the API does not tell when its
+// quota resets, e.g. Bitbucket's rolling hour.
+const defaultTokenCooldown = time.Hour
+
+// TokenPool rotates several API tokens of the same service. The requests are sent with
+// the current token until its quota is exhausted, then with the next token which has
+// remaining quota. The rate limit responses are passed through only if all the tokens are
+// exhausted, so that the matcher sleeps until the earliest reset.
+type TokenPool struct {
+	tokens    []*tokenState
+	current   int
+	rotations int
+	lock      sync.Mutex
+}
+
+type tokenState struct {
+	value string
+	TokenUsage
+}
+
+// TokenUsage is the quota usage of a single token in a TokenPool.
+type TokenUsage struct {
+	// Requests is the number of requests sent with the token.
+	Requests int
+	// Remaining is the remaining quota reported by the API or -1 if unknown.
+	Remaining int
+	// Reset is when the quota resets. It is zero if unknown.
+	Reset time.Time
+}
+
+// NewTokenPool creates a new TokenPool with the given tokens. The empty tokens are ignored.
+func NewTokenPool(tokens ...string) *TokenPool {
+	pool := &TokenPool{}
+	for _, token := range tokens {
+		if token != "" {
+			pool.tokens = append(pool.tokens, &tokenState{
+				value: token, TokenUsage: TokenUsage{Remaining: -1}})
+		}
+	}
+	return pool
+}
+
+// ReadTokens reads the tokens from a file, one per line. The empty lines and the lines
+// starting with "#" are ignored.
+func ReadTokens(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var tokens []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			tokens = append(tokens, line)
+		}
+	}
+	return tokens, nil
+}
+
+// Len returns the number of tokens.
+func (p *TokenPool) Len() int {
+	return len(p.tokens)
+}
+
+// Usage returns the quota usage of each token in the original order.
+func (p *TokenPool) Usage() []TokenUsage {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	usage := make([]TokenUsage, len(p.tokens))
+	for i, token := range p.tokens {
+		usage[i] = token.TokenUsage
+	}
+	return usage
+}
+
+// Rotations returns how many times the pool switched to the next token.
+func (p *TokenPool) Rotations() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.rotations
+}
+
+// client returns the HTTP client which authorizes each request with a token from the pool.
+// It returns nil if the pool is empty, so that the API clients fall back to their defaults.
+func (p *TokenPool) client(authorize func(req *http.Request, token string)) *http.Client {
+	if p.Len() == 0 {
+		return nil
+	}
+	return &http.Client{Transport: &tokenTransport{
+		pool: p, authorize: authorize, base: http.DefaultTransport}}
+}
+
+// exhausted indicates whether the token has no quota at the given time.
+func (s *tokenState) exhausted(now time.Time) bool {
+	return s.Remaining == 0 && now.Before(s.Reset)
+}
+
+// acquire picks the token for the next request: the current one if it has quota, otherwise
+// the next one with quota, otherwise the one which resets first.
+func (p *TokenPool) acquire() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := time.Now()
+	index := -1
+	for i := range p.tokens {
+		candidate := (p.current + i) % len(p.tokens)
+		if !p.tokens[candidate].exhausted(now) {
+			index = candidate
+			break
+		}
+	}
+	if index < 0 {
+		index = p.current
+		for i, token := range p.tokens {
+			if token.Reset.Before(p.tokens[index].Reset) {
+				index = i
+			}
+		}
+	}
+	if index != p.current {
+		p.current = index
+		p.rotations++
+	}
+	p.tokens[index].Requests++
+	return index
+}
+
+// update records the quota reported in the response and returns true if the token is
+// exhausted and there is another token with quota to retry the request with.
+func (p *TokenPool) update(index int, response *http.Response) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	token := p.tokens[index]
+	now := time.Now()
+	remaining, hasRemaining := rateLimitHeader(response.Header, "Remaining")
+	if hasRemaining {
+		token.Remaining = int(remaining)
+	}
+	if reset, hasReset := rateLimitHeader(response.Header, "Reset"); hasReset {
+		token.Reset = time.Unix(reset, 0)
+	}
+	code := response.StatusCode
+	if code != http.StatusTooManyRequests &&
+		!(code == http.StatusForbidden && hasRemaining && remaining == 0) {
+		return false
+	}
+	token.Remaining = 0
+	if !token.Reset.After(now) {
+		token.Reset = now.Add(defaultTokenCooldown)
+		if seconds, err := strconv.Atoi(response.Header.Get("Retry-After")); err == nil {
+			token.Reset = now.Add(time.Duration(seconds) * time.Second)
+		}
+	}
+	for _, other := range p.tokens {
+		if !other.exhausted(now) {
+			logrus.Warnf("API token #%d is exhausted until %s, rotating", index+1,
+				token.Reset.UTC())
+			return true
+		}
+	}
+	return false
+}
+
+// rateLimitHeader parses X-RateLimit-<name> (GitHub) or RateLimit-<name> (GitLab).
+func rateLimitHeader(header http.Header, name string) (int64, bool) {
+	for _, key := range []string{"X-Ratelimit-" + name, "Ratelimit-" + name} {
+		if value := header.Get(key); value != "" {
+			if parsed, err := strconv.ParseInt(value, 10, 64); err == nil {
+				return parsed, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// tokenTransport authorizes the requests with the tokens from the pool and repeats them with
+// the next token if the current one is exhausted.
+type tokenTransport struct {
+	pool      *TokenPool
+	authorize func(req *http.Request, token string)
+	base      http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		index := t.pool.acquire()
+		authorized := req.Clone(req.Context())
+		if attempt > 1 && req.Body != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			authorized.Body = body
+		}
+		t.authorize(authorized, t.pool.tokens[index].value)
+		response, err := t.base.RoundTrip(authorized)
+		if err != nil {
+			return nil, err
+		}
+		if !t.pool.update(index, response) || attempt >= t.pool.Len() ||
+			(req.Body != nil && req.GetBody == nil) {
+			return response, nil
+		}
+		io.Copy(ioutil.Discard, response.Body)
+		response.Body.Close()
+	}
+}
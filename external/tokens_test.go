@@ -0,0 +1,162 @@
+package external
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testQuotaServer serves each token until its quota is exhausted and then replies with
+// the rate limit error in the style of the service which uses the given header.
+type testQuotaServer struct {
+	*httptest.Server
+	lock   sync.Mutex
+	quotas map[string]int
+	tokens []string
+	bodies []string
+}
+
+func newTestQuotaServer(header string, quotas map[string]int) *testQuotaServer {
+	server := &testQuotaServer{quotas: quotas}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.lock.Lock()
+		defer server.lock.Unlock()
+		token := r.Header.Get(header)
+		token = strings.TrimPrefix(token, "Bearer ")
+		quota, exists := server.quotas[token]
+		if !exists {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		server.tokens = append(server.tokens, token)
+		server.bodies = append(server.bodies, string(body))
+		reset := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+		if quota == 0 {
+			switch header {
+			case "Authorization":
+				w.Header().Set("X-RateLimit-Remaining", "0")
+				w.Header().Set("X-RateLimit-Reset", reset)
+				w.WriteHeader(http.StatusForbidden)
+			case "Private-Token":
+				w.Header().Set("RateLimit-Remaining", "0")
+				w.Header().Set("RateLimit-Reset", reset)
+				w.WriteHeader(http.StatusTooManyRequests)
+			default:
+				w.WriteHeader(http.StatusTooManyRequests)
+			}
+			return
+		}
+		server.quotas[token]--
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(quota-1))
+		w.Header().Set("X-RateLimit-Reset", reset)
+		w.Header().Set("Content-Type", "application/json")
+		if header == "Private-Token" {
+			// GitLab looks up the users with the search
+			w.Write([]byte("[]"))
+		} else {
+			w.Write([]byte("{}"))
+		}
+	}))
+	return server
+}
+
+func TestTokenPoolRotation(t *testing.T) {
+	req := require.New(t)
+	server := newTestQuotaServer("Authorization", map[string]int{"a": 0, "b": 2})
+	defer server.Close()
+	pool := NewTokenPool("a", "", "b")
+	req.Equal(2, pool.Len())
+	client := pool.client(func(req *http.Request, token string) {
+		req.Header.Set("Authorization", "Bearer "+token)
+	})
+	post := func() int {
+		response, err := client.Post(server.URL, "text/plain", strings.NewReader("body"))
+		req.NoError(err)
+		response.Body.Close()
+		return response.StatusCode
+	}
+	req.Equal(http.StatusOK, post())
+	req.Equal(http.StatusOK, post())
+	// all the tokens are exhausted, the rate limit error is passed through
+	req.Equal(http.StatusForbidden, post())
+	req.Equal([]string{"a", "b", "b", "b"}, server.tokens)
+	// the body is replayed on the retry with the next token
+	req.Equal([]string{"body", "body", "body", "body"}, server.bodies)
+	req.Equal(1, pool.Rotations())
+	usage := pool.Usage()
+	req.Len(usage, 2)
+	req.Equal(1, usage[0].Requests)
+	req.Equal(0, usage[0].Remaining)
+	req.Equal(3, usage[1].Requests)
+	req.Equal(0, usage[1].Remaining)
+	req.True(usage[1].Reset.After(time.Now()))
+}
+
+func TestTokenPoolRetryAfter(t *testing.T) {
+	req := require.New(t)
+	pool := NewTokenPool("a", "b")
+	response := &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{}}
+	response.Header.Set("Retry-After", "60")
+	req.True(pool.update(pool.acquire(), response))
+	usage := pool.Usage()
+	req.Equal(0, usage[0].Remaining)
+	req.WithinDuration(time.Now().Add(time.Minute), usage[0].Reset, 5*time.Second)
+	req.Equal(-1, usage[1].Remaining)
+	req.Equal(1, pool.acquire())
+	// no hints: the token rests for the default cooldown
+	response.Header.Del("Retry-After")
+	req.False(pool.update(1, response))
+	usage = pool.Usage()
+	req.WithinDuration(time.Now().Add(defaultTokenCooldown), usage[1].Reset, 5*time.Second)
+	// both are exhausted, the one which resets first is picked
+	req.Equal(0, pool.acquire())
+	req.Nil(NewTokenPool().client(nil))
+}
+
+func TestMatchersWithTokens(t *testing.T) {
+	for _, provider := range []string{"github", "gitlab", "bitbucket"} {
+		t.Run(provider, func(t *testing.T) {
+			req := require.New(t)
+			header := map[string]string{
+				"github": "Authorization", "gitlab": "Private-Token", "bitbucket": "Authorization",
+			}[provider]
+			server := newTestQuotaServer(header, map[string]int{"a": 0, "b": 1})
+			defer server.Close()
+			pool := NewTokenPool("a", "b")
+			matcher, err := TokenPoolMatchers[provider](server.URL+"/", pool)
+			req.NoError(err)
+			_, err = matcher.(Profiler).Profile(context.Background(), "vmarkovtsev")
+			if err != ErrNoMatches {
+				req.NoError(err)
+			}
+			req.Equal([]string{"a", "b"}, server.tokens)
+			usage := pool.Usage()
+			req.Equal(1, usage[0].Requests)
+			req.Equal(0, usage[0].Remaining)
+			req.Equal(1, usage[1].Requests)
+			req.Equal(0, usage[1].Remaining)
+			req.Equal(1, pool.Rotations())
+		})
+	}
+}
+
+func TestReadTokens(t *testing.T) {
+	req := require.New(t)
+	path := filepath.Join(t.TempDir(), "tokens.txt")
+	req.NoError(ioutil.WriteFile(path, []byte("# GitHub\na\n\n  b  \n#c\n"), 0666))
+	tokens, err := ReadTokens(path)
+	req.NoError(err)
+	req.Equal([]string{"a", "b"}, tokens)
+	_, err = ReadTokens(filepath.Join(t.TempDir(), "missing.txt"))
+	req.Error(err)
+}
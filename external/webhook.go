@@ -0,0 +1,434 @@
+package external
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/sirupsen/logrus"
+)
+
+// WebhookConfig defines how WebhookMatcher calls an HTTP/JSON identity service.
+// The URLs, the bodies and the header values are text/template-s executed with WebhookQuery;
+// the "json" function escapes the string values in the bodies, e.g. {"email": {{json .Email}}}.
+type WebhookConfig struct {
+	// Email is the request which matches by email.
+	Email WebhookRequest `json:"email"`
+	// Commit is the request which matches by commit. May be nil.
+	Commit *WebhookRequest `json:"commit"`
+	// User is the JSONPath-like expression which extracts the user from the response,
+	// e.g. "$.data[0].login". The requests may override it.
+	User string `json:"user"`
+	// Headers are added to each request. "Authorization: Bearer <token>" is added by default
+	// if the token is not empty.
+	Headers map[string]string `json:"headers"`
+	// NoMatchCodes are the HTTP status codes which mean that there is no match. 404 by default.
+	NoMatchCodes []int `json:"no_match_codes"`
+	// RetryCodes are the HTTP status codes which are retried with the exponential backoff.
+	// 408, 429 and 5xx by default.
+	RetryCodes []int `json:"retry_codes"`
+}
+
+// WebhookRequest is the HTTP request template.
+type WebhookRequest struct {
+	// Method is GET by default.
+	Method string `json:"method"`
+	URL    string `json:"url"`
+	// Body is sent with the "application/json" content type if not empty.
+	Body string `json:"body"`
+	// User overrides WebhookConfig.User.
+	User string `json:"user"`
+}
+
+// WebhookQuery is the data of the WebhookConfig templates. The repository and commit fields
+// are empty while matching by email.
+type WebhookQuery struct {
+	Email    string
+	Repo     string
+	RepoHost string
+	RepoPath string
+	Commit   string
+	Token    string
+}
+
+// WebhookMatcher matches emails and users of an arbitrary HTTP/JSON service.
+type WebhookMatcher struct {
+	email        *webhookRequest
+	commit       *webhookRequest
+	headers      map[string]*template.Template
+	noMatchCodes map[int]bool
+	retryCodes   map[int]bool
+	token        string
+}
+
+// webhookRequest is the parsed WebhookRequest.
+type webhookRequest struct {
+	method string
+	url    *template.Template
+	body   *template.Template
+	user   []jsonPathStep
+}
+
+// NewWebhookMatcher creates a new matcher given the path to the JSON file with WebhookConfig
+// and the token which is available in the templates.
+func NewWebhookMatcher(apiURL, token string) (Matcher, error) {
+	if apiURL == "" {
+		return WebhookMatcher{}, errors.New("the path to the webhook config must be specified")
+	}
+	data, err := ioutil.ReadFile(apiURL)
+	if err != nil {
+		return WebhookMatcher{}, err
+	}
+	config := WebhookConfig{}
+	if err = json.Unmarshal(data, &config); err != nil {
+		return WebhookMatcher{}, fmt.Errorf("failed to parse %s: %v", apiURL, err)
+	}
+	return NewWebhookMatcherFromConfig(config, token)
+}
+
+// NewWebhookMatcherFromConfig creates a new matcher given the config and the token which is
+// available in the templates.
+func NewWebhookMatcherFromConfig(config WebhookConfig, token string) (Matcher, error) {
+	m := WebhookMatcher{
+		headers:      map[string]*template.Template{},
+		noMatchCodes: map[int]bool{},
+		token:        token,
+	}
+	var err error
+	if m.email, err = newWebhookRequest("email", config.Email, config.User); err != nil {
+		return WebhookMatcher{}, err
+	}
+	if config.Commit != nil {
+		if m.commit, err = newWebhookRequest("commit", *config.Commit, config.User); err != nil {
+			return WebhookMatcher{}, err
+		}
+	}
+	headers := config.Headers
+	if len(headers) == 0 && token != "" {
+		headers = map[string]string{"Authorization": "Bearer {{.Token}}"}
+	}
+	for key, value := range headers {
+		if m.headers[key], err = parseWebhookTemplate("header "+key, value); err != nil {
+			return WebhookMatcher{}, err
+		}
+	}
+	if len(config.NoMatchCodes) == 0 {
+		config.NoMatchCodes = []int{http.StatusNotFound}
+	}
+	for _, code := range config.NoMatchCodes {
+		m.noMatchCodes[code] = true
+	}
+	if len(config.RetryCodes) > 0 {
+		m.retryCodes = map[int]bool{}
+		for _, code := range config.RetryCodes {
+			m.retryCodes[code] = true
+		}
+	}
+	return m, nil
+}
+
+func newWebhookRequest(name string, request WebhookRequest, user string) (
+	*webhookRequest, error) {
+	if request.URL == "" {
+		return nil, fmt.Errorf("the %s request URL must be specified", name)
+	}
+	result := &webhookRequest{method: strings.ToUpper(request.Method)}
+	if result.method == "" {
+		result.method = http.MethodGet
+	}
+	var err error
+	if result.url, err = parseWebhookTemplate(name+" URL", request.URL); err != nil {
+		return nil, err
+	}
+	if request.Body != "" {
+		if result.body, err = parseWebhookTemplate(name+" body", request.Body); err != nil {
+			return nil, err
+		}
+	}
+	if request.User != "" {
+		user = request.User
+	}
+	if user == "" {
+		return nil, fmt.Errorf("the %s user path must be specified", name)
+	}
+	if result.user, err = parseJSONPath(user); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+var webhookTemplateFuncs = template.FuncMap{
+	"json": func(value string) (string, error) {
+		data, err := json.Marshal(value)
+		return string(data), err
+	},
+}
+
+func parseWebhookTemplate(name, text string) (*template.Template, error) {
+	tmpl, err := template.New(name).Funcs(webhookTemplateFuncs).Option("missingkey=error").
+		Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s template: %v", name, err)
+	}
+	return tmpl, nil
+}
+
+func executeWebhookTemplate(tmpl *template.Template, query WebhookQuery) (string, error) {
+	buffer := &bytes.Buffer{}
+	if err := tmpl.Execute(buffer, query); err != nil {
+		return "", err
+	}
+	return buffer.String(), nil
+}
+
+// MatchByEmail executes the email request.
+func (m WebhookMatcher) MatchByEmail(ctx context.Context, email string) (string, error) {
+	return m.match(ctx, m.email, WebhookQuery{Email: email})
+}
+
+// SupportsMatchingByCommit indicates whether this Matcher allows querying identities by commit metadata.
+func (m WebhookMatcher) SupportsMatchingByCommit() bool {
+	return m.commit != nil
+}
+
+// MatchByCommit executes the commit request.
+func (m WebhookMatcher) MatchByCommit(
+	ctx context.Context, email, repo, commit string) (string, error) {
+	if m.commit == nil {
+		return "", errors.New("not implemented")
+	}
+	return m.match(ctx, m.commit, WebhookQuery{
+		Email: email, Repo: repo, RepoHost: RepoHost(repo), RepoPath: repoPath(repo),
+		Commit: commit})
+}
+
+// OnIdle does nothing here.
+func (m WebhookMatcher) OnIdle() error {
+	return nil
+}
+
+func (m WebhookMatcher) isRetryCode(code int) bool {
+	if m.retryCodes == nil {
+		return isTransientCode(code)
+	}
+	return m.retryCodes[code]
+}
+
+// match sends the request and extracts the user from the response, retrying if needed.
+func (m WebhookMatcher) match(ctx context.Context, request *webhookRequest,
+	query WebhookQuery) (string, error) {
+	query.Token = m.token
+	var numFailures uint64
+	for {
+		req, err := m.newRequest(ctx, request, query)
+		if err != nil {
+			return "", err
+		}
+		response, err := http.DefaultClient.Do(req)
+		if ctx.Err() != nil {
+			if err == nil {
+				response.Body.Close()
+			}
+			return "", context.Canceled
+		}
+		if err == nil && m.noMatchCodes[response.StatusCode] {
+			response.Body.Close()
+			logrus.Warnf("unable to find users for email: %s", query.Email)
+			return "", ErrNoMatches
+		}
+		status := checkHTTPResponse(ctx, response, err, &numFailures, m.isRetryCode)
+		if status != responseSuccess {
+			if err == nil {
+				response.Body.Close()
+				err = fmt.Errorf("HTTP %d: %s", response.StatusCode, req.URL)
+			}
+			if status == responseRetry && ctx.Err() == nil {
+				continue
+			}
+			if ctx.Err() != nil {
+				return "", context.Canceled
+			}
+			return "", err
+		}
+		var body interface{}
+		err = json.NewDecoder(response.Body).Decode(&body)
+		response.Body.Close()
+		if err != nil {
+			return "", fmt.Errorf("failed to decode the response from %s: %v", req.URL, err)
+		}
+		user := jsonPathString(evaluateJSONPath(body, request.user))
+		if user == "" {
+			logrus.Warnf("unable to find users for email: %s", query.Email)
+			return "", ErrNoMatches
+		}
+		return user, nil
+	}
+}
+
+func (m WebhookMatcher) newRequest(ctx context.Context, request *webhookRequest,
+	query WebhookQuery) (*http.Request, error) {
+	u, err := executeWebhookTemplate(request.url, query)
+	if err != nil {
+		return nil, err
+	}
+	var body []byte
+	if request.body != nil {
+		text, err := executeWebhookTemplate(request.body, query)
+		if err != nil {
+			return nil, err
+		}
+		body = []byte(text)
+	}
+	req, err := http.NewRequest(request.method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for key, tmpl := range m.headers {
+		value, err := executeWebhookTemplate(tmpl, query)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set(key, value)
+	}
+	return req, nil
+}
+
+// jsonPathStep is either an object key, an array index, or the wildcard.
+type jsonPathStep struct {
+	key      string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+// parseJSONPath parses the subset of JSONPath: "$.key", "$['key']", "$[0]" and "$[*]".
+// The leading "$" is optional, e.g. "data[0].login".
+func parseJSONPath(path string) ([]jsonPathStep, error) {
+	invalid := func() ([]jsonPathStep, error) {
+		return nil, fmt.Errorf("invalid JSONPath: %s", path)
+	}
+	rest := strings.TrimPrefix(strings.TrimSpace(path), "$")
+	if rest != "" && rest[0] != '.' && rest[0] != '[' {
+		rest = "." + rest
+	}
+	var steps []jsonPathStep
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return invalid()
+			}
+			if rest[:end] == "*" {
+				steps = append(steps, jsonPathStep{wildcard: true})
+			} else {
+				steps = append(steps, jsonPathStep{key: rest[:end]})
+			}
+			rest = rest[end:]
+		case '[':
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return invalid()
+			}
+			inner := strings.TrimSpace(rest[1:end])
+			rest = rest[end+1:]
+			if inner == "*" {
+				steps = append(steps, jsonPathStep{wildcard: true})
+			} else if len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') &&
+				inner[len(inner)-1] == inner[0] {
+				steps = append(steps, jsonPathStep{key: inner[1 : len(inner)-1]})
+			} else if index, err := strconv.Atoi(inner); err == nil {
+				steps = append(steps, jsonPathStep{index: index, isIndex: true})
+			} else {
+				return invalid()
+			}
+		default:
+			return invalid()
+		}
+	}
+	return steps, nil
+}
+
+// evaluateJSONPath returns the value at the path in the decoded JSON or nil if it does not
+// exist. The wildcard selects the first element whose remaining path is not empty.
+// Negative indexes count from the end.
+func evaluateJSONPath(value interface{}, steps []jsonPathStep) interface{} {
+	for i, step := range steps {
+		switch typed := value.(type) {
+		case map[string]interface{}:
+			if step.wildcard {
+				keys := make([]string, 0, len(typed))
+				for key := range typed {
+					keys = append(keys, key)
+				}
+				sort.Strings(keys)
+				for _, key := range keys {
+					if result := evaluateJSONPath(typed[key], steps[i+1:]); jsonPathString(
+						result) != "" {
+						return result
+					}
+				}
+				return nil
+			}
+			if step.isIndex {
+				return nil
+			}
+			value = typed[step.key]
+		case []interface{}:
+			if step.wildcard {
+				for _, item := range typed {
+					if result := evaluateJSONPath(item, steps[i+1:]); jsonPathString(
+						result) != "" {
+						return result
+					}
+				}
+				return nil
+			}
+			if !step.isIndex {
+				return nil
+			}
+			index := step.index
+			if index < 0 {
+				index += len(typed)
+			}
+			if index < 0 || index >= len(typed) {
+				return nil
+			}
+			value = typed[index]
+		default:
+			return nil
+		}
+	}
+	return value
+}
+
+// jsonPathString converts the scalar JSON value to string. Null, objects and arrays are empty.
+func jsonPathString(value interface{}) string {
+	switch typed := value.(type) {
+	case string:
+		return typed
+	case float64:
+		return strconv.FormatFloat(typed, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(typed)
+	default:
+		return ""
+	}
+}
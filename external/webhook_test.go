@@ -0,0 +1,198 @@
+package external
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newWebhookServer emulates an in-house identity service. It fails the first request to
+// /flaky with 503 and always fails /broken with 500.
+func newWebhookServer(t *testing.T) (*httptest.Server, *int32) {
+	var flaky int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/people" && r.Method == http.MethodGet:
+			if r.Header.Get("Authorization") != "Bearer secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			switch r.URL.Query().Get("email") {
+			case "vadim@sourced.tech":
+				fmt.Fprint(w, `{"data": [{"login": null}, {"login": "vmarkovtsev", "id": 42}]}`)
+			case "nobody@sourced.tech":
+				fmt.Fprint(w, `{"data": []}`)
+			default:
+				w.WriteHeader(http.StatusGone)
+			}
+		case r.URL.Path == "/commits" && r.Method == http.MethodPost:
+			var body map[string]string
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			if body["repo"] == "src-d/hercules" && body["commit"] == "abc" &&
+				body["email"] == "vadim@\"sourced\".tech" {
+				fmt.Fprint(w, `{"author": {"id": 42}}`)
+				return
+			}
+			w.WriteHeader(http.StatusNotFound)
+		case r.URL.Path == "/flaky":
+			if atomic.AddInt32(&flaky, 1) == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			fmt.Fprint(w, `{"user": "flaky"}`)
+		case r.URL.Path == "/broken":
+			atomic.AddInt32(&flaky, 1)
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	return server, &flaky
+}
+
+func TestWebhookMatcher(t *testing.T) {
+	req := require.New(t)
+	server, _ := newWebhookServer(t)
+	defer server.Close()
+	config := fmt.Sprintf(`{
+  "email": {"url": "%[1]s/people?email={{urlquery .Email}}"},
+  "commit": {
+    "method": "post",
+    "url": "%[1]s/commits",
+    "body": "{\"repo\": {{json .RepoPath}}, \"commit\": {{json .Commit}}, \"email\": {{json .Email}}}",
+    "user": "$['author'].id"
+  },
+  "user": "$.data[*].login",
+  "no_match_codes": [404, 410]
+}`, server.URL)
+	path := filepath.Join(t.TempDir(), "webhook.json")
+	req.NoError(ioutil.WriteFile(path, []byte(config), 0666))
+	matcher, err := NewWebhookMatcher(path, "secret")
+	req.NoError(err)
+	req.True(matcher.SupportsMatchingByCommit())
+	ctx := context.Background()
+
+	user, err := matcher.MatchByEmail(ctx, "vadim@sourced.tech")
+	req.NoError(err)
+	req.Equal("vmarkovtsev", user)
+	_, err = matcher.MatchByEmail(ctx, "nobody@sourced.tech")
+	req.Equal(ErrNoMatches, err)
+	_, err = matcher.MatchByEmail(ctx, "gone@sourced.tech")
+	req.Equal(ErrNoMatches, err)
+
+	user, err = matcher.MatchByCommit(
+		ctx, `vadim@"sourced".tech`, "git@github.com:src-d/hercules.git", "abc")
+	req.NoError(err)
+	req.Equal("42", user)
+	_, err = matcher.MatchByCommit(
+		ctx, "vadim@sourced.tech", "git@github.com:src-d/hercules.git", "def")
+	req.Equal(ErrNoMatches, err)
+	req.NoError(matcher.OnIdle())
+
+	matcher, err = NewWebhookMatcher(path, "wrong")
+	req.NoError(err)
+	_, err = matcher.MatchByEmail(ctx, "vadim@sourced.tech")
+	req.Error(err)
+	req.NotEqual(ErrNoMatches, err)
+}
+
+func TestWebhookMatcherRetry(t *testing.T) {
+	req := require.New(t)
+	defer func(delay time.Duration) { retryBaseDelay = delay }(retryBaseDelay)
+	retryBaseDelay = time.Millisecond
+	server, requests := newWebhookServer(t)
+	defer server.Close()
+
+	matcher, err := NewWebhookMatcherFromConfig(WebhookConfig{
+		Email: WebhookRequest{URL: server.URL + "/flaky"}, User: "user"}, "")
+	req.NoError(err)
+	req.False(matcher.SupportsMatchingByCommit())
+	user, err := matcher.MatchByEmail(context.Background(), "vadim@sourced.tech")
+	req.NoError(err)
+	req.Equal("flaky", user)
+	req.Equal(int32(2), atomic.LoadInt32(requests))
+
+	// 503 is not retried
+	atomic.StoreInt32(requests, 0)
+	matcher, err = NewWebhookMatcherFromConfig(WebhookConfig{
+		Email: WebhookRequest{URL: server.URL + "/flaky"}, User: "user",
+		RetryCodes: []int{429}}, "")
+	req.NoError(err)
+	_, err = matcher.MatchByEmail(context.Background(), "vadim@sourced.tech")
+	req.Error(err)
+	req.Equal(int32(1), atomic.LoadInt32(requests))
+
+	atomic.StoreInt32(requests, 0)
+	matcher, err = NewWebhookMatcherFromConfig(WebhookConfig{
+		Email: WebhookRequest{URL: server.URL + "/broken"}, User: "user"}, "")
+	req.NoError(err)
+	_, err = matcher.MatchByEmail(context.Background(), "vadim@sourced.tech")
+	req.Error(err)
+	req.Equal(int32(maxNumFailures+1), atomic.LoadInt32(requests))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = matcher.MatchByEmail(ctx, "vadim@sourced.tech")
+	req.Equal(context.Canceled, err)
+}
+
+func TestNewWebhookMatcherErrors(t *testing.T) {
+	for _, config := range []WebhookConfig{
+		{User: "login"},
+		{Email: WebhookRequest{URL: "http://localhost"}},
+		{Email: WebhookRequest{URL: "http://localhost/{{.Email"}, User: "login"},
+		{Email: WebhookRequest{URL: "http://localhost"}, User: "data[x]"},
+		{Email: WebhookRequest{URL: "http://localhost"}, User: "login",
+			Commit: &WebhookRequest{}},
+		{Email: WebhookRequest{URL: "http://localhost"}, User: "login",
+			Headers: map[string]string{"X-Token": "{{.Secret}"}},
+	} {
+		_, err := NewWebhookMatcherFromConfig(config, "")
+		require.Error(t, err, fmt.Sprint(config))
+	}
+	_, err := NewWebhookMatcher("", "")
+	require.Error(t, err)
+	_, err = NewWebhookMatcher("testdata/webhook/missing.json", "")
+	require.Error(t, err)
+}
+
+func TestJSONPath(t *testing.T) {
+	req := require.New(t)
+	var doc interface{}
+	req.NoError(json.Unmarshal([]byte(`{"data": {"users": [{"login": "a", "id": 1},
+		{"login": "b", "active": true}], "a.b": "dotted"}}`), &doc))
+	for path, expected := range map[string]string{
+		"$.data.users[0].login":   "a",
+		"data.users[-1].login":    "b",
+		"$.data.users[0].id":      "1",
+		"$.data.users[*].active":  "true",
+		`$.data["a.b"]`:           "dotted",
+		"$['data'].users[2].name": "",
+		"$.data.users.login":      "",
+		"$.data[0]":               "",
+		"$.data.*":                "dotted",
+		"$.data":                  "",
+	} {
+		steps, err := parseJSONPath(path)
+		req.NoError(err, path)
+		req.Equal(expected, jsonPathString(evaluateJSONPath(doc, steps)), path)
+	}
+	for _, path := range []string{"$.", "$..a", "$[0", "$[abc]"} {
+		_, err := parseJSONPath(path)
+		req.Error(err, path)
+	}
+	steps, err := parseJSONPath("")
+	req.NoError(err)
+	req.Empty(steps)
+	req.True(strings.HasPrefix(fmt.Sprint(evaluateJSONPath(doc, steps)), "map["))
+}
@@ -0,0 +1,357 @@
+package idmatch
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/briandowns/spinner"
+	"github.com/go-sql-driver/mysql"
+	"github.com/sirupsen/logrus"
+)
+
+// GitbaseOptions configure fetching the signatures from gitbase.
+type GitbaseOptions struct {
+	// ConnString is the MySQL DSN of gitbase, see GitbaseConnection.
+	ConnString string
+	// Filters restrict the scanned commits.
+	Filters SignatureFilters
+	// QueryTimeout limits each query. The timed out queries are retried. Zero means unlimited.
+	QueryTimeout time.Duration
+}
+
+// gitbaseDriver is the database/sql driver of gitbase.
+var gitbaseDriver = "mysql"
+
+// gitbaseRetryBaseDelay is the first sleep interval of the exponential backoff.
+var gitbaseRetryBaseDelay = time.Second
+
+// gitbaseMaxRetries is the number of times a transiently failed query is retried.
+const gitbaseMaxRetries = 6
+
+// isTransientGitbaseError returns true for the errors which are worth retrying: the dropped
+// connections, the network errors, the timed out queries and the MySQL errors which do not
+// depend on the query.
+func isTransientGitbaseError(err error) bool {
+	switch err {
+	case driver.ErrBadConn, mysql.ErrInvalidConn, io.EOF, io.ErrUnexpectedEOF,
+		context.DeadlineExceeded:
+		return true
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	if mysqlErr, ok := err.(*mysql.MySQLError); ok {
+		switch mysqlErr.Number {
+		// too many connections, server shutdown, lock wait timeout, deadlock,
+		// query interrupted, server has gone away, lost connection
+		case 1040, 1053, 1205, 1213, 1317, 2006, 2013:
+			return true
+		}
+	}
+	return false
+}
+
+// retryGitbase calls query with the timeout until it succeeds, fails with a permanent error or
+// exhausts gitbaseMaxRetries. The sleep between the attempts grows exponentially and is
+// interrupted if ctx is canceled.
+func retryGitbase(ctx context.Context, timeout time.Duration,
+	query func(ctx context.Context) error) error {
+	for attempt := 0; ; attempt++ {
+		queryCtx, cancel := ctx, context.CancelFunc(func() {})
+		if timeout > 0 {
+			queryCtx, cancel = context.WithTimeout(ctx, timeout)
+		}
+		err := query(queryCtx)
+		cancel()
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		if !isTransientGitbaseError(err) || attempt >= gitbaseMaxRetries {
+			return err
+		}
+		sleepTime := time.Duration(1<<uint(attempt)) * gitbaseRetryBaseDelay
+		logrus.Warnf("gitbase query failed: %v, retrying in %s", err, sleepTime)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(sleepTime):
+		}
+	}
+}
+
+// queryRepositories lists the repositories which match the filters.
+func queryRepositories(ctx context.Context, db *sql.DB, filters SignatureFilters) (
+	[]string, error) {
+	rows, err := db.QueryContext(ctx, filters.repositoriesSQL())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var repos []string
+	for rows.Next() {
+		var repo string
+		if err := rows.Scan(&repo); err != nil {
+			return nil, err
+		}
+		repos = append(repos, repo)
+	}
+	return repos, rows.Err()
+}
+
+// queryRepositorySignatures fetches all the signatures in the repository.
+func queryRepositorySignatures(ctx context.Context, db *sql.DB, filters SignatureFilters,
+	repo string) ([]signatureWithRepo, error) {
+	rows, err := db.QueryContext(ctx, filters.repositorySQL(repo))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []signatureWithRepo
+	for rows.Next() {
+		var sig signatureWithRepo
+		if err := rows.Scan(&sig.repo, &sig.name, &sig.email, &sig.hash, &sig.firstSeen, &sig.time,
+			&sig.commits); err != nil {
+			return nil, err
+		}
+		result = append(result, sig)
+	}
+	return result, rows.Err()
+}
+
+// scanSignaturesFromDatabase fetches the signatures from gitbase one repository at a time.
+// The signatures of each repository are buffered until the query succeeds, so that a retried
+// query never visits them twice. The repositories which are finished in the checkpoint are
+// skipped and the rest are checkpointed as they are fetched. checkpoint may be nil.
+func scanSignaturesFromDatabase(ctx context.Context, opts GitbaseOptions,
+	checkpoint *signaturesCheckpoint, visit signatureVisitor) error {
+	cfg, err := mysql.ParseDSN(opts.ConnString)
+	if err != nil {
+		return err
+	}
+	cfg.ParseTime = true
+	db, err := sql.Open(gitbaseDriver, cfg.FormatDSN())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	db.SetMaxIdleConns(0)
+
+	var repos []string
+	err = retryGitbase(ctx, opts.QueryTimeout, func(ctx context.Context) error {
+		var err error
+		repos, err = queryRepositories(ctx, db, opts.Filters)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	spin := spinner.New(spinner.CharSets[11], 100*time.Millisecond)
+	// the spinner reads the suffix concurrently
+	setProgress := func(done int) {
+		spin.Lock()
+		spin.Suffix = fmt.Sprintf(" %d/%d repositories", done, len(repos))
+		spin.Unlock()
+	}
+	spin.Start()
+	defer spin.Stop()
+	for i, repo := range repos {
+		setProgress(i)
+		if checkpoint != nil && checkpoint.finished(repo) {
+			continue
+		}
+		var sigs []signatureWithRepo
+		err := retryGitbase(ctx, opts.QueryTimeout, func(ctx context.Context) error {
+			var err error
+			sigs, err = queryRepositorySignatures(ctx, db, opts.Filters, repo)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to fetch the signatures in %s: %v", repo, err)
+		}
+		for _, sig := range sigs {
+			if checkpoint != nil {
+				if err := checkpoint.cache.write(sig); err != nil {
+					return err
+				}
+			}
+			if err := visit(sig); err != nil {
+				return err
+			}
+		}
+		if checkpoint != nil {
+			if err := checkpoint.finish(repo); err != nil {
+				return err
+			}
+		}
+	}
+	setProgress(len(repos))
+	return nil
+}
+
+// signaturesCheckpoint keeps the progress of fetching the signatures cache from gitbase, so that
+// an interrupted run resumes where it stopped. The signatures are appended to the temporary
+// cache file and each finished repository is appended to the progress file together with
+// the size of the temporary cache at that moment.
+type signaturesCheckpoint struct {
+	cache    *signaturesCacheWriter
+	progress *os.File
+	done     map[string]struct{}
+}
+
+// progressPath returns the path to the progress file of the signatures cache.
+func progressPath(cachePath string) string {
+	return cachePath + ".progress"
+}
+
+// openSignaturesCheckpoint starts writing the signatures cache at path. If the previous run
+// with the same query was interrupted, its finished repositories are visited from
+// the temporary cache and the rest of it is discarded.
+func openSignaturesCheckpoint(path, query string, visit signatureVisitor) (
+	*signaturesCheckpoint, error) {
+	checkpoint, err := resumeSignaturesCheckpoint(path, query, visit)
+	if checkpoint != nil || err != nil {
+		return checkpoint, err
+	}
+	cache, err := newSignaturesCacheWriter(path)
+	if err != nil {
+		return nil, err
+	}
+	// the header must be on disk before the first checkpoint refers to it
+	if err = cache.flush(); err != nil {
+		cache.abort()
+		return nil, err
+	}
+	progress, err := os.Create(progressPath(path))
+	if err == nil {
+		_, err = fmt.Fprintf(progress, "%s\n", query)
+	}
+	if err != nil {
+		cache.abort()
+		return nil, err
+	}
+	return &signaturesCheckpoint{cache: cache, progress: progress, done: map[string]struct{}{}}, nil
+}
+
+// resumeSignaturesCheckpoint returns nil without an error if there is nothing to resume.
+func resumeSignaturesCheckpoint(path, query string, visit signatureVisitor) (
+	*signaturesCheckpoint, error) {
+	tmpPath := path + ".tmp"
+	if _, err := os.Stat(tmpPath); err != nil {
+		return nil, nil
+	}
+	done, offset, err := readSignaturesProgress(progressPath(path), query)
+	if err != nil || offset == 0 {
+		if err != nil {
+			logrus.Warnf("cannot resume fetching the signatures: %v", err)
+		}
+		return nil, nil
+	}
+	if err = os.Truncate(tmpPath, offset); err != nil {
+		return nil, err
+	}
+	logrus.Printf("resuming fetching the signatures after %d repositories", len(done))
+	if err = scanSignatures(tmpPath, InputOptions{Format: "csv"}, visit); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+	progress, err := os.OpenFile(progressPath(path), os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &signaturesCheckpoint{
+		cache:    &signaturesCacheWriter{path: path, file: file, writer: csv.NewWriter(file)},
+		progress: progress,
+		done:     done,
+	}, nil
+}
+
+// readSignaturesProgress reads the finished repositories and the size of the temporary cache
+// after the last of them. The offset is zero if the progress was recorded for another query.
+// The last line may be truncated by the interruption and is ignored then.
+func readSignaturesProgress(path, query string) (map[string]struct{}, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	if !scanner.Scan() || scanner.Text() != query {
+		return nil, 0, scanner.Err()
+	}
+	done := map[string]struct{}{}
+	var offset int64
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), "\t", 2)
+		if len(parts) != 2 {
+			break
+		}
+		size, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			break
+		}
+		done[parts[1]] = struct{}{}
+		offset = size
+	}
+	return done, offset, scanner.Err()
+}
+
+// finished indicates whether the repository was fetched by the interrupted run.
+func (c *signaturesCheckpoint) finished(repo string) bool {
+	_, exists := c.done[repo]
+	return exists
+}
+
+// finish records that all the signatures in the repository are written.
+func (c *signaturesCheckpoint) finish(repo string) error {
+	if err := c.cache.flush(); err != nil {
+		return err
+	}
+	if err := c.cache.file.Sync(); err != nil {
+		return err
+	}
+	offset, err := c.cache.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err = fmt.Fprintf(c.progress, "%d\t%s\n", offset, repo); err != nil {
+		return err
+	}
+	c.done[repo] = struct{}{}
+	return c.progress.Sync()
+}
+
+// commit moves the complete cache to the destination and removes the progress.
+func (c *signaturesCheckpoint) commit() error {
+	err := c.cache.commit()
+	if errClose := c.progress.Close(); err == nil {
+		err = errClose
+	}
+	if err == nil {
+		err = os.Remove(c.progress.Name())
+	}
+	return err
+}
+
+// suspend closes the files and keeps them to resume later.
+func (c *signaturesCheckpoint) suspend() {
+	if err := c.cache.flush(); err != nil {
+		logrus.Warnf("failed to flush the signatures cache: %v", err)
+	}
+	_ = c.cache.file.Close()
+	_ = c.progress.Close()
+}
@@ -0,0 +1,298 @@
+package idmatch
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/stretchr/testify/require"
+)
+
+// testGitbase serves the signatures of the repositories from memory. The queries fail with
+// the errors in failures first, the key of the repositories listing is empty.
+type testGitbase struct {
+	lock     sync.Mutex
+	repos    map[string][]signatureWithRepo
+	failures map[string][]error
+	// queried are the repositories whose signatures were queried successfully
+	queried []string
+}
+
+var (
+	testGitbaseOnce    sync.Once
+	testGitbaseCurrent *testGitbase
+)
+
+// useTestGitbase makes scanSignaturesFromDatabase() query the in-memory gitbase.
+func useTestGitbase(t *testing.T, gitbase *testGitbase) {
+	testGitbaseOnce.Do(func() { sql.Register("idmatch-test-gitbase", testGitbaseDriver{}) })
+	originalDriver, originalDelay := gitbaseDriver, gitbaseRetryBaseDelay
+	gitbaseDriver, gitbaseRetryBaseDelay = "idmatch-test-gitbase", time.Millisecond
+	testGitbaseCurrent = gitbase
+	t.Cleanup(func() {
+		gitbaseDriver, gitbaseRetryBaseDelay = originalDriver, originalDelay
+		testGitbaseCurrent = nil
+	})
+}
+
+type testGitbaseDriver struct{}
+
+func (testGitbaseDriver) Open(name string) (driver.Conn, error) {
+	return testGitbaseConn{}, nil
+}
+
+type testGitbaseConn struct{}
+
+func (testGitbaseConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (testGitbaseConn) Close() error {
+	return nil
+}
+
+func (testGitbaseConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (testGitbaseConn) QueryContext(ctx context.Context, query string,
+	args []driver.NamedValue) (driver.Rows, error) {
+	gitbase := testGitbaseCurrent
+	gitbase.lock.Lock()
+	defer gitbase.lock.Unlock()
+	repo := ""
+	if pos := strings.Index(query, "repository_id = '"); pos >= 0 {
+		repo = query[pos+len("repository_id = '"):]
+		repo = repo[:strings.Index(repo, "'")]
+	}
+	if failures := gitbase.failures[repo]; len(failures) > 0 {
+		gitbase.failures[repo] = failures[1:]
+		return nil, failures[0]
+	}
+	rows := &testGitbaseRows{}
+	if repo == "" {
+		rows.columns = []string{"repository_id"}
+		var repos []string
+		for repo := range gitbase.repos {
+			repos = append(repos, repo)
+		}
+		sort.Strings(repos)
+		for _, repo := range repos {
+			rows.values = append(rows.values, []driver.Value{repo})
+		}
+		return rows, nil
+	}
+	gitbase.queried = append(gitbase.queried, repo)
+	rows.columns = []string{"repository_id", "commit_author_name", "commit_author_email",
+		"MAX(commit_hash)", "MIN(commit_author_when)", "MAX(commit_author_when)", "COUNT(*)"}
+	for _, sig := range gitbase.repos[repo] {
+		rows.values = append(rows.values, []driver.Value{
+			sig.repo, sig.name, sig.email, sig.hash, sig.firstSeen, sig.time, int64(sig.commits)})
+	}
+	return rows, nil
+}
+
+type testGitbaseRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *testGitbaseRows) Columns() []string {
+	return r.columns
+}
+
+func (r *testGitbaseRows) Close() error {
+	return nil
+}
+
+func (r *testGitbaseRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+// newTestGitbase returns the gitbase with Signatures grouped by repository.
+func newTestGitbase() *testGitbase {
+	gitbase := &testGitbase{repos: map[string][]signatureWithRepo{}, failures: map[string][]error{}}
+	for _, sig := range Signatures {
+		sig.firstSeen = sig.time
+		sig.commits = 1
+		gitbase.repos[sig.repo] = append(gitbase.repos[sig.repo], sig)
+	}
+	return gitbase
+}
+
+// collectSignatures returns the visitor which appends to the slice.
+func collectSignatures(sigs *[]signatureWithRepo) signatureVisitor {
+	return func(sig signatureWithRepo) error {
+		*sigs = append(*sigs, sig)
+		return nil
+	}
+}
+
+// sortedSignatures returns the signatures sorted by their hashes.
+func sortedSignatures(sigs []signatureWithRepo) []signatureWithRepo {
+	sort.Slice(sigs, func(i, j int) bool { return sigs[i].hash < sigs[j].hash })
+	return sigs
+}
+
+// cleanTestSignatures cleans the names and the emails and sorts the signatures by their hashes.
+func cleanTestSignatures(sigs []signatureWithRepo) []signatureWithRepo {
+	for i := range sigs {
+		sigs[i].name, _ = cleanName(sigs[i].name)
+		sigs[i].email, _ = cleanEmail(sigs[i].email)
+	}
+	return sortedSignatures(sigs)
+}
+
+func TestScanSignaturesFromDatabaseRetries(t *testing.T) {
+	req := require.New(t)
+	gitbase := newTestGitbase()
+	gitbase.failures[""] = []error{driver.ErrBadConn}
+	gitbase.failures["repo1"] = []error{mysql.ErrInvalidConn, &mysql.MySQLError{Number: 2013}}
+	useTestGitbase(t, gitbase)
+	var sigs []signatureWithRepo
+	req.NoError(scanSignaturesFromDatabase(
+		context.Background(), GitbaseOptions{}, nil, collectSignatures(&sigs)))
+	// the failed queries do not visit the signatures twice
+	expected := newTestGitbase()
+	req.Equal(sortedSignatures(append(expected.repos["repo1"], expected.repos["repo2"]...)),
+		sortedSignatures(sigs))
+	req.Equal([]string{"repo1", "repo2"}, gitbase.queried)
+}
+
+func TestScanSignaturesFromDatabasePermanentError(t *testing.T) {
+	req := require.New(t)
+	gitbase := newTestGitbase()
+	gitbase.failures["repo1"] = []error{&mysql.MySQLError{Number: 1105, Message: "syntax"}}
+	useTestGitbase(t, gitbase)
+	err := scanSignaturesFromDatabase(context.Background(), GitbaseOptions{}, nil,
+		func(signatureWithRepo) error { return nil })
+	req.EqualError(err, "failed to fetch the signatures in repo1: Error 1105: syntax")
+	req.Empty(gitbase.queried)
+}
+
+func TestFindSignaturesResume(t *testing.T) {
+	req := require.New(t)
+	path := filepath.Join(t.TempDir(), "signatures.csv")
+	gitbase := newTestGitbase()
+	gitbase.failures["repo2"] = []error{&mysql.MySQLError{Number: 1105, Message: "crash"}}
+	useTestGitbase(t, gitbase)
+	var sigs []signatureWithRepo
+	req.Error(findSignatures(context.Background(), GitbaseOptions{}, path,
+		collectSignatures(&sigs)))
+	_, err := os.Stat(path)
+	req.True(os.IsNotExist(err))
+	req.Equal([]string{"repo1"}, gitbase.queried)
+
+	// simulate the signatures of repo2 which were written before the interruption
+	tmp, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_APPEND, 0666)
+	req.NoError(err)
+	_, err = tmp.WriteString("repo2,bob,bob@google.com,zzz,")
+	req.NoError(err)
+	req.NoError(tmp.Close())
+
+	sigs = nil
+	req.NoError(findSignatures(context.Background(), GitbaseOptions{}, path,
+		collectSignatures(&sigs)))
+	req.Equal([]string{"repo1", "repo2"}, gitbase.queried)
+	expected := newTestGitbase()
+	all := cleanTestSignatures(append(expected.repos["repo1"], expected.repos["repo2"]...))
+	// the signatures of repo1 are read from the cache which stores them cleaned
+	req.Equal(all, cleanTestSignatures(sigs))
+	for _, name := range []string{path + ".tmp", progressPath(path)} {
+		_, err = os.Stat(name)
+		req.True(os.IsNotExist(err), name)
+	}
+	cached, err := readSignaturesFromDisk(path)
+	req.NoError(err)
+	req.Equal(all, cleanTestSignatures(cached))
+}
+
+func TestFindSignaturesResumeAnotherQuery(t *testing.T) {
+	req := require.New(t)
+	path := filepath.Join(t.TempDir(), "signatures.csv")
+	gitbase := newTestGitbase()
+	gitbase.failures["repo2"] = []error{&mysql.MySQLError{Number: 1105, Message: "crash"}}
+	useTestGitbase(t, gitbase)
+	req.Error(findSignatures(context.Background(), GitbaseOptions{}, path,
+		func(signatureWithRepo) error { return nil }))
+	opts := GitbaseOptions{Filters: SignatureFilters{Refs: []string{"master"}}}
+	req.NoError(findSignatures(context.Background(), opts, path,
+		func(signatureWithRepo) error { return nil }))
+	// the progress of the unfiltered query is discarded
+	req.Equal([]string{"repo1", "repo1", "repo2"}, gitbase.queried)
+}
+
+func TestFindPeopleTimezoneOverlap(t *testing.T) {
+	req := require.New(t)
+	useTestGitbase(t, newTestGitbase())
+	people, _, _, err := FindPeople(context.Background(), GitbaseOptions{}, "",
+		newTestBlacklist(t), 12)
+	req.NoError(err)
+	req.NotEmpty(people)
+	// gitbase does not expose the commit UTC offsets
+	req.False(people.hasTimezones())
+	err = ReducePeople(people, nil, newTestBlacklist(t), ReduceOptions{
+		MaxIdentities: 100, MinTimezoneOverlap: 0.5})
+	req.EqualError(err, "the timezone overlap check requires the commit timezones but "+
+		"the signatures have none: gitbase does not expose the commit UTC offsets, "+
+		"set the timezones column of the input or of the signatures cache")
+	req.NoError(ReducePeople(people, nil, newTestBlacklist(t), ReduceOptions{MaxIdentities: 100}))
+}
+
+func TestReadSignaturesProgress(t *testing.T) {
+	req := require.New(t)
+	path := filepath.Join(t.TempDir(), "signatures.csv.progress")
+	req.NoError(ioutil.WriteFile(path, []byte("abc\n100\trepo1\n200\trepo 2\n30"), 0666))
+	done, offset, err := readSignaturesProgress(path, "abc")
+	req.NoError(err)
+	req.Equal(map[string]struct{}{"repo1": {}, "repo 2": {}}, done)
+	req.Equal(int64(200), offset)
+	_, offset, err = readSignaturesProgress(path, "def")
+	req.NoError(err)
+	req.Zero(offset)
+}
+
+func TestIsTransientGitbaseError(t *testing.T) {
+	req := require.New(t)
+	for _, err := range []error{driver.ErrBadConn, mysql.ErrInvalidConn, io.EOF,
+		context.DeadlineExceeded, &mysql.MySQLError{Number: 2006}} {
+		req.True(isTransientGitbaseError(err), err.Error())
+	}
+	for _, err := range []error{context.Canceled, errors.New("syntax error"),
+		&mysql.MySQLError{Number: 1105}} {
+		req.False(isTransientGitbaseError(err), err.Error())
+	}
+}
+
+func TestRetryGitbaseTimeout(t *testing.T) {
+	req := require.New(t)
+	defer func(original time.Duration) { gitbaseRetryBaseDelay = original }(gitbaseRetryBaseDelay)
+	gitbaseRetryBaseDelay = time.Millisecond
+	attempts := 0
+	err := retryGitbase(context.Background(), time.Millisecond, func(ctx context.Context) error {
+		attempts++
+		if attempts < 3 {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	})
+	req.NoError(err)
+	req.Equal(3, attempts)
+}
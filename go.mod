@@ -1,28 +1,47 @@
 module github.com/src-d/identity-matching
 
+go 1.22
+
 require (
-	github.com/apache/thrift v0.12.0 // indirect
 	github.com/briandowns/spinner v1.6.1
+	github.com/go-asn1-ber/asn1-ber v1.5.1
+	github.com/go-ldap/ldap/v3 v3.4.1
 	github.com/go-sql-driver/mysql v1.4.1
-	github.com/golang/snappy v0.0.1 // indirect
-	github.com/google/go-github v17.0.0+incompatible // indirect
+	github.com/klauspost/compress v1.18.0
 	github.com/mjibson/esc v0.2.0
-	github.com/pkg/errors v0.8.1 // indirect
 	github.com/sirupsen/logrus v1.3.0
 	github.com/spf13/pflag v1.0.3
 	github.com/stretchr/testify v1.3.0
-	github.com/wbrefvem/go-bitbucket v0.0.0-20190128183802-fc08fd046abb
 	github.com/xanzy/go-gitlab v0.18.0
 	github.com/xitongsys/parquet-go v1.3.0
 	github.com/xitongsys/parquet-go-source v0.0.0-20190611011107-a9b8f78bccbe
-	golang.org/x/crypto v0.0.0-20191001141032-4663e185863a // indirect
+	go.etcd.io/bbolt v1.3.6
 	golang.org/x/lint v0.0.0-20190930215403-16217165b5de
-	golang.org/x/net v0.0.0-20190930134127-c5a3c61f89f3 // indirect
-	golang.org/x/oauth2 v0.0.0-20190219183015-4b83411ed2b3
-	golang.org/x/sync v0.0.0-20190911185100-cd5d95a43a6e // indirect
-	golang.org/x/sys v0.0.0-20190927073244-c990c680b611 // indirect
-	golang.org/x/text v0.3.2
-	golang.org/x/tools v0.0.0-20191010075000-0337d82405ff
+	golang.org/x/text v0.14.0
+	golang.org/x/tools v0.10.0
 	gonum.org/v1/gonum v0.0.0-20190624220246-e34e6b933b2b
 	gopkg.in/google/go-github.v15 v15.0.0
 )
+
+require (
+	github.com/Azure/go-ntlmssp v0.0.0-20200615164410-66371956d46c // indirect
+	github.com/apache/thrift v0.12.0 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/fatih/color v1.7.0 // indirect
+	github.com/golang/protobuf v1.2.0 // indirect
+	github.com/golang/snappy v0.0.1 // indirect
+	github.com/google/go-github v17.0.0+incompatible // indirect
+	github.com/google/go-querystring v1.0.0 // indirect
+	github.com/konsorten/go-windows-terminal-sequences v1.0.1 // indirect
+	github.com/mattn/go-colorable v0.1.2 // indirect
+	github.com/mattn/go-isatty v0.0.8 // indirect
+	github.com/pkg/errors v0.8.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	golang.org/x/crypto v0.17.0 // indirect
+	golang.org/x/mod v0.11.0 // indirect
+	golang.org/x/net v0.19.0 // indirect
+	golang.org/x/oauth2 v0.0.0-20190219183015-4b83411ed2b3 // indirect
+	golang.org/x/sys v0.15.0 // indirect
+	golang.org/x/term v0.15.0 // indirect
+	google.golang.org/appengine v1.4.0 // indirect
+)
@@ -0,0 +1,575 @@
+package idmatch
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/sirupsen/logrus"
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/reader"
+	"github.com/xitongsys/parquet-go/source"
+)
+
+// InputOptions configure reading the signatures from a tabular file.
+type InputOptions struct {
+	// Format is one of InputFormats. The empty format is detected by the file extension or,
+	// if it is unknown, by the contents.
+	Format string
+	// Columns maps the signature fields to the column names in the file, e.g. "email" to
+	// "author_email". The fields which are not mapped are read from the columns with the same
+	// names.
+	Columns map[string]string
+}
+
+// InputFormats are the supported formats of the signatures input.
+var InputFormats = []string{"csv", "jsonl", "parquet"}
+
+// StdinPath is the input path which means the standard input.
+const StdinPath = "-"
+
+// requiredSignatureColumns must be present in the input, the rest of signaturesCacheColumns
+// are optional.
+var requiredSignatureColumns = map[string]struct{}{"repo": {}, "name": {}, "email": {}}
+
+// parquetChunkSize is the number of rows read from each Parquet column at once.
+const parquetChunkSize = 10000
+
+// ParseInputColumns parses the comma-separated field=column pairs, e.g.
+// "email=author_email,name=author_name". The fields are the signaturesCacheColumns.
+func ParseInputColumns(spec string) (map[string]string, error) {
+	columns := map[string]string{}
+	if spec == "" {
+		return columns, nil
+	}
+	known := map[string]struct{}{}
+	for _, name := range signaturesCacheColumns {
+		known[name] = struct{}{}
+	}
+	for _, item := range strings.Split(spec, ",") {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("invalid column mapping: %s", item)
+		}
+		if _, exists := known[parts[0]]; !exists {
+			return nil, fmt.Errorf("unknown signature field %s, must be one of %s", parts[0],
+				strings.Join(signaturesCacheColumns, ", "))
+		}
+		columns[parts[0]] = parts[1]
+	}
+	return columns, nil
+}
+
+// tableReader reads the rows of a tabular input as strings.
+type tableReader interface {
+	// Columns returns the names of the columns.
+	Columns() []string
+	// Read returns the next row aligned with Columns(). It returns io.EOF after the last row.
+	Read() ([]string, error)
+}
+
+// multiCloser closes several layers of the input, the outermost first.
+type multiCloser []io.Closer
+
+func (c multiCloser) Close() error {
+	var result error
+	for _, closer := range c {
+		if err := closer.Close(); err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+// nopCloser does not close stdin.
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
+
+// openInput opens the file or stdin if the path is StdinPath and decompresses gzip and zstd
+// detected by the magic bytes. It returns whether the contents were compressed.
+func openInput(path string) (*bufio.Reader, multiCloser, bool, error) {
+	var raw io.Reader
+	var closers multiCloser
+	if path == StdinPath {
+		raw = os.Stdin
+		closers = multiCloser{nopCloser{}}
+	} else {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		raw = file
+		closers = multiCloser{file}
+	}
+	buffered := bufio.NewReader(raw)
+	magic, _ := buffered.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			closers.Close()
+			return nil, nil, false, err
+		}
+		return bufio.NewReader(gz), append(multiCloser{gz}, closers...), true, nil
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		zr, err := zstd.NewReader(buffered)
+		if err != nil {
+			closers.Close()
+			return nil, nil, false, err
+		}
+		zrc := zr.IOReadCloser()
+		return bufio.NewReader(zrc), append(multiCloser{zrc}, closers...), true, nil
+	}
+	return buffered, closers, false, nil
+}
+
+// detectInputFormat returns the format by the file extension, ignoring the compression
+// extensions, or by the first bytes of the decompressed contents.
+func detectInputFormat(path string, contents *bufio.Reader) string {
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext == ".gz" || ext == ".zst" || ext == ".zstd" {
+		ext = strings.ToLower(filepath.Ext(strings.TrimSuffix(path, filepath.Ext(path))))
+	}
+	switch ext {
+	case ".csv":
+		return "csv"
+	case ".jsonl", ".ndjson":
+		return "jsonl"
+	case ".parquet":
+		return "parquet"
+	}
+	head, _ := contents.Peek(4)
+	if bytes.Equal(head, []byte("PAR1")) {
+		return "parquet"
+	}
+	if trimmed := bytes.TrimLeft(head, " \t\r\n"); len(trimmed) > 0 && trimmed[0] == '{' {
+		return "jsonl"
+	}
+	return "csv"
+}
+
+// openTable opens the tabular input at path in the given or detected format. mapping is
+// the same as InputOptions.Columns, it names the columns of the schemaless formats.
+func openTable(path, format string, mapping map[string]string) (
+	tableReader, io.Closer, string, error) {
+	contents, closer, compressed, err := openInput(path)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if format == "" {
+		format = detectInputFormat(path, contents)
+	}
+	var table tableReader
+	switch format {
+	case "csv":
+		table, err = newCSVTableReader(contents)
+	case "jsonl":
+		table = newJSONLTableReader(contents, mappedSignatureColumns(mapping))
+	case "parquet":
+		var file source.ParquetFile
+		if path != StdinPath && !compressed {
+			file, err = local.NewLocalFileReader(path)
+		} else {
+			// Parquet needs random access
+			var data []byte
+			if data, err = ioutil.ReadAll(contents); err == nil {
+				file, err = buffer.NewBufferFile(data)
+			}
+		}
+		if err == nil {
+			closer = append(multiCloser{file}, closer...)
+			table, err = newParquetTableReader(file)
+		}
+	default:
+		err = fmt.Errorf("unsupported input format %s, must be one of %s", format,
+			strings.Join(InputFormats, ", "))
+	}
+	if err != nil {
+		closer.Close()
+		return nil, nil, "", err
+	}
+	return table, closer, format, nil
+}
+
+// csvTableReader reads CSV with the header.
+type csvTableReader struct {
+	reader  *csv.Reader
+	columns []string
+}
+
+func newCSVTableReader(contents io.Reader) (*csvTableReader, error) {
+	r := csv.NewReader(contents)
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return &csvTableReader{reader: r, columns: header}, nil
+}
+
+func (t *csvTableReader) Columns() []string {
+	return t.columns
+}
+
+func (t *csvTableReader) Read() ([]string, error) {
+	record, err := t.reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	if len(record) != len(t.columns) {
+		return nil, fmt.Errorf("invalid CSV record: %s", strings.Join(record, ","))
+	}
+	return record, nil
+}
+
+// jsonlTableReader reads one JSON object per line. The objects do not share a header, so
+// the columns are given and each of them is looked up in every object; the absent keys are
+// empty.
+type jsonlTableReader struct {
+	decoder *json.Decoder
+	columns []string
+}
+
+func newJSONLTableReader(contents io.Reader, columns []string) *jsonlTableReader {
+	t := &jsonlTableReader{decoder: json.NewDecoder(contents), columns: columns}
+	t.decoder.UseNumber()
+	return t
+}
+
+func (t *jsonlTableReader) Columns() []string {
+	return t.columns
+}
+
+func (t *jsonlTableReader) Read() ([]string, error) {
+	var object map[string]interface{}
+	if err := t.decoder.Decode(&object); err != nil {
+		if err == io.EOF {
+			return nil, err
+		}
+		return nil, fmt.Errorf("invalid JSONL input: %v", err)
+	}
+	record := make([]string, len(t.columns))
+	for i, column := range t.columns {
+		switch value := object[column].(type) {
+		case nil:
+		case string:
+			record[i] = value
+		case json.Number:
+			record[i] = value.String()
+		case bool:
+			record[i] = strconv.FormatBool(value)
+		default:
+			return nil, fmt.Errorf("invalid JSONL input: unsupported value of %s: %v",
+				column, value)
+		}
+	}
+	return record, nil
+}
+
+// parquetTableReader reads the top-level columns of a Parquet file in chunks.
+type parquetTableReader struct {
+	reader    *reader.ParquetReader
+	columns   []string
+	elements  []*parquet.SchemaElement
+	remaining int64
+	chunk     [][]string
+}
+
+func newParquetTableReader(file source.ParquetFile) (*parquetTableReader, error) {
+	pr, err := reader.NewParquetColumnReader(file, int64(runtime.NumCPU()))
+	if err != nil {
+		return nil, fmt.Errorf("invalid Parquet input: %v", err)
+	}
+	t := &parquetTableReader{reader: pr, remaining: pr.GetNumRows()}
+	root := pr.SchemaHandler.GetRootName() + "."
+	for _, path := range pr.SchemaHandler.ValueColumns {
+		name := strings.TrimPrefix(path, root)
+		if strings.Contains(name, ".") {
+			// nested columns are not supported
+			continue
+		}
+		t.columns = append(t.columns, name)
+		t.elements = append(t.elements,
+			pr.SchemaHandler.SchemaElements[pr.SchemaHandler.MapIndex[path]])
+	}
+	return t, nil
+}
+
+func (t *parquetTableReader) Columns() []string {
+	return t.columns
+}
+
+func (t *parquetTableReader) Read() ([]string, error) {
+	if len(t.chunk) == 0 {
+		if t.remaining == 0 {
+			return nil, io.EOF
+		}
+		size := int64(parquetChunkSize)
+		if size > t.remaining {
+			size = t.remaining
+		}
+		t.chunk = make([][]string, size)
+		for i := range t.chunk {
+			t.chunk[i] = make([]string, len(t.columns))
+		}
+		for j, column := range t.columns {
+			values, err := t.readColumn(column, size)
+			if err != nil {
+				return nil, err
+			}
+			for i, value := range values {
+				t.chunk[i][j] = parquetValueString(value, t.elements[j])
+			}
+		}
+		t.remaining -= size
+	}
+	record := t.chunk[0]
+	t.chunk = t.chunk[1:]
+	return record, nil
+}
+
+// readColumn returns the next size values of the top-level column. ReadColumnByPath() of
+// parquet-go ignores the errors of opening the column and of reading its pages, so the column
+// buffer is opened and filled here to report them.
+func (t *parquetTableReader) readColumn(column string, size int64) ([]interface{}, error) {
+	path := t.reader.SchemaHandler.GetRootName() + "." + column
+	buffer, exists := t.reader.ColumnBuffers[path]
+	if !exists {
+		var err error
+		buffer, err = reader.NewColumnBuffer(
+			t.reader.PFile, t.reader.Footer, t.reader.SchemaHandler, path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Parquet input: failed to open column %s: %v",
+				column, err)
+		}
+		t.reader.ColumnBuffers[path] = buffer
+	}
+	// the same loop as in ColumnBufferType.ReadRows() which drops the error
+	var err error
+	for buffer.DataTableNumRows < size && err == nil {
+		err = buffer.ReadPage()
+	}
+	if buffer.DataTableNumRows < size {
+		return nil, fmt.Errorf("invalid Parquet input: failed to read column %s: %v", column, err)
+	}
+	table, _ := buffer.ReadRows(size)
+	return table.Values, nil
+}
+
+// parquetValueString converts the Parquet value to a string. The timestamps and the dates
+// are formatted as RFC3339.
+func parquetValueString(value interface{}, element *parquet.SchemaElement) string {
+	if value == nil {
+		return ""
+	}
+	if element.GetType() == parquet.Type_INT96 {
+		return int96ToTime(value.(string)).Format(time.RFC3339)
+	}
+	if element.IsSetConvertedType() {
+		var number int64
+		switch v := value.(type) {
+		case int32:
+			number = int64(v)
+		case int64:
+			number = v
+		}
+		switch element.GetConvertedType() {
+		case parquet.ConvertedType_TIMESTAMP_MILLIS:
+			return fromMillis(number).Format(time.RFC3339)
+		case parquet.ConvertedType_TIMESTAMP_MICROS:
+			return time.Unix(0, number*int64(time.Microsecond)).UTC().Format(time.RFC3339)
+		case parquet.ConvertedType_DATE:
+			return time.Unix(number*24*60*60, 0).UTC().Format(time.RFC3339)
+		}
+	}
+	return fmt.Sprint(value)
+}
+
+// int96ToTime converts the legacy Parquet timestamp: the nanoseconds of the day and the Julian
+// day, both little-endian.
+func int96ToTime(value string) time.Time {
+	if len(value) != 12 {
+		return time.Time{}
+	}
+	nanos := int64(binary.LittleEndian.Uint64([]byte(value[:8])))
+	days := int64(binary.LittleEndian.Uint32([]byte(value[8:])))
+	const unixEpochJulianDay = 2440588
+	return time.Unix((days-unixEpochJulianDay)*24*60*60, nanos).UTC()
+}
+
+// mappedSignatureColumns returns the input column names of signaturesCacheColumns according to
+// the mapping, see InputOptions.Columns.
+func mappedSignatureColumns(mapping map[string]string) []string {
+	columns := make([]string, len(signaturesCacheColumns))
+	for i, field := range signaturesCacheColumns {
+		if column, mapped := mapping[field]; mapped {
+			columns[i] = column
+		} else {
+			columns[i] = field
+		}
+	}
+	return columns
+}
+
+// mapSignatureColumns returns the positions of the signature fields in the input columns.
+// The optional fields which are absent are not mapped.
+func mapSignatureColumns(columns []string, mapping map[string]string, format string) (
+	map[string]int, error) {
+	positions := map[string]int{}
+	for i, column := range columns {
+		positions[column] = i
+	}
+	index := map[string]int{}
+	for _, field := range signaturesCacheColumns {
+		column, mapped := mapping[field]
+		if !mapped {
+			column = field
+		}
+		position, exists := positions[column]
+		if !exists {
+			if _, required := requiredSignatureColumns[field]; required || mapped {
+				return nil, fmt.Errorf("invalid %s file: missing column %s",
+					strings.ToUpper(format), column)
+			}
+			continue
+		}
+		index[field] = position
+	}
+	return index, nil
+}
+
+// inputTimeLayouts are the accepted formats of the times besides the Unix timestamps.
+var inputTimeLayouts = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02T15:04:05",
+	"2006-01-02"}
+
+// parseInputTime parses the time in one of inputTimeLayouts, in UTC if the timezone is not
+// specified, or the Unix timestamp in seconds, possibly fractional or in the exponent notation
+// as the JSON numbers are. The empty value is the zero time.
+func parseInputTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0).UTC(), nil
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil &&
+		!math.IsNaN(seconds) && !math.IsInf(seconds, 0) {
+		whole, fraction := math.Modf(seconds)
+		return time.Unix(int64(whole), int64(math.Round(fraction*1e9))).UTC(), nil
+	}
+	var err error
+	for _, layout := range inputTimeLayouts {
+		var parsed time.Time
+		if parsed, err = time.Parse(layout, value); err == nil {
+			return parsed, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+// parseSignature converts the input row to the signature. index maps the fields to
+// the positions in the row.
+func parseSignature(record []string, index map[string]int) (signatureWithRepo, error) {
+	text := func(field string) string {
+		if position, exists := index[field]; exists {
+			return strings.TrimSpace(record[position])
+		}
+		return ""
+	}
+	var sig signatureWithRepo
+	for _, field := range []struct {
+		name string
+		dest *string
+	}{{"repo", &sig.repo}, {"name", &sig.name}, {"email", &sig.email}, {"hash", &sig.hash}} {
+		normValue, _, err := removeDiacritical(text(field.name))
+		if err != nil {
+			return sig, err
+		}
+		*field.dest = strings.TrimSpace(normalizeSpaces(strings.ToLower(normValue)))
+	}
+	var err error
+	if sig.time, err = parseInputTime(text("time")); err != nil {
+		return sig, err
+	}
+	if sig.firstSeen, err = parseInputTime(text("first_seen")); err != nil {
+		return sig, err
+	}
+	if commits := text("commits"); commits != "" {
+		if sig.commits, err = strconv.Atoi(commits); err != nil {
+			return sig, err
+		}
+	}
+	sig.timezones, err = parseTimezoneHistogram(text("timezones"))
+	return sig, err
+}
+
+// scanSignatures streams the signatures from the tabular file at path, StdinPath means stdin.
+// The rows without the repository, the name or the email are skipped.
+func scanSignatures(path string, opts InputOptions, visit signatureVisitor) (err error) {
+	table, closer, format, err := openTable(path, opts.Format, opts.Columns)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		errClose := closer.Close()
+		if err == nil {
+			err = errClose
+		}
+	}()
+	if len(table.Columns()) == 0 {
+		return nil
+	}
+	index, err := mapSignatureColumns(table.Columns(), opts.Columns, format)
+	if err != nil {
+		return err
+	}
+	for {
+		record, err := table.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		sig, err := parseSignature(record, index)
+		if err != nil || sig.repo == "" || sig.email == "" || sig.name == "" {
+			logrus.Warnf("invalid input row: %v: %v", sig.String(), err)
+			continue
+		}
+		if err = visit(sig); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSignatures reads all the signatures from the tabular file into memory. Use
+// scanSignatures() for the large inputs.
+func readSignatures(path string, opts InputOptions) ([]signatureWithRepo, error) {
+	var commits []signatureWithRepo
+	err := scanSignatures(path, opts, func(sig signatureWithRepo) error {
+		commits = append(commits, sig)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return commits, nil
+}
@@ -0,0 +1,248 @@
+package idmatch
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+func TestParseInputColumns(t *testing.T) {
+	req := require.New(t)
+	columns, err := ParseInputColumns("email=author_email,name=author_name")
+	req.NoError(err)
+	req.Equal(map[string]string{"email": "author_email", "name": "author_name"}, columns)
+	columns, err = ParseInputColumns("")
+	req.NoError(err)
+	req.Empty(columns)
+	_, err = ParseInputColumns("email")
+	req.EqualError(err, "invalid column mapping: email")
+	_, err = ParseInputColumns("author=author_name")
+	req.Error(err)
+}
+
+func TestParseInputTime(t *testing.T) {
+	req := require.New(t)
+	expected := time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, value := range []string{
+		"2019-01-02T03:04:05Z", "2019-01-02 03:04:05", "2019-01-02T03:04:05", "1546398245"} {
+		parsed, err := parseInputTime(value)
+		req.NoError(err, value)
+		req.True(expected.Equal(parsed), value)
+	}
+	// the JSON numbers
+	for value, expected := range map[string]time.Time{
+		"1546398245.5":  expected.Add(500 * time.Millisecond),
+		"1.546398245e9": expected,
+		"1546398245.0":  expected,
+	} {
+		parsed, err := parseInputTime(value)
+		req.NoError(err, value)
+		req.True(expected.Equal(parsed), value)
+	}
+	parsed, err := parseInputTime("")
+	req.NoError(err)
+	req.True(parsed.IsZero())
+	for _, value := range []string{"yesterday", "NaN", "Inf"} {
+		_, err = parseInputTime(value)
+		req.Error(err, value)
+	}
+}
+
+func TestReadSignaturesMinimalCSV(t *testing.T) {
+	req := require.New(t)
+	path := filepath.Join(t.TempDir(), "signatures.csv")
+	req.NoError(ioutil.WriteFile(path, []byte(`repo,email,name,branch
+repo1,Bob@google.com,Bob,master
+repo1,alice@google.com,,master
+`), 0666))
+	commits, err := readSignaturesFromDisk(path)
+	req.NoError(err)
+	req.Equal([]signatureWithRepo{{repo: "repo1", name: "bob", email: "bob@google.com"}}, commits)
+	people, err := newPeople(commits, newTestBlacklist(t))
+	req.NoError(err)
+	req.Nil(people[1].SampleCommit)
+}
+
+func TestReadSignaturesColumnMapping(t *testing.T) {
+	req := require.New(t)
+	path := filepath.Join(t.TempDir(), "export")
+	req.NoError(ioutil.WriteFile(path, []byte(`repository,author_email,author_name,sha,committed_at
+repo1,bob@google.com,Bob,aaa,2019-01-01 00:00:00
+`), 0666))
+	opts := InputOptions{Columns: map[string]string{"repo": "repository",
+		"email": "author_email", "name": "author_name", "hash": "sha", "time": "committed_at"}}
+	commits, err := readSignatures(path, opts)
+	req.NoError(err)
+	req.Equal([]signatureWithRepo{{repo: "repo1", name: "bob", email: "bob@google.com",
+		hash: "aaa", time: time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)}}, commits)
+
+	opts.Columns["commits"] = "count"
+	_, err = readSignatures(path, opts)
+	req.EqualError(err, "invalid CSV file: missing column count")
+	_, err = readSignatures(path, InputOptions{Format: "xml"})
+	req.EqualError(err, "unsupported input format xml, must be one of csv, jsonl, parquet")
+}
+
+const testJSONLSignatures = `{"repo": "repo1", "email": "bob@google.com", "name": "Bob", "time": 1546300800, "commits": 3, "extra": null}
+{"repo": "repo2", "email": "alice@google.com", "name": "Alice", "hash": "bbb", "time": 1.5463008005e9}
+`
+
+var testJSONLSignaturesRead = []signatureWithRepo{
+	{repo: "repo1", name: "bob", email: "bob@google.com",
+		time: time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC), commits: 3},
+	// the keys absent in the first object are still read
+	{repo: "repo2", name: "alice", email: "alice@google.com", hash: "bbb",
+		time: time.Date(2019, 1, 1, 0, 0, 0, 500000000, time.UTC)},
+}
+
+func TestReadSignaturesJSONLColumnMapping(t *testing.T) {
+	req := require.New(t)
+	path := filepath.Join(t.TempDir(), "signatures.jsonl")
+	req.NoError(ioutil.WriteFile(path, []byte(
+		`{"repository": "repo1", "author_email": "bob@google.com", "author_name": "Bob"}
+{"repository": "repo1", "author_email": "alice@google.com", "author_name": "Alice", "sha": "bbb"}
+{"repository": "repo2", "author_email": "eve@google.com", "sha": "ccc"}
+`), 0666))
+	opts := InputOptions{Columns: map[string]string{"repo": "repository",
+		"email": "author_email", "name": "author_name", "hash": "sha"}}
+	commits, err := readSignatures(path, opts)
+	req.NoError(err)
+	// the row without the name is skipped
+	req.Equal([]signatureWithRepo{
+		{repo: "repo1", name: "bob", email: "bob@google.com"},
+		{repo: "repo1", name: "alice", email: "alice@google.com", hash: "bbb"},
+	}, commits)
+}
+
+func TestReadSignaturesJSONLCompressed(t *testing.T) {
+	req := require.New(t)
+	dir := t.TempDir()
+
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	_, err := gz.Write([]byte(testJSONLSignatures))
+	req.NoError(err)
+	req.NoError(gz.Close())
+	req.NoError(ioutil.WriteFile(filepath.Join(dir, "signatures.jsonl.gz"), gzipped.Bytes(), 0666))
+
+	var zstded bytes.Buffer
+	zw, err := zstd.NewWriter(&zstded)
+	req.NoError(err)
+	_, err = zw.Write([]byte(testJSONLSignatures))
+	req.NoError(err)
+	req.NoError(zw.Close())
+	// the format is detected by the contents
+	req.NoError(ioutil.WriteFile(filepath.Join(dir, "signatures"), zstded.Bytes(), 0666))
+
+	for _, name := range []string{"signatures.jsonl.gz", "signatures"} {
+		commits, err := readSignatures(filepath.Join(dir, name), InputOptions{})
+		req.NoError(err, name)
+		req.Equal(testJSONLSignaturesRead, commits, name)
+	}
+}
+
+func TestReadSignaturesStdin(t *testing.T) {
+	req := require.New(t)
+	path := filepath.Join(t.TempDir(), "stdin")
+	req.NoError(ioutil.WriteFile(path, []byte(testJSONLSignatures), 0666))
+	stdin, err := os.Open(path)
+	req.NoError(err)
+	defer stdin.Close()
+	defer func(original *os.File) { os.Stdin = original }(os.Stdin)
+	os.Stdin = stdin
+	commits, err := readSignatures(StdinPath, InputOptions{})
+	req.NoError(err)
+	req.Equal(testJSONLSignaturesRead, commits)
+}
+
+type testParquetSignature struct {
+	Repository string `parquet:"name=repository, type=UTF8"`
+	Email      string `parquet:"name=author_email, type=UTF8"`
+	Name       string `parquet:"name=author_name, type=UTF8"`
+	Hash       string `parquet:"name=hash, type=UTF8"`
+	Time       int64  `parquet:"name=time, type=TIMESTAMP_MILLIS"`
+	Commits    int64  `parquet:"name=commits, type=INT_64"`
+}
+
+func TestReadSignaturesParquet(t *testing.T) {
+	req := require.New(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "signatures.parquet")
+	pf, err := local.NewLocalFileWriter(path)
+	req.NoError(err)
+	pw, err := writer.NewParquetWriter(pf, new(testParquetSignature), 1)
+	req.NoError(err)
+	pw.CompressionType = parquet.CompressionCodec_SNAPPY
+	when := time.Date(2019, 1, 1, 12, 0, 0, 0, time.UTC)
+	req.NoError(pw.Write(testParquetSignature{
+		Repository: "repo1", Email: "bob@google.com", Name: "Bob", Hash: "aaa",
+		Time: toMillis(when), Commits: 2}))
+	req.NoError(pw.Write(testParquetSignature{
+		Repository: "repo2", Email: "alice@google.com", Name: "Alice", Time: toMillis(when)}))
+	req.NoError(pw.WriteStop())
+	req.NoError(pf.Close())
+	expected := []signatureWithRepo{
+		{repo: "repo1", name: "bob", email: "bob@google.com", hash: "aaa", time: when, commits: 2},
+		{repo: "repo2", name: "alice", email: "alice@google.com", time: when},
+	}
+	opts := InputOptions{Columns: map[string]string{
+		"repo": "repository", "email": "author_email", "name": "author_name"}}
+	commits, err := readSignatures(path, opts)
+	req.NoError(err)
+	req.Equal(expected, commits)
+
+	// the compressed Parquet is read into memory
+	data, err := ioutil.ReadFile(path)
+	req.NoError(err)
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	_, err = gz.Write(data)
+	req.NoError(err)
+	req.NoError(gz.Close())
+	req.NoError(ioutil.WriteFile(path+".gz", gzipped.Bytes(), 0666))
+	commits, err = readSignatures(path+".gz", opts)
+	req.NoError(err)
+	req.Equal(expected, commits)
+}
+
+func TestReadSignaturesParquetCorrupted(t *testing.T) {
+	req := require.New(t)
+	path := filepath.Join(t.TempDir(), "signatures.parquet")
+	pf, err := local.NewLocalFileWriter(path)
+	req.NoError(err)
+	pw, err := writer.NewParquetWriter(pf, new(testParquetSignature), 1)
+	req.NoError(err)
+	pw.CompressionType = parquet.CompressionCodec_UNCOMPRESSED
+	req.NoError(pw.Write(testParquetSignature{
+		Repository: "repo1", Email: "bob@google.com", Name: "Bob", Hash: "aaa"}))
+	req.NoError(pw.WriteStop())
+	req.NoError(pf.Close())
+	// the first page header of the repository column follows the magic, the footer is intact
+	data, err := ioutil.ReadFile(path)
+	req.NoError(err)
+	for i := 4; i < 12; i++ {
+		data[i] = 0xff
+	}
+	req.NoError(ioutil.WriteFile(path, data, 0666))
+	opts := InputOptions{Columns: map[string]string{
+		"repo": "repository", "email": "author_email", "name": "author_name"}}
+	_, err = readSignatures(path, opts)
+	req.Error(err)
+	req.Contains(err.Error(), "invalid Parquet input: failed to read column repository: ")
+}
+
+func TestInt96ToTime(t *testing.T) {
+	// 2019-01-01T12:00:00Z is the Julian day 2458485 and 12 hours
+	value := []byte{0, 0x80, 0xa7, 0x48, 0x4a, 0x27, 0, 0, 0x75, 0x83, 0x25, 0}
+	require.Equal(t, time.Date(2019, 1, 1, 12, 0, 0, 0, time.UTC), int96ToTime(string(value)))
+}
@@ -2,30 +2,19 @@ package idmatch
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sort"
+	"sync"
 
 	"github.com/sirupsen/logrus"
 	"gonum.org/v1/gonum/floats"
-	simplegraph "gonum.org/v1/gonum/graph"
-	"gonum.org/v1/gonum/graph/simple"
-	"gonum.org/v1/gonum/graph/topo"
-	"gonum.org/v1/gonum/graph/traverse"
 	"gonum.org/v1/gonum/stat"
 
 	"github.com/src-d/identity-matching/external"
 	"github.com/src-d/identity-matching/reporter"
 )
 
-type node struct {
-	Value *Person
-	id    int64
-}
-
-func (g node) ID() int64 {
-	return g.id
-}
-
 // Int64Slice attaches the methods of Interface to []int64, sorting in increasing order.
 type Int64Slice []int64
 
@@ -36,62 +25,262 @@ func (p Int64Slice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
 // Sort is a convenience method.
 func (p Int64Slice) Sort() { sort.Sort(p) }
 
+// externalQuery is a single lookup of an email with an external matcher.
+type externalQuery struct {
+	id    int64
+	email string
+	// the following fields are set by the worker
+	provider string
+	username string
+	err      error
+	done     chan struct{}
+}
+
+// queryExternalMatcher runs the queries with the given number of concurrent workers.
+// Each query's done channel is closed after it finishes, so the caller can consume
+// the results in the original order while the rest are still running.
+// If batchSize is greater than 1 and the matcher is an external.BatchMatcher, the queries
+// by commit are grouped by repository and sent in batches of up to batchSize.
+func queryExternalMatcher(ctx context.Context, people People, matcher external.Matcher,
+	queries []*externalQuery, workers, batchSize int) *sync.WaitGroup {
+	if workers < 1 {
+		workers = 1
+	}
+	batches := batchExternalQueries(people, matcher, queries, batchSize)
+	jobs := make(chan []*externalQuery)
+	wg := &sync.WaitGroup{}
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for batch := range jobs {
+				if len(batch) > 1 {
+					runExternalBatch(ctx, people, matcher.(external.BatchMatcher), batch)
+					continue
+				}
+				query := batch[0]
+				person := people[query.id]
+				byCommit := matcher.SupportsMatchingByCommit() && person.SampleCommit != nil
+				providers, hasProviders := matcher.(external.ProviderMatcher)
+				switch {
+				case byCommit && hasProviders:
+					query.provider, query.username, query.err = providers.MatchByCommitWithProvider(
+						ctx, query.email, person.SampleCommit.Repo, person.SampleCommit.Hash)
+				case byCommit:
+					query.username, query.err = matcher.MatchByCommit(
+						ctx, query.email, person.SampleCommit.Repo, person.SampleCommit.Hash)
+				case hasProviders:
+					query.provider, query.username, query.err = providers.MatchByEmailWithProvider(
+						ctx, query.email)
+				default:
+					query.username, query.err = matcher.MatchByEmail(ctx, query.email)
+				}
+				close(query.done)
+			}
+		}()
+	}
+	go func() {
+		defer close(jobs)
+		for _, batch := range batches {
+			select {
+			case jobs <- batch:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return wg
+}
+
+// batchExternalQueries splits the queries into the jobs for queryExternalMatcher().
+// The queries by commit are grouped by repository in the order of appearance, the rest
+// are single query jobs.
+func batchExternalQueries(people People, matcher external.Matcher, queries []*externalQuery,
+	batchSize int) [][]*externalQuery {
+	_, isBatcher := matcher.(external.BatchMatcher)
+	if batchSize <= 1 || !isBatcher || !matcher.SupportsMatchingByCommit() {
+		batches := make([][]*externalQuery, len(queries))
+		for i, query := range queries {
+			batches[i] = []*externalQuery{query}
+		}
+		return batches
+	}
+	var batches [][]*externalQuery
+	repoBatches := map[string]int{}
+	for _, query := range queries {
+		commit := people[query.id].SampleCommit
+		if commit == nil {
+			batches = append(batches, []*externalQuery{query})
+			continue
+		}
+		if index, exists := repoBatches[commit.Repo]; exists && len(batches[index]) < batchSize {
+			batches[index] = append(batches[index], query)
+			continue
+		}
+		repoBatches[commit.Repo] = len(batches)
+		batches = append(batches, []*externalQuery{query})
+	}
+	return batches
+}
+
+// runExternalBatch resolves the batch of queries by commit and closes their done channels.
+func runExternalBatch(ctx context.Context, people People, matcher external.BatchMatcher,
+	batch []*externalQuery) {
+	commitQueries := make([]external.CommitQuery, len(batch))
+	for i, query := range batch {
+		commit := people[query.id].SampleCommit
+		commitQueries[i] = external.CommitQuery{
+			Email: query.email, Repo: commit.Repo, Commit: commit.Hash}
+	}
+	matches, err := matcher.MatchByCommits(ctx, commitQueries)
+	for i, query := range batch {
+		if err != nil {
+			query.err = err
+		} else {
+			query.provider, query.username, query.err =
+				matches[i].Provider, matches[i].User, matches[i].Err
+		}
+		close(query.done)
+	}
+}
+
 // addEdgesWithMatcher adds edges by the ground truth from an external matcher.
-func addEdgesWithMatcher(people People, peopleGraph *simple.UndirectedGraph,
-	matcher external.Matcher) (map[string]struct{}, error) {
+// The matcher is queried by opts.ExternalWorkers concurrent workers, while the results
+// are applied sequentially in the order of the person IDs so that they are deterministic.
+func addEdgesWithMatcher(people People, components *identityComponents,
+	matcher external.Matcher, opts ReduceOptions) (map[string]struct{}, error) {
 	unprocessedEmails := map[string]struct{}{}
 	// Add edges by the groundtruth fetched with external matcher.
 	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
 
-	username2extID := make(map[string]node)
-	var username string
-	var err error
+	keys := make([]int64, 0, len(people))
+	for key := range people {
+		keys = append(keys, key)
+	}
+	Int64Slice(keys).Sort()
+	var queries []*externalQuery
+	for _, index := range keys {
+		for _, email := range people[index].Emails {
+			queries = append(queries, &externalQuery{
+				id: index, email: email, done: make(chan struct{})})
+		}
+	}
+	workers := queryExternalMatcher(
+		ctx, people, matcher, queries, opts.ExternalWorkers, opts.ExternalBatchSize)
+	defer func() {
+		// stop the workers in case of an early return
+		cancel()
+		workers.Wait()
+	}()
+
+	username2extID := make(map[externalIdentity]int64)
 	noMatchWarned := map[string]struct{}{}
-	for index, person := range people {
-		for _, email := range person.Emails {
-			if matcher.SupportsMatchingByCommit() && person.SampleCommit != nil {
-				username, err = matcher.MatchByCommit(
-					ctx, email, person.SampleCommit.Repo, person.SampleCommit.Hash)
+	for _, query := range queries {
+		<-query.done
+		index, email, err := query.id, query.email, query.err
+		username := externalIdentity{provider: query.provider, user: query.username}
+		person := people[index]
+		if err != nil {
+			if err == external.ErrNoMatches {
+				pstr := person.String()
+				if _, exists := noMatchWarned[pstr]; !exists {
+					noMatchWarned[pstr] = struct{}{}
+					logrus.Warnf("no matches for person %s", pstr)
+				}
 			} else {
-				username, err = matcher.MatchByEmail(ctx, email)
+				logrus.Errorf("unexpected error for person %s: %v", person.String(), err)
 			}
-			if err != nil {
-				if err == external.ErrNoMatches {
-					pstr := person.String()
-					if _, exists := noMatchWarned[pstr]; !exists {
-						noMatchWarned[pstr] = struct{}{}
-						logrus.Warnf("no matches for person %s", pstr)
-					}
-				} else {
-					logrus.Errorf("unexpected error for person %s: %v", person.String(), err)
-				}
+			unprocessedEmails[email] = struct{}{}
+		} else {
+			externalID := person.externalIdentity()
+			if externalID != (externalIdentity{}) && username != externalID {
+				return unprocessedEmails, fmt.Errorf(
+					"person %s has emails with different external ids: %s %s",
+					person.String(), externalID, username)
+			}
+			val, ok := username2extID[username]
+			if ok && !passIdentitiesLimit(people, components, opts, edgeExternal, val, index, email) {
+				// the rejected match must not leave the ExternalID which would merge the person
+				// with the rest later, so the email falls back to the heuristics
 				unprocessedEmails[email] = struct{}{}
-			} else {
-				if person.ExternalID != "" && username != person.ExternalID {
-					return unprocessedEmails, fmt.Errorf(
-						"person %s has emails with different external ids: %s %s",
-						person.String(), person.ExternalID, username)
-				}
-				person.ExternalID = username
-				if val, ok := username2extID[username]; ok {
-					err := setEdge(peopleGraph, val, peopleGraph.Node(index).(node))
-					if err != nil {
-						return unprocessedEmails, nil
-					}
-				} else {
-					username2extID[username] = peopleGraph.Node(int64(index)).(node)
+				continue
+			}
+			person.setExternalIdentity(username)
+			if err := components.setExternalID(index, username); err != nil {
+				return unprocessedEmails, err
+			}
+			if ok {
+				if err := setEdge(components, val, index); err != nil {
+					return unprocessedEmails, err
 				}
-				reporter.Increment("external API emails found")
+			} else {
+				username2extID[username] = index
 			}
+			reporter.Increment("external API emails found")
 		}
 	}
-	err = matcher.OnIdle()
+	workers.Wait()
+	err := matcher.OnIdle()
 	reporter.Commit("external API components", len(username2extID))
 	reporter.Commit("external API emails not found", len(unprocessedEmails))
 	return unprocessedEmails, err
 }
 
+// IdentitiesLimitPolicy defines how ReduceOptions.MaxIdentities is enforced.
+type IdentitiesLimitPolicy string
+
+const (
+	// IdentitiesLimitLenient enforces the limit for the heuristic (name and repository) matches
+	// only; the matches by email and by the external API may exceed it.
+	IdentitiesLimitLenient IdentitiesLimitPolicy = "lenient"
+	// IdentitiesLimitStrict enforces the limit for every match and reports each rejected one.
+	IdentitiesLimitStrict IdentitiesLimitPolicy = "strict"
+	// IdentitiesLimitReportOnly enforces the limit the same way as IdentitiesLimitLenient, so
+	// the results do not change, and reports each match which exceeds it.
+	IdentitiesLimitReportOnly IdentitiesLimitPolicy = "report-only"
+)
+
+// IdentitiesLimitPolicies lists all the supported values of IdentitiesLimitPolicy.
+var IdentitiesLimitPolicies = []IdentitiesLimitPolicy{
+	IdentitiesLimitLenient, IdentitiesLimitStrict, IdentitiesLimitReportOnly}
+
+// edge kinds, that is, the reasons to match two identities
+const (
+	edgeExternal = "external"
+	edgeEmail    = "email"
+	edgeName     = "name"
+	edgeRepos    = "repositories"
+)
+
+// ReduceOptions are the tunable parameters of ReducePeople.
+type ReduceOptions struct {
+	// MaxIdentities is the maximum number of unique names and emails summed in a person
+	// above which no more identities are merged. See also LimitPolicy.
+	MaxIdentities int
+	// LimitPolicy defines to which matches MaxIdentities applies. The empty value means
+	// IdentitiesLimitLenient.
+	LimitPolicy IdentitiesLimitPolicy
+	// MinTimezoneOverlap is the minimum overlap of the commit timezone distributions of two
+	// identities with the same name required to merge them. 0 disables the check. ReducePeople
+	// fails if it is enabled and none of the people has the timezones.
+	MinTimezoneOverlap float64
+	// MinRepoSimilarity is the minimum product of the repository set similarity and the name
+	// similarity of two people to merge them. 0 disables the repository co-occurrence heuristic.
+	MinRepoSimilarity float64
+	// MinRepoNameSimilarity is the minimum name similarity of two people to merge them by
+	// the repository co-occurrence heuristic.
+	MinRepoNameSimilarity float64
+	// MaxRepoPeople is the maximum number of people who committed to a repository to consider
+	// it niche in the repository co-occurrence heuristic.
+	MaxRepoPeople int
+	// ExternalWorkers is the number of concurrent queries to the external matcher.
+	// Values below 1 mean 1.
+	ExternalWorkers int
+	// ExternalBatchSize is the maximum number of commits resolved by a single query to
+	// the external matcher if it supports batching. Values below 2 disable batching.
+	ExternalBatchSize int
+}
+
 // ReducePeople merges the identities together by following the fixed set of rules.
 // 1. Run the external matching, if available.
 // 2. Run the series of heuristics on those items which were left untouched in the list (everything
@@ -100,25 +289,34 @@ func addEdgesWithMatcher(people People, peopleGraph *simple.UndirectedGraph,
 // The heuristics are:
 // TODO(vmarkovtsev): describe the current approach
 func ReducePeople(people People, matcher external.Matcher, blacklist Blacklist,
-	maxIdentities int) error {
-	peopleGraph := simple.NewUndirectedGraph()
-	for index, person := range people {
-		peopleGraph.AddNode(node{person, index})
+	opts ReduceOptions) error {
+	if opts.MinTimezoneOverlap > 0 && !people.hasTimezones() {
+		return errors.New("the timezone overlap check requires the commit timezones but " +
+			"the signatures have none: gitbase does not expose the commit UTC offsets, " +
+			"set the timezones column of the input or of the signatures cache")
 	}
+	components := newIdentityComponents(people)
 
 	unmatchedEmails := map[string]struct{}{}
 	var err error
 	if matcher != nil {
-		unmatchedEmails, err = addEdgesWithMatcher(people, peopleGraph, matcher)
+		unmatchedEmails, err = addEdgesWithMatcher(people, components, matcher, opts)
 		if err != nil {
 			return err
 		}
 	}
 
+	// We need to sort keys because the algorithm is order dependent
+	keys := make([]int64, 0, len(people))
+	for k := range people {
+		keys = append(keys, k)
+	}
+	Int64Slice(keys).Sort()
+
 	// Add edges by the same unpopular email
-	email2id := make(map[string]node)
-	for index, person := range people {
-		for _, email := range person.Emails {
+	email2id := make(map[string]int64)
+	for _, index := range keys {
+		for _, email := range people[index].Emails {
 			if matcher != nil {
 				if _, unmatched := unmatchedEmails[email]; !unmatched {
 					// Do not process emails which were matched by an external matcher
@@ -130,41 +328,41 @@ func ReducePeople(people People, matcher external.Matcher, blacklist Blacklist,
 				continue
 			}
 			if val, ok := email2id[email]; ok {
-				err = setEdge(peopleGraph, val, peopleGraph.Node(index).(node))
+				if !passIdentitiesLimit(people, components, opts, edgeEmail, val, index, email) {
+					continue
+				}
+				err = setEdge(components, val, index)
 				if err != nil {
 					return err
 				}
 			} else {
-				email2id[email] = peopleGraph.Node(index).(node)
+				email2id[email] = index
 			}
 		}
 	}
 	reporter.Commit("people matched by email", len(email2id))
 
 	// Add edges by the same unpopular name
-	name2id := make(map[string]map[string][]node)
-	// We need to sort keys because the algorithm is order dependent
-	keys := make([]int64, 0, len(people))
-	for k := range people {
-		keys = append(keys, k)
-	}
-	Int64Slice(keys).Sort()
+	name2id := make(map[string]map[externalIdentity][]int64)
 	for _, index := range keys {
-		myNode := peopleGraph.Node(index).(node)
-		for _, name := range myNode.Value.NamesWithRepos {
+		for _, name := range people[index].NamesWithRepos {
 			if blacklist.isPopularName(name.String()) {
 				reporter.Increment("popular names found")
 				continue
 			}
 			for { // this for is to exit with break from the block when required
+				externalID := components.externalID(index)
 				sameNameIDNodes, exists := name2id[name.String()]
 				if exists {
-					if sameNameAndExternalIDNodes, exists := sameNameIDNodes[myNode.Value.ExternalID]; exists {
+					if sameNameAndExternalIDNodes, exists := sameNameIDNodes[externalID]; exists {
 						for _, connectedNode := range sameNameAndExternalIDNodes {
-							if !passIdentitiesLimit(peopleGraph, maxIdentities, myNode, connectedNode) {
+							if !passIdentitiesLimit(people, components, opts, edgeName, index,
+								connectedNode, name.String()) ||
+								!passTimezoneOverlap(people, components, opts.MinTimezoneOverlap,
+									index, connectedNode) {
 								continue
 							}
-							err = setEdge(peopleGraph, connectedNode, myNode)
+							err = setEdge(components, connectedNode, index)
 							if err != nil {
 								return err
 							}
@@ -172,33 +370,42 @@ func ReducePeople(people People, matcher external.Matcher, blacklist Blacklist,
 						break
 					}
 				} else {
-					sameNameIDNodes = map[string][]node{}
+					sameNameIDNodes = map[externalIdentity][]int64{}
 					name2id[name.String()] = sameNameIDNodes
 				}
-				sameNameIDNodes[myNode.Value.ExternalID] = append(sameNameIDNodes[myNode.Value.ExternalID], myNode)
+				sameNameIDNodes[externalID] = append(sameNameIDNodes[externalID], index)
 				break
 			}
 		}
 	}
 
 	// Merge names with only one found external id
-	for _, externalIDs := range name2id {
+	names := make([]string, 0, len(name2id))
+	for name := range name2id {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		externalIDs := name2id[name]
 		if len(externalIDs) == 2 { // one should be empty => merge them
 			toMerge := false
-			var connected []node
+			var connected []int64
 			for externalID, nodes := range externalIDs {
-				if externalID == "" {
+				if externalID == (externalIdentity{}) {
 					toMerge = true
 				}
 				connected = append(connected, nodes...)
 			}
+			Int64Slice(connected).Sort()
 			if toMerge {
 				for x, edgeX := range connected {
 					for _, edgeY := range connected[x+1:] {
-						if !passIdentitiesLimit(peopleGraph, maxIdentities, edgeX, edgeY) {
+						if !passIdentitiesLimit(people, components, opts, edgeName, edgeX, edgeY, name) ||
+							!passTimezoneOverlap(people, components, opts.MinTimezoneOverlap,
+								edgeX, edgeY) {
 							continue
 						}
-						err = setEdge(peopleGraph, edgeX, edgeY)
+						err = setEdge(components, edgeX, edgeY)
 						// err can occur here and it is fine.
 					}
 				}
@@ -208,11 +415,15 @@ func ReducePeople(people People, matcher external.Matcher, blacklist Blacklist,
 
 	reporter.Commit("people matched by name", len(name2id))
 
+	if opts.MinRepoSimilarity > 0 {
+		addEdgesByRepoCooccurrence(people, components, opts)
+	}
+
 	var componentsSize []float64
-	for _, component := range topo.ConnectedComponents(peopleGraph) {
-		var toMerge []int64
-		for _, node := range component {
-			toMerge = append(toMerge, node.ID())
+	for _, toMerge := range components.groups() {
+		externalID := components.externalID(toMerge[0])
+		for _, id := range toMerge {
+			people[id].setExternalIdentity(externalID)
 		}
 		componentsSize = append(componentsSize, float64(len(toMerge)))
 		_, err := people.Merge(toMerge...)
@@ -235,73 +446,75 @@ func ReducePeople(people People, matcher external.Matcher, blacklist Blacklist,
 	return nil
 }
 
-func passIdentitiesLimit(graph *simple.UndirectedGraph, maxIdentities int, node1, node2 node) bool {
-	n1Emails, n1Names := componentUniqueEmailsAndNames(graph, node1)
-	n2Emails, n2Names := componentUniqueEmailsAndNames(graph, node2)
-	if n1Emails+n1Names >= maxIdentities || n2Names+n2Emails >= maxIdentities {
+// passIdentitiesLimit checks whether the components of two people can be connected by an edge
+// of the given kind according to opts.MaxIdentities and opts.LimitPolicy. alias is
+// the email, name, etc. which caused the match. The heuristic (name and repository) matches
+// are always limited, the policy decides whether the matches by email and by the external API
+// are limited and whether the matches above the limit are reported.
+func passIdentitiesLimit(people People, components *identityComponents, opts ReduceOptions,
+	kind string, id1, id2 int64, alias string) bool {
+	policy := opts.LimitPolicy
+	if policy == "" {
+		policy = IdentitiesLimitLenient
+	}
+	heuristic := kind != edgeEmail && kind != edgeExternal
+	if policy == IdentitiesLimitLenient && !heuristic {
+		return true
+	}
+	if components.connected(id1, id2) {
+		return true
+	}
+	n1Emails, n1Names := components.uniqueEmailsAndNames(id1)
+	n2Emails, n2Names := components.uniqueEmailsAndNames(id2)
+	if n1Emails+n1Names < opts.MaxIdentities && n2Names+n2Emails < opts.MaxIdentities {
+		return true
+	}
+	if policy == IdentitiesLimitLenient {
 		logrus.Debugf(
 			"above the identities limit: %s (%d emails, %d names) and %s (%d emails, %d names)",
-			node1.Value.String(), n1Emails, n1Names, node2.Value.String(), n2Emails, n2Names)
+			people[id1].String(), n1Emails, n1Names, people[id2].String(), n2Emails, n2Names)
 		return false
 	}
-	return true
+	pass := policy == IdentitiesLimitReportOnly && !heuristic
+	action := "rejected"
+	if pass {
+		action = "accepted"
+	}
+	logrus.Warnf("%s %s match by %s above the identities limit: %s (%d emails, %d names) "+
+		"and %s (%d emails, %d names)", action, kind, alias,
+		people[id1].String(), n1Emails, n1Names, people[id2].String(), n2Emails, n2Names)
+	reporter.Increment(fmt.Sprintf("%s matches above the identities limit", kind))
+	return pass
 }
 
-// setEdge propagates ExternalID when you connect two components
-func setEdge(graph *simple.UndirectedGraph, node1, node2 node) error {
-	externalID1 := node1.Value.ExternalID
-	externalID2 := node2.Value.ExternalID
-	if externalID1 != "" && externalID2 != "" && externalID1 != externalID2 {
-		return fmt.Errorf(
-			"cannot set edge between nodes with different ExternalIDs: %s %s",
-			externalID1, externalID2)
-	}
-	var nodeToFix node
-	newExternalID := ""
-	if externalID1 == "" && externalID2 != "" {
-		newExternalID = externalID2
-		nodeToFix = node1
-	} else if externalID1 != "" && externalID2 == "" {
-		newExternalID = externalID1
-		nodeToFix = node2
+// passTimezoneOverlap vetoes merging the components of two identities by name if they commit
+// from different timezones. The timezones of the whole components are compared, so that a chain
+// of merges cannot join the identities which commit from disjoint timezones. Components with
+// unknown timezones always pass.
+func passTimezoneOverlap(people People, components *identityComponents, minOverlap float64,
+	id1, id2 int64) bool {
+	if minOverlap <= 0 || components.connected(id1, id2) {
+		return true
 	}
-	if newExternalID != "" {
-		var w traverse.DepthFirst
-		w.Walk(graph, nodeToFix, func(sn simplegraph.Node) bool {
-			n := sn.(node)
-			if n.Value.ExternalID != "" && n.Value.ExternalID != newExternalID {
-				panic(fmt.Errorf(
-					"cannot set edge between components with different ExternalIDs: |%s| |%s|",
-					newExternalID, n.Value.ExternalID))
-			}
-			n.Value.ExternalID = newExternalID
-			return false
-		})
+	overlap, known := components.timezoneOverlap(id1, id2)
+	if known && overlap < minOverlap {
+		logrus.Debugf("timezones do not overlap: %s and %s (%.2f)",
+			people[id1].String(), people[id2].String(), overlap)
+		reporter.Increment("name matches vetoed by timezone")
+		return false
 	}
+	return true
+}
 
-	graph.SetEdge(graph.NewEdge(node1, node2))
+// setEdge connects two components and propagates ExternalID.
+func setEdge(components *identityComponents, id1, id2 int64) error {
+	if err := components.union(id1, id2); err != nil {
+		return err
+	}
 	reporter.Increment("graph edges")
 	return nil
 }
 
-// componentUniqueEmailsAndNames calculates the number of unique emails and names in the component
-// with n node inside
-func componentUniqueEmailsAndNames(graph *simple.UndirectedGraph, n simplegraph.Node) (int, int) {
-	emails := map[string]struct{}{}
-	names := map[string]struct{}{}
-	var w traverse.DepthFirst
-	w.Walk(graph, n, func(sn simplegraph.Node) bool {
-		for _, email := range sn.(node).Value.Emails {
-			emails[email] = struct{}{}
-		}
-		for _, name := range sn.(node).Value.NamesWithRepos {
-			names[name.String()] = struct{}{}
-		}
-		return false
-	})
-	return len(emails), len(names)
-}
-
 func setPrimaryValue(people People, freqs map[string]*Frequency, getter func(*Person) []string,
 	setter func(*Person, string), minRecentCount int) {
 	for _, p := range people {
@@ -336,16 +549,53 @@ func setPrimaryValue(people People, freqs map[string]*Frequency, getter func(*Pe
 // SetPrimaryValues sets people primary name and email to the most frequent name and email of
 // the person's identity. Stats for the fixed recent period of time are used if there are at least
 // minRecentCount commits made by the person's identity in that period. Otherwise the stats
-// for all the time are used.
+// for all the time are used. If preferExternalNames is true, the primary name is
+// the ExternalName instead, if the person has it.
 func SetPrimaryValues(people People, nameFreqs, emailFreqs map[string]*Frequency,
-	minRecentCount int) {
+	minRecentCount int, preferExternalNames bool) {
 	setPrimaryValue(people, nameFreqs, func(p *Person) []string {
 		names := make([]string, len(p.NamesWithRepos))
 		for i, n := range p.NamesWithRepos {
 			names[i] = n.Name
 		}
 		return names
-	}, func(p *Person, name string) { p.PrimaryName = name }, minRecentCount)
+	}, func(p *Person, name string) {
+		if preferExternalNames && p.ExternalName != "" {
+			name = p.ExternalName
+		}
+		p.PrimaryName = name
+	}, minRecentCount)
 	setPrimaryValue(people, emailFreqs, func(p *Person) []string { return p.Emails },
 		func(p *Person, email string) { p.PrimaryEmail = email }, minRecentCount)
 }
+
+// FetchExternalProfiles sets the external profile fields of the people matched by
+// the external matcher which knows the profiles of its users, e.g. the display names in
+// the corporate directory.
+func FetchExternalProfiles(ctx context.Context, people People, profiler external.Profiler) error {
+	found := 0
+	var err error
+	people.ForEach(func(id int64, p *Person) bool {
+		if p.ExternalID == "" {
+			return false
+		}
+		var profile external.Profile
+		if providers, ok := profiler.(external.ProviderProfiler); ok {
+			profile, err = providers.ProfileWithProvider(ctx, p.ExternalIDProvider, p.ExternalID)
+		} else {
+			profile, err = profiler.Profile(ctx, p.ExternalID)
+		}
+		if err == external.ErrNoMatches {
+			err = nil
+			return false
+		}
+		if err != nil {
+			return true
+		}
+		p.setExternalProfile(profile)
+		found++
+		return false
+	})
+	reporter.Commit("people with external profiles", found)
+	return err
+}
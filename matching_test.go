@@ -2,14 +2,18 @@ package idmatch
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math/rand"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
-	"gonum.org/v1/gonum/graph/simple"
 
 	"github.com/src-d/identity-matching/external"
+	"github.com/src-d/identity-matching/reporter"
 )
 
 var githubTestToken = os.Getenv("GITHUB_TEST_TOKEN")
@@ -41,7 +45,7 @@ func TestReducePeople(t *testing.T) {
 
 	blacklist := newTestBlacklist(t)
 
-	err := ReducePeople(people, nil, blacklist, 100)
+	err := ReducePeople(people, nil, blacklist, ReduceOptions{MaxIdentities: 100})
 	require.Equal(t, err, nil)
 	require.Equal(t, people, reducedPeople)
 }
@@ -78,20 +82,164 @@ func TestReducePeopleMaxIdentities(t *testing.T) {
 
 	blacklist := newTestBlacklist(t)
 
-	err := ReducePeople(people, nil, blacklist, 4)
+	err := ReducePeople(people, nil, blacklist, ReduceOptions{MaxIdentities: 4})
 	require.Equal(t, err, nil)
 	require.Equal(t, reducedPeople, people)
 }
 
-func printTestSkippedNoToken() {
-	fmt.Println("GITHUB_TEST_TOKEN environment variable is not set, skipping the test")
+func TestReducePeopleMaxIdentitiesPolicy(t *testing.T) {
+	newPeople := func() People {
+		return People{
+			1: {ID: 1, NamesWithRepos: []NameWithRepo{{"A", ""}}, Emails: []string{"shared@google.com"}},
+			2: {ID: 2, NamesWithRepos: []NameWithRepo{{"B", ""}}, Emails: []string{"shared@google.com"}},
+			3: {ID: 3, NamesWithRepos: []NameWithRepo{{"C", ""}}, Emails: []string{"shared@google.com"}},
+			4: {ID: 4, NamesWithRepos: []NameWithRepo{{"D", ""}}, Emails: []string{"shared@google.com"}},
+		}
+	}
+	blacklist := newTestBlacklist(t)
+	const key = "email matches above the identities limit"
+
+	for _, policy := range []IdentitiesLimitPolicy{"", IdentitiesLimitLenient} {
+		reporter.Reset()
+		people := newPeople()
+		err := ReducePeople(people, nil, blacklist, ReduceOptions{MaxIdentities: 3, LimitPolicy: policy})
+		require.NoError(t, err)
+		require.Len(t, people, 1)
+		_, exists := reporter.Get(key)
+		require.False(t, exists)
+	}
+
+	reporter.Reset()
+	people := newPeople()
+	err := ReducePeople(people, nil, blacklist, ReduceOptions{
+		MaxIdentities: 3, LimitPolicy: IdentitiesLimitStrict})
+	require.NoError(t, err)
+	require.Len(t, people, 3)
+	require.Equal(t, []NameWithRepo{{"A", ""}, {"B", ""}}, people[1].NamesWithRepos)
+	violations, _ := reporter.Get(key)
+	require.Equal(t, 2, violations)
+
+	reporter.Reset()
+	people = newPeople()
+	err = ReducePeople(people, nil, blacklist, ReduceOptions{
+		MaxIdentities: 3, LimitPolicy: IdentitiesLimitReportOnly})
+	require.NoError(t, err)
+	require.Len(t, people, 1)
+	violations, _ = reporter.Get(key)
+	require.Equal(t, 2, violations)
 }
 
-func TestReducePeopleExternalMatching(t *testing.T) {
-	if githubTestToken == "" {
-		printTestSkippedNoToken()
-		return
+func TestReducePeopleMaxIdentitiesReportOnlyKeepsNameLimit(t *testing.T) {
+	newPeople := func() People {
+		return People{
+			1: {ID: 1, NamesWithRepos: []NameWithRepo{{"Bob", ""}}, Emails: []string{"bob1@google.com"}},
+			2: {ID: 2, NamesWithRepos: []NameWithRepo{{"Bob", ""}}, Emails: []string{"bob2@google.com"}},
+			3: {ID: 3, NamesWithRepos: []NameWithRepo{{"Bob", ""}}, Emails: []string{"bob3@google.com"}},
+			4: {ID: 4, NamesWithRepos: []NameWithRepo{{"Bob", ""}}, Emails: []string{"bob4@google.com"}},
+		}
+	}
+	blacklist := newTestBlacklist(t)
+	lenient := newPeople()
+	require.NoError(t, ReducePeople(lenient, nil, blacklist, ReduceOptions{MaxIdentities: 3}))
+	require.Len(t, lenient, 3)
+
+	reporter.Reset()
+	reportOnly := newPeople()
+	require.NoError(t, ReducePeople(reportOnly, nil, blacklist, ReduceOptions{
+		MaxIdentities: 3, LimitPolicy: IdentitiesLimitReportOnly}))
+	require.Equal(t, lenient, reportOnly)
+	violations, _ := reporter.Get("name matches above the identities limit")
+	require.Equal(t, 2, violations)
+}
+
+func TestReducePeopleMaxIdentitiesStrictExternal(t *testing.T) {
+	people := People{
+		1: {ID: 1, NamesWithRepos: []NameWithRepo{{"A", ""}}, Emails: []string{"a@google.com"}},
+		2: {ID: 2, NamesWithRepos: []NameWithRepo{{"B", ""}}, Emails: []string{"b@google.com"}},
+		3: {ID: 3, NamesWithRepos: []NameWithRepo{{"C", ""}}, Emails: []string{"c@google.com"}},
+		4: {ID: 4, NamesWithRepos: []NameWithRepo{{"D", ""}}, Emails: []string{"d@google.com"}},
+	}
+	matcher := TestMapMatcher{users: map[string]string{
+		"a@google.com": "shared", "b@google.com": "shared", "c@google.com": "shared",
+		"d@google.com": "shared"}}
+	reporter.Reset()
+	err := ReducePeople(people, matcher, newTestBlacklist(t), ReduceOptions{
+		MaxIdentities: 3, LimitPolicy: IdentitiesLimitStrict})
+	require.NoError(t, err)
+	require.Len(t, people, 3)
+	require.Equal(t, []string{"a@google.com", "b@google.com"}, people[1].Emails)
+	require.Equal(t, "shared", people[1].ExternalID)
+	// the rejected matches do not leave the ExternalID
+	require.Equal(t, "", people[3].ExternalID)
+	require.Equal(t, "", people[4].ExternalID)
+	violations, _ := reporter.Get("external matches above the identities limit")
+	require.Equal(t, 2, violations)
+}
+
+func TestReducePeopleTimezoneOverlap(t *testing.T) {
+	tzStats := func(email string, tz TimezoneHistogram) map[string]AliasStats {
+		return map[string]AliasStats{email: {Commits: tz.total(), Timezones: tz}}
+	}
+	newPeople := func() People {
+		return People{
+			1: {ID: 1, NamesWithRepos: []NameWithRepo{{"Bob", ""}}, Emails: []string{"bob@google.com"},
+				EmailStats: tzStats("bob@google.com", TimezoneHistogram{120: 10, 60: 5})},
+			2: {ID: 2, NamesWithRepos: []NameWithRepo{{"Bob", ""}}, Emails: []string{"bob@yahoo.com"},
+				EmailStats: tzStats("bob@yahoo.com", TimezoneHistogram{-420: 7})},
+			3: {ID: 3, NamesWithRepos: []NameWithRepo{{"Bob", ""}}, Emails: []string{"bob@gmail.com"},
+				EmailStats: tzStats("bob@gmail.com", TimezoneHistogram{120: 1})},
+			4: {ID: 4, NamesWithRepos: []NameWithRepo{{"Bob", ""}}, Emails: []string{"bob@inbox.com"}},
+		}
+	}
+	blacklist := newTestBlacklist(t)
+
+	people := newPeople()
+	err := ReducePeople(people, nil, blacklist, ReduceOptions{MaxIdentities: 100})
+	require.NoError(t, err)
+	require.Len(t, people, 1)
+
+	people = newPeople()
+	err = ReducePeople(people, nil, blacklist, ReduceOptions{
+		MaxIdentities: 100, MinTimezoneOverlap: 0.5})
+	require.NoError(t, err)
+	require.Len(t, people, 2)
+	require.Equal(t, []string{"bob@gmail.com", "bob@google.com", "bob@inbox.com"}, people[1].Emails)
+	require.Equal(t, []string{"bob@yahoo.com"}, people[2].Emails)
+}
+
+func TestReducePeopleTimezoneOverlapChain(t *testing.T) {
+	// bob@gmail.com has unknown timezones and must not bridge the disjoint timezones
+	people := People{
+		1: {ID: 1, NamesWithRepos: []NameWithRepo{{"Bob", ""}}, Emails: []string{"bob@google.com"},
+			EmailStats: map[string]AliasStats{
+				"bob@google.com": {Commits: 3, Timezones: TimezoneHistogram{120: 3}}}},
+		2: {ID: 2, NamesWithRepos: []NameWithRepo{{"Bob", ""}}, Emails: []string{"bob@gmail.com"}},
+		3: {ID: 3, NamesWithRepos: []NameWithRepo{{"Bob", ""}}, Emails: []string{"bob@yahoo.com"},
+			EmailStats: map[string]AliasStats{
+				"bob@yahoo.com": {Commits: 2, Timezones: TimezoneHistogram{-420: 2}}}},
+	}
+	err := ReducePeople(people, nil, newTestBlacklist(t), ReduceOptions{
+		MaxIdentities: 100, MinTimezoneOverlap: 0.5})
+	require.NoError(t, err)
+	require.Len(t, people, 2)
+	require.Equal(t, []string{"bob@gmail.com", "bob@google.com"}, people[1].Emails)
+	require.Equal(t, []string{"bob@yahoo.com"}, people[3].Emails)
+}
+
+// newTestGitHubMatcher queries the GitHub API if GITHUB_TEST_TOKEN is set and replays
+// the recorded responses from the fixture otherwise.
+func newTestGitHubMatcher(t *testing.T, fixture string) external.Matcher {
+	if githubTestToken != "" {
+		matcher, err := external.NewGitHubMatcher("", githubTestToken)
+		require.NoError(t, err)
+		return matcher
 	}
+	matcher, err := external.NewReplayMatcher(fixture)
+	require.NoError(t, err)
+	return matcher
+}
+
+func TestReducePeopleExternalMatching(t *testing.T) {
 	var people = People{
 		1: {ID: 1,
 			NamesWithRepos: []NameWithRepo{{"Máximo Cuadros", ""}},
@@ -117,19 +265,15 @@ func TestReducePeopleExternalMatching(t *testing.T) {
 	}
 
 	blacklist := newTestBlacklist(t)
-	matcher, _ := external.NewGitHubMatcher("", githubTestToken)
+	matcher := newTestGitHubMatcher(t, "testdata/external-github-emails.json")
 
-	err := ReducePeople(people, matcher, blacklist, 100)
+	err := ReducePeople(people, matcher, blacklist, ReduceOptions{MaxIdentities: 100})
 
 	require.Equal(t, err, nil)
 	require.Equal(t, people, reducedPeople)
 }
 
 func TestReducePeopleBothMatching(t *testing.T) {
-	if githubTestToken == "" {
-		printTestSkippedNoToken()
-		return
-	}
 	var people = People{
 		1: {ID: 1,
 			NamesWithRepos: []NameWithRepo{{"Máximo Cuadros", ""}},
@@ -182,19 +326,15 @@ func TestReducePeopleBothMatching(t *testing.T) {
 	}
 
 	blacklist := newTestBlacklist(t)
-	matcher, _ := external.NewGitHubMatcher("", githubTestToken)
+	matcher := newTestGitHubMatcher(t, "testdata/external-github-emails.json")
 
-	err := ReducePeople(people, matcher, blacklist, 100)
+	err := ReducePeople(people, matcher, blacklist, ReduceOptions{MaxIdentities: 100})
 
 	require.Equal(t, err, nil)
 	require.Equal(t, people, reducedPeople)
 }
 
 func TestReducePeopleBothMatchingDifferentExternalIdsNoMerge(t *testing.T) {
-	if githubTestToken == "" {
-		printTestSkippedNoToken()
-		return
-	}
 	var people = People{
 		1: {ID: 1,
 			NamesWithRepos: []NameWithRepo{{"Máximo Cuadros", ""}},
@@ -252,9 +392,9 @@ func TestReducePeopleBothMatchingDifferentExternalIdsNoMerge(t *testing.T) {
 	}
 
 	blacklist := newTestBlacklist(t)
-	matcher, _ := external.NewGitHubMatcher("", githubTestToken)
+	matcher := newTestGitHubMatcher(t, "testdata/external-github-emails.json")
 
-	err := ReducePeople(people, matcher, blacklist, 100)
+	err := ReducePeople(people, matcher, blacklist, ReduceOptions{MaxIdentities: 100})
 
 	require.Equal(t, err, nil)
 	require.Equal(t, people, reducedPeople)
@@ -309,11 +449,230 @@ func TestReducePeopleSameNameDifferentExternalIds(t *testing.T) {
 
 	blacklist := newTestBlacklist(t)
 
-	err := ReducePeople(people, TestMatcher{}, blacklist, 100)
+	err := ReducePeople(people, TestMatcher{}, blacklist, ReduceOptions{MaxIdentities: 100})
 	require.Equal(t, err, nil)
 	require.Equal(t, people, reducedPeople)
 }
 
+// TestSlowMatcher matches the Gmail emails by the part before "@" after a random delay.
+type TestSlowMatcher struct {
+	TestMatcher
+}
+
+func (m TestSlowMatcher) MatchByEmail(ctx context.Context, email string) (user string, err error) {
+	time.Sleep(time.Duration(rand.Intn(1000)) * time.Microsecond)
+	if !strings.HasSuffix(email, "@gmail.com") {
+		return "", external.ErrNoMatches
+	}
+	return strings.Split(email, "@")[0], nil
+}
+
+func TestReducePeopleExternalWorkers(t *testing.T) {
+	newPeople := func() People {
+		people := People{}
+		for i := int64(1); i <= 50; i++ {
+			people[i] = &Person{ID: i,
+				NamesWithRepos: []NameWithRepo{{fmt.Sprintf("name %d", i), ""}},
+				Emails: []string{fmt.Sprintf("user%d@gmail.com", i%7),
+					fmt.Sprintf("%d@sourced.tech", i)}}
+		}
+		people[50].Emails = []string{"@nowhere"}
+		return people
+	}
+	blacklist := newTestBlacklist(t)
+	opts := ReduceOptions{MaxIdentities: 9, LimitPolicy: IdentitiesLimitStrict}
+	expected := newPeople()
+	require.NoError(t, ReducePeople(expected, TestSlowMatcher{}, blacklist, opts))
+	require.Len(t, expected, 29)
+	opts.ExternalWorkers = 8
+	for i := 0; i < 5; i++ {
+		people := newPeople()
+		require.NoError(t, ReducePeople(people, TestSlowMatcher{}, blacklist, opts))
+		require.Equal(t, expected, people)
+	}
+}
+
+// TestBatchMatcher is TestSlowMatcher which resolves the commits in batches and records
+// their sizes.
+type TestBatchMatcher struct {
+	TestSlowMatcher
+	batches chan int
+}
+
+func (m TestBatchMatcher) SupportsMatchingByCommit() bool {
+	return true
+}
+
+func (m TestBatchMatcher) MatchByCommit(
+	ctx context.Context, email, repo, commit string) (user string, err error) {
+	return m.MatchByEmail(ctx, email)
+}
+
+func (m TestBatchMatcher) MatchByCommits(ctx context.Context, queries []external.CommitQuery) (
+	[]external.CommitMatch, error) {
+	m.batches <- len(queries)
+	matches := make([]external.CommitMatch, len(queries))
+	for i, query := range queries {
+		matches[i].User, matches[i].Err = m.MatchByEmail(ctx, query.Email)
+	}
+	return matches, nil
+}
+
+func TestReducePeopleExternalBatch(t *testing.T) {
+	newPeople := func() People {
+		people := People{}
+		for i := int64(1); i <= 50; i++ {
+			people[i] = &Person{ID: i,
+				NamesWithRepos: []NameWithRepo{{fmt.Sprintf("name %d", i), ""}},
+				Emails: []string{fmt.Sprintf("user%d@gmail.com", i%7),
+					fmt.Sprintf("%d@sourced.tech", i)}}
+			if i%10 != 0 {
+				people[i].SampleCommit = &Commit{
+					Repo: fmt.Sprintf("github.com/src-d/repo%d", i%3), Hash: fmt.Sprint(i)}
+			}
+		}
+		return people
+	}
+	blacklist := newTestBlacklist(t)
+	opts := ReduceOptions{MaxIdentities: 9, LimitPolicy: IdentitiesLimitStrict}
+	expected := newPeople()
+	matcher := TestBatchMatcher{batches: make(chan int, 100)}
+	require.NoError(t, ReducePeople(expected, matcher, blacklist, opts))
+	require.Len(t, matcher.batches, 0)
+	opts.ExternalWorkers = 4
+	opts.ExternalBatchSize = 8
+	people := newPeople()
+	require.NoError(t, ReducePeople(people, matcher, blacklist, opts))
+	require.Equal(t, expected, people)
+	close(matcher.batches)
+	// 45 people with commits, 2 emails each, in 3 repositories
+	sizes := map[int]int{}
+	for size := range matcher.batches {
+		sizes[size]++
+	}
+	require.Equal(t, map[int]int{8: 9, 6: 3}, sizes)
+}
+
+// TestMapMatcher matches the emails by the predefined mapping.
+type TestMapMatcher struct {
+	TestMatcher
+	users map[string]string
+}
+
+func (m TestMapMatcher) MatchByEmail(ctx context.Context, email string) (user string, err error) {
+	if user, exists := m.users[email]; exists {
+		return user, nil
+	}
+	return "", external.ErrNoMatches
+}
+
+func TestReducePeopleMultipleProviders(t *testing.T) {
+	people := People{
+		1: {ID: 1, NamesWithRepos: []NameWithRepo{{"Bob", ""}}, Emails: []string{"bob@google.com"},
+			SampleCommit: &Commit{Repo: "git://github.com/bob/project.git"}},
+		2: {ID: 2, NamesWithRepos: []NameWithRepo{{"Bob", ""}}, Emails: []string{"bob@company.com"},
+			SampleCommit: &Commit{Repo: "https://git.company.com/bob/project"}},
+		3: {ID: 3, NamesWithRepos: []NameWithRepo{{"Robert", ""}},
+			Emails: []string{"robert@gmail.com"}},
+	}
+	users := map[string]string{
+		"bob@google.com": "bob", "bob@company.com": "bob", "robert@gmail.com": "bob"}
+	matcher := external.NewCompositeMatcher(
+		external.MatcherRoute{Provider: "github", Hosts: []string{"github.com"},
+			Matcher: TestMapMatcher{users: users}},
+		external.MatcherRoute{Provider: "gitlab", Hosts: []string{"git.company.com"},
+			Matcher: TestMapMatcher{users: users}},
+	)
+	err := ReducePeople(people, matcher, newTestBlacklist(t), ReduceOptions{MaxIdentities: 100})
+	require.NoError(t, err)
+	require.Len(t, people, 2)
+	require.Equal(t, []string{"bob@google.com", "robert@gmail.com"}, people[1].Emails)
+	require.Equal(t, "github", people[1].ExternalIDProvider)
+	require.Equal(t, "bob", people[1].ExternalID)
+	require.Equal(t, []string{"bob@company.com"}, people[2].Emails)
+	require.Equal(t, "gitlab", people[2].ExternalIDProvider)
+	require.Equal(t, "bob", people[2].ExternalID)
+}
+
+func TestReducePeopleBitbucketAccountIDs(t *testing.T) {
+	// the Bitbucket account IDs contain a colon and share the prefix
+	const (
+		bob   = "557058:7bfc3d8e-3c4a-4b39-9f6f-0f4d9e8a1c2b"
+		alice = "557058:1e2f9a7c-5d6b-4c3a-8e9f-0a1b2c3d4e5f"
+	)
+	newPeople := func() People {
+		return People{
+			1: {ID: 1, NamesWithRepos: []NameWithRepo{{"Bob", ""}},
+				Emails:       []string{"bob@company.com"},
+				SampleCommit: &Commit{Repo: "https://bitbucket.org/team/project"}},
+			2: {ID: 2, NamesWithRepos: []NameWithRepo{{"Alice", ""}},
+				Emails:       []string{"alice@company.com"},
+				SampleCommit: &Commit{Repo: "https://bitbucket.org/team/project"}},
+			3: {ID: 3, NamesWithRepos: []NameWithRepo{{"Robert", ""}},
+				Emails: []string{"robert@gmail.com"}},
+		}
+	}
+	users := map[string]string{
+		"bob@company.com": bob, "alice@company.com": alice, "robert@gmail.com": bob}
+	for provider, matcher := range map[string]external.Matcher{
+		"": TestMapMatcher{users: users},
+		"bitbucket": external.NewCompositeMatcher(external.MatcherRoute{
+			Provider: "bitbucket", Hosts: []string{"bitbucket.org"},
+			Matcher: TestMapMatcher{users: users}}),
+	} {
+		t.Run(provider, func(t *testing.T) {
+			people := newPeople()
+			err := ReducePeople(people, matcher, newTestBlacklist(t), ReduceOptions{MaxIdentities: 100})
+			require.NoError(t, err)
+			require.Len(t, people, 2)
+			require.Equal(t, []string{"bob@company.com", "robert@gmail.com"}, people[1].Emails)
+			require.Equal(t, provider, people[1].ExternalIDProvider)
+			require.Equal(t, bob, people[1].ExternalID)
+			require.Equal(t, provider, people[2].ExternalIDProvider)
+			require.Equal(t, alice, people[2].ExternalID)
+		})
+	}
+}
+
+// TestProfiler returns the profiles by the predefined mapping.
+type TestProfiler struct {
+	profiles map[string]external.Profile
+	err      error
+}
+
+func (n TestProfiler) Profile(ctx context.Context, user string) (external.Profile, error) {
+	if n.err != nil {
+		return external.Profile{}, n.err
+	}
+	if profile, exists := n.profiles[user]; exists {
+		return profile, nil
+	}
+	return external.Profile{}, external.ErrNoMatches
+}
+
+func TestFetchExternalProfiles(t *testing.T) {
+	req := require.New(t)
+	people := People{
+		1: {ID: 1, ExternalID: "bob", ExternalIDProvider: "github"},
+		2: {ID: 2, ExternalID: "alice", ExternalIDProvider: "github"},
+		3: {ID: 3},
+	}
+	created := time.Date(2010, 1, 2, 3, 4, 5, 0, time.UTC)
+	profiler := TestProfiler{profiles: map[string]external.Profile{"bob": {
+		DisplayName: "Robert Smith", AvatarURL: "https://avatars.githubusercontent.com/u/1",
+		ProfileURL: "https://github.com/bob", CreatedAt: created}}}
+	req.NoError(FetchExternalProfiles(context.Background(), people, profiler))
+	req.Equal("Robert Smith", people[1].ExternalName)
+	req.Equal("https://avatars.githubusercontent.com/u/1", people[1].ExternalAvatarURL)
+	req.Equal("https://github.com/bob", people[1].ExternalProfileURL)
+	req.Equal(created, people[1].ExternalCreatedAt)
+	req.False(people[2].hasExternalProfile())
+	req.False(people[3].hasExternalProfile())
+	errTest := errors.New("test")
+	req.Equal(errTest, FetchExternalProfiles(context.Background(), people, TestProfiler{
+		err: errTest}))
+}
+
 func TestSetPrimaryValue(t *testing.T) {
 	people := People{
 		1: {ID: 1, NamesWithRepos: []NameWithRepo{
@@ -402,7 +761,15 @@ func TestSetPrimaryValues(t *testing.T) {
 			Emails:      []string{"email@google.com"},
 			PrimaryName: "popular", PrimaryEmail: "email@google.com"},
 	}
-	SetPrimaryValues(people, nameFreqs, emailFreqs, 5)
+	SetPrimaryValues(people, nameFreqs, emailFreqs, 5, false)
+	require.Equal(t, expected, people)
+
+	people[3].ExternalName = "Alice Smith"
+	expected[3].ExternalName = "Alice Smith"
+	SetPrimaryValues(people, nameFreqs, emailFreqs, 5, false)
+	require.Equal(t, expected, people)
+	expected[3].PrimaryName = "Alice Smith"
+	SetPrimaryValues(people, nameFreqs, emailFreqs, 5, true)
 	require.Equal(t, expected, people)
 }
 
@@ -413,14 +780,37 @@ func TestAddEdgesWithMatcherCommits(t *testing.T) {
 			Hash: "d78a9c8b0c077b5ecdb3cf1e1efab4635c97dd7b",
 			Repo: "git://github.com/src-d/hercules.git",
 		}}
-	matcher, _ := external.NewGitHubMatcher("", githubTestToken)
-	peopleGraph := simple.NewUndirectedGraph()
-	for index, person := range people {
-		peopleGraph.AddNode(node{person, index})
-	}
-	unprocessedEmails, err := addEdgesWithMatcher(people, peopleGraph, matcher)
+	matcher := newTestGitHubMatcher(t, "testdata/external-github.json")
+	unprocessedEmails, err := addEdgesWithMatcher(people, newIdentityComponents(people), matcher,
+		ReduceOptions{})
 	req := require.New(t)
 	req.NoError(err)
 	req.Equal(0, len(unprocessedEmails))
 	req.Equal("vmarkovtsev", people[1].ExternalID)
 }
+
+func TestAddEdgesWithMatcherReplay(t *testing.T) {
+	people := People{}
+	people[1] = &Person{ID: 1, NamesWithRepos: []NameWithRepo{{"Vadim", ""}},
+		Emails: []string{"vadim@sourced.tech"}, SampleCommit: &Commit{
+			Hash: "d78a9c8b0c077b5ecdb3cf1e1efab4635c97dd7b",
+			Repo: "git://github.com/src-d/hercules.git",
+		}}
+	people[2] = &Person{ID: 2, NamesWithRepos: []NameWithRepo{{"Bob", ""}},
+		Emails: []string{"bob@sourced.tech"}, SampleCommit: &Commit{
+			Hash: "8d20cc5916edf7cfa6a9c5ed069f0640dc823c12",
+			Repo: "git://github.com/src-d/hercules.git",
+		}}
+	people[3] = &Person{ID: 3, NamesWithRepos: []NameWithRepo{{"Alice", ""}},
+		Emails: []string{"alice@sourced.tech"}}
+	req := require.New(t)
+	matcher, err := external.NewReplayMatcher("testdata/external-github.json")
+	req.NoError(err)
+	unprocessedEmails, err := addEdgesWithMatcher(people, newIdentityComponents(people), matcher,
+		ReduceOptions{})
+	req.NoError(err)
+	req.Equal(map[string]struct{}{"alice@sourced.tech": {}, "bob@sourced.tech": {}},
+		unprocessedEmails)
+	req.Equal("vmarkovtsev", people[1].ExternalID)
+	req.Equal("", people[2].ExternalID)
+}
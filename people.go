@@ -2,26 +2,24 @@ package idmatch
 
 import (
 	"context"
-	"database/sql"
 	"encoding/csv"
-	"encoding/hex"
 	"fmt"
-	"hash/fnv"
-	"io"
+	"math"
 	"os"
 	"regexp"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/briandowns/spinner"
 	"github.com/sirupsen/logrus"
 	"github.com/xitongsys/parquet-go-source/local"
 	"github.com/xitongsys/parquet-go/parquet"
 	"github.com/xitongsys/parquet-go/reader"
 	"github.com/xitongsys/parquet-go/writer"
 
+	"github.com/src-d/identity-matching/external"
 	"github.com/src-d/identity-matching/reporter"
 )
 
@@ -31,7 +29,28 @@ type signatureWithRepo struct {
 	name  string
 	email string
 	hash  string
-	time  time.Time
+	// time is the latest (last seen) commit time.
+	time time.Time
+	// firstSeen is the earliest commit time. Zero if unknown.
+	firstSeen time.Time
+	// commits is the number of commits with this signature. Zero if unknown.
+	commits int
+	// timezones is the distribution of the commit UTC offsets. Nil if unknown.
+	timezones TimezoneHistogram
+}
+
+// stats returns the commit activity of the signature. Signatures without the first seen time
+// and the number of commits, e.g. read from an old cache, are treated as a single commit.
+func (swr signatureWithRepo) stats() AliasStats {
+	stats := AliasStats{FirstSeen: swr.firstSeen, LastSeen: swr.time, Commits: swr.commits,
+		Timezones: swr.timezones.Copy()}
+	if stats.FirstSeen.IsZero() {
+		stats.FirstSeen = swr.time
+	}
+	if stats.Commits == 0 {
+		stats.Commits = 1
+	}
+	return stats
 }
 
 func (swr signatureWithRepo) String() string {
@@ -66,6 +85,55 @@ type Commit struct {
 	Repo string
 }
 
+// AliasStats is the commit activity of a single email or name alias.
+type AliasStats struct {
+	FirstSeen time.Time
+	LastSeen  time.Time
+	Commits   int
+	// Timezones is the distribution of the commit UTC offsets. Nil if unknown.
+	Timezones TimezoneHistogram
+}
+
+// Add accumulates the activity of another occurrence of the same alias.
+func (s *AliasStats) Add(other AliasStats) {
+	if s.Commits == 0 {
+		*s = other
+		s.Timezones = other.Timezones.Copy()
+		return
+	}
+	if other.FirstSeen.Before(s.FirstSeen) {
+		s.FirstSeen = other.FirstSeen
+	}
+	if other.LastSeen.After(s.LastSeen) {
+		s.LastSeen = other.LastSeen
+	}
+	s.Commits += other.Commits
+	if other.Timezones != nil {
+		if s.Timezones == nil {
+			s.Timezones = TimezoneHistogram{}
+		}
+		s.Timezones.Add(other.Timezones)
+	}
+}
+
+// RecentCommits estimates the number of commits made after the given time assuming that
+// they are evenly distributed between the first and the last seen times.
+func (s AliasStats) RecentCommits(since time.Time) int {
+	if !s.LastSeen.After(since) {
+		return 0
+	}
+	if s.FirstSeen.After(since) || !s.LastSeen.After(s.FirstSeen) {
+		return s.Commits
+	}
+	ratio := float64(s.LastSeen.Sub(since)) / float64(s.LastSeen.Sub(s.FirstSeen))
+	recent := int(math.Round(ratio * float64(s.Commits)))
+	if recent < 1 {
+		// the last commit is recent anyway
+		recent = 1
+	}
+	return recent
+}
+
 // Person is a single individual that can have multiple names and emails.
 type Person struct {
 	ID             int64
@@ -74,8 +142,117 @@ type Person struct {
 	// SampleCommit in an example Git commit which mentions this identity. May be nil.
 	SampleCommit *Commit
 	ExternalID   string
-	PrimaryName  string
-	PrimaryEmail string
+	// ExternalIDProvider is the external matcher shorthand which found ExternalID, e.g. "github".
+	ExternalIDProvider string
+	// ExternalName is the display name of ExternalID in the external service, e.g. in
+	// the corporate directory. It is a candidate primary name. May be empty.
+	ExternalName string
+	// ExternalAvatarURL is the avatar of ExternalID in the external service. May be empty.
+	ExternalAvatarURL string
+	// ExternalProfileURL is the web page of ExternalID in the external service. May be empty.
+	ExternalProfileURL string
+	// ExternalCreatedAt is the registration date of ExternalID in the external service.
+	// May be zero.
+	ExternalCreatedAt time.Time
+	PrimaryName       string
+	PrimaryEmail      string
+	// EmailStats is the commit activity of each email. May be nil.
+	EmailStats map[string]AliasStats
+	// NameStats is the commit activity of each name. May be nil.
+	NameStats map[NameWithRepo]AliasStats
+	// Repos is the sorted list of repositories the person committed to. May be nil.
+	// It is not stored in the Parquet output.
+	Repos []string
+}
+
+// externalIdentity is ExternalID together with ExternalIDProvider. The users of different
+// providers never clash, and the users are kept verbatim because they may contain any characters,
+// e.g. the Bitbucket account IDs have a colon. The zero value means no ExternalID.
+type externalIdentity struct {
+	provider string
+	user     string
+}
+
+// String formats the identity for the logs.
+func (id externalIdentity) String() string {
+	if id.provider == "" {
+		return id.user
+	}
+	return id.provider + "/" + id.user
+}
+
+// externalIdentity returns ExternalID together with ExternalIDProvider.
+func (p *Person) externalIdentity() externalIdentity {
+	if p.ExternalID == "" {
+		return externalIdentity{}
+	}
+	return externalIdentity{provider: p.ExternalIDProvider, user: p.ExternalID}
+}
+
+// setExternalIdentity is the inverse of externalIdentity().
+func (p *Person) setExternalIdentity(id externalIdentity) {
+	p.ExternalIDProvider, p.ExternalID = id.provider, id.user
+}
+
+// externalProfile returns the profile of ExternalID in the external service.
+func (p *Person) externalProfile() external.Profile {
+	return external.Profile{
+		DisplayName: p.ExternalName,
+		AvatarURL:   p.ExternalAvatarURL,
+		ProfileURL:  p.ExternalProfileURL,
+		CreatedAt:   p.ExternalCreatedAt,
+	}
+}
+
+// setExternalProfile is the inverse of externalProfile().
+func (p *Person) setExternalProfile(profile external.Profile) {
+	p.ExternalName = profile.DisplayName
+	p.ExternalAvatarURL = profile.AvatarURL
+	p.ExternalProfileURL = profile.ProfileURL
+	p.ExternalCreatedAt = profile.CreatedAt
+}
+
+// hasExternalProfile indicates whether any of the external profile fields is set.
+func (p *Person) hasExternalProfile() bool {
+	return p.externalProfile() != external.Profile{}
+}
+
+// Timezones returns the distribution of the person's commit UTC offsets. Every commit has
+// exactly one email, so the histograms of the emails are summed.
+func (p *Person) Timezones() TimezoneHistogram {
+	result := TimezoneHistogram{}
+	for _, stats := range p.EmailStats {
+		result.Add(stats.Timezones)
+	}
+	return result
+}
+
+// hasTimezones reports whether any person has the commit timezones.
+func (p People) hasTimezones() bool {
+	for _, person := range p {
+		if len(person.Timezones()) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Person) addEmailStats(email string, stats AliasStats) {
+	if p.EmailStats == nil {
+		p.EmailStats = map[string]AliasStats{}
+	}
+	val := p.EmailStats[email]
+	val.Add(stats)
+	p.EmailStats[email] = val
+}
+
+func (p *Person) addNameStats(name NameWithRepo, stats AliasStats) {
+	if p.NameStats == nil {
+		p.NameStats = map[NameWithRepo]AliasStats{}
+	}
+	val := p.NameStats[name]
+	val.Add(stats)
+	p.NameStats[name] = val
 }
 
 func uniqueNamesWithRepo(names []NameWithRepo) []NameWithRepo {
@@ -123,56 +300,167 @@ func (p Person) String() string {
 // People is a map of persons indexed by their ID.
 type People map[int64]*Person
 
-func newPeople(commits []signatureWithRepo, blacklist Blacklist) (People, error) {
-	result := make(People)
-	var id int64
-	var nameWithRepo NameWithRepo
+// identityKey is the cleaned email, name and repository of a signature. The signatures with
+// the same key belong to the same Person.
+type identityKey struct {
+	email string
+	name  string
+	repo  string
+}
 
-	for _, p := range commits {
-		name, err := cleanName(p.name)
-		if err != nil {
-			return nil, err
-		}
-		email, err := cleanEmail(p.email)
-		if err != nil {
-			return nil, err
-		}
-		if blacklist.isPopularName(name) {
-			reporter.Increment("popular names")
-			nameWithRepo = NameWithRepo{name, p.repo}
-		} else {
-			nameWithRepo = NameWithRepo{name, ""}
-		}
+// peopleAggregator builds People and the name and email frequencies from the stream of
+// signatures in a single pass. The signatures are aggregated per identityKey and the repeated
+// strings are interned, so the memory scales with the number of distinct identities rather
+// than with the number of signatures.
+type peopleAggregator struct {
+	blacklist       Blacklist
+	recentStartTime time.Time
+	strings         stringInterner
+	identities      map[identityKey]*Person
+	people          People
+	nameFreqs       map[string]*Frequency
+	emailFreqs      map[string]*Frequency
+	// signatures is the number of the aggregated signatures.
+	signatures int
+}
 
-		ignoredName := blacklist.isIgnoredName(name)
-		ignoredEmail := blacklist.isIgnoredEmail(email)
-		if ignoredName {
-			reporter.Increment("ignored names")
-		}
-		if ignoredEmail {
-			reporter.Increment("ignored emails")
-		}
-		if ignoredEmail || ignoredName {
-			continue
+func newPeopleAggregator(blacklist Blacklist, recentStartTime time.Time) *peopleAggregator {
+	return &peopleAggregator{
+		blacklist:       blacklist,
+		recentStartTime: recentStartTime,
+		strings:         stringInterner{},
+		identities:      map[identityKey]*Person{},
+		people:          People{},
+		nameFreqs:       map[string]*Frequency{},
+		emailFreqs:      map[string]*Frequency{},
+	}
+}
+
+// add aggregates the signature. The frequencies include the ignored names and emails.
+func (a *peopleAggregator) add(sig signatureWithRepo) error {
+	name, err := cleanName(sig.name)
+	if err != nil {
+		return err
+	}
+	email, err := cleanEmail(sig.email)
+	if err != nil {
+		return err
+	}
+	a.signatures++
+	name, email = a.strings.intern(name), a.strings.intern(email)
+	stats := sig.stats()
+	for _, freq := range []struct {
+		freqs map[string]*Frequency
+		value string
+	}{{a.nameFreqs, name}, {a.emailFreqs, email}} {
+		val := freq.freqs[freq.value]
+		if val == nil {
+			val = &Frequency{}
+			freq.freqs[freq.value] = val
 		}
+		val.Total += stats.Commits
+		val.Recent += stats.RecentCommits(a.recentStartTime)
+	}
+
+	repo := a.strings.intern(sig.repo)
+	var nameWithRepo NameWithRepo
+	if a.blacklist.isPopularName(name) {
+		reporter.Increment("popular names")
+		nameWithRepo = NameWithRepo{name, repo}
+	} else {
+		nameWithRepo = NameWithRepo{name, ""}
+	}
+	ignoredName := a.blacklist.isIgnoredName(name)
+	ignoredEmail := a.blacklist.isIgnoredEmail(email)
+	if ignoredName {
+		reporter.Increment("ignored names")
+	}
+	if ignoredEmail {
+		reporter.Increment("ignored emails")
+	}
+	if ignoredEmail || ignoredName {
+		return nil
+	}
 
-		id++
-		result[id] = &Person{
+	key := identityKey{email: email, name: name, repo: repo}
+	person := a.identities[key]
+	if person == nil {
+		id := int64(len(a.people) + 1)
+		person = &Person{
 			ID:             id,
 			NamesWithRepos: []NameWithRepo{nameWithRepo},
 			Emails:         []string{email},
-			SampleCommit:   &Commit{p.hash, p.repo},
+			Repos:          []string{repo},
 		}
+		a.identities[key] = person
+		a.people[id] = person
+	}
+	if person.SampleCommit == nil && sig.hash != "" {
+		person.SampleCommit = &Commit{sig.hash, repo}
 	}
-	reporter.Commit("people after filtering", len(result))
-	return result, nil
+	person.addEmailStats(email, stats)
+	person.addNameStats(nameWithRepo, stats)
+	return nil
+}
+
+// finish returns the aggregated people and the name and email frequencies.
+func (a *peopleAggregator) finish() (People, map[string]*Frequency, map[string]*Frequency) {
+	reporter.Commit("people after filtering", len(a.people))
+	a.identities = nil
+	a.strings = nil
+	return a.people, a.nameFreqs, a.emailFreqs
+}
+
+// newPeople aggregates the signatures which are already in memory.
+func newPeople(commits []signatureWithRepo, blacklist Blacklist) (People, error) {
+	aggregator := newPeopleAggregator(blacklist, time.Now())
+	for _, commit := range commits {
+		if err := aggregator.add(commit); err != nil {
+			return nil, err
+		}
+	}
+	people, _, _ := aggregator.finish()
+	return people, nil
 }
 
 type parquetPersonAlias struct {
-	ID    int64  `parquet:"name=id, type=INT_64"`
-	Email string `parquet:"name=email, type=UTF8"`
-	Name  string `parquet:"name=name, type=UTF8"`
-	Repo  string `parquet:"name=repo, type=UTF8"`
+	ID        int64  `parquet:"name=id, type=INT_64"`
+	Email     string `parquet:"name=email, type=UTF8"`
+	Name      string `parquet:"name=name, type=UTF8"`
+	Repo      string `parquet:"name=repo, type=UTF8"`
+	FirstSeen int64  `parquet:"name=first_seen, type=TIMESTAMP_MILLIS"`
+	LastSeen  int64  `parquet:"name=last_seen, type=TIMESTAMP_MILLIS"`
+	Commits   int64  `parquet:"name=commits, type=INT_64"`
+}
+
+func newParquetPersonAlias(id int64, email string, name NameWithRepo, stats AliasStats,
+) parquetPersonAlias {
+	alias := parquetPersonAlias{ID: id, Email: email, Name: name.Name, Repo: name.Repo}
+	if stats.Commits > 0 {
+		alias.FirstSeen = toMillis(stats.FirstSeen)
+		alias.LastSeen = toMillis(stats.LastSeen)
+		alias.Commits = int64(stats.Commits)
+	}
+	return alias
+}
+
+func (a parquetPersonAlias) stats() (AliasStats, bool) {
+	if a.Commits == 0 {
+		return AliasStats{}, false
+	}
+	return AliasStats{
+		FirstSeen: fromMillis(a.FirstSeen),
+		LastSeen:  fromMillis(a.LastSeen),
+		Commits:   int(a.Commits),
+	}, true
+}
+
+func toMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func fromMillis(ms int64) time.Time {
+	return time.Unix(0, ms*int64(time.Millisecond)).UTC()
 }
 
 type parquetPersonIdentity struct {
@@ -181,9 +469,13 @@ type parquetPersonIdentity struct {
 	PrimaryEmail       string `parquet:"name=primary_email, type=UTF8"`
 	ExternalIDProvider string `parquet:"name=external_id_provider, type=UTF8"`
 	ExternalID         string `parquet:"name=external_id, type=UTF8"`
+	ExternalName       string `parquet:"name=external_name, type=UTF8"`
+	ExternalAvatarURL  string `parquet:"name=external_avatar_url, type=UTF8"`
+	ExternalProfileURL string `parquet:"name=external_profile_url, type=UTF8"`
+	ExternalCreatedAt  int64  `parquet:"name=external_created_at, type=TIMESTAMP_MILLIS"`
 }
 
-func readFromParquet(pathAliases string) (People, string, error) {
+func readFromParquet(pathAliases string) (People, error) {
 	pathAliases, pathIDs := preparePaths(pathAliases)
 	getParquetReader := func(path string, obj interface{}) (*reader.ParquetReader, func()) {
 		fr, err := local.NewLocalFileReader(path)
@@ -210,7 +502,7 @@ func readFromParquet(pathAliases string) (People, string, error) {
 	parquetPersonAliases := make([]parquetPersonAlias, num)
 	if err := pr.Read(&parquetPersonAliases); err != nil {
 		logrus.Printf("read error in %s: %v", pathAliases, err)
-		return nil, "", err
+		return nil, err
 	}
 	pr.ReadStop()
 
@@ -220,7 +512,7 @@ func readFromParquet(pathAliases string) (People, string, error) {
 	parquetPersonsIDs := make([]parquetPersonIdentity, numIds)
 	if err := prIDs.Read(&parquetPersonsIDs); err != nil {
 		logrus.Printf("read error in %s: %v", pathIDs, err)
-		return nil, "", err
+		return nil, err
 	}
 	prIDs.ReadStop()
 	id2PersonID := map[int64]parquetPersonIdentity{}
@@ -229,38 +521,49 @@ func readFromParquet(pathAliases string) (People, string, error) {
 	}
 
 	people := make(People)
-	var externalIDProvider, curExternalIDProvider string
 	for _, person := range parquetPersonAliases {
 		if _, ok := people[person.ID]; !ok {
-			people[person.ID] = &Person{person.ID, nil, nil, nil, "", "", ""}
+			people[person.ID] = &Person{ID: person.ID}
 		}
+		stats, hasStats := person.stats()
 		if person.Email != "" {
 			people[person.ID].Emails = append(people[person.ID].Emails, person.Email)
+			if hasStats {
+				people[person.ID].addEmailStats(person.Email, stats)
+			}
 		}
 		if person.Name != "" {
-			people[person.ID].NamesWithRepos = append(people[person.ID].NamesWithRepos,
-				NameWithRepo{person.Name, person.Repo})
+			name := NameWithRepo{person.Name, person.Repo}
+			people[person.ID].NamesWithRepos = append(people[person.ID].NamesWithRepos, name)
+			if hasStats {
+				people[person.ID].addNameStats(name, stats)
+			}
 		}
 	}
 	for _, p := range people {
 		people[p.ID].PrimaryName = id2PersonID[p.ID].PrimaryName
 		people[p.ID].PrimaryEmail = id2PersonID[p.ID].PrimaryEmail
 		people[p.ID].ExternalID = id2PersonID[p.ID].ExternalID
-		curExternalIDProvider = id2PersonID[p.ID].ExternalIDProvider
 		if people[p.ID].ExternalID != "" {
-			if externalIDProvider != "" && externalIDProvider != curExternalIDProvider {
-				return people, externalIDProvider, fmt.Errorf(
-					"there are multiple ExternalIDProvider-s for %s: %s %s",
-					people[p.ID].String(), externalIDProvider, curExternalIDProvider)
+			people[p.ID].ExternalIDProvider = id2PersonID[p.ID].ExternalIDProvider
+			identity := id2PersonID[p.ID]
+			profile := external.Profile{
+				DisplayName: identity.ExternalName,
+				AvatarURL:   identity.ExternalAvatarURL,
+				ProfileURL:  identity.ExternalProfileURL,
 			}
-			externalIDProvider = curExternalIDProvider
+			if identity.ExternalCreatedAt != 0 {
+				profile.CreatedAt = fromMillis(identity.ExternalCreatedAt)
+			}
+			people[p.ID].setExternalProfile(profile)
 		}
 	}
-	return people, externalIDProvider, nil
+	return people, nil
 }
 
-// WriteToParquet saves People structure to parquet file.
-func (p People) WriteToParquet(path string, externalIDProvider string) (err error) {
+// WriteToParquet saves People structure to parquet file. Each identity is written with its own
+// ExternalIDProvider.
+func (p People) WriteToParquet(path string) (err error) {
 	path, pathIDs := preparePaths(path)
 	getParquetWriter := func(path string, obj interface{}) (*writer.ParquetWriter, func()) {
 		pf, err := local.NewLocalFileWriter(path)
@@ -296,22 +599,26 @@ func (p People) WriteToParquet(path string, externalIDProvider string) (err erro
 	p.ForEach(func(key int64, val *Person) bool {
 		provider := ""
 		if val.ExternalID != "" {
-			provider = externalIDProvider
+			provider = val.ExternalIDProvider
 		}
-		if err := pwIDs.Write(parquetPersonIdentity{
+		identity := parquetPersonIdentity{
 			val.ID, val.PrimaryName, val.PrimaryEmail, provider,
-			val.ExternalID}); err != nil {
+			val.ExternalID, val.ExternalName, val.ExternalAvatarURL, val.ExternalProfileURL, 0}
+		if !val.ExternalCreatedAt.IsZero() {
+			identity.ExternalCreatedAt = toMillis(val.ExternalCreatedAt)
+		}
+		if err := pwIDs.Write(identity); err != nil {
 			return true
 		}
 		for _, email := range val.Emails {
-			if err := pw.Write(parquetPersonAlias{
-				val.ID, email, "", ""}); err != nil {
+			if err := pw.Write(newParquetPersonAlias(
+				val.ID, email, NameWithRepo{}, val.EmailStats[email])); err != nil {
 				return true
 			}
 		}
 		for _, name := range val.NamesWithRepos {
-			if err = pw.Write(parquetPersonAlias{
-				val.ID, "", name.Name, name.Repo}); err != nil {
+			if err = pw.Write(newParquetPersonAlias(
+				val.ID, "", name, val.NameStats[name])); err != nil {
 				return true
 			}
 		}
@@ -333,20 +640,32 @@ func preparePaths(rawPath string) (pathAliases, pathIDs string) {
 func (p People) Merge(ids ...int64) (int64, error) {
 	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
 	p0 := p[ids[0]]
-	newExternalID := p0.ExternalID
+	newExternalID := p0.externalIdentity()
 	for _, id := range ids[1:] {
-		if newExternalID == "" {
-			newExternalID = p[id].ExternalID
-		} else if p[id].ExternalID != "" && p[id].ExternalID != newExternalID {
+		externalID := p[id].externalIdentity()
+		if newExternalID == (externalIdentity{}) {
+			newExternalID = externalID
+		} else if externalID != (externalIdentity{}) && externalID != newExternalID {
 			return -1, fmt.Errorf("cannot merge ids %v with different ExternalIDs: %s %s",
-				ids, newExternalID, p[id].ExternalID)
+				ids, newExternalID, externalID)
+		}
+		if !p0.hasExternalProfile() {
+			p0.setExternalProfile(p[id].externalProfile())
 		}
 		p0.Emails = append(p0.Emails, p[id].Emails...)
 		p0.NamesWithRepos = append(p0.NamesWithRepos, p[id].NamesWithRepos...)
+		p0.Repos = append(p0.Repos, p[id].Repos...)
+		for email, stats := range p[id].EmailStats {
+			p0.addEmailStats(email, stats)
+		}
+		for name, stats := range p[id].NameStats {
+			p0.addNameStats(name, stats)
+		}
 		delete(p, id)
 	}
 	p0.Emails = unique(p0.Emails)
 	p0.NamesWithRepos = uniqueNamesWithRepo(p0.NamesWithRepos)
+	p0.Repos = unique(p0.Repos)
 	p0.SampleCommit = nil
 
 	return ids[0], nil
@@ -367,24 +686,39 @@ func (p People) ForEach(f func(int64, *Person) bool) {
 	}
 }
 
-// FindPeople returns all the people in the database or from the disk cache.
-func FindPeople(ctx context.Context, connString string, cachePath string, blacklist Blacklist,
+// FindPeople returns all the people in the database or from the disk cache. The signatures
+// are streamed and aggregated on the fly.
+func FindPeople(ctx context.Context, opts GitbaseOptions, cachePath string, blacklist Blacklist,
 	recentMonths int) (People, map[string]*Frequency, map[string]*Frequency, error) {
 	if recentMonths == 0 {
 		logrus.Panicf("recentMonths should be a positive integer")
 	}
-	commits, err := findSignatures(ctx, connString, cachePath)
-	reporter.Commit("people found", len(commits))
+	aggregator := newPeopleAggregator(blacklist, time.Now().AddDate(0, -recentMonths, 0))
+	err := findSignatures(ctx, opts, cachePath, aggregator.add)
+	reporter.Commit("people found", aggregator.signatures)
 	if err != nil {
 		return nil, nil, nil, err
 	}
-	people, err := newPeople(commits, blacklist)
+	people, nameFreqs, emailFreqs := aggregator.finish()
+	return people, nameFreqs, emailFreqs, nil
+}
+
+// ReadPeople returns all the people in the tabular file at path, StdinPath means stdin.
+// The signatures are streamed and aggregated on the fly.
+func ReadPeople(path string, opts InputOptions, blacklist Blacklist, recentMonths int) (
+	People, map[string]*Frequency, map[string]*Frequency, error) {
+	if recentMonths == 0 {
+		logrus.Panicf("recentMonths should be a positive integer")
+	}
+	logrus.Printf("reading signatures from %s", path)
+	aggregator := newPeopleAggregator(blacklist, time.Now().AddDate(0, -recentMonths, 0))
+	err := scanSignatures(path, opts, aggregator.add)
+	reporter.Commit("people found", aggregator.signatures)
 	if err != nil {
 		return nil, nil, nil, err
 	}
-	recentStartTime := time.Now().AddDate(0, -recentMonths, 0)
-	nameFreqs, emailFreqs, err := getStats(commits, recentStartTime)
-	return people, nameFreqs, emailFreqs, err
+	people, nameFreqs, emailFreqs := aggregator.finish()
+	return people, nameFreqs, emailFreqs, nil
 }
 
 // Frequency is a pair of word frequencies for a certain recent period of time and for all the time
@@ -393,213 +727,117 @@ type Frequency struct {
 	Total  int
 }
 
-func countFreqs(commits []signatureWithRepo, getter func(signatureWithRepo) string, cleaner func(string) (string, error),
-	recentStartTime time.Time) (map[string]*Frequency, error) {
-	freqs := map[string]*Frequency{}
-	for _, commit := range commits {
-		value, err := cleaner(getter(commit))
-		if err != nil {
-			return nil, err
-		}
-		if _, ok := freqs[value]; !ok {
-			freqs[value] = &Frequency{}
-		}
-		freqs[value].Total++
-		if commit.time.After(recentStartTime) {
-			freqs[value].Recent++
-		}
-	}
-	return freqs, nil
-}
+// signaturesCacheColumns are the columns of the raw signatures cache. They are also the fields
+// of the signatures input, where only requiredSignatureColumns are mandatory.
+var signaturesCacheColumns = []string{
+	"repo", "name", "email", "hash", "time", "first_seen", "commits", "timezones"}
 
-// getStats calculates frequencies of names and emails in commits for future primary names and
-// emails detection. Stats are collected both for the given recent period of time and for all
-// the time.
-func getStats(commits []signatureWithRepo, recentStartTime time.Time) (
-	nameFreqs, emailFreqs map[string]*Frequency, err error) {
-	nameFreqs, err = countFreqs(commits, func(c signatureWithRepo) string { return c.name }, cleanName, recentStartTime)
-	if err != nil {
-		return nil, nil, err
-	}
-	emailFreqs, err = countFreqs(commits, func(c signatureWithRepo) string { return c.email }, cleanEmail, recentStartTime)
-	return nameFreqs, emailFreqs, nil
+// readSignaturesFromDisk reads the raw signatures cache or any other tabular input with
+// the same column names.
+func readSignaturesFromDisk(filePath string) ([]signatureWithRepo, error) {
+	return readSignatures(filePath, InputOptions{})
 }
 
-const findPeopleSQL = `
-SELECT repository_id, commit_author_name, commit_author_email, MAX(commit_hash), MAX(commit_author_when)
-FROM commits
-GROUP BY repository_id, commit_author_name, commit_author_email;
-`
-
-// HashPeopleDiscoverySQL returns the hashsum of the SQL used to fetch the raw Git signatures.
-func HashPeopleDiscoverySQL() string {
-	h := fnv.New32a()
-	n, err := h.Write([]byte(findPeopleSQL))
-	if err != nil || n != len(findPeopleSQL) {
-		logrus.Panicf("HashPeopleDiscoverySQL: %d %d %v", n, len(findPeopleSQL), err)
-	}
-	return hex.EncodeToString(h.Sum(nil))
+// signatureVisitor is called for each signature in the order of reading. The returned error
+// stops the reading.
+type signatureVisitor func(sig signatureWithRepo) error
+
+// signaturesCacheWriter writes the raw signatures cache one signature at a time. The cache is
+// written to a temporary file which replaces the destination only in commit(), so that
+// an interrupted run never leaves a truncated cache behind.
+type signaturesCacheWriter struct {
+	path   string
+	file   *os.File
+	writer *csv.Writer
 }
 
-func readSignaturesFromDisk(filePath string) (commits []signatureWithRepo, err error) {
-	var file *os.File
-	file, err = os.Open(filePath)
+func newSignaturesCacheWriter(filePath string) (*signaturesCacheWriter, error) {
+	file, err := os.Create(filePath + ".tmp")
 	if err != nil {
 		return nil, err
 	}
-	defer func() {
-		errClose := file.Close()
-		if err == nil {
-			err = errClose
-		}
-	}()
-
-	r := csv.NewReader(file)
-	header := make(map[string]int)
-	rowIndex := 0
-	for {
-		record, err := r.Read()
-		rowIndex++
-
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return nil, err
-		}
-		if len(header) == 0 {
-			if len(record) != 5 {
-				return nil, fmt.Errorf(
-					"invalid CSV file: should have 5 columns instead of %d", len(record))
-			}
-			for index, name := range record {
-				header[name] = index
-			}
-		} else {
-			if len(record) != len(header) {
-				return nil, fmt.Errorf("invalid CSV record: %s", strings.Join(record, ","))
-			}
-
-			for key := range header {
-				if key != "time" {
-					normValue, _, err := removeDiacritical(record[header[key]])
-					if err != nil {
-						return nil, err
-					}
-					record[header[key]] = strings.TrimSpace(normalizeSpaces(strings.ToLower(normValue)))
-				} else {
-					record[header[key]] = strings.TrimSpace(record[header[key]])
-				}
-			}
-
-			person := signatureWithRepo{
-				repo:  record[header["repo"]],
-				name:  record[header["name"]],
-				email: record[header["email"]],
-				hash:  record[header["hash"]],
-			}
-			person.time, err = time.Parse(time.RFC3339, record[header["time"]])
-			if err != nil || person.repo == "" || person.email == "" || person.name == "" ||
-				person.hash == "" {
-				logrus.Warnf("invalid cache item: %v: %v", person.String(), err)
-				continue
-			}
-			commits = append(commits, person)
-		}
+	w := &signaturesCacheWriter{path: filePath, file: file, writer: csv.NewWriter(file)}
+	if err = w.writer.Write(signaturesCacheColumns); err != nil {
+		w.abort()
+		return nil, err
 	}
+	return w, nil
+}
 
-	if err == io.EOF {
-		err = nil
-	}
-	return
+// flush writes the buffered signatures to the file.
+func (w *signaturesCacheWriter) flush() error {
+	w.writer.Flush()
+	return w.writer.Error()
 }
 
-func readSignaturesFromDatabase(ctx context.Context, conn string) ([]signatureWithRepo, error) {
-	db, err := sql.Open("mysql", conn+"?parseTime=true")
-	if err != nil {
-		return nil, err
-	}
-	db.SetMaxIdleConns(0)
+func (w *signaturesCacheWriter) write(p signatureWithRepo) error {
+	stats := p.stats()
+	return w.writer.Write([]string{p.repo, p.name, p.email, p.hash, p.time.Format(time.RFC3339),
+		stats.FirstSeen.Format(time.RFC3339), strconv.Itoa(stats.Commits),
+		p.timezones.String()})
+}
 
-	rows, err := db.QueryContext(ctx, findPeopleSQL)
-	if err != nil {
-		return nil, err
+// commit flushes the cache and moves it to the destination.
+func (w *signaturesCacheWriter) commit() error {
+	err := w.flush()
+	if errClose := w.file.Close(); err == nil {
+		err = errClose
 	}
-
-	spin := spinner.New(spinner.CharSets[11], 100*time.Millisecond)
-	spin.Start()
-	defer spin.Stop()
-	var result []signatureWithRepo
-	i := 0
-	for rows.Next() {
-		spin.Suffix = fmt.Sprintf(" %d", i+1)
-		i++
-		var repo, name, email, hash string
-		var time time.Time
-		if err := rows.Scan(&repo, &name, &email, &hash, &time); err != nil {
-			return nil, err
-		}
-		result = append(result, signatureWithRepo{repo, name, email, hash, time})
+	if err == nil {
+		err = os.Rename(w.file.Name(), w.path)
 	}
-
-	return result, rows.Err()
-}
-
-func storeSignaturesOnDisk(filePath string, result []signatureWithRepo) (err error) {
-	var file *os.File
-	file, err = os.Create(filePath)
 	if err != nil {
-		return
+		_ = os.Remove(w.file.Name())
 	}
-	defer func() {
-		errClose := file.Close()
-		if err == nil {
-			err = errClose
-		}
-	}()
+	return err
+}
 
-	writer := csv.NewWriter(file)
-	defer func() {
-		writer.Flush()
-		if err == nil {
-			err = writer.Error()
-		}
-	}()
-	err = writer.Write([]string{"repo", "name", "email", "hash", "time"})
+// abort discards the written signatures.
+func (w *signaturesCacheWriter) abort() {
+	_ = w.file.Close()
+	_ = os.Remove(w.file.Name())
+}
+
+func storeSignaturesOnDisk(filePath string, result []signatureWithRepo) error {
+	w, err := newSignaturesCacheWriter(filePath)
 	if err != nil {
-		return
+		return err
 	}
 	for _, p := range result {
-		err = writer.Write([]string{p.repo, p.name, p.email, p.hash, p.time.Format(time.RFC3339)})
-		if err != nil {
-			return
+		if err = w.write(p); err != nil {
+			w.abort()
+			return err
 		}
 	}
-	return
+	return w.commit()
 }
 
-func findSignatures(ctx context.Context, connStr string, path string) ([]signatureWithRepo, error) {
+// findSignatures streams the signatures from the cache at path if it exists, otherwise from
+// the database while writing the cache. The interrupted writing of the cache is resumed.
+func findSignatures(ctx context.Context, opts GitbaseOptions, path string,
+	visit signatureVisitor) error {
 	if _, err := os.Stat(path); err == nil {
 		logrus.Printf("reading signatures from the cache: %s", path)
-		return readSignaturesFromDisk(path)
+		return scanSignatures(path, InputOptions{}, visit)
 	} else if !os.IsNotExist(err) {
-		return nil, err
+		return err
 	}
 
 	logrus.Printf("signatures are not cached in %s, loading them from the database", path)
-	result, err := readSignaturesFromDatabase(ctx, connStr)
+	if path == "" {
+		return scanSignaturesFromDatabase(ctx, opts, nil, visit)
+	}
+	checkpoint, err := openSignaturesCheckpoint(
+		path, HashPeopleDiscoverySQL(opts.Filters), visit)
 	if err != nil {
-		return nil, err
+		return err
 	}
-
-	if path != "" {
-		logrus.Printf("writing the signatures cache to %s", path)
-		if err := storeSignaturesOnDisk(path, result); err != nil {
-			return nil, err
-		}
+	if err = scanSignaturesFromDatabase(ctx, opts, checkpoint, visit); err != nil {
+		checkpoint.suspend()
+		return err
 	}
-
-	return result, nil
+	logrus.Printf("writing the signatures cache to %s", path)
+	return checkpoint.commit()
 }
 
 func cleanName(name string) (string, error) {
@@ -4,8 +4,10 @@ import (
 	"context"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
+	"unsafe"
 
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/require"
@@ -26,68 +28,122 @@ var Signatures = []signatureWithRepo{
 		time: time.Now().AddDate(0, -4, 0).Truncate(time.Second).UTC()},
 }
 
-func TestPeopleNew(t *testing.T) {
-	expected := People{
-		1: {ID: 1, NamesWithRepos: []NameWithRepo{{"bob", ""}}, Emails: []string{"bob@google.com"},
-			SampleCommit: &Commit{"aaa", "repo1"}},
-		2: {ID: 2, NamesWithRepos: []NameWithRepo{{"bob", ""}}, Emails: []string{"bob@google.com"},
-			SampleCommit: &Commit{"bbb", "repo2"}},
-		3: {ID: 3, NamesWithRepos: []NameWithRepo{{"alice", ""}}, Emails: []string{"alice@google.com"},
-			SampleCommit: &Commit{"ccc", "repo1"}},
-		4: {ID: 4, NamesWithRepos: []NameWithRepo{{"bob", ""}}, Emails: []string{"bob@google.com"},
-			SampleCommit: &Commit{"ddd", "repo1"}},
+// newTestPerson creates a Person from a single signature in Signatures.
+func newTestPerson(id int64, name, email string, sig int) *Person {
+	stats := AliasStats{FirstSeen: Signatures[sig].time, LastSeen: Signatures[sig].time, Commits: 1}
+	return &Person{ID: id, NamesWithRepos: []NameWithRepo{{name, ""}}, Emails: []string{email},
+		SampleCommit: &Commit{Signatures[sig].hash, Signatures[sig].repo},
+		Repos:        []string{Signatures[sig].repo},
+		EmailStats:   map[string]AliasStats{email: stats},
+		NameStats:    map[NameWithRepo]AliasStats{{name, ""}: stats}}
+}
+
+// newTestPeople returns the people aggregated from Signatures.
+func newTestPeople() People {
+	bob := newTestPerson(1, "bob", "bob@google.com", 0)
+	bobStats := AliasStats{FirstSeen: Signatures[0].time, LastSeen: Signatures[3].time, Commits: 2}
+	bob.EmailStats["bob@google.com"] = bobStats
+	bob.NameStats[NameWithRepo{"bob", ""}] = bobStats
+	return People{
+		1: bob,
+		2: newTestPerson(2, "bob", "bob@google.com", 1),
+		3: newTestPerson(3, "alice", "alice@google.com", 2),
 	}
+}
+
+func TestPeopleNew(t *testing.T) {
+	// the signatures 0 and 3 have the same email, name and repository
+	expected := newTestPeople()
 	people, err := newPeople(Signatures, newTestBlacklist(t))
 	require.NoError(t, err)
 	require.Equal(t, expected, people)
 }
 
+func TestPeopleNewStats(t *testing.T) {
+	first := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	last := time.Date(2019, 4, 1, 0, 0, 0, 0, time.UTC)
+	people, err := newPeople([]signatureWithRepo{
+		{repo: "repo1", name: "Bob", email: "bob@google.com", hash: "aaa",
+			time: last, firstSeen: first, commits: 10},
+	}, newTestBlacklist(t))
+	require.NoError(t, err)
+	stats := AliasStats{FirstSeen: first, LastSeen: last, Commits: 10}
+	require.Equal(t, map[string]AliasStats{"bob@google.com": stats}, people[1].EmailStats)
+	require.Equal(t, map[NameWithRepo]AliasStats{{"bob", ""}: stats}, people[1].NameStats)
+}
+
+func TestAliasStatsAdd(t *testing.T) {
+	t1 := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	t2 := time.Date(2019, 2, 1, 0, 0, 0, 0, time.UTC)
+	t3 := time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC)
+	var stats AliasStats
+	stats.Add(AliasStats{FirstSeen: t2, LastSeen: t2, Commits: 1})
+	require.Equal(t, AliasStats{FirstSeen: t2, LastSeen: t2, Commits: 1}, stats)
+	stats.Add(AliasStats{FirstSeen: t1, LastSeen: t3, Commits: 5})
+	require.Equal(t, AliasStats{FirstSeen: t1, LastSeen: t3, Commits: 6}, stats)
+}
+
+func TestAliasStatsRecentCommits(t *testing.T) {
+	first := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	last := time.Date(2019, 1, 11, 0, 0, 0, 0, time.UTC)
+	stats := AliasStats{FirstSeen: first, LastSeen: last, Commits: 20}
+	require.Equal(t, 0, stats.RecentCommits(last))
+	require.Equal(t, 20, stats.RecentCommits(first.AddDate(0, 0, -1)))
+	require.Equal(t, 6, stats.RecentCommits(first.AddDate(0, 0, 7)))
+	require.Equal(t, 1, stats.RecentCommits(last.Add(-time.Second)))
+	single := AliasStats{FirstSeen: last, LastSeen: last, Commits: 3}
+	require.Equal(t, 3, single.RecentCommits(first))
+}
+
 func TestTwoPeopleMerge(t *testing.T) {
 	require := require.New(t)
 	people, err := newPeople(Signatures, newTestBlacklist(t))
 	require.NoError(err)
 	mergedID, err := people.Merge(1, 2)
+	bobStats := AliasStats{FirstSeen: Signatures[1].time, LastSeen: Signatures[3].time, Commits: 3}
 	expected := People{
-		1: {ID: 1, NamesWithRepos: []NameWithRepo{{"bob", ""}}, Emails: []string{"bob@google.com"}},
-		3: {ID: 3, NamesWithRepos: []NameWithRepo{{"alice", ""}}, Emails: []string{"alice@google.com"},
-			SampleCommit: &Commit{"ccc", "repo1"}},
-		4: {ID: 4, NamesWithRepos: []NameWithRepo{{"bob", ""}}, Emails: []string{"bob@google.com"},
-			SampleCommit: &Commit{"ddd", "repo1"}},
+		1: {ID: 1, NamesWithRepos: []NameWithRepo{{"bob", ""}}, Emails: []string{"bob@google.com"},
+			Repos:      []string{"repo1", "repo2"},
+			EmailStats: map[string]AliasStats{"bob@google.com": bobStats},
+			NameStats:  map[NameWithRepo]AliasStats{{"bob", ""}: bobStats}},
+		3: newTestPerson(3, "alice", "alice@google.com", 2),
 	}
 	require.Equal(int64(1), mergedID)
 	require.Equal(expected, people)
 	require.NoError(err)
 
-	mergedID, err = people.Merge(3, 4)
-	expected = People{
-		1: {ID: 1, NamesWithRepos: []NameWithRepo{{"bob", ""}}, Emails: []string{"bob@google.com"}},
-		3: {ID: 3,
-			NamesWithRepos: []NameWithRepo{{"alice", ""}, {"bob", ""}},
-			Emails:         []string{"alice@google.com", "bob@google.com"}},
-	}
-	require.Equal(int64(3), mergedID)
-	require.Equal(expected, people)
-	require.NoError(err)
-
-	mergedID, err = people.Merge(1, 3)
+	mergedID, err = people.Merge(3, 1)
+	aliceStats := AliasStats{FirstSeen: Signatures[2].time, LastSeen: Signatures[2].time, Commits: 1}
 	expected = People{
 		1: {ID: 1,
 			NamesWithRepos: []NameWithRepo{{"alice", ""}, {"bob", ""}},
-			Emails:         []string{"alice@google.com", "bob@google.com"}},
+			Emails:         []string{"alice@google.com", "bob@google.com"},
+			Repos:          []string{"repo1", "repo2"},
+			EmailStats: map[string]AliasStats{
+				"alice@google.com": aliceStats, "bob@google.com": bobStats},
+			NameStats: map[NameWithRepo]AliasStats{
+				{"alice", ""}: aliceStats, {"bob", ""}: bobStats}},
 	}
 	require.Equal(int64(1), mergedID)
 	require.Equal(expected, people)
 	require.NoError(err)
 }
 
-func TestFourPeopleMerge(t *testing.T) {
+func TestThreePeopleMerge(t *testing.T) {
 	people, err := newPeople(Signatures, newTestBlacklist(t))
 	require.NoError(t, err)
-	mergedID, err := people.Merge(1, 2, 3, 4)
+	mergedID, err := people.Merge(1, 2, 3)
+	aliceStats := AliasStats{FirstSeen: Signatures[2].time, LastSeen: Signatures[2].time, Commits: 1}
+	bobStats := AliasStats{FirstSeen: Signatures[1].time, LastSeen: Signatures[3].time, Commits: 3}
 	expected := People{
 		1: {ID: 1,
 			NamesWithRepos: []NameWithRepo{{"alice", ""}, {"bob", ""}},
-			Emails:         []string{"alice@google.com", "bob@google.com"}},
+			Emails:         []string{"alice@google.com", "bob@google.com"},
+			Repos:          []string{"repo1", "repo2"},
+			EmailStats: map[string]AliasStats{
+				"alice@google.com": aliceStats, "bob@google.com": bobStats},
+			NameStats: map[NameWithRepo]AliasStats{
+				{"alice", ""}: aliceStats, {"bob", ""}: bobStats}},
 	}
 	require.Equal(t, int64(1), mergedID)
 	require.Equal(t, expected, people)
@@ -111,7 +167,7 @@ func TestPeopleForEach(t *testing.T) {
 		keys = append(keys, key)
 		return false
 	})
-	require.Equal(t, []int64{1, 2, 3, 4}, keys)
+	require.Equal(t, []int64{1, 2, 3}, keys)
 }
 
 func tempFile(t *testing.T, pattern string) (*os.File, func()) {
@@ -131,15 +187,26 @@ func TestFindSignatures(t *testing.T) {
 
 	err := storeSignaturesOnDisk(peopleFile.Name(), Signatures)
 	req.NoError(err)
-	people, err := findSignatures(context.TODO(), "0.0.0.0:3306", peopleFile.Name())
+	var people []signatureWithRepo
+	err = findSignatures(context.TODO(), GitbaseOptions{ConnString: "0.0.0.0:3306"}, peopleFile.Name(),
+		func(sig signatureWithRepo) error {
+			people = append(people, sig)
+			return nil
+		})
 	req.NoError(err)
 	req.Equal([]signatureWithRepo{
-		{repo: "repo1", name: "bob", email: "bob@google.com", hash: "aaa", time: Signatures[0].time},
-		{repo: "repo2", name: "bob", email: "bob@google.com", hash: "bbb", time: Signatures[1].time},
-		{repo: "repo1", name: "alice", email: "alice@google.com", hash: "ccc", time: Signatures[2].time},
-		{repo: "repo1", name: "bob", email: "bob@google.com", hash: "ddd", time: Signatures[3].time},
-		{repo: "repo1", name: "bob", email: "bad-email@domen", hash: "eee", time: Signatures[4].time},
-		{repo: "repo1", name: "admin", email: "someone@google.com", hash: "fff", time: Signatures[5].time},
+		{repo: "repo1", name: "bob", email: "bob@google.com", hash: "aaa", time: Signatures[0].time,
+			firstSeen: Signatures[0].time, commits: 1},
+		{repo: "repo2", name: "bob", email: "bob@google.com", hash: "bbb", time: Signatures[1].time,
+			firstSeen: Signatures[1].time, commits: 1},
+		{repo: "repo1", name: "alice", email: "alice@google.com", hash: "ccc", time: Signatures[2].time,
+			firstSeen: Signatures[2].time, commits: 1},
+		{repo: "repo1", name: "bob", email: "bob@google.com", hash: "ddd", time: Signatures[3].time,
+			firstSeen: Signatures[3].time, commits: 1},
+		{repo: "repo1", name: "bob", email: "bad-email@domen", hash: "eee", time: Signatures[4].time,
+			firstSeen: Signatures[4].time, commits: 1},
+		{repo: "repo1", name: "admin", email: "someone@google.com", hash: "fff", time: Signatures[5].time,
+			firstSeen: Signatures[5].time, commits: 1},
 	}, people)
 }
 
@@ -152,21 +219,12 @@ func TestFindPeople(t *testing.T) {
 		return
 	}
 	people, nameFreqs, emailFreqs, err := FindPeople(
-		context.TODO(), "0.0.0.0:3306", peopleFile.Name(), newTestBlacklist(t), 12)
+		context.TODO(), GitbaseOptions{ConnString: "0.0.0.0:3306"}, peopleFile.Name(),
+		newTestBlacklist(t), 12)
 	if err != nil {
 		return
 	}
-	expected := People{
-		1: {ID: 1, NamesWithRepos: []NameWithRepo{{"bob", ""}}, Emails: []string{"bob@google.com"},
-			SampleCommit: &Commit{"aaa", "repo1"}},
-		2: {ID: 2, NamesWithRepos: []NameWithRepo{{"bob", ""}}, Emails: []string{"bob@google.com"},
-			SampleCommit: &Commit{"bbb", "repo2"}},
-		3: {ID: 3, NamesWithRepos: []NameWithRepo{{"alice", ""}}, Emails: []string{"alice@google.com"},
-			SampleCommit: &Commit{"ccc", "repo1"}},
-		4: {ID: 4, NamesWithRepos: []NameWithRepo{{"bob", ""}}, Emails: []string{"bob@google.com"},
-			SampleCommit: &Commit{"ddd", "repo1"}},
-	}
-	require.Equal(t, expected, people)
+	require.Equal(t, newTestPeople(), people)
 	require.Equal(t, map[string]*Frequency{"alice": {0, 1},
 		"admin": {1, 1}, "bob": {2, 4}}, nameFreqs)
 	require.Equal(t, map[string]*Frequency{"bob@google.com": {2, 3},
@@ -187,29 +245,75 @@ func TestStoreAndReadPeopleOnDisk(t *testing.T) {
 	req.NoError(err)
 	peopleFileContent, err := ioutil.ReadFile(peopleFile.Name())
 	req.NoError(err)
-	expectedContent := `repo,name,email,hash,time
-repo1,Bob,Bob@google.com,aaa,` + Signatures[0].time.Format(time.RFC3339) + `
-repo2,Bob,Bob@google.com,bbb,` + Signatures[1].time.Format(time.RFC3339) + `
-repo1,Alice,alice@google.com,ccc,` + Signatures[2].time.Format(time.RFC3339) + `
-repo1,Bob,Bob@google.com,ddd,` + Signatures[3].time.Format(time.RFC3339) + `
-repo1,Bob,bad-email@domen,eee,` + Signatures[4].time.Format(time.RFC3339) + `
-repo1,admin,someone@google.com,fff,` + Signatures[5].time.Format(time.RFC3339) + `
+	formatTime := func(i int) string {
+		return Signatures[i].time.Format(time.RFC3339) + "," + Signatures[i].time.Format(time.RFC3339)
+	}
+	expectedContent := `repo,name,email,hash,time,first_seen,commits,timezones
+repo1,Bob,Bob@google.com,aaa,` + formatTime(0) + `,1,
+repo2,Bob,Bob@google.com,bbb,` + formatTime(1) + `,1,
+repo1,Alice,alice@google.com,ccc,` + formatTime(2) + `,1,
+repo1,Bob,Bob@google.com,ddd,` + formatTime(3) + `,1,
+repo1,Bob,bad-email@domen,eee,` + formatTime(4) + `,1,
+repo1,admin,someone@google.com,fff,` + formatTime(5) + `,1,
 `
 	req.Equal(expectedContent, string(peopleFileContent))
 
 	commitsRead, err := readSignaturesFromDisk(peopleFile.Name())
 	req.NoError(err)
 	expectedPersonsRead := []signatureWithRepo{
-		0: {repo: "repo1", name: "bob", email: "bob@google.com", hash: "aaa", time: Signatures[0].time},
-		1: {repo: "repo2", name: "bob", email: "bob@google.com", hash: "bbb", time: Signatures[1].time},
-		2: {repo: "repo1", name: "alice", email: "alice@google.com", hash: "ccc", time: Signatures[2].time},
-		3: {repo: "repo1", name: "bob", email: "bob@google.com", hash: "ddd", time: Signatures[3].time},
-		4: {repo: "repo1", name: "bob", email: "bad-email@domen", hash: "eee", time: Signatures[4].time},
-		5: {repo: "repo1", name: "admin", email: "someone@google.com", hash: "fff", time: Signatures[5].time},
+		0: {repo: "repo1", name: "bob", email: "bob@google.com", hash: "aaa", time: Signatures[0].time,
+			firstSeen: Signatures[0].time, commits: 1},
+		1: {repo: "repo2", name: "bob", email: "bob@google.com", hash: "bbb", time: Signatures[1].time,
+			firstSeen: Signatures[1].time, commits: 1},
+		2: {repo: "repo1", name: "alice", email: "alice@google.com", hash: "ccc", time: Signatures[2].time,
+			firstSeen: Signatures[2].time, commits: 1},
+		3: {repo: "repo1", name: "bob", email: "bob@google.com", hash: "ddd", time: Signatures[3].time,
+			firstSeen: Signatures[3].time, commits: 1},
+		4: {repo: "repo1", name: "bob", email: "bad-email@domen", hash: "eee", time: Signatures[4].time,
+			firstSeen: Signatures[4].time, commits: 1},
+		5: {repo: "repo1", name: "admin", email: "someone@google.com", hash: "fff", time: Signatures[5].time,
+			firstSeen: Signatures[5].time, commits: 1},
 	}
 	req.Equal(expectedPersonsRead, commitsRead)
 }
 
+func TestReadLegacyPeopleFromDisk(t *testing.T) {
+	req := require.New(t)
+	peopleFile, cleanup := tempFile(t, "*.csv")
+	defer cleanup()
+	_, err := peopleFile.WriteString(`repo,name,email,hash,time
+repo1,Bob,Bob@google.com,aaa,2019-01-01T00:00:00Z
+`)
+	req.NoError(err)
+	commitsRead, err := readSignaturesFromDisk(peopleFile.Name())
+	req.NoError(err)
+	req.Equal([]signatureWithRepo{{repo: "repo1", name: "bob", email: "bob@google.com",
+		hash: "aaa", time: time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)}}, commitsRead)
+}
+
+func TestStoreAndReadTimezonesOnDisk(t *testing.T) {
+	req := require.New(t)
+	peopleFile, cleanup := tempFile(t, "*.csv")
+	defer cleanup()
+	sig := signatureWithRepo{repo: "repo1", name: "bob", email: "bob@google.com", hash: "aaa",
+		time: Signatures[0].time, firstSeen: Signatures[1].time, commits: 3,
+		timezones: TimezoneHistogram{120: 2, -420: 1}}
+	req.NoError(storeSignaturesOnDisk(peopleFile.Name(), []signatureWithRepo{sig}))
+	commitsRead, err := readSignaturesFromDisk(peopleFile.Name())
+	req.NoError(err)
+	req.Equal([]signatureWithRepo{sig}, commitsRead)
+}
+
+func TestReadPeopleFromDiskInvalidHeader(t *testing.T) {
+	req := require.New(t)
+	peopleFile, cleanup := tempFile(t, "*.csv")
+	defer cleanup()
+	_, err := peopleFile.WriteString("repo,name,hash,time\n")
+	req.NoError(err)
+	_, err = readSignaturesFromDisk(peopleFile.Name())
+	req.EqualError(err, "invalid CSV file: missing column email")
+}
+
 func TestWriteAndReadParquet(t *testing.T) {
 	tmpfile, cleanup := tempFile(t, "*.parquet")
 	defer cleanup()
@@ -218,15 +322,16 @@ func TestWriteAndReadParquet(t *testing.T) {
 	require.NoError(t, err)
 	for _, p := range expectedPeople {
 		p.SampleCommit = nil
+		p.Repos = nil
 	}
 
-	err = expectedPeople.WriteToParquet(tmpfile.Name(), "")
+	err = expectedPeople.WriteToParquet(tmpfile.Name())
 	if err != nil {
 		logrus.Fatal(err)
 	}
-	people, provider, err := readFromParquet(tmpfile.Name())
+	people, err := readFromParquet(tmpfile.Name())
+	require.NoError(t, err)
 	require.Equal(t, expectedPeople, people)
-	require.Equal(t, "", provider)
 }
 
 func TestWriteAndReadParquetWithExternalID(t *testing.T) {
@@ -237,17 +342,25 @@ func TestWriteAndReadParquetWithExternalID(t *testing.T) {
 	require.NoError(t, err)
 	for _, p := range expectedPeople {
 		p.SampleCommit = nil
+		p.Repos = nil
 	}
 
-	expectedIDProvider := "test"
 	expectedPeople[1].ExternalID = "username1"
+	expectedPeople[1].ExternalIDProvider = "github"
 	expectedPeople[2].ExternalID = "username2"
+	expectedPeople[2].ExternalIDProvider = "gitlab"
+	expectedPeople[2].ExternalName = "User Name"
+	expectedPeople[2].ExternalAvatarURL = "https://gitlab.com/uploads/avatar.png"
+	expectedPeople[2].ExternalProfileURL = "https://gitlab.com/username2"
+	expectedPeople[2].ExternalCreatedAt = time.Date(2019, 9, 26, 9, 32, 17, 0, time.UTC)
+	expectedPeople[3].ExternalID = "557058:7bfc3d8e-3c4a-4b39-9f6f-0f4d9e8a1c2b"
+	expectedPeople[3].ExternalIDProvider = "bitbucket"
 
-	err = expectedPeople.WriteToParquet(tmpfile.Name(), expectedIDProvider)
+	err = expectedPeople.WriteToParquet(tmpfile.Name())
+	require.NoError(t, err)
+	people, err := readFromParquet(tmpfile.Name())
 	require.NoError(t, err)
-	people, provider, err := readFromParquet(tmpfile.Name())
 	require.Equal(t, expectedPeople, people)
-	require.Equal(t, expectedIDProvider, provider)
 }
 
 func TestCleanName(t *testing.T) {
@@ -279,19 +392,70 @@ func TestNormalizeSpaces(t *testing.T) {
 	require.Equal("12", normalizeSpaces("12"))
 }
 
-func TestCountFreqs(t *testing.T) {
-	freqs, err := countFreqs(Signatures, func(c signatureWithRepo) string { return c.name },
-		cleanName, time.Now().AddDate(0, -19, 0))
-	require.NoError(t, err)
+// aggregateTestSignatures aggregates the signatures with the given recent start time.
+func aggregateTestSignatures(t *testing.T, commits []signatureWithRepo, recentStartTime time.Time,
+) (People, map[string]*Frequency, map[string]*Frequency) {
+	aggregator := newPeopleAggregator(newTestBlacklist(t), recentStartTime)
+	for _, commit := range commits {
+		require.NoError(t, aggregator.add(commit))
+	}
+	require.Equal(t, len(commits), aggregator.signatures)
+	return aggregator.finish()
+}
+
+func TestAggregateFreqs(t *testing.T) {
+	_, freqs, _ := aggregateTestSignatures(t, Signatures, time.Now().AddDate(0, -19, 0))
 	require.Equal(t, map[string]*Frequency{"alice": {1, 1}, "admin": {1, 1}, "bob": {3, 4}}, freqs)
 }
 
-func TestGetStats(t *testing.T) {
-	nameFreqs, emailFreqs, err := getStats(Signatures, time.Now().AddDate(0, -12, 0))
-	require.NoError(t, err)
+func TestAggregateFreqsCommits(t *testing.T) {
+	first := time.Now().AddDate(0, -10, 0)
+	last := time.Now().AddDate(0, 0, -1)
+	_, freqs, _ := aggregateTestSignatures(t, []signatureWithRepo{
+		{repo: "repo1", name: "Bob", email: "bob@google.com", hash: "aaa",
+			time: last, firstSeen: first, commits: 10},
+		{repo: "repo2", name: "Bob", email: "bob@google.com", hash: "bbb", time: first},
+	}, time.Now().AddDate(0, -5, 0))
+	require.Equal(t, map[string]*Frequency{"bob": {5, 11}}, freqs)
+}
+
+func TestAggregateStats(t *testing.T) {
+	people, nameFreqs, emailFreqs := aggregateTestSignatures(
+		t, Signatures, time.Now().AddDate(0, -12, 0))
+	require.Equal(t, newTestPeople(), people)
 	require.Equal(t, map[string]*Frequency{"alice": {0, 1}, "admin": {1, 1}, "bob": {2, 4}},
 		nameFreqs)
 	require.Equal(t, map[string]*Frequency{"bob@google.com": {2, 3},
 		"alice@google.com": {0, 1}, "bad-email@domen": {0, 1},
 		"someone@google.com": {1, 1}}, emailFreqs)
 }
+
+func TestAggregateInterns(t *testing.T) {
+	aggregator := newPeopleAggregator(newTestBlacklist(t), time.Now())
+	for _, repo := range []string{"repo1", "repo2"} {
+		// the distinct copies of the same strings
+		require.NoError(t, aggregator.add(signatureWithRepo{
+			repo: string([]byte(repo)), name: string([]byte("Bob")),
+			email: string([]byte("bob@google.com"))}))
+	}
+	people, _, _ := aggregator.finish()
+	require.Len(t, people, 2)
+	require.Nil(t, people[1].SampleCommit)
+	email1, email2 := people[1].Emails[0], people[2].Emails[0]
+	require.True(t, unsafe.StringData(email1) == unsafe.StringData(email2))
+	name1, name2 := people[1].NamesWithRepos[0].Name, people[2].NamesWithRepos[0].Name
+	require.True(t, unsafe.StringData(name1) == unsafe.StringData(name2))
+}
+
+func TestSignaturesCacheWriterAbort(t *testing.T) {
+	req := require.New(t)
+	path := filepath.Join(t.TempDir(), "signatures.csv")
+	w, err := newSignaturesCacheWriter(path)
+	req.NoError(err)
+	req.NoError(w.write(Signatures[0]))
+	w.abort()
+	_, err = os.Stat(path)
+	req.True(os.IsNotExist(err))
+	_, err = os.Stat(path + ".tmp")
+	req.True(os.IsNotExist(err))
+}
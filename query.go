@@ -0,0 +1,187 @@
+package idmatch
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// findPeopleSQL fetches the signatures from gitbase. gitbase converts the commit times to UTC and
+// does not expose the original offsets, so the signatures loaded from the database have no
+// timezones and ReducePeople rejects ReduceOptions.MinTimezoneOverlap for them; the timezones
+// can be supplied through --input or the signatures cache instead. The placeholders are the commits counter,
+// the scanned tables and the optional WHERE clause, see SignatureFilters.SQL().
+const findPeopleSQL = `
+SELECT repository_id, commit_author_name, commit_author_email, MAX(commit_hash),
+       MIN(commit_author_when), MAX(commit_author_when), %s
+FROM %s
+%sGROUP BY repository_id, commit_author_name, commit_author_email;
+`
+
+// sqlTimeLayout is the format of the time literals in the gitbase queries.
+const sqlTimeLayout = "2006-01-02 15:04:05"
+
+// SignatureFilters restrict the commits which are scanned in gitbase. The zero value scans all
+// the commits.
+type SignatureFilters struct {
+	// Repos are the glob patterns of the repositories to include, e.g. "github.com/src-d/*".
+	// "*" matches any sequence of characters including "/" and "?" matches any single
+	// character. Empty means all the repositories.
+	Repos []string
+	// ExcludeRepos are the glob patterns of the repositories to exclude, they take precedence
+	// over Repos.
+	ExcludeRepos []string
+	// Since is the earliest commit time, inclusive. Zero means unbounded.
+	Since time.Time
+	// Until is the latest commit time, exclusive. Zero means unbounded.
+	Until time.Time
+	// Refs are the references whose history is scanned. The short names are branches, e.g.
+	// "master" means "refs/heads/master". Empty means all the commits.
+	Refs []string
+}
+
+// Validate checks that the filters can be converted to SQL.
+func (f SignatureFilters) Validate() error {
+	for _, pattern := range append(append([]string{}, f.Repos...), f.ExcludeRepos...) {
+		if pattern == "" {
+			return errors.New("empty repository pattern")
+		}
+		if strings.ContainsAny(pattern, "[]") {
+			return fmt.Errorf("character classes are not supported in repository patterns: %s",
+				pattern)
+		}
+	}
+	if !f.Since.IsZero() && !f.Until.IsZero() && !f.Since.Before(f.Until) {
+		return fmt.Errorf("empty commit time range: %s - %s",
+			f.Since.Format(time.RFC3339), f.Until.Format(time.RFC3339))
+	}
+	for _, ref := range f.Refs {
+		if ref == "" {
+			return errors.New("empty reference")
+		}
+	}
+	return nil
+}
+
+// SQL generates the gitbase query which fetches the signatures of the filtered commits.
+// The patterns and the references are sorted so that the query does not depend on their order.
+// The commits reachable from several references are counted once.
+func (f SignatureFilters) SQL() string {
+	return f.sql("")
+}
+
+// repositorySQL generates the gitbase query which fetches the signatures of the filtered
+// commits in a single repository. The repository is expected to match the patterns.
+func (f SignatureFilters) repositorySQL(repo string) string {
+	return f.sql(repo)
+}
+
+// repositoriesSQL generates the gitbase query which lists the repositories matching
+// the patterns.
+func (f SignatureFilters) repositoriesSQL() string {
+	query := "SELECT repository_id FROM repositories\n"
+	if conditions := f.repositoryConditions(); len(conditions) > 0 {
+		query += "WHERE " + strings.Join(conditions, "\n  AND ") + "\n"
+	}
+	return query + "ORDER BY repository_id;\n"
+}
+
+// repositoryConditions converts Repos and ExcludeRepos to the SQL conditions.
+func (f SignatureFilters) repositoryConditions() []string {
+	var conditions []string
+	if len(f.Repos) > 0 {
+		var patterns []string
+		for _, pattern := range unique(f.Repos) {
+			patterns = append(patterns, "repository_id LIKE "+sqlQuote(globToLike(pattern)))
+		}
+		conditions = append(conditions, "("+strings.Join(patterns, " OR ")+")")
+	}
+	for _, pattern := range unique(f.ExcludeRepos) {
+		conditions = append(conditions, "repository_id NOT LIKE "+sqlQuote(globToLike(pattern)))
+	}
+	return conditions
+}
+
+// sql generates the signatures query in the given repository, all the matching repositories
+// if it is empty.
+func (f SignatureFilters) sql(repo string) string {
+	count, from := "COUNT(*)", "commits"
+	var conditions []string
+	if len(f.Refs) > 0 {
+		count, from = "COUNT(DISTINCT commit_hash)", "commits NATURAL JOIN ref_commits"
+		refs := make([]string, len(f.Refs))
+		for i, ref := range f.Refs {
+			refs[i] = sqlQuote(qualifyRef(ref))
+		}
+		refs = unique(refs)
+		conditions = append(conditions, "ref_commits.ref_name IN ("+strings.Join(refs, ", ")+")")
+	}
+	if repo != "" {
+		conditions = append(conditions, "repository_id = "+sqlQuote(repo))
+	} else {
+		conditions = append(conditions, f.repositoryConditions()...)
+	}
+	if !f.Since.IsZero() {
+		conditions = append(conditions,
+			"commit_author_when >= "+sqlQuote(f.Since.UTC().Format(sqlTimeLayout)))
+	}
+	if !f.Until.IsZero() {
+		conditions = append(conditions,
+			"commit_author_when < "+sqlQuote(f.Until.UTC().Format(sqlTimeLayout)))
+	}
+	where := ""
+	if len(conditions) > 0 {
+		where = "WHERE " + strings.Join(conditions, "\n  AND ") + "\n"
+	}
+	return fmt.Sprintf(findPeopleSQL, count, from, where)
+}
+
+// qualifyRef converts the short branch name to the full reference name.
+func qualifyRef(ref string) string {
+	if ref == "HEAD" || strings.HasPrefix(ref, "refs/") {
+		return ref
+	}
+	return "refs/heads/" + ref
+}
+
+// globToLike converts the glob pattern to the pattern of the SQL LIKE operator.
+func globToLike(pattern string) string {
+	var result strings.Builder
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			result.WriteRune('%')
+		case '?':
+			result.WriteRune('_')
+		case '%', '_', '\\':
+			result.WriteRune('\\')
+			result.WriteRune(r)
+		default:
+			result.WriteRune(r)
+		}
+	}
+	return result.String()
+}
+
+// sqlQuote converts the string to the SQL string literal.
+func sqlQuote(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+// HashPeopleDiscoverySQL returns the hashsum of the SQL used to fetch the raw Git signatures
+// with the given filters. The differently filtered signatures have different hashes.
+func HashPeopleDiscoverySQL(filters SignatureFilters) string {
+	query := filters.SQL()
+	h := fnv.New32a()
+	n, err := h.Write([]byte(query))
+	if err != nil || n != len(query) {
+		logrus.Panicf("HashPeopleDiscoverySQL: %d %d %v", n, len(query), err)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,96 @@
+package idmatch
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignatureFiltersSQLUnfiltered(t *testing.T) {
+	// the unfiltered query keeps the hash of the existing caches
+	require.Equal(t, `
+SELECT repository_id, commit_author_name, commit_author_email, MAX(commit_hash),
+       MIN(commit_author_when), MAX(commit_author_when), COUNT(*)
+FROM commits
+GROUP BY repository_id, commit_author_name, commit_author_email;
+`, SignatureFilters{}.SQL())
+}
+
+func TestSignatureFiltersSQL(t *testing.T) {
+	filters := SignatureFilters{
+		Repos:        []string{"github.com/src-d/*", "gitlab.com/o'neil/repo_?"},
+		ExcludeRepos: []string{"*/archive-*"},
+		Since:        time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC),
+		Until:        time.Date(2020, 1, 1, 3, 0, 0, 0, time.FixedZone("", 3*60*60)),
+		Refs:         []string{"master", "refs/tags/v1.0", "HEAD", "refs/heads/master"},
+	}
+	require.Equal(t, `
+SELECT repository_id, commit_author_name, commit_author_email, MAX(commit_hash),
+       MIN(commit_author_when), MAX(commit_author_when), COUNT(DISTINCT commit_hash)
+FROM commits NATURAL JOIN ref_commits
+WHERE ref_commits.ref_name IN ('HEAD', 'refs/heads/master', 'refs/tags/v1.0')
+  AND (repository_id LIKE 'github.com/src-d/%' OR repository_id LIKE 'gitlab.com/o''neil/repo\\__')
+  AND repository_id NOT LIKE '%/archive-%'
+  AND commit_author_when >= '2019-01-01 00:00:00'
+  AND commit_author_when < '2020-01-01 00:00:00'
+GROUP BY repository_id, commit_author_name, commit_author_email;
+`, filters.SQL())
+}
+
+func TestSignatureFiltersValidate(t *testing.T) {
+	req := require.New(t)
+	req.NoError(SignatureFilters{}.Validate())
+	req.EqualError(SignatureFilters{Repos: []string{"repo[12]"}}.Validate(),
+		"character classes are not supported in repository patterns: repo[12]")
+	req.EqualError(SignatureFilters{ExcludeRepos: []string{""}}.Validate(),
+		"empty repository pattern")
+	req.EqualError(SignatureFilters{Refs: []string{""}}.Validate(), "empty reference")
+	when := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	req.EqualError(SignatureFilters{Since: when, Until: when}.Validate(),
+		"empty commit time range: 2019-01-01T00:00:00Z - 2019-01-01T00:00:00Z")
+}
+
+func TestHashPeopleDiscoverySQL(t *testing.T) {
+	req := require.New(t)
+	unfiltered := HashPeopleDiscoverySQL(SignatureFilters{})
+	req.Len(unfiltered, 8)
+	for _, filters := range []SignatureFilters{
+		{Repos: []string{"github.com/src-d/*"}},
+		{ExcludeRepos: []string{"github.com/src-d/*"}},
+		{Since: time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{Until: time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{Refs: []string{"master"}},
+	} {
+		req.NotEqual(unfiltered, HashPeopleDiscoverySQL(filters), filters)
+	}
+	// the order of the patterns does not matter
+	req.Equal(HashPeopleDiscoverySQL(SignatureFilters{Repos: []string{"a/*", "b/*"}}),
+		HashPeopleDiscoverySQL(SignatureFilters{Repos: []string{"b/*", "a/*"}}))
+}
+
+func TestGlobToLike(t *testing.T) {
+	require.Equal(t, `a%b_c\%d\_e\\f`, globToLike(`a*b?c%d_e\f`))
+}
+
+func TestSignatureFiltersRepositoriesSQL(t *testing.T) {
+	req := require.New(t)
+	req.Equal("SELECT repository_id FROM repositories\nORDER BY repository_id;\n",
+		SignatureFilters{}.repositoriesSQL())
+	filters := SignatureFilters{Repos: []string{"github.com/*"}, ExcludeRepos: []string{"*-old"},
+		Since: time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)}
+	req.Equal(`SELECT repository_id FROM repositories
+WHERE (repository_id LIKE 'github.com/%')
+  AND repository_id NOT LIKE '%-old'
+ORDER BY repository_id;
+`, filters.repositoriesSQL())
+	// the patterns are not repeated for the single repository
+	req.Equal(`
+SELECT repository_id, commit_author_name, commit_author_email, MAX(commit_hash),
+       MIN(commit_author_when), MAX(commit_author_when), COUNT(*)
+FROM commits
+WHERE repository_id = 'github.com/o''neil/repo'
+  AND commit_author_when >= '2019-01-01 00:00:00'
+GROUP BY repository_id, commit_author_name, commit_author_email;
+`, filters.repositorySQL("github.com/o'neil/repo"))
+}
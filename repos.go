@@ -0,0 +1,239 @@
+package idmatch
+
+import (
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/src-d/identity-matching/reporter"
+)
+
+// repoCooccurrence keeps the repositories and the names of the connected components of
+// the identity graph in sync with the union-find as the components are joined.
+type repoCooccurrence struct {
+	people     People
+	identities *identityComponents
+	// the following maps are indexed by the set roots
+	repos map[int64][]string
+	names map[int64][]string
+	// versions change each time the set is joined with another one
+	versions map[int64]int64
+	// repo2roots maps each repository to the roots of the sets which committed to it
+	repo2roots map[string]map[int64]struct{}
+}
+
+func newRepoCooccurrence(people People, identities *identityComponents) *repoCooccurrence {
+	r := &repoCooccurrence{
+		people:     people,
+		identities: identities,
+		repos:      map[int64][]string{},
+		names:      map[int64][]string{},
+		versions:   map[int64]int64{},
+		repo2roots: map[string]map[int64]struct{}{},
+	}
+	for _, group := range identities.groups() {
+		var repos, names []string
+		for _, id := range group {
+			person := people[id]
+			repos = append(repos, person.Repos...)
+			for _, name := range person.NamesWithRepos {
+				names = append(names, name.Name)
+			}
+		}
+		root := identities.find(group[0])
+		r.repos[root], r.names[root] = unique(repos), unique(names)
+		for _, repo := range r.repos[root] {
+			roots := r.repo2roots[repo]
+			if roots == nil {
+				roots = map[int64]struct{}{}
+				r.repo2roots[repo] = roots
+			}
+			roots[root] = struct{}{}
+		}
+	}
+	return r
+}
+
+// weight returns the inverse document frequency of the repository among the current sets.
+func (r *repoCooccurrence) weight(repo string) float64 {
+	return math.Log(1 + float64(len(r.repos))/float64(len(r.repo2roots[repo])))
+}
+
+// candidates returns the pairs of the current set roots which committed to the same repository
+// with at most maxPeople sets, ordered by the roots.
+func (r *repoCooccurrence) candidates(maxPeople int) [][2]int64 {
+	pairs := map[[2]int64]struct{}{}
+	for _, roots := range r.repo2roots {
+		if len(roots) > maxPeople {
+			continue
+		}
+		sorted := make([]int64, 0, len(roots))
+		for root := range roots {
+			sorted = append(sorted, root)
+		}
+		Int64Slice(sorted).Sort()
+		for i, x := range sorted {
+			for _, y := range sorted[i+1:] {
+				pairs[[2]int64{x, y}] = struct{}{}
+			}
+		}
+	}
+	result := make([][2]int64, 0, len(pairs))
+	for pair := range pairs {
+		result = append(result, pair)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i][0] != result[j][0] {
+			return result[i][0] < result[j][0]
+		}
+		return result[i][1] < result[j][1]
+	})
+	return result
+}
+
+// union joins the sets which contain the two people and moves their repositories and names
+// to the new root.
+func (r *repoCooccurrence) union(id1, id2 int64) error {
+	root1, root2 := r.identities.find(id1), r.identities.find(id2)
+	if err := setEdge(r.identities, root1, root2); err != nil {
+		return err
+	}
+	root := r.identities.find(root1)
+	repos := unique(append(r.repos[root1], r.repos[root2]...))
+	names := unique(append(r.names[root1], r.names[root2]...))
+	for _, old := range []int64{root1, root2} {
+		for _, repo := range r.repos[old] {
+			delete(r.repo2roots[repo], old)
+		}
+		delete(r.repos, old)
+		delete(r.names, old)
+	}
+	r.repos[root], r.names[root] = repos, names
+	r.versions[root] = r.versions[root1] + r.versions[root2] + 1
+	for _, repo := range repos {
+		r.repo2roots[repo][root] = struct{}{}
+	}
+	return nil
+}
+
+// repoSimilarity calculates the weighted Jaccard similarity of two sorted repository lists.
+// Each repository is weighted by its inverse document frequency so that the niche repositories
+// matter more than the popular ones.
+func repoSimilarity(repos1, repos2 []string, weight func(repo string) float64) float64 {
+	var intersection, union float64
+	i, j := 0, 0
+	for i < len(repos1) || j < len(repos2) {
+		switch {
+		case j == len(repos2) || i < len(repos1) && repos1[i] < repos2[j]:
+			union += weight(repos1[i])
+			i++
+		case i == len(repos1) || repos1[i] > repos2[j]:
+			union += weight(repos2[j])
+			j++
+		default:
+			intersection += weight(repos1[i])
+			union += weight(repos1[i])
+			i++
+			j++
+		}
+	}
+	if union == 0 {
+		return 0
+	}
+	return intersection / union
+}
+
+// commonRepos returns the intersection of two sorted repository lists.
+func commonRepos(repos1, repos2 []string) []string {
+	var result []string
+	i, j := 0, 0
+	for i < len(repos1) && j < len(repos2) {
+		switch {
+		case repos1[i] < repos2[j]:
+			i++
+		case repos1[i] > repos2[j]:
+			j++
+		default:
+			result = append(result, repos1[i])
+			i++
+			j++
+		}
+	}
+	return result
+}
+
+// maxNameSimilarity returns the similarity of the most similar pair of names.
+func maxNameSimilarity(names1, names2 []string) float64 {
+	result := 0.0
+	for _, name1 := range names1 {
+		for _, name2 := range names2 {
+			if sim := nameSimilarity(name1, name2); sim > result {
+				result = sim
+			}
+		}
+	}
+	return result
+}
+
+// addEdgesByRepoCooccurrence links the connected components which committed to the same niche
+// repositories and have similar names. The edge weight is the product of the repository set
+// similarity and the name similarity. The identity graph is kept as the union-find of its
+// connected components without the individual edges, so the weight is not stored: the components
+// are linked if it is not less than opts.MinRepoSimilarity and the weight is logged. Only
+// the repositories with at most opts.MaxRepoPeople components are used to find the candidate
+// pairs, so the complexity stays linear in the number of components.
+//
+// The repositories, the names, the repository weights and the niche repositories are updated
+// after each join, and the candidates are collected again until no more components are joined,
+// because the joins can make more repositories niche.
+func addEdgesByRepoCooccurrence(people People, identities *identityComponents,
+	opts ReduceOptions) {
+	r := newRepoCooccurrence(people, identities)
+	// evaluated are the pairs of the sets which did not change since they were checked
+	type versionedPair struct{ root1, version1, root2, version2 int64 }
+	evaluated := map[versionedPair]struct{}{}
+	for joined := true; joined; {
+		joined = false
+		for _, pair := range r.candidates(opts.MaxRepoPeople) {
+			root1, root2 := identities.find(pair[0]), identities.find(pair[1])
+			if root1 == root2 {
+				continue
+			}
+			key := versionedPair{root1, r.versions[root1], root2, r.versions[root2]}
+			if _, exists := evaluated[key]; exists {
+				continue
+			}
+			evaluated[key] = struct{}{}
+			if r.match(root1, root2, opts) {
+				joined = true
+			}
+		}
+	}
+}
+
+// match links the sets with the given roots if they pass the thresholds and the limits.
+func (r *repoCooccurrence) match(root1, root2 int64, opts ReduceOptions) bool {
+	nameSim := maxNameSimilarity(r.names[root1], r.names[root2])
+	if nameSim < opts.MinRepoNameSimilarity {
+		return false
+	}
+	score := repoSimilarity(r.repos[root1], r.repos[root2], r.weight) * nameSim
+	if score < opts.MinRepoSimilarity {
+		return false
+	}
+	if !passIdentitiesLimit(r.people, r.identities, opts, edgeRepos, root1, root2,
+		strings.Join(commonRepos(r.repos[root1], r.repos[root2]), ",")) ||
+		!passTimezoneOverlap(r.people, r.identities, opts.MinTimezoneOverlap, root1, root2) {
+		return false
+	}
+	if err := r.union(root1, root2); err != nil {
+		// different ExternalIDs
+		return false
+	}
+	logrus.Debugf("matched by repositories: %s and %s (%.2f)",
+		r.people[root1].String(), r.people[root2].String(), score)
+	reporter.Increment("people matched by repositories")
+	return true
+}
@@ -0,0 +1,81 @@
+package idmatch
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRepoSimilarity(t *testing.T) {
+	req := require.New(t)
+	weights := map[string]float64{"a": 1, "b": 1, "c": 2, "d": 4}
+	weight := func(repo string) float64 { return weights[repo] }
+	req.Equal(1.0, repoSimilarity([]string{"a", "b"}, []string{"a", "b"}, weight))
+	req.Equal(0.0, repoSimilarity([]string{"a"}, []string{"b"}, weight))
+	req.Equal(0.0, repoSimilarity(nil, nil, weight))
+	req.InDelta(2.0/7, repoSimilarity([]string{"a", "c"}, []string{"c", "d"}, weight), 1e-6)
+	req.InDelta(4.0/5, repoSimilarity([]string{"a", "d"}, []string{"d"}, weight), 1e-6)
+}
+
+func TestMaxNameSimilarity(t *testing.T) {
+	require.Equal(t, 1.0, maxNameSimilarity([]string{"ann", "bob"}, []string{"bob"}))
+	require.Equal(t, 0.0, maxNameSimilarity([]string{"ann"}, nil))
+}
+
+func TestReducePeopleRepoCooccurrence(t *testing.T) {
+	newPeople := func() People {
+		people := People{
+			1: {ID: 1, NamesWithRepos: []NameWithRepo{{"vadim markovtsev", ""}},
+				Emails: []string{"vadim@sourced.tech"}, Repos: []string{"hercules", "linux"}},
+			2: {ID: 2, NamesWithRepos: []NameWithRepo{{"vadim markovcev", ""}},
+				Emails: []string{"vadim@gmail.com"}, Repos: []string{"hercules"}},
+			3: {ID: 3, NamesWithRepos: []NameWithRepo{{"vadim smirnov", ""}},
+				Emails: []string{"smirnov@gmail.com"}, Repos: []string{"hercules"}},
+			4: {ID: 4, NamesWithRepos: []NameWithRepo{{"linus torvalds", ""}},
+				Emails: []string{"linus@kernel.org"}, Repos: []string{"linux"}},
+			5: {ID: 5, NamesWithRepos: []NameWithRepo{{"linus torvald", ""}},
+				Emails: []string{"torvalds@kernel.org"}, Repos: []string{"linux"}},
+		}
+		return people
+	}
+	blacklist := newTestBlacklist(t)
+	opts := ReduceOptions{MaxIdentities: 100, MinRepoNameSimilarity: 0.8, MaxRepoPeople: 3}
+
+	people := newPeople()
+	require.NoError(t, ReducePeople(people, nil, blacklist, opts))
+	require.Len(t, people, 5)
+
+	people = newPeople()
+	opts.MinRepoSimilarity = 0.3
+	require.NoError(t, ReducePeople(people, nil, blacklist, opts))
+	require.Len(t, people, 3)
+	require.Equal(t, []string{"vadim@gmail.com", "vadim@sourced.tech"}, people[1].Emails)
+	require.Equal(t, []string{"hercules", "linux"}, people[1].Repos)
+	require.Equal(t, []string{"linus@kernel.org", "torvalds@kernel.org"}, people[4].Emails)
+
+	// linux is not niche anymore
+	people = newPeople()
+	people[6] = &Person{ID: 6, NamesWithRepos: []NameWithRepo{{"someone", ""}},
+		Emails: []string{"someone@kernel.org"}, Repos: []string{"linux"}}
+	require.NoError(t, ReducePeople(people, nil, blacklist, opts))
+	require.Len(t, people, 5)
+	require.Equal(t, []string{"linus@kernel.org"}, people[4].Emails)
+}
+
+func TestReducePeopleRepoCooccurrenceRecomputes(t *testing.T) {
+	people := People{
+		1: {ID: 1, NamesWithRepos: []NameWithRepo{{"vadim markovtsev", ""}},
+			Emails: []string{"vadim@sourced.tech"}, Repos: []string{"hercules", "labours"}},
+		2: {ID: 2, NamesWithRepos: []NameWithRepo{{"vadim markovcev", ""}},
+			Emails: []string{"vadim@gmail.com"}, Repos: []string{"hercules", "labours"}},
+		3: {ID: 3, NamesWithRepos: []NameWithRepo{{"vadim markovtsv", ""}},
+			Emails: []string{"vadim@yahoo.com"}, Repos: []string{"labours"}},
+	}
+	// labours has 3 people, so it becomes niche only after 1 and 2 are merged by hercules
+	opts := ReduceOptions{MaxIdentities: 100, MinRepoSimilarity: 0.3, MinRepoNameSimilarity: 0.8,
+		MaxRepoPeople: 2}
+	require.NoError(t, ReducePeople(people, nil, newTestBlacklist(t), opts))
+	require.Len(t, people, 1)
+	require.Equal(t, []string{"vadim@gmail.com", "vadim@sourced.tech", "vadim@yahoo.com"},
+		people[1].Emails)
+}
@@ -45,3 +45,61 @@ func isMn(r rune) bool {
 func removeDiacritical(s string) (string, int, error) {
 	return transform.String(transform.Chain(norm.NFD, transform.RemoveFunc(isMn), norm.NFC), s)
 }
+
+// levenshtein calculates the edit distance between two strings in runes.
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// nameSimilarity returns 1 for identical names, 0 for completely different names and
+// the normalized edit distance complement in between.
+func nameSimilarity(a, b string) float64 {
+	maxLen := utf8.RuneCountInString(a)
+	if l := utf8.RuneCountInString(b); l > maxLen {
+		maxLen = l
+	}
+	if maxLen == 0 {
+		return 1
+	}
+	return 1 - float64(levenshtein(a, b))/float64(maxLen)
+}
+
+// stringInterner deduplicates the equal strings so that all their occurrences share the same
+// memory.
+type stringInterner map[string]string
+
+// intern returns the shared copy of the string.
+func (in stringInterner) intern(s string) string {
+	if shared, exists := in[s]; exists {
+		return shared
+	}
+	in[s] = s
+	return s
+}
@@ -33,3 +33,19 @@ func TestIsCapitalized(t *testing.T) {
 	require.True(isCapitalized("Capitalized"))
 	require.False(isCapitalized(""))
 }
+
+func TestLevenshtein(t *testing.T) {
+	require := require.New(t)
+	require.Equal(0, levenshtein("", ""))
+	require.Equal(3, levenshtein("", "abc"))
+	require.Equal(3, levenshtein("kitten", "sitting"))
+	require.Equal(1, levenshtein("máximo", "maximo"))
+}
+
+func TestNameSimilarity(t *testing.T) {
+	require := require.New(t)
+	require.Equal(1.0, nameSimilarity("", ""))
+	require.Equal(1.0, nameSimilarity("bob", "bob"))
+	require.Equal(0.0, nameSimilarity("bob", "ann"))
+	require.InDelta(0.9, nameSimilarity("bob smith", "bob smitt"), 0.02)
+}
@@ -0,0 +1,128 @@
+package idmatch
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// TimezoneHistogram maps UTC offsets in minutes to the number of commits made with that offset.
+type TimezoneHistogram map[int]int
+
+// Add accumulates the commits from another histogram.
+func (h TimezoneHistogram) Add(other TimezoneHistogram) {
+	for offset, commits := range other {
+		h[offset] += commits
+	}
+}
+
+// Copy returns a deep copy of the histogram. The copy of a nil histogram is nil.
+func (h TimezoneHistogram) Copy() TimezoneHistogram {
+	if h == nil {
+		return nil
+	}
+	result := make(TimezoneHistogram, len(h))
+	result.Add(h)
+	return result
+}
+
+func (h TimezoneHistogram) total() int {
+	total := 0
+	for _, commits := range h {
+		total += commits
+	}
+	return total
+}
+
+// Overlap returns the intersection of the normalized histograms, from 0 (never committed with
+// the same UTC offset) to 1 (identical distributions). The second value is false if any of
+// the histograms is empty and the overlap is unknown.
+func (h TimezoneHistogram) Overlap(other TimezoneHistogram) (float64, bool) {
+	total1, total2 := h.total(), other.total()
+	if total1 == 0 || total2 == 0 {
+		return 0, false
+	}
+	overlap := 0.0
+	for offset, commits1 := range h {
+		share1 := float64(commits1) / float64(total1)
+		share2 := float64(other[offset]) / float64(total2)
+		if share1 < share2 {
+			overlap += share1
+		} else {
+			overlap += share2
+		}
+	}
+	return overlap, true
+}
+
+// String formats the histogram as space separated "offset:commits" pairs ordered by offset,
+// e.g. "-0700:1 +0200:5".
+func (h TimezoneHistogram) String() string {
+	offsets := make([]int, 0, len(h))
+	for offset := range h {
+		offsets = append(offsets, offset)
+	}
+	sort.Ints(offsets)
+	parts := make([]string, len(offsets))
+	for i, offset := range offsets {
+		parts[i] = formatTimezoneOffset(offset) + ":" + strconv.Itoa(h[offset])
+	}
+	return strings.Join(parts, " ")
+}
+
+// parseTimezoneHistogram is the inverse of TimezoneHistogram.String(). It returns nil for
+// an empty string.
+func parseTimezoneHistogram(text string) (TimezoneHistogram, error) {
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	h := TimezoneHistogram{}
+	for _, field := range fields {
+		parts := strings.Split(field, ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid timezone histogram item: %s", field)
+		}
+		offset, err := parseTimezoneOffset(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		commits, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid timezone histogram item: %s", field)
+		}
+		h[offset] += commits
+	}
+	return h, nil
+}
+
+// formatTimezoneOffset formats the offset in minutes the same way as Git does, e.g. "+0200".
+func formatTimezoneOffset(offset int) string {
+	sign := "+"
+	if offset < 0 {
+		sign = "-"
+		offset = -offset
+	}
+	return fmt.Sprintf("%s%02d%02d", sign, offset/60, offset%60)
+}
+
+// parseTimezoneOffset is the inverse of formatTimezoneOffset.
+func parseTimezoneOffset(text string) (int, error) {
+	if len(text) != 5 || (text[0] != '+' && text[0] != '-') {
+		return 0, fmt.Errorf("invalid timezone offset: %s", text)
+	}
+	hours, err := strconv.Atoi(text[1:3])
+	if err != nil {
+		return 0, fmt.Errorf("invalid timezone offset: %s", text)
+	}
+	minutes, err := strconv.Atoi(text[3:])
+	if err != nil || minutes >= 60 {
+		return 0, fmt.Errorf("invalid timezone offset: %s", text)
+	}
+	offset := hours*60 + minutes
+	if text[0] == '-' {
+		offset = -offset
+	}
+	return offset, nil
+}
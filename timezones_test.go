@@ -0,0 +1,47 @@
+package idmatch
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimezoneHistogramOverlap(t *testing.T) {
+	req := require.New(t)
+	overlap, known := TimezoneHistogram{60: 3, 120: 1}.Overlap(TimezoneHistogram{60: 1})
+	req.True(known)
+	req.InDelta(0.75, overlap, 1e-6)
+	overlap, known = TimezoneHistogram{60: 3}.Overlap(TimezoneHistogram{-420: 3})
+	req.True(known)
+	req.Equal(0.0, overlap)
+	overlap, known = TimezoneHistogram{60: 3}.Overlap(TimezoneHistogram{60: 10})
+	req.True(known)
+	req.InDelta(1.0, overlap, 1e-6)
+	_, known = TimezoneHistogram{60: 3}.Overlap(nil)
+	req.False(known)
+}
+
+func TestTimezoneHistogramAddCopy(t *testing.T) {
+	h := TimezoneHistogram{60: 1}
+	c := h.Copy()
+	c.Add(TimezoneHistogram{60: 2, 0: 1})
+	require.Equal(t, TimezoneHistogram{60: 1}, h)
+	require.Equal(t, TimezoneHistogram{60: 3, 0: 1}, c)
+	require.Nil(t, TimezoneHistogram(nil).Copy())
+}
+
+func TestTimezoneHistogramString(t *testing.T) {
+	req := require.New(t)
+	h := TimezoneHistogram{120: 5, -420: 1, 330: 2}
+	req.Equal("-0700:1 +0200:5 +0530:2", h.String())
+	parsed, err := parseTimezoneHistogram(h.String())
+	req.NoError(err)
+	req.Equal(h, parsed)
+	parsed, err = parseTimezoneHistogram("")
+	req.NoError(err)
+	req.Nil(parsed)
+	for _, invalid := range []string{"+0200", "0200:1", "+02:1", "+0260:1", "+0200:x"} {
+		_, err = parseTimezoneHistogram(invalid)
+		req.Error(err, invalid)
+	}
+}